@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"time-series-analytics-engine/storage"
+	"time-series-analytics-engine/timeexpr"
+
+	"github.com/gorilla/mux"
+)
+
+// AnnotationRequest creates or replaces an annotation. Times use the
+// timeexpr syntax; an omitted time is now on create and unchanged on update.
+type AnnotationRequest struct {
+	Time    string   `json:"time,omitempty"`
+	TimeEnd string   `json:"time_end,omitempty"`
+	Title   string   `json:"title"`
+	Text    string   `json:"text,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// AnnotationListResponse is the result of an annotation query
+type AnnotationListResponse struct {
+	Annotations []*storage.Annotation `json:"annotations"`
+	Count       int                   `json:"count"`
+}
+
+// SetAnnotationStore enables the annotation endpoints
+func (s *Server) SetAnnotationStore(store *storage.AnnotationStore) {
+	s.annotations = store
+}
+
+// requireAnnotations rejects annotation requests when no store is set
+func (s *Server) requireAnnotations(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.annotations == nil {
+			http.Error(w, "Annotations are not enabled", http.StatusNotImplemented)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// queryAnnotations handles GET /api/v1/annotations. Annotations overlapping
+// start and end are returned; tags may be comma separated or repeated, and
+// match=any returns annotations carrying any rather than all of them.
+func (s *Server) queryAnnotations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	start, end, err := parseTimeRangeParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := storage.AnnotationQuery{Start: start, End: end, Tags: splitTags(query["tags"])}
+	switch match := query.Get("match"); match {
+	case "", "all":
+	case "any":
+		q.MatchAny = true
+	default:
+		http.Error(w, fmt.Sprintf("Invalid match: %s", match), http.StatusBadRequest)
+		return
+	}
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit: %s", limitParam), http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+
+	annotations := s.annotations.Query(q)
+	if annotations == nil {
+		annotations = []*storage.Annotation{}
+	}
+	json.NewEncoder(w).Encode(AnnotationListResponse{Annotations: annotations, Count: len(annotations)})
+}
+
+// createAnnotation handles POST /api/v1/annotations
+func (s *Server) createAnnotation(w http.ResponseWriter, r *http.Request) {
+	annotation, err := decodeAnnotation(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created, err := s.annotations.Create(annotation)
+	if err != nil {
+		writeAnnotationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// getAnnotation handles GET /api/v1/annotations/{id}
+func (s *Server) getAnnotation(w http.ResponseWriter, r *http.Request) {
+	annotation, ok := s.annotations.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, storage.ErrAnnotationNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(annotation)
+}
+
+// updateAnnotation handles PUT /api/v1/annotations/{id}, replacing the
+// annotation's fields
+func (s *Server) updateAnnotation(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	existing, ok := s.annotations.Get(id)
+	if !ok {
+		http.Error(w, storage.ErrAnnotationNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	annotation, err := decodeAnnotation(r, existing.Time)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := s.annotations.Update(id, annotation)
+	if err != nil {
+		writeAnnotationError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(updated)
+}
+
+// deleteAnnotation handles DELETE /api/v1/annotations/{id}
+func (s *Server) deleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	if err := s.annotations.Delete(mux.Vars(r)["id"]); err != nil {
+		writeAnnotationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeAnnotation reads an AnnotationRequest, using defaultTime when the
+// request has no time
+func decodeAnnotation(r *http.Request, defaultTime time.Time) (storage.Annotation, error) {
+	var req AnnotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return storage.Annotation{}, fmt.Errorf("Invalid JSON: %v", err)
+	}
+	loc, err := parseLocation(r.URL.Query().Get("tz"))
+	if err != nil {
+		return storage.Annotation{}, err
+	}
+
+	now := time.Now()
+	annotation := storage.Annotation{
+		Time:  defaultTime,
+		Title: req.Title,
+		Text:  req.Text,
+		Tags:  splitTags(req.Tags),
+	}
+	if req.Time != "" {
+		if annotation.Time, err = timeexpr.Parse(req.Time, now, loc); err != nil {
+			return storage.Annotation{}, fmt.Errorf("Invalid time: %v", err)
+		}
+	}
+	if req.TimeEnd != "" {
+		end, err := timeexpr.Parse(req.TimeEnd, now, loc)
+		if err != nil {
+			return storage.Annotation{}, fmt.Errorf("Invalid time_end: %v", err)
+		}
+		annotation.TimeEnd = &end
+	}
+	return annotation, nil
+}
+
+func writeAnnotationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrAnnotationNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Invalid annotation: %v", err), http.StatusBadRequest)
+}
+
+// splitTags flattens comma separated tags, dropping empty ones and any
+// leading # as used in Grafana tag queries
+func splitTags(values []string) []string {
+	var tags []string
+	for _, value := range values {
+		for _, tag := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if tag = strings.TrimPrefix(tag, "#"); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// grafanaAnnotationRequest is the body Grafana's JSON datasources post to
+// /annotations. The annotation definition is echoed back in each result.
+type grafanaAnnotationRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Annotation json.RawMessage `json:"annotation"`
+}
+
+// grafanaAnnotation is one result of a Grafana annotation query. Times are
+// unix milliseconds.
+type grafanaAnnotation struct {
+	Annotation json.RawMessage `json:"annotation"`
+	Time       int64           `json:"time"`
+	TimeEnd    int64           `json:"timeEnd,omitempty"`
+	IsRegion   bool            `json:"isRegion"`
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+	Tags       []string        `json:"tags"`
+}
+
+// grafanaHealth answers the connection test of a Grafana datasource
+func (s *Server) grafanaHealth(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// grafanaAnnotations handles POST /api/grafana/annotations for the Grafana
+// JSON datasource. The annotation query is a list of tags, e.g. "#deploy
+// #prod", all of which must match; an empty query returns every annotation
+// in the dashboard's range.
+func (s *Server) grafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	var req grafanaAnnotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	var definition struct {
+		Query string `json:"query"`
+	}
+	if len(req.Annotation) > 0 {
+		if err := json.Unmarshal(req.Annotation, &definition); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid annotation: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	annotations := s.annotations.Query(storage.AnnotationQuery{
+		Start: req.Range.From,
+		End:   req.Range.To,
+		Tags:  splitTags([]string{definition.Query}),
+	})
+	results := make([]grafanaAnnotation, len(annotations))
+	for i, annotation := range annotations {
+		results[i] = grafanaAnnotation{
+			Annotation: req.Annotation,
+			Time:       annotation.Time.UnixMilli(),
+			Title:      annotation.Title,
+			Text:       annotation.Text,
+			Tags:       annotation.Tags,
+		}
+		if annotation.TimeEnd != nil {
+			results[i].TimeEnd = annotation.TimeEnd.UnixMilli()
+			results[i].IsRegion = true
+		}
+	}
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestAnnotations_CRUD(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.SetAnnotationStore(engine.Annotations())
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do("POST", "/api/v1/annotations", `{"time": "now-1h", "time_end": "now-30m", "title": "Deploy", "tags": ["deploy", "prod"]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created storage.Annotation
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.ID == "" || created.TimeEnd == nil || created.TimeEnd.Sub(created.Time) != 30*time.Minute {
+		t.Fatalf("Unexpected annotation: %+v", created)
+	}
+
+	if rec := do("POST", "/api/v1/annotations", `{"title": ""}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a missing title, got %d", rec.Code)
+	}
+
+	// An update without a time keeps the annotation where it was
+	rec = do("PUT", "/api/v1/annotations/"+created.ID, `{"title": "Deploy v2", "tags": ["deploy"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var updated storage.Annotation
+	json.NewDecoder(rec.Body).Decode(&updated)
+	if updated.Title != "Deploy v2" || !updated.Time.Equal(created.Time) || updated.TimeEnd != nil {
+		t.Errorf("Unexpected update: %+v", updated)
+	}
+
+	for _, tt := range []struct {
+		query string
+		count int
+	}{
+		{"start=-2h&tags=deploy", 1},
+		{"start=-2h&tags=deploy,prod", 0},
+		{"start=-2h&tags=deploy&tags=prod&match=any", 1},
+		{"start=-10m", 0},
+	} {
+		rec := do("GET", "/api/v1/annotations?"+tt.query, "")
+		var response AnnotationListResponse
+		json.NewDecoder(rec.Body).Decode(&response)
+		if rec.Code != http.StatusOK || response.Count != tt.count {
+			t.Errorf("%s: expected %d annotations, got %d (%d)", tt.query, tt.count, response.Count, rec.Code)
+		}
+	}
+
+	if rec := do("DELETE", "/api/v1/annotations/"+created.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", rec.Code)
+	}
+	if rec := do("GET", "/api/v1/annotations/"+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestAnnotations_Grafana(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.SetAnnotationStore(engine.Annotations())
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	end := base.Add(time.Hour)
+	engine.Annotations().Create(storage.Annotation{Time: base, TimeEnd: &end, Title: "Incident", Tags: []string{"incident"}})
+	engine.Annotations().Create(storage.Annotation{Time: base, Title: "Deploy", Tags: []string{"deploy"}})
+
+	body := `{"range": {"from": "2024-01-01T00:00:00Z", "to": "2024-01-02T00:00:00Z"},
+		"annotation": {"name": "incidents", "enable": true, "query": "#incident"}}`
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/grafana/annotations", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var results []grafanaAnnotation
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected only the tagged annotation, got %+v", results)
+	}
+	result := results[0]
+	if result.Title != "Incident" || !result.IsRegion || result.Time != base.UnixMilli() || result.TimeEnd != end.UnixMilli() {
+		t.Errorf("Unexpected Grafana annotation: %+v", result)
+	}
+	if !strings.Contains(string(result.Annotation), `"name":"incidents"`) {
+		t.Errorf("Expected the annotation definition to be echoed, got %s", result.Annotation)
+	}
+}
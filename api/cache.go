@@ -0,0 +1,495 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"time-series-analytics-engine/query"
+	"time-series-analytics-engine/storage"
+)
+
+// queryCacheChunkSteps is the number of steps each cached chunk of a
+// result spans
+const queryCacheChunkSteps = 60
+
+// pointSize approximates the memory used by one cached result point
+const pointSize = 40
+
+// cacheEntryOverhead approximates the bookkeeping memory of one cache entry
+// or result series
+const cacheEntryOverhead = 128
+
+// QueryCache is an LRU cache of evaluated expression results bounded by
+// memory size. Results are cached in chunks of steps aligned in local time,
+// keyed on the normalized expression, the step and the chunk start, so a
+// dashboard whose range slides forward only evaluates the chunks it has not
+// seen. Expressions whose steps depend on the start of the range, and
+// calendar steps, are cached whole for their exact range instead.
+//
+// Each chunk remembers the selectors and windows it read, and is indexed by
+// the metric names they select; a change to a series one of them matches,
+// whether a write, an eviction from hot storage or a retention drop,
+// invalidates it.
+type QueryCache struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	lru      *list.List
+	entries  map[string]*list.Element
+	byName   map[string]map[*list.Element]struct{}
+	bytes    int64
+	inFlight map[*cacheFill]struct{}
+
+	stats QueryCacheStats
+
+	mu sync.Mutex
+}
+
+// QueryCacheStats contains query cache counters
+type QueryCacheStats struct {
+	Hits          int64 `json:"hits"`
+	PartialHits   int64 `json:"partial_hits"`
+	Misses        int64 `json:"misses"`
+	Invalidations int64 `json:"invalidations"`
+	Evictions     int64 `json:"evictions"`
+	Entries       int   `json:"entries"`
+	SizeBytes     int64 `json:"size_bytes"`
+	MaxBytes      int64 `json:"max_bytes"`
+}
+
+// cacheEntry holds the result of one expression over one chunk
+type cacheEntry struct {
+	key     string
+	results []query.Result
+	reads   []cacheRead
+	names   []string
+	size    int64
+	expires time.Time
+}
+
+// cacheRead is one selection an evaluation made from storage
+type cacheRead struct {
+	matchers   []*storage.LabelMatcher
+	start, end time.Time
+}
+
+// cacheFill tracks an evaluation in progress so changes to what it has read
+// while it runs keep its stale result out of the cache
+type cacheFill struct {
+	reads []cacheRead
+	dirty bool
+}
+
+// cacheChunk is one part of a query's range, from start up to end
+type cacheChunk struct {
+	key        string
+	start, end time.Time
+	// store is false for chunks not yet complete, which are evaluated only
+	// as far as the query asks and not cached
+	store   bool
+	results []query.Result
+	cached  bool
+}
+
+// NewQueryCache creates a query cache holding up to maxBytes of results.
+// Entries older than ttl are discarded; a zero ttl keeps them until evicted.
+func NewQueryCache(maxBytes int64, ttl time.Duration) *QueryCache {
+	return &QueryCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		byName:   make(map[string]map[*list.Element]struct{}),
+		inFlight: make(map[*cacheFill]struct{}),
+	}
+}
+
+// Evaluate returns the result of an expression over params, which must be
+// aligned with query.AlignParams. Cached chunks are reused and each run of
+// missing chunks is evaluated at once. The returned results are the
+// caller's to modify.
+func (qc *QueryCache) Evaluate(ctx context.Context, st query.Storage, expr query.Expr, params query.Params) ([]query.Result, error) {
+	now := time.Now()
+	chunks, evalParams := splitRange(expr, params, now)
+
+	qc.mu.Lock()
+	hits := 0
+	for _, chunk := range chunks {
+		if results, ok := qc.lookupLocked(chunk.key, now); ok {
+			chunk.results, chunk.cached = results, true
+			hits++
+		}
+	}
+	switch {
+	case hits == len(chunks):
+		qc.stats.Hits++
+	case hits > 0:
+		qc.stats.PartialHits++
+	default:
+		qc.stats.Misses++
+	}
+	qc.mu.Unlock()
+
+	for i := 0; i < len(chunks); {
+		if chunks[i].cached {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(chunks) && !chunks[j].cached {
+			j++
+		}
+		if err := qc.fill(ctx, st, expr, evalParams, chunks[i:j], params.End, now); err != nil {
+			return nil, err
+		}
+		i = j
+	}
+	return mergeChunks(chunks, params), nil
+}
+
+// Invalidate drops cached results that read a changed series within the
+// changed range. It is meant to be registered as a storage change watcher.
+// Only results indexed under the series' metric name, or that select
+// series by other labels, are checked.
+func (qc *QueryCache) Invalidate(changes []storage.DataChange) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if qc.lru.Len() == 0 && len(qc.inFlight) == 0 {
+		return
+	}
+	for _, dataChange := range changes {
+		change := &cacheChange{DataChange: dataChange}
+		change.labels, change.known = seriesLabels(change.SeriesID)
+
+		for fill := range qc.inFlight {
+			if change.readBy(fill.reads) {
+				fill.dirty = true
+			}
+		}
+
+		// Series whose labels are unknown may match any entry
+		if !change.known {
+			for elem := qc.lru.Front(); elem != nil; {
+				next := elem.Next()
+				qc.invalidateLocked(elem, change)
+				elem = next
+			}
+			continue
+		}
+		for _, name := range []string{change.labels[storage.MetricNameLabel], ""} {
+			for elem := range qc.byName[name] {
+				qc.invalidateLocked(elem, change)
+			}
+		}
+	}
+}
+
+// Stats returns a snapshot of the cache counters
+func (qc *QueryCache) Stats() QueryCacheStats {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	stats := qc.stats
+	stats.Entries = qc.lru.Len()
+	stats.SizeBytes = qc.bytes
+	stats.MaxBytes = qc.maxBytes
+	return stats
+}
+
+// fill evaluates a run of adjacent missing chunks and caches the complete
+// ones, unless data they read changed meanwhile
+func (qc *QueryCache) fill(ctx context.Context, st query.Storage, expr query.Expr, params query.Params, run []*cacheChunk, end, now time.Time) error {
+	fill := &cacheFill{}
+	qc.mu.Lock()
+	qc.inFlight[fill] = struct{}{}
+	qc.mu.Unlock()
+
+	params.Start = run[0].start
+	params.End = run[len(run)-1].end.Add(-time.Nanosecond)
+	if !run[len(run)-1].store && end.Before(params.End) {
+		params.End = end
+	}
+	results, err := query.Evaluate(ctx, &recordingStorage{Storage: st, cache: qc, fill: fill}, expr, params)
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	delete(qc.inFlight, fill)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		k := 0
+		for start := 0; start < len(result.Points); {
+			for !result.Points[start].Timestamp.Before(run[k].end) {
+				k++
+			}
+			stop := start + 1
+			for stop < len(result.Points) && result.Points[stop].Timestamp.Before(run[k].end) {
+				stop++
+			}
+			run[k].results = append(run[k].results, query.Result{Labels: result.Labels, Points: result.Points[start:stop]})
+			start = stop
+		}
+	}
+	if fill.dirty {
+		return nil
+	}
+
+	// Reads are clipped to each chunk, as the windows a run reads are its
+	// steps shifted by constant lookbacks and offsets
+	evaluated := params.End.Add(time.Nanosecond)
+	for _, chunk := range run {
+		if !chunk.store {
+			continue
+		}
+		reads := make([]cacheRead, len(fill.reads))
+		for i, read := range fill.reads {
+			reads[i] = cacheRead{
+				matchers: read.matchers,
+				start:    read.start.Add(chunk.start.Sub(params.Start)),
+				end:      read.end.Add(-evaluated.Sub(chunk.end)),
+			}
+		}
+		qc.storeLocked(chunk.key, copyResults(chunk.results), reads, now)
+	}
+	return nil
+}
+
+func (qc *QueryCache) lookupLocked(key string, now time.Time) ([]query.Result, bool) {
+	elem, ok := qc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && now.After(entry.expires) {
+		qc.removeLocked(elem)
+		return nil, false
+	}
+	qc.lru.MoveToFront(elem)
+	return entry.results, true
+}
+
+func (qc *QueryCache) storeLocked(key string, results []query.Result, reads []cacheRead, now time.Time) {
+	entry := &cacheEntry{key: key, results: results, reads: reads, names: readNames(reads)}
+	entry.size = int64(len(key) + cacheEntryOverhead)
+	for _, result := range results {
+		entry.size += int64(len(result.Points)*pointSize + cacheEntryOverhead)
+		for name, value := range result.Labels {
+			entry.size += int64(len(name) + len(value))
+		}
+	}
+	if entry.size > qc.maxBytes {
+		return
+	}
+	if qc.ttl > 0 {
+		entry.expires = now.Add(qc.ttl)
+	}
+
+	if elem, ok := qc.entries[key]; ok {
+		qc.removeLocked(elem)
+	}
+	elem := qc.lru.PushFront(entry)
+	qc.entries[key] = elem
+	for _, name := range entry.names {
+		if qc.byName[name] == nil {
+			qc.byName[name] = make(map[*list.Element]struct{})
+		}
+		qc.byName[name][elem] = struct{}{}
+	}
+	qc.bytes += entry.size
+
+	for qc.bytes > qc.maxBytes {
+		qc.removeLocked(qc.lru.Back())
+		qc.stats.Evictions++
+	}
+}
+
+func (qc *QueryCache) invalidateLocked(elem *list.Element, change *cacheChange) {
+	if change.readBy(elem.Value.(*cacheEntry).reads) {
+		qc.removeLocked(elem)
+		qc.stats.Invalidations++
+	}
+}
+
+func (qc *QueryCache) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	qc.lru.Remove(elem)
+	qc.bytes -= entry.size
+	delete(qc.entries, entry.key)
+	for _, name := range entry.names {
+		delete(qc.byName[name], elem)
+		if len(qc.byName[name]) == 0 {
+			delete(qc.byName, name)
+		}
+	}
+}
+
+// recordingStorage records the selections of an evaluation in its fill
+// before making them, so changes racing with the reads are not missed
+type recordingStorage struct {
+	query.Storage
+	cache *QueryCache
+	fill  *cacheFill
+}
+
+func (rs *recordingStorage) Select(matchers []*storage.LabelMatcher, start, end time.Time) []storage.SeriesInfo {
+	rs.cache.mu.Lock()
+	rs.fill.reads = append(rs.fill.reads, cacheRead{matchers: matchers, start: start, end: end})
+	rs.cache.mu.Unlock()
+	return rs.Storage.Select(matchers, start, end)
+}
+
+// splitRange divides aligned params into the chunks cached separately and
+// returns the params to evaluate missing chunks with. Chunks are aligned to
+// multiples of their length in the zone offset at the start of the range,
+// which missing chunks are evaluated in so that their steps line up
+// wherever the range they are evaluated over starts.
+func splitRange(expr query.Expr, params query.Params, now time.Time) ([]*cacheChunk, query.Params) {
+	aggregation := params.Aggregation
+	if aggregation == "" {
+		aggregation = query.BucketAvg
+	}
+	loc := params.Location
+	if loc == nil {
+		loc = params.Start.Location()
+	}
+
+	if params.Calendar != "" || !query.Splittable(expr) {
+		step := params.Calendar
+		if step == "" {
+			step = params.Step.String()
+		}
+		key := fmt.Sprintf("%s|%s|%s|%s|%d|%d", query.Format(expr), step, aggregation,
+			loc, params.Start.UnixNano(), params.End.UnixNano())
+		return []*cacheChunk{{key: key, start: params.Start, end: params.End.Add(time.Nanosecond), store: true}}, params
+	}
+
+	zone, offset := params.Start.In(loc).Zone()
+	zoneOffset := time.Duration(offset) * time.Second
+	params.Location = time.FixedZone(zone, offset)
+
+	size := queryCacheChunkSteps * params.Step
+	prefix := fmt.Sprintf("%s|%s|%s|%d", query.Format(expr), params.Step, aggregation, offset)
+	var chunks []*cacheChunk
+	for start := params.Start.Add(zoneOffset).Truncate(size).Add(-zoneOffset); !start.After(params.End); start = start.Add(size) {
+		end := start.Add(size)
+		chunks = append(chunks, &cacheChunk{
+			key:   fmt.Sprintf("%s|%d", prefix, start.UnixNano()),
+			start: start.In(params.Location),
+			end:   end,
+			store: !end.After(now),
+		})
+	}
+	return chunks, params
+}
+
+// mergeChunks joins the results of adjacent chunks into fresh results over
+// the range of params, in the time zone it was given in
+func mergeChunks(chunks []*cacheChunk, params query.Params) []query.Result {
+	loc := params.Location
+	if loc == nil {
+		loc = params.Start.Location()
+	}
+
+	var merged []query.Result
+	index := make(map[string]int)
+	for _, chunk := range chunks {
+		for _, result := range chunk.results {
+			key := storage.SeriesKey(result.Labels[storage.MetricNameLabel], result.Labels)
+			i, ok := index[key]
+			if !ok {
+				i = len(merged)
+				index[key] = i
+				merged = append(merged, query.Result{Labels: result.Labels})
+			}
+			for _, point := range result.Points {
+				if point.Timestamp.Before(params.Start) || point.Timestamp.After(params.End) {
+					continue
+				}
+				point.Timestamp = point.Timestamp.In(loc)
+				merged[i].Points = append(merged[i].Points, point)
+			}
+		}
+	}
+
+	results := merged[:0]
+	for _, result := range merged {
+		if len(result.Points) > 0 {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// cacheChange is a data change matched against cached reads
+type cacheChange struct {
+	storage.DataChange
+	labels map[string]string
+	known  bool
+}
+
+// readBy reports whether any of the reads selects the changed series within
+// the changed range. Series whose labels are not known match every selector.
+func (c *cacheChange) readBy(reads []cacheRead) bool {
+	for _, read := range reads {
+		if !c.Start.IsZero() && (c.End.Before(read.start) || c.Start.After(read.end)) {
+			continue
+		}
+		if !c.known || storage.MatchesLabels(c.labels, read.matchers) {
+			return true
+		}
+	}
+	return false
+}
+
+// readNames returns the metric names an entry is indexed under: the names
+// its reads select by equality, or "" for reads selecting by other labels
+func readNames(reads []cacheRead) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, read := range reads {
+		name := ""
+		for _, m := range read.matchers {
+			if m.Name == storage.MetricNameLabel && m.Type == storage.MatchEqual {
+				name = m.Value
+				break
+			}
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// seriesLabels recovers a series' labels from its ID, which SeriesKey writes
+// in selector form. known is false for IDs that are not selectors.
+func seriesLabels(seriesID string) (map[string]string, bool) {
+	matchers, err := storage.ParseSelector(seriesID)
+	if err != nil {
+		return nil, false
+	}
+	labels := make(map[string]string, len(matchers))
+	for _, m := range matchers {
+		if m.Type != storage.MatchEqual {
+			return nil, false
+		}
+		labels[m.Name] = m.Value
+	}
+	return labels, true
+}
+
+// copyResults copies results deeply enough that scaling or trimming the
+// points of one copy leaves the others intact
+func copyResults(results []query.Result) []query.Result {
+	copied := make([]query.Result, len(results))
+	for i, result := range results {
+		copied[i] = query.Result{Labels: result.Labels, Points: append([]storage.DataPoint(nil), result.Points...)}
+	}
+	return copied
+}
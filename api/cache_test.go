@@ -0,0 +1,198 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+	"time-series-analytics-engine/query"
+	"time-series-analytics-engine/storage"
+)
+
+// newCacheTestEngine creates a storage engine invalidating cache, with
+// count points, one per minute from base on, for each series
+func newCacheTestEngine(t *testing.T, cache *QueryCache, maxPoints, count int, base time.Time, names ...string) *storage.StorageEngine {
+	engine, err := storage.NewStorageEngine(&storage.StorageConfig{
+		Hot: storage.HotStorageConfig{MaxSeries: 100, MaxPointsPerSeries: maxPoints},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	engine.AddChangeWatcher(cache.Invalidate)
+	for _, name := range names {
+		for i := 0; i < count; i++ {
+			engine.AddPoint(name, nil, base.Add(time.Duration(i)*time.Minute), float64(i))
+		}
+	}
+	return engine
+}
+
+func cachedEvaluate(t *testing.T, cache *QueryCache, st query.Storage, input string, start, end time.Time) []query.Result {
+	expr, err := query.ParseExpr(input)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %v", input, err)
+	}
+	params, err := query.AlignParams(query.Params{Start: start, End: end, Step: time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to align %q: %v", input, err)
+	}
+	results, err := cache.Evaluate(context.Background(), st, expr, params)
+	if err != nil {
+		t.Fatalf("Failed to evaluate %q: %v", input, err)
+	}
+	return results
+}
+
+func TestQueryCache_NormalizedKey(t *testing.T) {
+	base := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	cache := NewQueryCache(1<<20, time.Hour)
+	engine := newCacheTestEngine(t, cache, 1000, 10, base, "cpu")
+
+	results := cachedEvaluate(t, cache, engine, `cpu * 2`, base, base.Add(9*time.Minute))
+	if len(results) != 1 || len(results[0].Points) != 10 || results[0].Points[9].Value != 18 {
+		t.Fatalf("Unexpected result %+v", results)
+	}
+	results[0].Points[9].Value = -1
+
+	// The same expression written differently over the same steps is a hit,
+	// and unaffected by changes the first caller made to its result
+	results = cachedEvaluate(t, cache, engine, `(cpu)*2`, base.Add(10*time.Second), base.Add(9*time.Minute+30*time.Second))
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected a hit for the normalized expression, got %+v", stats)
+	}
+	if results[0].Points[9].Value != 18 {
+		t.Errorf("Expected the cached result to be unchanged, got %v", results[0].Points[9].Value)
+	}
+
+	// Other ranges within the same chunk hit as well, other expressions miss
+	cachedEvaluate(t, cache, engine, `cpu * 2`, base.Add(5*time.Minute), base.Add(7*time.Minute))
+	cachedEvaluate(t, cache, engine, `cpu * 3`, base, base.Add(9*time.Minute))
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Errorf("Expected only the other expression to miss, got %+v", stats)
+	}
+}
+
+// selectRecorder records the ranges evaluations select
+type selectRecorder struct {
+	query.Storage
+	starts []time.Time
+}
+
+func (r *selectRecorder) Select(matchers []*storage.LabelMatcher, start, end time.Time) []storage.SeriesInfo {
+	r.starts = append(r.starts, start)
+	return r.Storage.Select(matchers, start, end)
+}
+
+func TestQueryCache_SlidingRangeEvaluatesTail(t *testing.T) {
+	base := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	cache := NewQueryCache(1<<20, time.Hour)
+	engine := newCacheTestEngine(t, cache, 1000, 200, base, "cpu")
+	recorder := &selectRecorder{Storage: engine}
+
+	cachedEvaluate(t, cache, recorder, `cpu`, base, base.Add(90*time.Minute))
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Entries != 2 {
+		t.Fatalf("Expected two chunks cached, got %+v", stats)
+	}
+
+	// Sliding the range forward reuses the chunks it still covers and only
+	// evaluates the new one
+	recorder.starts = nil
+	results := cachedEvaluate(t, cache, recorder, `cpu`, base.Add(30*time.Minute), base.Add(150*time.Minute))
+	if stats := cache.Stats(); stats.PartialHits != 1 || stats.Entries != 3 {
+		t.Errorf("Expected a partial hit, got %+v", stats)
+	}
+	if len(recorder.starts) != 1 || !recorder.starts[0].Equal(base.Add(2*time.Hour)) {
+		t.Errorf("Expected only the last chunk to be read, got reads from %v", recorder.starts)
+	}
+	if len(results) != 1 || len(results[0].Points) != 121 {
+		t.Fatalf("Expected 121 points, got %+v", results)
+	}
+	for i, point := range results[0].Points {
+		if !point.Timestamp.Equal(base.Add(time.Duration(30+i)*time.Minute)) || point.Value != float64(30+i) {
+			t.Fatalf("Unexpected point %d: %+v", i, point)
+		}
+	}
+
+	// Expressions depending on where the range starts are cached whole
+	cachedEvaluate(t, cache, recorder, `cumsum(cpu)`, base.Add(30*time.Minute), base.Add(150*time.Minute))
+	cachedEvaluate(t, cache, recorder, `cumsum(cpu)`, base.Add(60*time.Minute), base.Add(150*time.Minute))
+	if stats := cache.Stats(); stats.Misses != 3 || stats.Entries != 5 {
+		t.Errorf("Expected each range of cumsum to miss, got %+v", stats)
+	}
+}
+
+func TestQueryCache_WritesInvalidateMatchingResults(t *testing.T) {
+	base := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	cache := NewQueryCache(1<<20, time.Hour)
+	engine := newCacheTestEngine(t, cache, 1000, 10, base, "cpu", "mem")
+
+	cachedEvaluate(t, cache, engine, `cpu`, base, base.Add(9*time.Minute))
+	cachedEvaluate(t, cache, engine, `mem`, base, base.Add(9*time.Minute))
+	cachedEvaluate(t, cache, engine, `moving_avg(cpu, 1h)`, base.Add(3*time.Hour), base.Add(4*time.Hour))
+
+	// A late write to cpu only invalidates results that read it at that time,
+	// including through a window reaching back before the chunk
+	engine.AddPoint("cpu", nil, base.Add(90*time.Second), 100)
+	if stats := cache.Stats(); stats.Invalidations != 1 || stats.Entries != 3 {
+		t.Fatalf("Expected only the cpu result to be invalidated, got %+v", stats)
+	}
+	engine.AddPoint("cpu", nil, base.Add(2*time.Hour+30*time.Minute), 1)
+	if stats := cache.Stats(); stats.Invalidations != 2 || stats.Entries != 2 {
+		t.Fatalf("Expected the first windowed chunk to be invalidated, got %+v", stats)
+	}
+
+	results := cachedEvaluate(t, cache, engine, `cpu`, base, base.Add(9*time.Minute))
+	if results[0].Points[1].Value != 50.5 {
+		t.Errorf("Expected the late write in the re-evaluated result, got %v", results[0].Points[1].Value)
+	}
+
+	// A new series matching a cached selector invalidates it as well
+	cachedEvaluate(t, cache, engine, `sum(cpu)`, base, base.Add(9*time.Minute))
+	engine.AddPoint(storage.SeriesKey("cpu", map[string]string{"host": "b"}), map[string]string{"host": "b"}, base, 1)
+	results = cachedEvaluate(t, cache, engine, `sum(cpu)`, base, base.Add(9*time.Minute))
+	if results[0].Points[0].Value != 1 {
+		t.Errorf("Expected the new series in the sum, got %v", results[0].Points[0].Value)
+	}
+}
+
+func TestQueryCache_EvictionInvalidates(t *testing.T) {
+	base := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	cache := NewQueryCache(1<<20, time.Hour)
+	engine := newCacheTestEngine(t, cache, 5, 5, base, "cpu")
+
+	results := cachedEvaluate(t, cache, engine, `cpu`, base, base.Add(2*time.Minute))
+	if len(results) != 1 || len(results[0].Points) != 3 {
+		t.Fatalf("Expected 3 points, got %+v", results)
+	}
+
+	// The series is full, so a write after the queried range evicts its
+	// oldest point from within it
+	engine.AddPoint("cpu", nil, base.Add(time.Hour), 1)
+	if stats := cache.Stats(); stats.Invalidations != 1 || stats.Entries != 0 {
+		t.Fatalf("Expected the eviction to invalidate the result, got %+v", stats)
+	}
+	results = cachedEvaluate(t, cache, engine, `cpu`, base, base.Add(2*time.Minute))
+	if len(results[0].Points) != 2 || !results[0].Points[0].Timestamp.Equal(base.Add(time.Minute)) {
+		t.Errorf("Expected the evicted point to be gone, got %v", results[0].Points)
+	}
+}
+
+func TestQueryCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	base := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	sizing := NewQueryCache(1<<20, 0)
+	engine := newCacheTestEngine(t, sizing, 1000, 10, base, "a", "b", "c")
+	cachedEvaluate(t, sizing, engine, `a`, base, base.Add(9*time.Minute))
+	cache := NewQueryCache(2*sizing.Stats().SizeBytes, 0)
+	engine.AddChangeWatcher(cache.Invalidate)
+
+	for _, input := range []string{"a", "b", "a", "c"} {
+		cachedEvaluate(t, cache, engine, input, base, base.Add(9*time.Minute))
+	}
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 || stats.SizeBytes > stats.MaxBytes {
+		t.Fatalf("Expected 2 entries after 1 eviction, got %+v", stats)
+	}
+	cachedEvaluate(t, cache, engine, `a`, base, base.Add(9*time.Minute))
+	if cache.Stats().Hits != 2 {
+		t.Error("Expected recently used result a to survive eviction")
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+	"time-series-analytics-engine/storage"
+	"time-series-analytics-engine/timeexpr"
+
+	"github.com/gorilla/mux"
+)
+
+// LabelsResponse represents the label names response
+type LabelsResponse struct {
+	Labels []string `json:"labels"`
+	Count  int      `json:"count"`
+}
+
+// LabelValuesResponse represents the label values response
+type LabelValuesResponse struct {
+	Label  string   `json:"label"`
+	Values []string `json:"values"`
+	Count  int      `json:"count"`
+}
+
+// MetadataResponse represents the metric metadata response
+type MetadataResponse struct {
+	Metrics []storage.MetricMetadata `json:"metrics"`
+	Count   int                      `json:"count"`
+}
+
+// listLabels returns the label names of series matching the optional
+// match[] selectors and time range
+func (s *Server) listLabels(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	matcherSets, err := parseMatchParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, err := parseTimeRangeParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	labels := s.storage.LabelNames(matcherSets, start, end)
+	json.NewEncoder(w).Encode(LabelsResponse{
+		Labels: labels,
+		Count:  len(labels),
+	})
+}
+
+// listLabelValues returns the values of one label across series matching the
+// optional match[] selectors and time range
+func (s *Server) listLabelValues(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	query := r.URL.Query()
+
+	matcherSets, err := parseMatchParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, err := parseTimeRangeParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values := s.storage.LabelValues(name, matcherSets, start, end)
+	json.NewEncoder(w).Encode(LabelValuesResponse{
+		Label:  name,
+		Values: values,
+		Count:  len(values),
+	})
+}
+
+// listMetadata returns per-metric metadata for series matching the optional
+// match[] selectors, metric name and time range
+func (s *Server) listMetadata(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	matcherSets, err := parseMatchParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if metric := query.Get("metric"); metric != "" {
+		nameMatcher, _ := storage.NewLabelMatcher(storage.MatchEqual, storage.MetricNameLabel, metric)
+		if len(matcherSets) == 0 {
+			matcherSets = [][]*storage.LabelMatcher{nil}
+		}
+		for i := range matcherSets {
+			matcherSets[i] = append(matcherSets[i], nameMatcher)
+		}
+	}
+	start, end, err := parseTimeRangeParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics := s.storage.MetricMetadata(matcherSets, start, end)
+	json.NewEncoder(w).Encode(MetadataResponse{
+		Metrics: metrics,
+		Count:   len(metrics),
+	})
+}
+
+// parseMatchParams parses repeated match[] selectors. Series matching any of
+// the selectors are included; no selectors means no filtering.
+func parseMatchParams(query url.Values) ([][]*storage.LabelMatcher, error) {
+	var matcherSets [][]*storage.LabelMatcher
+	for _, selector := range append(query["match[]"], query["match"]...) {
+		matchers, err := storage.ParseSelector(selector)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid match[] selector: %v", err)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	return matcherSets, nil
+}
+
+// parseTimeRangeParams parses the optional start and end parameters used by
+// discovery endpoints. Omitted bounds are returned as zero times, which
+// leaves that side of the range open.
+func parseTimeRangeParams(query url.Values) (time.Time, time.Time, error) {
+	var start, end time.Time
+	now := time.Now()
+
+	loc, err := parseLocation(query.Get("tz"))
+	if err != nil {
+		return start, end, err
+	}
+	if startParam := query.Get("start"); startParam != "" {
+		if start, err = timeexpr.Parse(startParam, now, loc); err != nil {
+			return start, end, fmt.Errorf("Invalid start: %v", err)
+		}
+	}
+	if endParam := query.Get("end"); endParam != "" {
+		if end, err = timeexpr.Parse(endParam, now, loc); err != nil {
+			return start, end, fmt.Errorf("Invalid end: %v", err)
+		}
+	}
+
+	return start, end, nil
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"time-series-analytics-engine/query"
+	"time-series-analytics-engine/storage"
+	"time-series-analytics-engine/timeexpr"
+)
+
+// ExpressionResponse is the result of a query expression: one entry per
+// result series, each with its labels
+type ExpressionResponse struct {
+	Query  string          `json:"query"`
+	Series []QueryResponse `json:"series"`
+	Count  int             `json:"count"`
+}
+
+// evaluateExpression handles /api/v1/query?query=..., evaluating an
+// expression over the step grid given by the step and agg parameters. Steps
+// may be durations or calendar steps (day, week, month, quarter) aligned in loc.
+// With the unit parameter every result must keep a metric with a known unit.
+func (s *Server) evaluateExpression(w http.ResponseWriter, r *http.Request, expression string, start, end time.Time, loc *time.Location, limit int, format string) {
+	params := query.Params{
+		Start:       start,
+		End:         end,
+		Location:    loc,
+		Aggregation: r.URL.Query().Get("agg"),
+	}
+	if stepParam := r.URL.Query().Get("step"); query.IsCalendarStep(stepParam) {
+		params.Calendar = stepParam
+	} else if stepParam != "" {
+		step, err := timeexpr.ParseDuration(stepParam)
+		if err != nil || step <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid step: %s", stepParam), http.StatusBadRequest)
+			return
+		}
+		params.Step = step
+	}
+
+	expr, err := query.ParseExpr(expression)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	results, err := s.evaluate(r.Context(), expr, params)
+	if err != nil {
+		var queryErr *query.Error
+		if errors.As(err, &queryErr) {
+			http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+			return
+		}
+		s.writeQueryError(w, r, "Failed to evaluate query", err)
+		return
+	}
+
+	// Results keep their metric's metadata while they keep its name, e.g.
+	// through filters and topk but not arithmetic
+	unit := r.URL.Query().Get("unit")
+	metadata := make([]*storage.Metadata, len(results))
+	total := 0
+	for i, result := range results {
+		seriesID := storage.SeriesKey(storage.MetricName("", result.Labels), result.Labels)
+		var md *storage.Metadata
+		if _, named := result.Labels[storage.MetricNameLabel]; named {
+			md = s.seriesMetadata(seriesID, result.Labels)
+		}
+		factor, converted, err := unitConversion(md, seriesID, unit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metadata[i] = converted
+		scalePoints(result.Points, factor)
+
+		// Apply limit per series, keeping the most recent points
+		if points := results[i].Points; limit > 0 && len(points) > limit {
+			results[i].Points = points[len(points)-limit:]
+		}
+		total += len(results[i].Points)
+	}
+	if err := s.checkQueryPoints(total); err != nil {
+		s.writeQueryError(w, r, "Failed to evaluate query", err)
+		return
+	}
+
+	if format != formatJSON {
+		writer := newSeriesWriter(w, format)
+		for _, result := range results {
+			seriesID := storage.SeriesKey(storage.MetricName("", result.Labels), result.Labels)
+			if _, err := writer.WriteSeries(seriesID, result.Labels, storage.NewSliceIterator(result.Points)); err != nil {
+				log.Printf("Error streaming query %s: %v", expression, err)
+				break
+			}
+		}
+		writer.Close()
+		return
+	}
+
+	response := ExpressionResponse{
+		Query:  expression,
+		Series: make([]QueryResponse, len(results)),
+		Count:  len(results),
+	}
+	for i, result := range results {
+		response.Series[i] = QueryResponse{
+			Series:   storage.SeriesKey(storage.MetricName("", result.Labels), result.Labels),
+			Labels:   result.Labels,
+			Metadata: metadata[i],
+			Points:   result.Points,
+			Count:    len(result.Points),
+		}
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// resolveSeries maps the series parameter to a stored series ID. It accepts
+// an exact series ID or a selector matching exactly one series; a field
+// narrows the selector to that field of a measurement.
+func (s *Server) resolveSeries(param, field string) (string, error) {
+	if field == "" && s.storage.SeriesExists(param) {
+		return param, nil
+	}
+	matchers, err := storage.ParseSelector(param)
+	if err != nil {
+		// Not a selector either; let the caller report the series as missing
+		return param, nil
+	}
+	if field != "" {
+		// The field parameter picks one field of a multi-field measurement
+		matcher, err := storage.NewLabelMatcher(storage.MatchEqual, storage.FieldLabel, field)
+		if err != nil {
+			return "", err
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	matched := s.storage.Select(matchers, time.Time{}, time.Time{})
+	switch len(matched) {
+	case 0:
+		return param, nil
+	case 1:
+		return matched[0].ID, nil
+	}
+	return "", fmt.Errorf("Selector %s matches %d series; use the 'query' parameter to combine them", param, len(matched))
+}
+
+// evaluate runs an expression over whole steps of the query range, through
+// the query cache when enabled. Reads fail with errTooManyPoints once they
+// exceed the point limit.
+func (s *Server) evaluate(ctx context.Context, expr query.Expr, params query.Params) ([]query.Result, error) {
+	params, err := query.AlignParams(params)
+	if err != nil {
+		return nil, err
+	}
+	st := s.newPointLimitStorage(s.storage)
+	if s.queryCache == nil {
+		return query.Evaluate(ctx, st, expr, params)
+	}
+	return s.queryCache.Evaluate(ctx, st, expr, params)
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestQueryData_Expression(t *testing.T) {
+	server, engine := newTestServer(t)
+	now := time.Now().Truncate(time.Minute)
+	for _, host := range []string{"a", "b"} {
+		labels := map[string]string{"host": host}
+		for i := 0; i < 5; i++ {
+			ts := now.Add(-time.Duration(i) * time.Minute)
+			engine.AddPoint(storage.SeriesKey("errors", labels), labels, ts, 1)
+			engine.AddPoint(storage.SeriesKey("requests", labels), labels, ts, 4)
+		}
+	}
+
+	params := url.Values{"query": {"errors / requests * 100"}, "start": {"-10m"}, "step": {"1m"}}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?"+params.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var response ExpressionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Count != 2 || response.Series[0].Labels["host"] == "" {
+		t.Fatalf("Expected one labelled series per host, got %+v", response)
+	}
+	if point := response.Series[0].Points[0]; point.Value != 25 {
+		t.Errorf("Expected 25%%, got %v", point.Value)
+	}
+
+	// A selector matching several series is rejected on the single-series path
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?series=errors", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an ambiguous series selector, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?"+url.Values{"series": {`errors{host="b"}`}}.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected a selector matching one series to resolve, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestQueryData_CalendarStep(t *testing.T) {
+	server, engine := newTestServer(t)
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone data unavailable: %v", err)
+	}
+
+	// Hourly points across the 2024 spring DST change, which has a 23 hour day
+	start := time.Date(2024, 3, 9, 0, 0, 0, 0, loc)
+	for ts := start; ts.Before(time.Date(2024, 3, 12, 0, 0, 0, 0, loc)); ts = ts.Add(time.Hour) {
+		engine.AddPoint("requests", nil, ts, 1)
+	}
+
+	params := url.Values{
+		"query": {"requests"},
+		"start": {"2024-03-09T00:00:00-05:00"},
+		"end":   {"2024-03-11T23:59:59-04:00"},
+		"step":  {"day"},
+		"agg":   {"count"},
+		"tz":    {"America/New_York"},
+	}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?"+params.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var response ExpressionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	points := response.Series[0].Points
+	if len(points) != 3 {
+		t.Fatalf("Expected 3 daily points, got %v", points)
+	}
+	for i, expected := range []float64{24, 23, 24} {
+		if points[i].Value != expected {
+			t.Errorf("Expected %v hours on day %d, got %v", expected, i, points[i].Value)
+		}
+		if local := points[i].Timestamp.In(loc); local.Hour() != 0 || local.Day() != 9+i {
+			t.Errorf("Expected step %d to start at local midnight, got %v", i, local)
+		}
+	}
+
+	params.Set("tz", "Mars/Olympus_Mons")
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?"+params.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown time zone, got %d", rec.Code)
+	}
+}
+
+func TestQueryData_TimeExpressions(t *testing.T) {
+	server, engine := newTestServer(t)
+	now := time.Now()
+	engine.AddPoint("requests", nil, now.Add(-36*time.Hour), 1)
+	engine.AddPoint("requests", nil, now.Add(-time.Minute), 2)
+
+	tests := []struct {
+		start, end string
+		code       int
+		points     int
+	}{
+		{"-2d", "now", http.StatusOK, 2},
+		{"now-1d", "", http.StatusOK, 1},
+		{strconv.FormatInt(now.Add(-48*time.Hour).UnixMilli(), 10), strconv.FormatInt(now.Unix(), 10), http.StatusOK, 2},
+		{"yesterday", "", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		params := url.Values{"series": {"requests"}, "start": {tt.start}, "end": {tt.end}}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?"+params.Encode(), nil))
+		if rec.Code != tt.code {
+			t.Errorf("start=%s end=%s: expected %d, got %d: %s", tt.start, tt.end, tt.code, rec.Code, rec.Body.String())
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var response QueryResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if response.Count != tt.points {
+			t.Errorf("start=%s end=%s: expected %d points, got %d", tt.start, tt.end, tt.points, response.Count)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIngestFields_QueryByField(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.streamProcessor.Start(context.Background())
+
+	body := `{"name": "sensor", "labels": {"device": "d1"}, "fields": {
+		"temperature": 21.5, "charging": true, "status": "low \"battery\"",
+		"battery": {"type": "int", "value": 12}}}`
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/metrics", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	server.streamProcessor.Stop()
+
+	query := func(field, format string) *httptest.ResponseRecorder {
+		params := url.Values{"series": {`sensor{device="d1"}`}, "field": {field}, "start": {"-1h"}}
+		if format != "" {
+			params.Set("format", format)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?"+params.Encode(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", field, rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+
+	for field, expected := range map[string]string{
+		"temperature": `"Value":21.5`,
+		"battery":     `"Value":12,"Type":"int"`,
+		"charging":    `"Value":true,"Type":"bool"`,
+		"status":      `"Value":"low \"battery\"","Type":"string"`,
+	} {
+		rec := query(field, "")
+		var response QueryResponse
+		json.Unmarshal(rec.Body.Bytes(), &response)
+		if response.Count != 1 || response.Labels["__field__"] != field {
+			t.Errorf("%s: expected the field's single point, got %s", field, rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("%s: expected %s in %s", field, expected, rec.Body.String())
+		}
+	}
+
+	if csv := query("status", "csv").Body.String(); !strings.Contains(csv, `,"low ""battery"""`) {
+		t.Errorf("Expected a quoted string value in CSV, got %s", csv)
+	}
+	if ndjson := query("charging", "ndjson").Body.String(); !strings.Contains(ndjson, `"value":true}`) {
+		t.Errorf("Expected a boolean value in NDJSON, got %s", ndjson)
+	}
+
+	// Without a field the selector matches every field of the device
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", `/api/v1/query?series=`+url.QueryEscape(`sensor{device="d1"}`), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an ambiguous selector, got %d", rec.Code)
+	}
+}
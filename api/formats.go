@@ -0,0 +1,318 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// Query result formats selected with the format parameter or the Accept header
+const (
+	formatJSON     = "json"
+	formatNDJSON   = "ndjson"
+	formatCSV      = "csv"
+	formatColumnar = "columnar"
+)
+
+// Content types of the query result formats
+const (
+	contentTypeNDJSON   = "application/x-ndjson"
+	contentTypeCSV      = "text/csv"
+	contentTypeColumnar = "application/vnd.tsdb.columnar+json"
+)
+
+// streamFlushInterval is the number of points written between flushes of a
+// streamed response
+const streamFlushInterval = 1000
+
+// negotiateFormat picks the result format from the format parameter, falling
+// back to the Accept header and then to JSON
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		switch format {
+		case formatJSON, formatNDJSON, formatCSV, formatColumnar:
+			return format, nil
+		}
+		return "", fmt.Errorf("Unsupported format: %s", format)
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		switch mediaType {
+		case contentTypeNDJSON, "application/ndjson":
+			return formatNDJSON, nil
+		case contentTypeCSV:
+			return formatCSV, nil
+		case contentTypeColumnar:
+			return formatColumnar, nil
+		case "application/json":
+			return formatJSON, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+// seriesWriter streams one or more series to a response in a specific format
+type seriesWriter interface {
+	// WriteSeries drains the iterator into the response, returning the number of points written
+	WriteSeries(seriesID string, labels map[string]string, it storage.PointIterator) (int, error)
+	// Close finishes the response
+	Close() error
+}
+
+// newSeriesWriter creates a streaming writer for a non-JSON format and sets
+// the response content type
+func newSeriesWriter(w http.ResponseWriter, format string) seriesWriter {
+	flusher, _ := w.(http.Flusher)
+	out := &flushWriter{Writer: bufio.NewWriter(w), flusher: flusher}
+
+	switch format {
+	case formatCSV:
+		w.Header().Set("Content-Type", contentTypeCSV)
+		return &csvSeriesWriter{out: out}
+	case formatColumnar:
+		w.Header().Set("Content-Type", contentTypeColumnar)
+		return &columnarSeriesWriter{out: out}
+	default:
+		w.Header().Set("Content-Type", contentTypeNDJSON)
+		return &ndjsonSeriesWriter{out: out}
+	}
+}
+
+// flushWriter buffers output and pushes it to the client periodically
+type flushWriter struct {
+	*bufio.Writer
+	flusher http.Flusher
+	pending int
+}
+
+// pointWritten flushes the buffer after every streamFlushInterval points
+func (fw *flushWriter) pointWritten() error {
+	fw.pending++
+	if fw.pending < streamFlushInterval {
+		return nil
+	}
+	fw.pending = 0
+	return fw.flush()
+}
+
+func (fw *flushWriter) flush() error {
+	if err := fw.Flush(); err != nil {
+		return err
+	}
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	return nil
+}
+
+// ndjsonSeriesWriter writes a header object per series followed by one
+// {"timestamp":<unix ms>,"value":<float>} object per point
+type ndjsonSeriesWriter struct {
+	out *flushWriter
+}
+
+func (nw *ndjsonSeriesWriter) WriteSeries(seriesID string, labels map[string]string, it storage.PointIterator) (int, error) {
+	defer it.Close()
+
+	header, err := json.Marshal(map[string]interface{}{"series": seriesID, "labels": labels})
+	if err != nil {
+		return 0, err
+	}
+	nw.out.Write(header)
+	nw.out.WriteByte('\n')
+
+	count := 0
+	buf := make([]byte, 0, 64)
+	for it.Next() {
+		point := it.At()
+		buf = append(buf[:0], `{"timestamp":`...)
+		buf = strconv.AppendInt(buf, point.Timestamp.UnixMilli(), 10)
+		buf = append(buf, `,"value":`...)
+		buf = appendJSONValue(buf, point)
+		buf = append(buf, "}\n"...)
+		if _, err := nw.out.Write(buf); err != nil {
+			return count, err
+		}
+		count++
+		if err := nw.out.pointWritten(); err != nil {
+			return count, err
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		// The status line is already sent, so report the failure in-band
+		errLine, _ := json.Marshal(map[string]string{"error": err.Error()})
+		nw.out.Write(errLine)
+		nw.out.WriteByte('\n')
+		return count, err
+	}
+	return count, nil
+}
+
+func (nw *ndjsonSeriesWriter) Close() error {
+	return nw.out.flush()
+}
+
+// csvSeriesWriter writes series,timestamp,value rows with RFC3339Nano timestamps
+type csvSeriesWriter struct {
+	out           *flushWriter
+	headerWritten bool
+}
+
+func (cw *csvSeriesWriter) WriteSeries(seriesID string, labels map[string]string, it storage.PointIterator) (int, error) {
+	defer it.Close()
+
+	if !cw.headerWritten {
+		cw.out.WriteString("series,timestamp,value\n")
+		cw.headerWritten = true
+	}
+
+	quotedID := csvField(seriesID)
+	count := 0
+	buf := make([]byte, 0, 96)
+	for it.Next() {
+		point := it.At()
+		buf = append(buf[:0], quotedID...)
+		buf = append(buf, ',')
+		buf = point.Timestamp.UTC().AppendFormat(buf, time.RFC3339Nano)
+		buf = append(buf, ',')
+		buf = appendCSVValue(buf, point)
+		buf = append(buf, '\n')
+		if _, err := cw.out.Write(buf); err != nil {
+			return count, err
+		}
+		count++
+		if err := cw.out.pointWritten(); err != nil {
+			return count, err
+		}
+	}
+	return count, it.Err()
+}
+
+func (cw *csvSeriesWriter) Close() error {
+	if !cw.headerWritten {
+		cw.out.WriteString("series,timestamp,value\n")
+	}
+	return cw.out.flush()
+}
+
+// columnarSeriesWriter writes each series as two parallel arrays of unix
+// millisecond timestamps and values, which is far more compact than an array
+// of point objects. Series are written as elements of a "series" array.
+type columnarSeriesWriter struct {
+	out     *flushWriter
+	written int
+}
+
+func (cw *columnarSeriesWriter) WriteSeries(seriesID string, labels map[string]string, it storage.PointIterator) (int, error) {
+	defer it.Close()
+
+	// Timestamps are streamed directly; values are held until the timestamp
+	// array is closed
+	if cw.written == 0 {
+		cw.out.WriteString(`{"series":[`)
+	} else {
+		cw.out.WriteByte(',')
+	}
+	cw.written++
+
+	header, err := json.Marshal(map[string]interface{}{"series": seriesID, "labels": labels})
+	if err != nil {
+		return 0, err
+	}
+	cw.out.Write(header[:len(header)-1])
+	cw.out.WriteString(`,"timestamps":[`)
+
+	var values []storage.DataPoint
+	buf := make([]byte, 0, 32)
+	for it.Next() {
+		point := it.At()
+		buf = buf[:0]
+		if len(values) > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendInt(buf, point.Timestamp.UnixMilli(), 10)
+		if _, err := cw.out.Write(buf); err != nil {
+			return len(values), err
+		}
+		values = append(values, point)
+		if err := cw.out.pointWritten(); err != nil {
+			return len(values), err
+		}
+	}
+
+	cw.out.WriteString(`],"values":[`)
+	for i, point := range values {
+		buf = buf[:0]
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONValue(buf, point)
+		cw.out.Write(buf)
+	}
+	cw.out.WriteString(`],"count":`)
+	cw.out.WriteString(strconv.Itoa(len(values)))
+	cw.out.WriteByte('}')
+
+	return len(values), it.Err()
+}
+
+func (cw *columnarSeriesWriter) Close() error {
+	if cw.written == 0 {
+		cw.out.WriteString(`{"series":[`)
+	}
+	cw.out.WriteString("]}\n")
+	return cw.out.flush()
+}
+
+// appendJSONFloat appends a float as a JSON number, encoding NaN and
+// infinities as null since JSON cannot represent them
+func appendJSONFloat(buf []byte, value float64) []byte {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return append(buf, "null"...)
+	}
+	return strconv.AppendFloat(buf, value, 'g', -1, 64)
+}
+
+// appendJSONValue appends a point's value as a JSON number, boolean or
+// string according to its type
+func appendJSONValue(buf []byte, point storage.DataPoint) []byte {
+	switch point.Type {
+	case storage.ValueInt:
+		return strconv.AppendInt(buf, point.Int, 10)
+	case storage.ValueBool:
+		return strconv.AppendBool(buf, point.Value != 0)
+	case storage.ValueString:
+		text, _ := json.Marshal(point.Text)
+		return append(buf, text...)
+	}
+	return appendJSONFloat(buf, point.Value)
+}
+
+// appendCSVValue appends a point's value as a CSV field
+func appendCSVValue(buf []byte, point storage.DataPoint) []byte {
+	switch point.Type {
+	case storage.ValueInt:
+		return strconv.AppendInt(buf, point.Int, 10)
+	case storage.ValueBool:
+		return strconv.AppendBool(buf, point.Value != 0)
+	case storage.ValueString:
+		return append(buf, csvField(point.Text)...)
+	}
+	return strconv.AppendFloat(buf, point.Value, 'g', -1, 64)
+}
+
+// csvField quotes a CSV field when it contains separators or quotes
+func csvField(field string) string {
+	if !strings.ContainsAny(field, ",\"\n\r") {
+		return field
+	}
+	return `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"time-series-analytics-engine/ingestion"
+	"time-series-analytics-engine/storage"
+	"time-series-analytics-engine/timeexpr"
+)
+
+// HistogramRequest is one histogram sample. Its observations are given in
+// exactly one of three forms: raw values, cumulative Prometheus-style
+// buckets, or a sketch built by the client.
+type HistogramRequest struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Timestamp string            `json:"timestamp,omitempty"`
+	Values    []float64         `json:"values,omitempty"`
+	Buckets   []BucketRequest   `json:"buckets,omitempty"`
+	Sketch    *storage.Sketch   `json:"sketch,omitempty"`
+	// Sum replaces the sum estimated from buckets when given
+	Sum *float64 `json:"sum,omitempty"`
+}
+
+// BucketRequest is a cumulative histogram bucket: the number of
+// observations less than or equal to LE
+type BucketRequest struct {
+	LE    BucketBound `json:"le"`
+	Count float64     `json:"count"`
+}
+
+// BucketBound is a bucket's upper bound, given as a number or as a string
+// such as "0.5" or "+Inf" as in Prometheus' le label
+type BucketBound float64
+
+// UnmarshalJSON accepts a number or a string
+func (b *BucketBound) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var bound float64
+		if err := json.Unmarshal(data, &bound); err != nil {
+			return fmt.Errorf("invalid bucket bound %s", data)
+		}
+		*b = BucketBound(bound)
+		return nil
+	}
+	switch s {
+	case "+Inf", "Inf":
+		*b = BucketBound(math.Inf(1))
+		return nil
+	}
+	bound, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(bound) {
+		return fmt.Errorf("invalid bucket bound %q", s)
+	}
+	*b = BucketBound(bound)
+	return nil
+}
+
+// HistogramBatchRequest is the body of POST /api/v1/histograms
+type HistogramBatchRequest struct {
+	Histograms []HistogramRequest `json:"histograms"`
+}
+
+// ingestHistograms handles POST /api/v1/histograms. Each histogram is stored
+// as a sketch, so samples can be merged across time and series and queried
+// with histogram_quantile.
+func (s *Server) ingestHistograms(w http.ResponseWriter, r *http.Request) {
+	var req HistogramBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Histograms) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	metrics := make([]ingestion.MetricData, 0, len(req.Histograms))
+	for i, h := range req.Histograms {
+		if h.Name == "" {
+			http.Error(w, fmt.Sprintf("Histogram %d: name is required", i), http.StatusBadRequest)
+			return
+		}
+		timestamp := now
+		if h.Timestamp != "" {
+			var err error
+			if timestamp, err = timeexpr.Parse(h.Timestamp, now, time.UTC); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid timestamp format: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		sketch, err := buildSketch(h)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Histogram %s: %v", h.Name, err), http.StatusBadRequest)
+			return
+		}
+		metrics = append(metrics, ingestion.MetricData{
+			Name:      h.Name,
+			Value:     sketch.Count(),
+			Timestamp: timestamp,
+			Labels:    h.Labels,
+			Sketch:    sketch,
+		})
+	}
+
+	if err := s.streamProcessor.IngestBatch(metrics); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to ingest histograms: %v", err), ingestStatus(w, err, http.StatusInternalServerError))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"count":  len(metrics),
+	})
+}
+
+// buildSketch converts a histogram request to a sketch
+func buildSketch(h HistogramRequest) (*storage.Sketch, error) {
+	forms := 0
+	for _, given := range []bool{len(h.Values) > 0, len(h.Buckets) > 0, h.Sketch != nil} {
+		if given {
+			forms++
+		}
+	}
+	if forms != 1 {
+		return nil, fmt.Errorf("exactly one of values, buckets or sketch is required")
+	}
+	if h.Sketch != nil {
+		return h.Sketch, nil
+	}
+
+	sketch, err := storage.NewSketch(storage.DefaultSketchAccuracy)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range h.Values {
+		if err := sketch.Add(value); err != nil {
+			return nil, err
+		}
+	}
+	if len(h.Buckets) > 0 {
+		if err := addBuckets(sketch, h.Buckets); err != nil {
+			return nil, err
+		}
+	}
+	if h.Sum != nil {
+		sketch.SetSum(*h.Sum)
+	}
+	return sketch, nil
+}
+
+// addBuckets adds cumulative buckets to a sketch. The observations of each
+// bucket are placed at the midpoint of its bounds; those of the first
+// bucket at its upper bound and those of the +Inf bucket at the largest
+// finite bound.
+func addBuckets(sketch *storage.Sketch, buckets []BucketRequest) error {
+	previousBound, previousCount := math.Inf(-1), 0.0
+	for _, bucket := range buckets {
+		bound := float64(bucket.LE)
+		if bound <= previousBound {
+			return fmt.Errorf("bucket bounds must be increasing")
+		}
+		n := bucket.Count - previousCount
+		if n < 0 {
+			return fmt.Errorf("bucket counts must be cumulative")
+		}
+		if err := sketch.AddBucket(previousBound, bound, n); err != nil {
+			return err
+		}
+		previousBound, previousCount = bound, bucket.Count
+	}
+	return nil
+}
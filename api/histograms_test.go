@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestIngestHistograms(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.streamProcessor.Start(context.Background())
+
+	body := `{"histograms": [
+		{"name": "request.duration", "labels": {"route": "/a"}, "values": [0.1, 0.2, 0.3, 0.4]},
+		{"name": "request.duration", "labels": {"route": "/b"}, "sum": 3.5,
+		 "buckets": [{"le": 0.5, "count": 2}, {"le": "1", "count": 5}, {"le": "+Inf", "count": 6}]},
+		{"name": "request.duration", "labels": {"route": "/c"},
+		 "sketch": {"accuracy": 0.01, "count": 2, "sum": 2, "positive": {"0": 2}}}
+	]}`
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/histograms", strings.NewReader(body)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	server.streamProcessor.Stop()
+
+	sketchOf := func(route string) *storage.Sketch {
+		labels := map[string]string{"route": route}
+		points, _ := engine.GetRange(context.Background(), storage.SeriesKey("request.duration", labels), time.Now().Add(-time.Minute), time.Now())
+		if len(points) != 1 || points[0].Sketch == nil {
+			t.Fatalf("Expected one histogram sample for %s, got %+v", route, points)
+		}
+		return points[0].Sketch
+	}
+
+	if sketch := sketchOf("/a"); sketch.Count() != 4 || math.Abs(sketch.Quantile(0.5)-0.2) > 0.01 {
+		t.Errorf("Unexpected sketch from values: count %v, median %v", sketch.Count(), sketch.Quantile(0.5))
+	}
+	// Buckets are placed at their midpoints, the +Inf bucket at the last bound
+	sketch := sketchOf("/b")
+	if sketch.Count() != 6 || sketch.Sum() != 3.5 || sketch.Quantile(1) != 1 {
+		t.Errorf("Unexpected sketch from buckets: count %v, sum %v, max %v", sketch.Count(), sketch.Sum(), sketch.Quantile(1))
+	}
+	if q := sketch.Quantile(0.5); math.Abs(q-0.75) > 0.01 {
+		t.Errorf("Expected the median in the (0.5, 1] bucket's midpoint, got %v", q)
+	}
+	if sketch := sketchOf("/c"); sketch.Count() != 2 {
+		t.Errorf("Expected the client's sketch to be stored, got count %v", sketch.Count())
+	}
+
+	for _, invalid := range []string{
+		`{"histograms": []}`,
+		`{"histograms": [{"name": "x"}]}`,
+		`{"histograms": [{"name": "x", "values": [1], "buckets": [{"le": 1, "count": 1}]}]}`,
+		`{"histograms": [{"name": "x", "buckets": [{"le": 1, "count": 3}, {"le": 2, "count": 1}]}]}`,
+		`{"histograms": [{"name": "x", "sketch": {"accuracy": 2, "count": 0}}]}`,
+	} {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/histograms", strings.NewReader(invalid)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", invalid, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time-series-analytics-engine/ingestion"
+)
+
+// InfluxError is the error body of the InfluxDB v2 write API, with the
+// rejected lines listed so agents can tell which points were dropped
+type InfluxError struct {
+	Code    string                `json:"code"`
+	Message string                `json:"message"`
+	Line    int                   `json:"line,omitempty"`
+	Errors  []ingestion.LineError `json:"errors,omitempty"`
+}
+
+// writeInfluxError writes an error in the InfluxDB v2 format
+func writeInfluxError(w http.ResponseWriter, code int, body InfluxError) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// influxWrite handles POST /api/v2/write, ingesting InfluxDB line protocol
+// as sent by Telegraf and the Influx client libraries. Timestamps are read in
+// the precision parameter's unit (ns by default); org and bucket are accepted
+// for compatibility and ignored. Valid lines are written even when others are
+// rejected, in which case the response is 400 listing the rejected lines.
+// While ingestion is saturated no line is written and the response is 429
+// with Retry-After. Writes over ingestion.MaxLineProtocolSize, compressed or
+// not, are rejected with 413.
+func (s *Server) influxWrite(w http.ResponseWriter, r *http.Request) {
+	// The limit applies to the body as sent and, in IngestLineProtocol, as
+	// decompressed
+	body := io.Reader(http.MaxBytesReader(w, r.Body, ingestion.MaxLineProtocolSize))
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeInfluxError(w, http.StatusBadRequest, InfluxError{Code: "invalid", Message: fmt.Sprintf("Invalid gzip body: %v", err)})
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	err := s.streamProcessor.IngestLineProtocol(body, r.URL.Query().Get("precision"))
+	var lineErrors ingestion.LineErrors
+	var maxBytes *http.MaxBytesError
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ingestion.ErrWriteTooLarge) || errors.As(err, &maxBytes):
+		writeInfluxError(w, http.StatusRequestEntityTooLarge, InfluxError{
+			Code:    "request too large",
+			Message: fmt.Sprintf("write exceeds the %d byte limit", ingestion.MaxLineProtocolSize),
+		})
+	case errors.As(err, &lineErrors):
+		writeInfluxError(w, http.StatusBadRequest, InfluxError{
+			Code:    "invalid",
+			Message: fmt.Sprintf("partial write: %v", err),
+			Line:    lineErrors[0].Line,
+			Errors:  lineErrors,
+		})
+	case errors.Is(err, ingestion.ErrSaturated):
+		writeInfluxError(w, ingestStatus(w, err, http.StatusTooManyRequests), InfluxError{Code: "too many requests", Message: err.Error()})
+	case ingestion.IsRetryable(err):
+		writeInfluxError(w, http.StatusServiceUnavailable, InfluxError{Code: "unavailable", Message: err.Error()})
+	default:
+		writeInfluxError(w, http.StatusBadRequest, InfluxError{Code: "invalid", Message: err.Error()})
+	}
+}
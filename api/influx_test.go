@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/ingestion"
+	"time-series-analytics-engine/storage"
+)
+
+func TestInfluxWrite(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.streamProcessor.Start(context.Background())
+
+	now := time.Now().UnixMilli()
+	body := fmt.Sprintf("cpu,host=a usage=12.5,cores=8i %d\ncpu,host=b usage=oops %d\n", now, now)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v2/write?org=o&bucket=b&precision=ms", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a partial write, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var influxErr InfluxError
+	json.Unmarshal(rec.Body.Bytes(), &influxErr)
+	if influxErr.Code != "invalid" || influxErr.Line != 2 || len(influxErr.Errors) != 1 {
+		t.Errorf("Expected line 2 to be reported, got %s", rec.Body.String())
+	}
+
+	// Telegraf compresses writes by default
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	fmt.Fprintf(gz, "cpu,host=b usage=3 %d\n", now)
+	gz.Close()
+	req := httptest.NewRequest("POST", "/api/v2/write?precision=ms", &compressed)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	server.streamProcessor.Stop()
+
+	for host, fields := range map[string]map[string]float64{"a": {"usage": 12.5, "cores": 8}, "b": {"usage": 3}} {
+		for field, expected := range fields {
+			key := storage.SeriesKey("cpu", storage.FieldLabels(map[string]string{"host": host}, field))
+			points, _ := engine.GetRange(context.Background(), key, time.UnixMilli(now-1), time.UnixMilli(now+1))
+			if len(points) != 1 || points[0].Value != expected {
+				t.Errorf("%s %s: expected %v, got %+v", host, field, expected, points)
+			}
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v2/write?precision=weeks", strings.NewReader("m v=1")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid precision, got %d", rec.Code)
+	}
+}
+
+func TestInfluxWriteTooLarge(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.streamProcessor.Start(context.Background())
+	defer server.streamProcessor.Stop()
+
+	// A small gzip body can decompress to far more than the limit
+	var bomb bytes.Buffer
+	gz := gzip.NewWriter(&bomb)
+	gz.Write(bytes.Repeat([]byte("\n"), ingestion.MaxLineProtocolSize+1))
+	gz.Close()
+	req := httptest.NewRequest("POST", "/api/v2/write", &bomb)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	var influxErr InfluxError
+	json.Unmarshal(rec.Body.Bytes(), &influxErr)
+	if rec.Code != http.StatusRequestEntityTooLarge || influxErr.Code != "request too large" {
+		t.Errorf("Expected 413 for a decompressed body over the limit, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	body := strings.Repeat("\n", ingestion.MaxLineProtocolSize+1)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v2/write", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body over the limit, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"time-series-analytics-engine/ingestion"
+	"time-series-analytics-engine/query"
+	"time-series-analytics-engine/storage"
+)
+
+// QueryLimits bounds the cost of a single query and the number of queries
+// running at once. Zero values disable the corresponding limit.
+type QueryLimits struct {
+	Timeout       time.Duration
+	MaxRange      time.Duration
+	MaxPoints     int
+	MaxConcurrent int
+}
+
+// errTooManyPoints is reported when a query reads or returns more points
+// than allowed
+var errTooManyPoints = errors.New("too many points")
+
+// SetQueryLimits configures the limits applied to data queries
+func (s *Server) SetQueryLimits(limits QueryLimits) {
+	s.queryLimits = limits
+	s.querySlots = nil
+	if limits.MaxConcurrent > 0 {
+		s.querySlots = make(chan struct{}, limits.MaxConcurrent)
+	}
+}
+
+// limitQuery wraps a data query handler with the concurrency limit and the
+// query timeout. The request context is cancelled on timeout or when the
+// client disconnects, which stops any storage reads in progress.
+func (s *Server) limitQuery(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.querySlots != nil {
+			select {
+			case s.querySlots <- struct{}{}:
+				defer func() { <-s.querySlots }()
+			default:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, fmt.Sprintf("Too many concurrent queries (limit %d), retry later", cap(s.querySlots)), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		if s.queryLimits.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), s.queryLimits.Timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		next(w, r)
+	}
+}
+
+// ingestStatus returns the status code for an ingestion error: 429 with a
+// Retry-After header when ingestion is saturated, 503 when the stream
+// processor is stopped, and fallback for errors that should not be retried
+func ingestStatus(w http.ResponseWriter, err error, fallback int) int {
+	if retryAfter, ok := ingestion.RetryAfter(err); ok {
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		return http.StatusTooManyRequests
+	}
+	if ingestion.IsRetryable(err) {
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
+
+// checkQueryRange rejects time ranges wider than the configured maximum
+func (s *Server) checkQueryRange(start, end time.Time) error {
+	if end.Before(start) {
+		return fmt.Errorf("Query end %s is before start %s", end.Format(time.RFC3339), start.Format(time.RFC3339))
+	}
+	if maxRange := s.queryLimits.MaxRange; maxRange > 0 && end.Sub(start) > maxRange {
+		return fmt.Errorf("Query range %v exceeds the maximum of %v", end.Sub(start).Round(time.Second), maxRange)
+	}
+	return nil
+}
+
+// checkQueryPoints rejects results larger than the configured maximum
+func (s *Server) checkQueryPoints(count int) error {
+	if maxPoints := s.queryLimits.MaxPoints; maxPoints > 0 && count > maxPoints {
+		return fmt.Errorf("%w: query returns %d points, more than the maximum of %d; narrow the range or set a limit", errTooManyPoints, count, maxPoints)
+	}
+	return nil
+}
+
+// writeQueryError reports a failed query read with a status that tells
+// timeouts and oversized results apart from storage failures
+func (s *Server) writeQueryError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	switch {
+	case errors.Is(err, errTooManyPoints):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, fmt.Sprintf("Query timed out after %v", s.queryLimits.Timeout), http.StatusServiceUnavailable)
+	case errors.Is(err, context.Canceled):
+		// The client went away, so there is nobody to respond to
+		log.Printf("Query cancelled: %s", r.URL.String())
+	default:
+		http.Error(w, fmt.Sprintf("%s: %v", message, err), http.StatusInternalServerError)
+	}
+}
+
+// pointLimitIterator fails with errTooManyPoints once more than max points
+// have been read, counting into count, which iterators may share
+type pointLimitIterator struct {
+	storage.PointIterator
+	max   int
+	count *int
+	err   error
+	// reading reports the limit as one on points read rather than returned
+	reading bool
+}
+
+// newPointLimitIterator applies the configured point limit to a streamed query
+func (s *Server) newPointLimitIterator(it storage.PointIterator) storage.PointIterator {
+	if s.queryLimits.MaxPoints <= 0 {
+		return it
+	}
+	return &pointLimitIterator{PointIterator: it, max: s.queryLimits.MaxPoints, count: new(int)}
+}
+
+// readRange reads a series' points in [start, end], keeping only the most
+// recent limit points when limit is positive. The point limit is checked
+// while reading, so an oversized range fails without being loaded first.
+func (s *Server) readRange(ctx context.Context, seriesID string, start, end time.Time, limit int) ([]storage.DataPoint, error) {
+	it := storage.NewTailIterator(s.storage.Iterator(ctx, seriesID, start, end), limit)
+	points, err := storage.CollectPoints(s.newPointLimitIterator(it))
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	return points, nil
+}
+
+func (it *pointLimitIterator) Next() bool {
+	if it.err != nil || !it.PointIterator.Next() {
+		return false
+	}
+	*it.count++
+	if *it.count > it.max {
+		if it.reading {
+			it.err = fmt.Errorf("%w: query reads more than the maximum of %d points; narrow the range", errTooManyPoints, it.max)
+		} else {
+			it.err = fmt.Errorf("%w: query returns more than the maximum of %d points; narrow the range or set a limit", errTooManyPoints, it.max)
+		}
+		return false
+	}
+	return true
+}
+
+func (it *pointLimitIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.PointIterator.Err()
+}
+
+// pointLimitStorage applies the point limit to all the raw points an
+// expression reads, so an oversized query fails while its series are read
+// instead of after it has been evaluated
+type pointLimitStorage struct {
+	query.Storage
+	max   int
+	count int
+}
+
+// newPointLimitStorage applies the configured point limit to expression reads
+func (s *Server) newPointLimitStorage(st query.Storage) query.Storage {
+	if s.queryLimits.MaxPoints <= 0 {
+		return st
+	}
+	return &pointLimitStorage{Storage: st, max: s.queryLimits.MaxPoints}
+}
+
+func (ls *pointLimitStorage) Iterator(ctx context.Context, seriesID string, start, end time.Time) storage.PointIterator {
+	return &pointLimitIterator{PointIterator: ls.Storage.Iterator(ctx, seriesID, start, end), max: ls.max, count: &ls.count, reading: true}
+}
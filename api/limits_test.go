@@ -0,0 +1,84 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/ingestion"
+	"time-series-analytics-engine/storage"
+)
+
+func newTestServer(t *testing.T) (*Server, *storage.StorageEngine) {
+	engine, err := storage.NewStorageEngine(&storage.StorageConfig{
+		Hot: storage.HotStorageConfig{MaxSeries: 100, MaxPointsPerSeries: 1000},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	processor := ingestion.NewStreamProcessor(engine, 100, 10, time.Second)
+	return NewServer(engine, processor), engine
+}
+
+func TestQueryLimits_RejectOversizedQueries(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.SetQueryLimits(QueryLimits{MaxRange: 2 * time.Hour, MaxPoints: 5})
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		engine.AddPoint("cpu.usage", nil, now.Add(-time.Duration(i)*time.Minute), float64(i))
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		reason string
+	}{
+		{"series=cpu.usage&start=-3h", http.StatusBadRequest, "exceeds the maximum"},
+		{"series=cpu.usage&start=-1h", http.StatusUnprocessableEntity, "maximum of 5"},
+		{"series=cpu.usage&start=-1h&limit=5", http.StatusOK, ""},
+		{"series=cpu.usage&start=-1h&format=ndjson", http.StatusOK, "maximum of 5"},
+		{"query=sum(cpu.usage)&start=-1h&step=1h", http.StatusUnprocessableEntity, "reads more than the maximum of 5"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d (%s)", tt.query, tt.status, rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), tt.reason) {
+			t.Errorf("%s: expected %q in response, got %s", tt.query, tt.reason, rec.Body.String())
+		}
+	}
+
+	// Analytics read their training data under the same limit
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"series_id": "cpu.usage", "start": "-1h"}`)
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/analytics/anomaly", body))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "maximum of 5") {
+		t.Errorf("Expected the anomaly detection to hit the point limit, got %d (%s)", rec.Code, rec.Body.String())
+	}
+}
+
+func TestQueryLimits_ConcurrencyAndTimeout(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.SetQueryLimits(QueryLimits{MaxConcurrent: 1, Timeout: time.Nanosecond})
+	engine.AddPoint("cpu.usage", nil, time.Now(), 1)
+
+	// Occupy the only query slot
+	server.querySlots <- struct{}{}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?series=cpu.usage", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After when saturated, got %d", rec.Code)
+	}
+	<-server.querySlots
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?series=cpu.usage", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "timed out") {
+		t.Errorf("Expected 503 timeout, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time-series-analytics-engine/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// MetricMetadataRequest sets the type, unit and help text of a metric
+type MetricMetadataRequest struct {
+	Type string `json:"type,omitempty"`
+	Unit string `json:"unit,omitempty"`
+	Help string `json:"help,omitempty"`
+}
+
+// MetricMetadataResponse is the metadata of one metric
+type MetricMetadataResponse struct {
+	Metric string `json:"metric"`
+	storage.Metadata
+}
+
+// getMetricMetadata handles GET /api/v1/metadata/{metric}
+func (s *Server) getMetricMetadata(w http.ResponseWriter, r *http.Request) {
+	metric := mux.Vars(r)["metric"]
+	md, ok := s.storage.Metadata(metric)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No metadata for metric %s", metric), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(MetricMetadataResponse{Metric: metric, Metadata: md})
+}
+
+// setMetricMetadata handles PUT /api/v1/metadata/{metric}, replacing the
+// metric's metadata
+func (s *Server) setMetricMetadata(w http.ResponseWriter, r *http.Request) {
+	metric := mux.Vars(r)["metric"]
+	var req MetricMetadataRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	metricType, err := storage.ParseMetricType(req.Type)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid metadata: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	md := storage.Metadata{Type: metricType, Unit: req.Unit, Help: req.Help}
+	if err := s.storage.SetMetadata(metric, md); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to set metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(MetricMetadataResponse{Metric: metric, Metadata: md})
+}
+
+// deleteMetricMetadata handles DELETE /api/v1/metadata/{metric}
+func (s *Server) deleteMetricMetadata(w http.ResponseWriter, r *http.Request) {
+	if err := s.storage.DeleteMetadata(mux.Vars(r)["metric"]); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// importPrometheus handles POST /api/v1/import/prometheus, ingesting a body
+// in the Prometheus text exposition format along with its # HELP, # TYPE
+// and # UNIT metadata
+func (s *Server) importPrometheus(w http.ResponseWriter, r *http.Request) {
+	if err := s.streamProcessor.IngestPrometheusText(r.Body); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to import metrics: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// seriesMetadata returns the metadata of a series' metric, or nil
+func (s *Server) seriesMetadata(seriesID string, labels map[string]string) *storage.Metadata {
+	md, ok := s.storage.Metadata(storage.MetricName(seriesID, labels))
+	if !ok {
+		return nil
+	}
+	return &md
+}
+
+// unitConversion converts a series' values to the unit requested with the
+// unit parameter. It returns the factor to scale values by and the metadata
+// to report, which carries the new unit.
+func unitConversion(md *storage.Metadata, seriesID, unit string) (float64, *storage.Metadata, error) {
+	if unit == "" {
+		return 1, md, nil
+	}
+	if md == nil || md.Unit == "" {
+		return 0, nil, fmt.Errorf("Cannot convert %s to %s: its unit is not known", seriesID, unit)
+	}
+	factor, err := storage.UnitFactor(md.Unit, unit)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Cannot convert %s: %v", seriesID, err)
+	}
+	converted := *md
+	converted.Unit = unit
+	return factor, &converted, nil
+}
+
+// scalePoints multiplies point values by factor in place
+func scalePoints(points []storage.DataPoint, factor float64) {
+	if factor == 1 {
+		return
+	}
+	for i := range points {
+		points[i] = scalePoint(points[i], factor)
+	}
+}
+
+// scalePoint multiplies a numeric value by factor. Scaled integers become
+// floats; booleans, strings and stale markers are left as they are.
+func scalePoint(point storage.DataPoint, factor float64) storage.DataPoint {
+	switch {
+	case storage.IsStaleMarker(point.Value):
+	case point.Type == storage.ValueFloat, point.Type == storage.ValueInt:
+		point.Value *= factor
+		point.Type = storage.ValueFloat
+	}
+	return point
+}
+
+// scaledIterator multiplies the values of another iterator by a factor
+type scaledIterator struct {
+	storage.PointIterator
+	factor float64
+}
+
+func newScaledIterator(it storage.PointIterator, factor float64) storage.PointIterator {
+	if factor == 1 {
+		return it
+	}
+	return &scaledIterator{PointIterator: it, factor: factor}
+}
+
+func (it *scaledIterator) At() storage.DataPoint {
+	return scalePoint(it.PointIterator.At(), it.factor)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestMetadata_ImportAndAdmin(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.streamProcessor.Start(context.Background())
+
+	body := "# HELP job_duration_seconds Time spent per job.\n# TYPE job_duration_seconds gauge\n# UNIT job_duration_seconds seconds\njob_duration_seconds{job=\"backup\"} 1.5\n"
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/import/prometheus", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	server.streamProcessor.Stop()
+
+	expected := storage.Metadata{Type: storage.MetricTypeGauge, Unit: "seconds", Help: "Time spent per job."}
+	if md, ok := engine.Metadata("job_duration_seconds"); !ok || md != expected {
+		t.Errorf("Expected %+v from the import, got %+v", expected, md)
+	}
+	if !engine.SeriesExists(`job_duration_seconds{job="backup"}`) {
+		t.Error("Expected the imported sample to be stored")
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/v1/metadata/memory_used", strings.NewReader(`{"type": "gauge", "unit": "bytes"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("PUT", "/api/v1/metadata/memory_used", strings.NewReader(`{"type": "widget"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown type, got %d", rec.Code)
+	}
+
+	engine.AddPoint("memory_used", nil, time.Now(), 2048)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/series", nil))
+	var series SeriesListResponse
+	json.NewDecoder(rec.Body).Decode(&series)
+	for _, info := range series.Series {
+		if info.ID == "memory_used" && (info.Metadata == nil || info.Metadata.Unit != "bytes") {
+			t.Errorf("Expected series listing to include metadata, got %+v", info)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/v1/metadata/job_duration_seconds", nil))
+	if _, ok := engine.Metadata("job_duration_seconds"); rec.Code != http.StatusNoContent || ok {
+		t.Errorf("Expected metadata to be deleted, got %d", rec.Code)
+	}
+}
+
+func TestMetadata_UnitConversion(t *testing.T) {
+	server, engine := newTestServer(t)
+	engine.SetMetadata("memory_used", storage.Metadata{Type: storage.MetricTypeGauge, Unit: "bytes"})
+	engine.AddPoint("memory_used", nil, time.Now().Add(-time.Minute), 2048)
+
+	tests := []struct {
+		params url.Values
+		status int
+	}{
+		{url.Values{"series": {"memory_used"}, "unit": {"KiB"}}, http.StatusOK},
+		{url.Values{"query": {"memory_used"}, "step": {"1m"}, "unit": {"KiB"}}, http.StatusOK},
+		// Arithmetic drops the metric and with it the unit
+		{url.Values{"query": {"memory_used * 2"}, "step": {"1m"}, "unit": {"KiB"}}, http.StatusBadRequest},
+		{url.Values{"series": {"memory_used"}, "unit": {"seconds"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/query?"+tt.params.Encode(), nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d: %s", tt.params.Encode(), tt.status, rec.Code, rec.Body.String())
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var result QueryResponse
+		if tt.params.Get("query") != "" {
+			var response ExpressionResponse
+			json.NewDecoder(rec.Body).Decode(&response)
+			if len(response.Series) != 1 {
+				t.Fatalf("Expected one series, got %+v", response)
+			}
+			result = response.Series[0]
+		} else {
+			json.NewDecoder(rec.Body).Decode(&result)
+		}
+		if result.Metadata == nil || result.Metadata.Unit != "KiB" || len(result.Points) == 0 || result.Points[0].Value != 2 {
+			t.Errorf("%s: expected 2 KiB, got %+v", tt.params.Encode(), result)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time-series-analytics-engine/ingestion"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// gRPC status codes sent in OTLP error responses
+const (
+	otlpCodeInvalidArgument   = 3
+	otlpCodeResourceExhausted = 8
+	otlpCodeUnavailable       = 14
+)
+
+// otlpMetrics handles POST /v1/metrics, the OTLP/HTTP metrics exporter
+// endpoint. Requests and responses are protobuf or JSON as the request's
+// Content-Type says. Data points that cannot be stored are reported in the
+// response's partial_success, as OTLP exporters must not retry them; only a
+// stopped processor gives a retryable 503, and saturated ingestion a 429
+// with Retry-After.
+func (s *Server) otlpMetrics(w http.ResponseWriter, r *http.Request) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := contentType == "application/json"
+	if !isJSON && contentType != "application/x-protobuf" {
+		http.Error(w, fmt.Sprintf("Unsupported content type: %s", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeOTLPStatus(w, isJSON, http.StatusBadRequest, otlpCodeInvalidArgument, fmt.Sprintf("Invalid gzip body: %v", err))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported content encoding: %s", encoding), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, ingestion.MaxOTLPRequestSize+1))
+	if err != nil {
+		writeOTLPStatus(w, isJSON, http.StatusBadRequest, otlpCodeInvalidArgument, fmt.Sprintf("Failed to read request: %v", err))
+		return
+	}
+	if len(data) > ingestion.MaxOTLPRequestSize {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var metrics []ingestion.OTLPMetric
+	if isJSON {
+		metrics, err = ingestion.DecodeOTLPJSON(data)
+	} else {
+		metrics, err = ingestion.DecodeOTLPProto(data)
+	}
+	if err != nil {
+		writeOTLPStatus(w, isJSON, http.StatusBadRequest, otlpCodeInvalidArgument, fmt.Sprintf("Invalid OTLP request: %v", err))
+		return
+	}
+
+	rejected, err := s.otlpReceiver.Ingest(metrics)
+	if err != nil && ingestion.IsRetryable(err) {
+		code := otlpCodeUnavailable
+		if errors.Is(err, ingestion.ErrSaturated) {
+			code = otlpCodeResourceExhausted
+		}
+		writeOTLPStatus(w, isJSON, ingestStatus(w, err, http.StatusServiceUnavailable), code, fmt.Sprintf("Failed to write data points: %v", err))
+		return
+	}
+	var message string
+	if err != nil {
+		message = err.Error()
+	}
+
+	if isJSON {
+		response := map[string]interface{}{}
+		if rejected > 0 {
+			response["partialSuccess"] = map[string]string{
+				"rejectedDataPoints": strconv.Itoa(rejected),
+				"errorMessage":       message,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	var response []byte
+	if rejected > 0 {
+		var partial []byte
+		partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+		partial = protowire.AppendVarint(partial, uint64(rejected))
+		partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+		partial = protowire.AppendString(partial, message)
+		response = protowire.AppendTag(response, 1, protowire.BytesType)
+		response = protowire.AppendBytes(response, partial)
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(response)
+}
+
+// writeOTLPStatus writes an OTLP error response: a google.rpc.Status in the
+// request's encoding
+func writeOTLPStatus(w http.ResponseWriter, isJSON bool, httpCode, code int, message string) {
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(httpCode)
+		json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message})
+		return
+	}
+	var status []byte
+	status = protowire.AppendTag(status, 1, protowire.VarintType)
+	status = protowire.AppendVarint(status, uint64(code))
+	status = protowire.AppendTag(status, 2, protowire.BytesType)
+	status = protowire.AppendString(status, message)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(httpCode)
+	w.Write(status)
+}
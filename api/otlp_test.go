@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestOTLPMetrics(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.streamProcessor.Start(context.Background())
+
+	now := time.Now()
+	body := fmt.Sprintf(`{"resourceMetrics":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},
+		"scopeMetrics":[{"metrics":[
+			{"name":"orders","description":"Orders placed","unit":"{order}","sum":{"aggregationTemporality":1,"isMonotonic":true,
+				"dataPoints":[{"timeUnixNano":"%d","asInt":"2"},{"timeUnixNano":"%d","asInt":"3"}]}},
+			{"name":"broken","histogram":{"aggregationTemporality":1,
+				"dataPoints":[{"timeUnixNano":"%d","count":"1","bucketCounts":["1"],"explicitBounds":[1,2]}]}}
+		]}]
+	}]}`, now.Add(-time.Second).UnixNano(), now.UnixNano(), now.UnixNano())
+	req := httptest.NewRequest("POST", "/v1/metrics", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response struct {
+		PartialSuccess struct {
+			RejectedDataPoints string `json:"rejectedDataPoints"`
+			ErrorMessage       string `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if response.PartialSuccess.RejectedDataPoints != "1" || !strings.Contains(response.PartialSuccess.ErrorMessage, "broken") {
+		t.Errorf("Expected the invalid histogram point to be rejected, got %s", rec.Body.String())
+	}
+
+	// An empty protobuf request is answered with an empty response
+	req = httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(nil))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("Expected an empty protobuf response, got %d: %q", rec.Code, rec.Body.String())
+	}
+	server.streamProcessor.Stop()
+
+	key := storage.SeriesKey("orders", map[string]string{"service.name": "checkout"})
+	points, _ := engine.GetRange(context.Background(), key, now.Add(-time.Minute), now.Add(time.Minute))
+	if len(points) != 2 || points[1].Value != 5 {
+		t.Errorf("Expected the delta sum stored as a running total, got %+v", points)
+	}
+	if md, ok := engine.Metadata("orders"); !ok || md.Type != storage.MetricTypeCounter || md.Help != "Orders placed" {
+		t.Errorf("Expected counter metadata, got %+v", md)
+	}
+
+	req = httptest.NewRequest("POST", "/v1/metrics", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for JSON sent as protobuf, got %d", rec.Code)
+	}
+
+	// Once stopped, exporters should retry
+	request := protowire.AppendTag(nil, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, nil)
+	req = httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(request))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once stopped, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/v1/metrics", strings.NewReader("x"))
+	req.Header.Set("Content-Type", "text/plain")
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time-series-analytics-engine/ingestion"
+	"time-series-analytics-engine/storage"
+)
+
+// SeriesExemplars holds the exemplars of one series
+type SeriesExemplars struct {
+	SeriesID  string             `json:"series_id"`
+	Labels    map[string]string  `json:"labels"`
+	Exemplars []storage.Exemplar `json:"exemplars"`
+}
+
+// ExemplarsResponse represents the exemplars query response
+type ExemplarsResponse struct {
+	Series []SeriesExemplars `json:"series"`
+	Count  int               `json:"count"`
+}
+
+// remoteWrite handles POST /api/v1/write, the Prometheus remote write
+// protocol. Prometheus retries requests answered with 5xx or 429 and drops
+// those answered with 4xx, so only temporary failures are reported as 5xx,
+// or as 429 with Retry-After while ingestion is saturated: invalid samples
+// get 400 after the valid ones in the request are written.
+func (s *Server) remoteWrite(w http.ResponseWriter, r *http.Request) {
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "snappy" {
+		http.Error(w, fmt.Sprintf("Unsupported content encoding: %s", encoding), http.StatusUnsupportedMediaType)
+		return
+	}
+	// Remote write 2.0 sends a different message under the same endpoint
+	if contentType := r.Header.Get("Content-Type"); strings.Contains(contentType, "proto=") && !strings.Contains(contentType, "proto=prometheus.WriteRequest") {
+		http.Error(w, fmt.Sprintf("Unsupported content type: %s", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, ingestion.MaxRemoteWriteSize+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(body) > ingestion.MaxRemoteWriteSize {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	req, err := ingestion.DecodeRemoteWrite(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid remote write request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.streamProcessor.IngestRemoteWrite(req); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to write samples: %v", err), ingestStatus(w, err, http.StatusBadRequest))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryExemplars handles GET /api/v1/exemplars, returning the exemplars of
+// series matching the match[] selectors within the optional time range
+func (s *Server) queryExemplars(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	matcherSets, err := parseMatchParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(matcherSets) == 0 {
+		http.Error(w, "At least one match[] selector is required", http.StatusBadRequest)
+		return
+	}
+	start, end, err := parseTimeRangeParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := ExemplarsResponse{Series: []SeriesExemplars{}}
+	seen := make(map[string]bool)
+	for _, matchers := range matcherSets {
+		for _, info := range s.storage.Select(matchers, start, end) {
+			if seen[info.ID] {
+				continue
+			}
+			seen[info.ID] = true
+			if exemplars := s.storage.Exemplars(info.ID, start, end); len(exemplars) > 0 {
+				response.Series = append(response.Series, SeriesExemplars{SeriesID: info.ID, Labels: info.Labels, Exemplars: exemplars})
+			}
+		}
+	}
+	response.Count = len(response.Series)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/ingestion"
+	"time-series-analytics-engine/storage"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteBody encodes a WriteRequest with one series holding a sample
+// and an exemplar
+func remoteWriteBody(labels map[string]string, value float64, timestamp time.Time) []byte {
+	appendMessage := func(b []byte, num protowire.Number, message []byte) []byte {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, message)
+	}
+	appendLabel := func(b []byte, name, value string) []byte {
+		label := protowire.AppendTag(nil, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, value)
+		return appendMessage(b, 1, label)
+	}
+	appendValue := func(b []byte, num protowire.Number) []byte {
+		b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(value))
+		b = protowire.AppendTag(b, num+1, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(timestamp.UnixMilli()))
+	}
+
+	var series []byte
+	for name, value := range labels {
+		series = appendLabel(series, name, value)
+	}
+	series = appendMessage(series, 2, appendValue(nil, 1))
+	series = appendMessage(series, 3, appendValue(appendLabel(nil, "trace_id", "t1"), 2))
+	return snappy.Encode(nil, appendMessage(nil, 1, series))
+}
+
+func TestRemoteWrite(t *testing.T) {
+	server, engine := newTestServer(t)
+	server.streamProcessor.Start(context.Background())
+
+	now := time.Now().Truncate(time.Millisecond)
+	post := func(body []byte, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(remoteWriteBody(map[string]string{"__name__": "node_load1", "instance": "a"}, 0.5, now), "snappy")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	server.streamProcessor.Stop()
+
+	seriesID := storage.SeriesKey("node_load1", map[string]string{"instance": "a"})
+	points, _ := engine.GetRange(context.Background(), seriesID, now.Add(-time.Second), now.Add(time.Second))
+	if len(points) != 1 || points[0].Value != 0.5 {
+		t.Errorf("Expected the sample to be stored, got %+v", points)
+	}
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/exemplars?match[]="+url.QueryEscape(`node_load1`), nil))
+	var response ExemplarsResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if response.Count != 1 || response.Series[0].Exemplars[0].Labels["trace_id"] != "t1" {
+		t.Errorf("Expected the exemplar to be stored, got %s", rec.Body.String())
+	}
+
+	for name, test := range map[string]struct {
+		body     []byte
+		encoding string
+		code     int
+	}{
+		"garbage":           {[]byte("not snappy"), "snappy", http.StatusBadRequest},
+		"unknown encoding":  {nil, "gzip", http.StatusUnsupportedMediaType},
+		"missing name":      {remoteWriteBody(map[string]string{"job": "x"}, 1, now), "snappy", http.StatusBadRequest},
+		"processor stopped": {remoteWriteBody(map[string]string{"__name__": "m"}, 1, now), "snappy", http.StatusServiceUnavailable},
+	} {
+		if rec := post(test.body, test.encoding); rec.Code != test.code {
+			t.Errorf("%s: expected %d, got %d: %s", name, test.code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestRemoteWrite_Saturated(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.streamProcessor.SetBackpressure(ingestion.BackpressureConfig{RatePerSecond: 0.5, Burst: 1})
+	server.streamProcessor.Start(context.Background())
+	defer server.streamProcessor.Stop()
+
+	now := time.Now()
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(remoteWriteBody(map[string]string{"__name__": "up"}, 1, now)))
+		req.Header.Set("Content-Encoding", "snappy")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := post(); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// The next token is two seconds away
+	rec := post()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected 429 with Retry-After 2, got %d and %q: %s", rec.Code, rec.Header().Get("Retry-After"), rec.Body.String())
+	}
+
+	// Other ingestion endpoints back off the same way
+	req := httptest.NewRequest("POST", "/api/v2/write", strings.NewReader("up value=1"))
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected line protocol writes to get 429, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -1,14 +1,17 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 	"time-series-analytics-engine/analytics/ml"
 	"time-series-analytics-engine/ingestion"
 	"time-series-analytics-engine/storage"
+	"time-series-analytics-engine/timeexpr"
 
 	"github.com/gorilla/mux"
 )
@@ -17,8 +20,19 @@ import (
 type StorageReader interface {
 	GetSeries(seriesID string) (*storage.Series, bool)
 	GetSeriesByLabels(labelFilters map[string]string) []*storage.Series
-	GetRange(seriesID string, start, end time.Time) ([]storage.DataPoint, error)
+	GetRange(ctx context.Context, seriesID string, start, end time.Time) ([]storage.DataPoint, error)
 	GetStorageStats() storage.StorageStats
+	SeriesExists(seriesID string) bool
+	Select(matchers []*storage.LabelMatcher, start, end time.Time) []storage.SeriesInfo
+	Iterator(ctx context.Context, seriesID string, start, end time.Time) storage.PointIterator
+	LabelNames(matcherSets [][]*storage.LabelMatcher, start, end time.Time) []string
+	LabelValues(name string, matcherSets [][]*storage.LabelMatcher, start, end time.Time) []string
+	MetricMetadata(matcherSets [][]*storage.LabelMatcher, start, end time.Time) []storage.MetricMetadata
+	Metadata(metric string) (storage.Metadata, bool)
+	SetMetadata(metric string, md storage.Metadata) error
+	DeleteMetadata(metric string) error
+	Exemplars(seriesID string, start, end time.Time) []storage.Exemplar
+	ListSeries(matcherSets [][]*storage.LabelMatcher, start, end time.Time, req storage.SeriesPageRequest) (storage.SeriesPage, error)
 }
 
 // Server represents the HTTP API server
@@ -26,8 +40,13 @@ type Server struct {
 	router           *mux.Router
 	storage          StorageReader
 	streamProcessor  *ingestion.StreamProcessor
+	otlpReceiver     *ingestion.OTLPReceiver
 	anomalyDetector  *ml.AnomalyDetector
 	forecastEngine   *ml.ForecastEngine
+	queryCache       *QueryCache
+	annotations      *storage.AnnotationStore
+	queryLimits      QueryLimits
+	querySlots       chan struct{}
 }
 
 // NewServer creates a new API server
@@ -59,6 +78,7 @@ func NewServer(storage StorageReader, streamProcessor *ingestion.StreamProcessor
 		router:          mux.NewRouter(),
 		storage:         storage,
 		streamProcessor: streamProcessor,
+		otlpReceiver:    ingestion.NewOTLPReceiver(streamProcessor),
 		anomalyDetector: ml.NewAnomalyDetector(anomalyConfig),
 		forecastEngine:  ml.NewForecastEngine(forecastConfig),
 	}
@@ -67,6 +87,12 @@ func NewServer(storage StorageReader, streamProcessor *ingestion.StreamProcessor
 	return server
 }
 
+// SetQueryCache enables caching of expression results. The cache must also
+// be registered as a storage change watcher so changes invalidate it.
+func (s *Server) SetQueryCache(cache *QueryCache) {
+	s.queryCache = cache
+}
+
 // ServeHTTP implements the http.Handler interface
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Add CORS headers
@@ -94,18 +120,50 @@ func (s *Server) setupRoutes() {
 	// Metric ingestion endpoints
 	api.HandleFunc("/metrics", s.ingestMetric).Methods("POST")
 	api.HandleFunc("/metrics/batch", s.ingestBatch).Methods("POST")
+	api.HandleFunc("/histograms", s.ingestHistograms).Methods("POST")
+	api.HandleFunc("/import/prometheus", s.importPrometheus).Methods("POST")
+	api.HandleFunc("/write", s.remoteWrite).Methods("POST")
 	
 	// Query endpoints
 	api.HandleFunc("/series", s.listSeries).Methods("GET")
-	api.HandleFunc("/query", s.queryData).Methods("GET")
+	api.HandleFunc("/query", s.limitQuery(s.queryData)).Methods("GET")
+	
+	// Discovery endpoints
+	api.HandleFunc("/labels", s.listLabels).Methods("GET")
+	api.HandleFunc("/label/{name}/values", s.listLabelValues).Methods("GET")
+	api.HandleFunc("/metadata", s.listMetadata).Methods("GET")
+	api.HandleFunc("/exemplars", s.queryExemplars).Methods("GET")
+	
+	// Metric metadata administration
+	api.HandleFunc("/metadata/{metric}", s.getMetricMetadata).Methods("GET")
+	api.HandleFunc("/metadata/{metric}", s.setMetricMetadata).Methods("PUT")
+	api.HandleFunc("/metadata/{metric}", s.deleteMetricMetadata).Methods("DELETE")
 	
 	// Analytics endpoints
-	api.HandleFunc("/analytics/anomaly", s.detectAnomalies).Methods("POST")
-	api.HandleFunc("/analytics/forecast", s.generateForecast).Methods("POST")
+	api.HandleFunc("/analytics/anomaly", s.limitQuery(s.detectAnomalies)).Methods("POST")
+	api.HandleFunc("/analytics/forecast", s.limitQuery(s.generateForecast)).Methods("POST")
+	
+	// Annotation endpoints
+	api.HandleFunc("/annotations", s.requireAnnotations(s.queryAnnotations)).Methods("GET")
+	api.HandleFunc("/annotations", s.requireAnnotations(s.createAnnotation)).Methods("POST")
+	api.HandleFunc("/annotations/{id}", s.requireAnnotations(s.getAnnotation)).Methods("GET")
+	api.HandleFunc("/annotations/{id}", s.requireAnnotations(s.updateAnnotation)).Methods("PUT")
+	api.HandleFunc("/annotations/{id}", s.requireAnnotations(s.deleteAnnotation)).Methods("DELETE")
 	
 	// System endpoints
 	api.HandleFunc("/stats", s.getStats).Methods("GET")
 	
+	// InfluxDB v2 compatible write endpoint
+	s.router.HandleFunc("/api/v2/write", s.influxWrite).Methods("POST")
+	
+	// OpenTelemetry OTLP/HTTP metrics receiver
+	s.router.HandleFunc("/v1/metrics", s.otlpMetrics).Methods("POST")
+	
+	// Grafana JSON datasource endpoints
+	grafana := s.router.PathPrefix("/api/grafana").Subrouter()
+	grafana.HandleFunc("/", s.grafanaHealth).Methods("GET")
+	grafana.HandleFunc("/annotations", s.requireAnnotations(s.grafanaAnnotations)).Methods("POST")
+	
 	// Health check
 	s.router.HandleFunc("/health", s.healthCheck).Methods("GET")
 	
@@ -113,12 +171,16 @@ func (s *Server) setupRoutes() {
 	s.router.HandleFunc("/", s.rootHandler).Methods("GET")
 }
 
-// MetricRequest represents an incoming metric request
+// MetricRequest represents an incoming metric request. A measurement of
+// several values sets Fields instead of Value, e.g.
+// {"temperature": 21.5, "online": true, "status": "charging",
+// "battery": {"type": "int", "value": 87}}.
 type MetricRequest struct {
 	Name      string            `json:"name"`
 	Value     float64           `json:"value"`
 	Timestamp string            `json:"timestamp,omitempty"`
 	Labels    map[string]string `json:"labels,omitempty"`
+	Fields    map[string]storage.FieldValue `json:"fields,omitempty"`
 }
 
 // BatchRequest represents a batch of metrics
@@ -128,18 +190,26 @@ type BatchRequest struct {
 
 // QueryResponse represents a query result
 type QueryResponse struct {
-	Series  string                   `json:"series"`
-	Labels  map[string]string        `json:"labels"`
-	Points  []storage.DataPoint      `json:"points"`
-	Count   int                      `json:"count"`
+	Series   string              `json:"series"`
+	Labels   map[string]string   `json:"labels"`
+	Metadata *storage.Metadata   `json:"metadata,omitempty"`
+	Points   []storage.DataPoint `json:"points"`
+	Count    int                 `json:"count"`
 }
 
 // SeriesListResponse represents the series list response
 type SeriesListResponse struct {
-	Series []storage.SeriesInfo `json:"series"`
-	Count  int                  `json:"count"`
+	Series     []storage.SeriesInfo `json:"series"`
+	Count      int                  `json:"count"`
+	Total      int                  `json:"total"`
+	NextCursor string               `json:"next_cursor,omitempty"`
 }
 
+const (
+	defaultSeriesPageSize = 1000
+	maxSeriesPageSize     = 10000
+)
+
 // Using SeriesInfo from storage package
 
 // StatsResponse represents system statistics
@@ -148,18 +218,12 @@ type StatsResponse struct {
 		SeriesCount  int   `json:"series_count"`
 		TotalPoints  int64 `json:"total_points"`
 	} `json:"storage"`
-	Ingestion struct {
-		TotalIngested    int64 `json:"total_ingested"`
-		TotalProcessed   int64 `json:"total_processed"`
-		TotalErrors      int64 `json:"total_errors"`
-		BatchesProcessed int64 `json:"batches_processed"`
-		BufferSize       int   `json:"buffer_size"`
-		IsRunning        bool  `json:"is_running"`
-	} `json:"ingestion"`
+	Ingestion ingestion.PipelineStats `json:"ingestion"`
 	System struct {
 		StartTime time.Time `json:"start_time"`
 		Uptime    string    `json:"uptime"`
 	} `json:"system"`
+	QueryCache *QueryCacheStats `json:"query_cache,omitempty"`
 }
 
 var startTime = time.Now()
@@ -178,7 +242,7 @@ func (s *Server) ingestMetric(w http.ResponseWriter, r *http.Request) {
 	if req.Timestamp == "" {
 		timestamp = time.Now()
 	} else {
-		timestamp, err = time.Parse(time.RFC3339, req.Timestamp)
+		timestamp, err = timeexpr.Parse(req.Timestamp, time.Now(), time.UTC)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid timestamp format: %v", err), http.StatusBadRequest)
 			return
@@ -191,11 +255,12 @@ func (s *Server) ingestMetric(w http.ResponseWriter, r *http.Request) {
 		Value:     req.Value,
 		Timestamp: timestamp,
 		Labels:    req.Labels,
+		Fields:    req.Fields,
 	}
 	
 	// Ingest metric
 	if err := s.streamProcessor.IngestMetric(metric); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to ingest metric: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to ingest metric: %v", err), ingestStatus(w, err, http.StatusInternalServerError))
 		return
 	}
 	
@@ -230,7 +295,7 @@ func (s *Server) ingestBatch(w http.ResponseWriter, r *http.Request) {
 		if m.Timestamp == "" {
 			timestamp = time.Now()
 		} else {
-			timestamp, err = time.Parse(time.RFC3339, m.Timestamp)
+			timestamp, err = timeexpr.Parse(m.Timestamp, time.Now(), time.UTC)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("Invalid timestamp format: %v", err), http.StatusBadRequest)
 				return
@@ -242,12 +307,13 @@ func (s *Server) ingestBatch(w http.ResponseWriter, r *http.Request) {
 			Value:     m.Value,
 			Timestamp: timestamp,
 			Labels:    m.Labels,
+			Fields:    m.Fields,
 		})
 	}
 	
 	// Ingest batch
 	if err := s.streamProcessor.IngestBatch(metrics); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to ingest batch: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to ingest batch: %v", err), ingestStatus(w, err, http.StatusInternalServerError))
 		return
 	}
 	
@@ -262,25 +328,68 @@ func (s *Server) ingestBatch(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// listSeries returns a list of all time series
+// listSeries returns a page of time series. Results are filtered by optional
+// match[] selectors, metric name prefix and time range, sorted by id, last_seen
+// or size, and paginated with an opaque cursor that stays stable while new
+// series are created.
 func (s *Server) listSeries(w http.ResponseWriter, r *http.Request) {
-	// Get all series (this is a simplified implementation)
-	// In a real system, you'd want pagination and filtering
-	allSeries := s.storage.GetSeriesByLabels(map[string]string{})
-	
-	var seriesList []storage.SeriesInfo
-	for _, series := range allSeries {
-		seriesList = append(seriesList, storage.SeriesInfo{
-			ID:       series.ID,
-			Labels:   series.Labels,
-			Size:     series.Size(),
-			LastSeen: series.LastSeen,
-		})
+	query := r.URL.Query()
+	
+	matcherSets, err := parseMatchParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, err := parseTimeRangeParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	pageRequest := storage.SeriesPageRequest{
+		Limit:      defaultSeriesPageSize,
+		Cursor:     query.Get("cursor"),
+		SortBy:     query.Get("sort"),
+		NamePrefix: query.Get("prefix"),
+	}
+	
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit: %s", limitParam), http.StatusBadRequest)
+			return
+		}
+		if limit > maxSeriesPageSize {
+			limit = maxSeriesPageSize
+		}
+		pageRequest.Limit = limit
+	}
+	
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		pageRequest.Descending = true
+	default:
+		http.Error(w, fmt.Sprintf("Invalid order: %s", order), http.StatusBadRequest)
+		return
+	}
+	
+	page, err := s.storage.ListSeries(matcherSets, start, end, pageRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid series listing request: %v", err), http.StatusBadRequest)
+		return
+	}
+	
+	seriesList := page.Series
+	if seriesList == nil {
+		seriesList = []storage.SeriesInfo{}
 	}
 	
 	response := SeriesListResponse{
-		Series: seriesList,
-		Count:  len(seriesList),
+		Series:     seriesList,
+		Count:      len(seriesList),
+		Total:      page.Total,
+		NextCursor: page.NextCursor,
 	}
 	
 	json.NewEncoder(w).Encode(response)
@@ -291,8 +400,9 @@ func (s *Server) queryData(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	
 	seriesID := query.Get("series")
-	if seriesID == "" {
-		http.Error(w, "Missing 'series' parameter", http.StatusBadRequest)
+	expression := query.Get("query")
+	if seriesID == "" && expression == "" {
+		http.Error(w, "Missing 'series' or 'query' parameter", http.StatusBadRequest)
 		return
 	}
 	
@@ -301,89 +411,112 @@ func (s *Server) queryData(w http.ResponseWriter, r *http.Request) {
 	endParam := query.Get("end")
 	limitParam := query.Get("limit")
 	
-	var startTime, endTime time.Time
-	var err error
-	
-	if startParam != "" {
-		// Support relative time like "-1h", "-30m", etc.
-		if startParam[0] == '-' {
-			duration, err := time.ParseDuration(startParam[1:])
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid start duration: %v", err), http.StatusBadRequest)
-				return
-			}
-			startTime = time.Now().Add(-duration)
-		} else {
-			startTime, err = time.Parse(time.RFC3339, startParam)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid start time format: %v", err), http.StatusBadRequest)
-				return
-			}
-		}
-	} else {
-		// Default to last hour
-		startTime = time.Now().Add(-time.Hour)
+	// Calendar steps and "now/d" rounding use the tz parameter
+	startTime, endTime, loc, err := parseTimeRange(startParam, endParam, query.Get("tz"), time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	
-	if endParam != "" {
-		endTime, err = time.Parse(time.RFC3339, endParam)
+	var limit int
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid end time format: %v", err), http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("Invalid limit: %v", err), http.StatusBadRequest)
 			return
 		}
-	} else {
-		endTime = time.Now()
 	}
 	
-	// Get data points in range
-	points, err := s.storage.GetRange(seriesID, startTime, endTime)
+	if err := s.checkQueryRange(startTime, endTime); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	
+	format, err := negotiateFormat(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to query data: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	
-	if len(points) == 0 {
-		// Check if series exists at all
-		if _, exists := s.storage.GetSeries(seriesID); !exists {
-			http.Error(w, "Series not found", http.StatusNotFound)
-			return
-		}
+	if expression != "" {
+		s.evaluateExpression(w, r, expression, startTime, endTime, loc, limit, format)
+		return
 	}
 	
-	// Apply limit if specified
-	if limitParam != "" {
-		limit, err := strconv.Atoi(limitParam)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid limit: %v", err), http.StatusBadRequest)
-			return
-		}
-		if limit > 0 && len(points) > limit {
-			// Get the most recent points
-			points = points[len(points)-limit:]
-		}
+	seriesID, err = s.resolveSeries(seriesID, query.Get("field"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	
-	// Get series metadata for labels
+	// Get series metadata for labels, and the unit to convert values to
 	var labels map[string]string
 	if series, exists := s.storage.GetSeries(seriesID); exists {
 		labels = series.Labels
 	} else {
 		labels = make(map[string]string)
 	}
+	factor, metadata, err := unitConversion(s.seriesMetadata(seriesID, labels), seriesID, query.Get("unit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	
+	if format != formatJSON {
+		s.streamQuery(w, r, seriesID, labels, factor, startTime, endTime, limit, format)
+		return
+	}
+	
+	// Get the most recent points in range, up to the limit if specified
+	points, err := s.readRange(r.Context(), seriesID, startTime, endTime, limit)
+	if err != nil {
+		s.writeQueryError(w, r, "Failed to query data", err)
+		return
+	}
+	
+	if len(points) == 0 {
+		// Check if series exists at all
+		if !s.storage.SeriesExists(seriesID) {
+			http.Error(w, "Series not found", http.StatusNotFound)
+			return
+		}
+	}
+	
+	scalePoints(points, factor)
 	response := QueryResponse{
-		Series: seriesID,
-		Labels: labels,
-		Points: points,
-		Count:  len(points),
+		Series:   seriesID,
+		Labels:   labels,
+		Metadata: metadata,
+		Points:   points,
+		Count:    len(points),
 	}
 	
 	json.NewEncoder(w).Encode(response)
 }
 
+// streamQuery writes a series' points in a streaming format straight from
+// the storage iterators, so large ranges are never held in memory. A positive
+// limit keeps only the most recent points, and values are multiplied by
+// factor for unit conversion. Failures after the response has started,
+// including hitting the point limit, are reported in-band.
+func (s *Server) streamQuery(w http.ResponseWriter, r *http.Request, seriesID string, labels map[string]string, factor float64, start, end time.Time, limit int, format string) {
+	if !s.storage.SeriesExists(seriesID) {
+		http.Error(w, "Series not found", http.StatusNotFound)
+		return
+	}
+	
+	it := storage.NewTailIterator(s.storage.Iterator(r.Context(), seriesID, start, end), limit)
+	it = newScaledIterator(s.newPointLimitIterator(it), factor)
+	
+	writer := newSeriesWriter(w, format)
+	if _, err := writer.WriteSeries(seriesID, labels, it); err != nil {
+		log.Printf("Error streaming series %s: %v", seriesID, err)
+	}
+	writer.Close()
+}
+
 // getStats returns system statistics
 func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
-	ingested, processed, errors, batches := s.streamProcessor.GetStats()
 	storageStats := s.storage.GetStorageStats()
 	
 	response := StatsResponse{
@@ -394,21 +527,7 @@ func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
 			SeriesCount: storageStats.Hot.SeriesCount,
 			TotalPoints: storageStats.Hot.TotalPoints,
 		},
-		Ingestion: struct {
-			TotalIngested    int64 `json:"total_ingested"`
-			TotalProcessed   int64 `json:"total_processed"`
-			TotalErrors      int64 `json:"total_errors"`
-			BatchesProcessed int64 `json:"batches_processed"`
-			BufferSize       int   `json:"buffer_size"`
-			IsRunning        bool  `json:"is_running"`
-		}{
-			TotalIngested:    ingested,
-			TotalProcessed:   processed,
-			TotalErrors:      errors,
-			BatchesProcessed: batches,
-			BufferSize:       s.streamProcessor.GetBufferSize(),
-			IsRunning:        s.streamProcessor.IsRunning(),
-		},
+		Ingestion: s.streamProcessor.GetStats(),
 		System: struct {
 			StartTime time.Time `json:"start_time"`
 			Uptime    string    `json:"uptime"`
@@ -418,6 +537,11 @@ func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 	
+	if s.queryCache != nil {
+		cacheStats := s.queryCache.Stats()
+		response.QueryCache = &cacheStats
+	}
+	
 	json.NewEncoder(w).Encode(response)
 }
 
@@ -450,10 +574,25 @@ func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
 		"endpoints": map[string]string{
 			"POST /api/v1/metrics":           "Ingest single metric",
 			"POST /api/v1/metrics/batch":     "Ingest metric batch",
+			"POST /api/v1/histograms":        "Ingest histogram samples as sketches",
 			"GET  /api/v1/series":            "List time series",
 			"GET  /api/v1/query":             "Query time series data",
+			"GET  /api/v1/labels":            "List label names",
+			"GET  /api/v1/label/{name}/values": "List values of a label",
+			"GET  /api/v1/metadata":          "List metric metadata",
+			"PUT  /api/v1/metadata/{metric}": "Set a metric's type, unit and help text",
+			"POST /api/v1/import/prometheus": "Import Prometheus text format with metadata",
+			"POST /api/v1/write":             "Prometheus remote write receiver",
+			"GET  /api/v1/exemplars":         "Query exemplars of matching series",
+			"POST /api/v2/write":             "Ingest InfluxDB line protocol",
+			"POST /v1/metrics":               "OTLP/HTTP metrics receiver (protobuf or JSON)",
 			"POST /api/v1/analytics/anomaly": "Detect anomalies in time series",
 			"POST /api/v1/analytics/forecast": "Generate forecasts for time series",
+			"GET  /api/v1/annotations":       "Query annotations by time and tags",
+			"POST /api/v1/annotations":       "Create an annotation",
+			"PUT  /api/v1/annotations/{id}":  "Update an annotation",
+			"DELETE /api/v1/annotations/{id}": "Delete an annotation",
+			"POST /api/grafana/annotations":  "Grafana JSON datasource annotations",
 			"GET  /api/v1/stats":             "System statistics",
 			"GET  /health":                   "Health check",
 		},
@@ -467,6 +606,7 @@ type AnomalyRequest struct {
 	SeriesID string `json:"series_id"`
 	Start    string `json:"start,omitempty"`
 	End      string `json:"end,omitempty"`
+	Timezone string `json:"tz,omitempty"`
 }
 
 // ForecastRequest represents a forecasting request
@@ -475,6 +615,7 @@ type ForecastRequest struct {
 	Horizon  int    `json:"horizon,omitempty"`
 	Start    string `json:"start,omitempty"`
 	End      string `json:"end,omitempty"`
+	Timezone string `json:"tz,omitempty"`
 }
 
 // detectAnomalies handles anomaly detection requests
@@ -490,45 +631,26 @@ func (s *Server) detectAnomalies(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Parse time range
-	var startTime, endTime time.Time
-	var err error
-	
-	if req.Start != "" {
-		if req.Start[0] == '-' {
-			duration, err := time.ParseDuration(req.Start[1:])
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid start duration: %v", err), http.StatusBadRequest)
-				return
-			}
-			startTime = time.Now().Add(-duration)
-		} else {
-			startTime, err = time.Parse(time.RFC3339, req.Start)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid start time format: %v", err), http.StatusBadRequest)
-				return
-			}
-		}
-	} else {
-		startTime = time.Now().Add(-24 * time.Hour) // Default to last 24 hours
+	// Parse time range, defaulting to the last 24 hours
+	startTime, endTime, _, err := parseTimeRange(req.Start, req.End, req.Timezone, 24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	
-	if req.End != "" {
-		endTime, err = time.Parse(time.RFC3339, req.End)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid end time format: %v", err), http.StatusBadRequest)
-			return
-		}
-	} else {
-		endTime = time.Now()
+	if err := s.checkQueryRange(startTime, endTime); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	
 	// Get training data
-	points, err := s.storage.GetRange(req.SeriesID, startTime, endTime)
+	points, err := s.readRange(r.Context(), req.SeriesID, startTime, endTime, 0)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get training data: %v", err), http.StatusInternalServerError)
+		s.writeQueryError(w, r, "Failed to get training data", err)
 		return
 	}
+	// Stale markers are NaN and would poison the models
+	points = storage.DropStaleMarkers(points)
 	
 	if len(points) == 0 {
 		http.Error(w, "No data found for the specified series and time range", http.StatusNotFound)
@@ -602,45 +724,26 @@ func (s *Server) generateForecast(w http.ResponseWriter, r *http.Request) {
 		horizon = 24 // Default to 24 steps ahead
 	}
 	
-	// Parse time range for training data
-	var startTime, endTime time.Time
-	var err error
-	
-	if req.Start != "" {
-		if req.Start[0] == '-' {
-			duration, err := time.ParseDuration(req.Start[1:])
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid start duration: %v", err), http.StatusBadRequest)
-				return
-			}
-			startTime = time.Now().Add(-duration)
-		} else {
-			startTime, err = time.Parse(time.RFC3339, req.Start)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid start time format: %v", err), http.StatusBadRequest)
-				return
-			}
-		}
-	} else {
-		startTime = time.Now().Add(-7 * 24 * time.Hour) // Default to last 7 days
+	// Parse time range for training data, defaulting to the last 7 days
+	startTime, endTime, _, err := parseTimeRange(req.Start, req.End, req.Timezone, 7*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	
-	if req.End != "" {
-		endTime, err = time.Parse(time.RFC3339, req.End)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid end time format: %v", err), http.StatusBadRequest)
-			return
-		}
-	} else {
-		endTime = time.Now()
+	if err := s.checkQueryRange(startTime, endTime); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	
 	// Get training data
-	points, err := s.storage.GetRange(req.SeriesID, startTime, endTime)
+	points, err := s.readRange(r.Context(), req.SeriesID, startTime, endTime, 0)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get training data: %v", err), http.StatusInternalServerError)
+		s.writeQueryError(w, r, "Failed to get training data", err)
 		return
 	}
+	// Stale markers are NaN and would poison the models
+	points = storage.DropStaleMarkers(points)
 	
 	if len(points) < 10 {
 		http.Error(w, "Insufficient data for forecasting (minimum 10 points required)", http.StatusBadRequest)
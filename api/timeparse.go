@@ -0,0 +1,34 @@
+package api
+
+import (
+	"fmt"
+	"time"
+	"time-series-analytics-engine/timeexpr"
+)
+
+// parseTimeRange parses a request's start, end and tz parameters. Times use
+// the shared expression syntax of the timeexpr package; an omitted start
+// defaults to defaultRange before end.
+func parseTimeRange(start, end, tz string, defaultRange time.Duration) (time.Time, time.Time, *time.Location, error) {
+	loc, err := parseLocation(tz)
+	if err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	startTime, endTime, err := timeexpr.ParseRange(start, end, defaultRange, time.Now(), loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, nil, fmt.Errorf("Invalid time range: %v", err)
+	}
+	return startTime, endTime, loc, nil
+}
+
+// parseLocation loads an IANA time zone, defaulting to the server's zone
+func parseLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid tz: %v", err)
+	}
+	return loc, nil
+}
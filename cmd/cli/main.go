@@ -9,9 +9,12 @@ import (
 	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+	"time-series-analytics-engine/timeexpr"
 )
 
 const (
@@ -29,6 +32,7 @@ type MetricData struct {
 	Value     float64           `json:"value"`
 	Timestamp string            `json:"timestamp,omitempty"`
 	Labels    map[string]string `json:"labels,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
 }
 
 func main() {
@@ -63,6 +67,10 @@ func main() {
 		handleForecast(config, args)
 	case "series":
 		handleSeries(config, args)
+	case "labels":
+		handleLabels(config, args)
+	case "metadata":
+		handleMetadata(config, args)
 	case "stats":
 		handleStats(config)
 	case "health":
@@ -90,6 +98,8 @@ COMMANDS:
     anomaly   - Detect anomalies in time-series data
     forecast  - Generate forecasts for time-series data
     series    - List all time series
+    labels    - List label names or the values of one label
+    metadata  - Show per-metric metadata
     stats     - Show system statistics
     health    - Check system health
     demo      - Run demo with sample data
@@ -98,6 +108,7 @@ COMMANDS:
 INGESTION:
     tsdb-cli --cmd ingest --metric cpu.usage --value 85.5
     tsdb-cli --cmd ingest --metric cpu.usage --value 85.5 --labels "host=server1,env=prod"
+    tsdb-cli --cmd ingest --metric sensor --labels "device=d1" --fields "temperature=21.5,battery=87i,online=true,status=charging"
     
     # Ingest random demo data
     tsdb-cli --cmd demo --series 5 --points 1000
@@ -105,13 +116,36 @@ INGESTION:
 QUERYING:
     tsdb-cli --cmd query --series cpu.usage --start -1h
     tsdb-cli --cmd query --series memory.usage --start 2024-01-01T00:00:00Z --end 2024-01-01T23:59:59Z
+    tsdb-cli --cmd query --series cpu.usage --start -24h --format csv > cpu.csv
+    tsdb-cli --cmd query --query 'sum by (host) (errors / requests * 100)' --start -6h --step 5m
+    tsdb-cli --cmd query --query 'avg(cpu.usage)' --step 1h --agg max
+    tsdb-cli --cmd query --query 'topk(5, cpu.usage)' --start -1h --step 1m
+    tsdb-cli --cmd query --query 'absent(heartbeat{host="db1"})' --start -1h --step 1m
+    tsdb-cli --cmd query --query 'histogram_quantile(0.99, sum by (route) (request.duration))' --start -1d --step 1h
+    tsdb-cli --cmd query --query 'requests - timeshift(moving_avg(requests, 1h), 1w)' --start -6h --step 5m
+    tsdb-cli --cmd query --query 'sum(orders)' --start now-3M/M --step month --agg sum --tz Europe/Berlin
+    tsdb-cli --cmd query --series memory.used --start -1h --unit GiB
+    tsdb-cli --cmd query --series 'sensor{device="d1"}' --field battery --start -1h
+
+TIME EXPRESSIONS (--start, --end):
+    now, now-7d, -2w        Relative to now; units ms, s, m, h, d, w, M (months), y
+    now-1d/d, now/w         Rounded down to the start of a day, week, month, ...
+    1700000000[000]         Unix seconds or milliseconds
+    2024-01-01T00:00:00Z    RFC3339, with optional fractional seconds
 
 ANALYTICS:
     tsdb-cli --cmd anomaly --series cpu.usage --start -24h
     tsdb-cli --cmd forecast --series cpu.usage --horizon 24
 
+DISCOVERY:
+    tsdb-cli --cmd labels
+    tsdb-cli --cmd labels --label host --match 'cpu.usage{env="prod"}'
+    tsdb-cli --cmd metadata --metric cpu.usage
+    tsdb-cli --cmd metadata --metric memory.used --type gauge --unit bytes --description "Resident memory"
+
 MONITORING:
     tsdb-cli --cmd series
+    tsdb-cli --cmd series --prefix demo. --sort last_seen --order desc --limit 50
     tsdb-cli --cmd stats
     tsdb-cli --cmd health
 
@@ -140,6 +174,7 @@ func handleIngest(config CLIConfig, args []string) {
 		metric    = getArg(args, "--metric", "")
 		value     = getArg(args, "--value", "0")
 		labels    = getArg(args, "--labels", "")
+		fields    = getArg(args, "--fields", "")
 		timestamp = getArg(args, "--timestamp", "")
 	)
 
@@ -173,6 +208,17 @@ func handleIngest(config CLIConfig, args []string) {
 		Value:  valueFloat,
 		Labels: labelMap,
 	}
+	if fields != "" {
+		data.Fields = make(map[string]interface{})
+		for _, pair := range strings.Split(fields, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				fmt.Printf("Error: Invalid field '%s'\n", pair)
+				return
+			}
+			data.Fields[kv[0]] = parseFieldValue(kv[1])
+		}
+	}
 
 	if timestamp != "" {
 		data.Timestamp = timestamp
@@ -184,7 +230,11 @@ func handleIngest(config CLIConfig, args []string) {
 		return
 	}
 
-	fmt.Printf("✓ Ingested metric: %s = %.2f\n", metric, valueFloat)
+	if len(data.Fields) > 0 {
+		fmt.Printf("✓ Ingested measurement: %s with %d fields\n", metric, len(data.Fields))
+	} else {
+		fmt.Printf("✓ Ingested metric: %s = %.2f\n", metric, valueFloat)
+	}
 	if len(labelMap) > 0 {
 		fmt.Printf("  Labels: %v\n", labelMap)
 	}
@@ -192,26 +242,56 @@ func handleIngest(config CLIConfig, args []string) {
 
 func handleQuery(config CLIConfig, args []string) {
 	var (
-		series = getArg(args, "--series", "")
-		start  = getArg(args, "--start", "-1h")
-		end    = getArg(args, "--end", "")
-		limit  = getArg(args, "--limit", "")
+		series     = getArg(args, "--series", "")
+		expression = getArg(args, "--query", "")
+		start      = getArg(args, "--start", "-1h")
+		end        = getArg(args, "--end", "")
+		step       = getArg(args, "--step", "")
+		agg        = getArg(args, "--agg", "")
+		tz         = getArg(args, "--tz", "")
+		unit       = getArg(args, "--unit", "")
+		field      = getArg(args, "--field", "")
+		limit      = getArg(args, "--limit", "")
+		format     = getArg(args, "--format", "")
 	)
 
-	if series == "" {
-		fmt.Println("Error: --series is required")
+	if series == "" && expression == "" {
+		fmt.Println("Error: --series or --query is required")
 		return
 	}
 
-	url := fmt.Sprintf("%s/api/v1/query?series=%s&start=%s", config.ServerURL, series, start)
-	if end != "" {
-		url += "&end=" + end
+	if !resolveTimes(tz, &start, &end) {
+		return
 	}
-	if limit != "" {
-		url += "&limit=" + limit
+
+	params := url.Values{}
+	params.Set("start", start)
+	for name, value := range map[string]string{
+		"series": series, "query": expression, "end": end, "step": step, "agg": agg, "tz": tz, "unit": unit, "field": field, "limit": limit,
+	} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	if format != "" && format != "json" {
+		// Streamed formats are copied to stdout as they arrive
+		params.Set("format", format)
+		resp, err := http.Get(fmt.Sprintf("%s/api/v1/query?%s", config.ServerURL, params.Encode()))
+		if err != nil {
+			fmt.Printf("Error querying data: %v\n", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			fmt.Printf("Query failed: %s\n", string(body))
+			return
+		}
+		io.Copy(os.Stdout, resp.Body)
+		return
 	}
 
-	resp, err := http.Get(url)
+	resp, err := http.Get(fmt.Sprintf("%s/api/v1/query?%s", config.ServerURL, params.Encode()))
 	if err != nil {
 		fmt.Printf("Error querying data: %v\n", err)
 		return
@@ -235,8 +315,20 @@ func handleQuery(config CLIConfig, args []string) {
 		return
 	}
 
-	fmt.Printf("Query Results for series: %s\n", series)
-	fmt.Printf("Points: %v\n", result["count"])
+	if expression != "" {
+		fmt.Printf("Query Results for: %s\n", expression)
+		fmt.Printf("Series: %v\n", result["count"])
+		if items, ok := result["series"].([]interface{}); ok {
+			for _, item := range items {
+				if entry, ok := item.(map[string]interface{}); ok {
+					fmt.Printf("  %v: %v points\n", entry["series"], entry["count"])
+				}
+			}
+		}
+	} else {
+		fmt.Printf("Query Results for series: %s\n", series)
+		fmt.Printf("Points: %v\n", result["count"])
+	}
 	if config.Verbose {
 		prettyJSON, _ := json.MarshalIndent(result, "", "  ")
 		fmt.Println(string(prettyJSON))
@@ -255,6 +347,10 @@ func handleAnomaly(config CLIConfig, args []string) {
 		return
 	}
 
+	if !resolveTimes("", &start, &end) {
+		return
+	}
+
 	reqData := map[string]string{
 		"series_id": series,
 		"start":     start,
@@ -319,6 +415,10 @@ func handleForecast(config CLIConfig, args []string) {
 		return
 	}
 
+	if !resolveTimes("", &start, &end) {
+		return
+	}
+
 	reqData := map[string]interface{}{
 		"series_id": series,
 		"horizon":   horizonInt,
@@ -366,9 +466,22 @@ func handleForecast(config CLIConfig, args []string) {
 }
 
 func handleSeries(config CLIConfig, args []string) {
-	url := fmt.Sprintf("%s/api/v1/series", config.ServerURL)
+	params := url.Values{}
+	for _, name := range []string{"limit", "cursor", "sort", "order", "prefix", "match"} {
+		if value := getArg(args, "--"+name, ""); value != "" {
+			if name == "match" {
+				name = "match[]"
+			}
+			params.Set(name, value)
+		}
+	}
 
-	resp, err := http.Get(url)
+	endpoint := fmt.Sprintf("%s/api/v1/series", config.ServerURL)
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+
+	resp, err := http.Get(endpoint)
 	if err != nil {
 		fmt.Printf("Error listing series: %v\n", err)
 		return
@@ -393,7 +506,21 @@ func handleSeries(config CLIConfig, args []string) {
 	}
 
 	fmt.Printf("📊 Time Series Summary\n")
-	fmt.Printf("Total Series: %v\n", result["count"])
+	fmt.Printf("Total Series: %v (%v in this page)\n", result["total"], result["count"])
+	if next, ok := result["next_cursor"].(string); ok && next != "" {
+		fmt.Printf("Next page: --cursor %s\n", next)
+	}
+
+	// Break the total down per metric using the metadata index
+	if metadata, err := fetchJSON(fmt.Sprintf("%s/api/v1/metadata", config.ServerURL)); err == nil {
+		if metrics, ok := metadata["metrics"].([]interface{}); ok {
+			for _, m := range metrics {
+				if metric, ok := m.(map[string]interface{}); ok {
+					fmt.Printf("  %-40v %v series\n", metric["metric"], metric["series_count"])
+				}
+			}
+		}
+	}
 
 	if config.Verbose {
 		prettyJSON, _ := json.MarshalIndent(result, "", "  ")
@@ -401,6 +528,124 @@ func handleSeries(config CLIConfig, args []string) {
 	}
 }
 
+func handleLabels(config CLIConfig, args []string) {
+	var (
+		label = getArg(args, "--label", "")
+		match = getArg(args, "--match", "")
+		start = getArg(args, "--start", "")
+		end   = getArg(args, "--end", "")
+	)
+
+	endpoint := fmt.Sprintf("%s/api/v1/labels", config.ServerURL)
+	if label != "" {
+		endpoint = fmt.Sprintf("%s/api/v1/label/%s/values", config.ServerURL, url.PathEscape(label))
+	}
+
+	if !resolveTimes("", &start, &end) {
+		return
+	}
+
+	params := url.Values{}
+	if match != "" {
+		params.Set("match[]", match)
+	}
+	if start != "" {
+		params.Set("start", start)
+	}
+	if end != "" {
+		params.Set("end", end)
+	}
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+
+	result, err := fetchJSON(endpoint)
+	if err != nil {
+		fmt.Printf("Error listing labels: %v\n", err)
+		return
+	}
+
+	key := "labels"
+	if label != "" {
+		key = "values"
+		fmt.Printf("🏷  Values of label %s (%v)\n", label, result["count"])
+	} else {
+		fmt.Printf("🏷  Label names (%v)\n", result["count"])
+	}
+	if items, ok := result[key].([]interface{}); ok {
+		for _, item := range items {
+			fmt.Printf("  %v\n", item)
+		}
+	}
+}
+
+func handleMetadata(config CLIConfig, args []string) {
+	var (
+		metric      = getArg(args, "--metric", "")
+		match       = getArg(args, "--match", "")
+		metricType  = getArg(args, "--type", "")
+		unit        = getArg(args, "--unit", "")
+		description = getArg(args, "--description", "")
+	)
+
+	if metricType != "" || unit != "" || description != "" {
+		setMetadata(config, metric, metricType, unit, description)
+		return
+	}
+
+	params := url.Values{}
+	if metric != "" {
+		params.Set("metric", metric)
+	}
+	if match != "" {
+		params.Set("match[]", match)
+	}
+	endpoint := fmt.Sprintf("%s/api/v1/metadata", config.ServerURL)
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+
+	result, err := fetchJSON(endpoint)
+	if err != nil {
+		fmt.Printf("Error getting metadata: %v\n", err)
+		return
+	}
+
+	fmt.Printf("📋 Metric Metadata (%v metrics)\n", result["count"])
+	prettyJSON, _ := json.MarshalIndent(result["metrics"], "", "  ")
+	fmt.Println(string(prettyJSON))
+}
+
+// setMetadata replaces the type, unit and help text of a metric
+func setMetadata(config CLIConfig, metric, metricType, unit, description string) {
+	if metric == "" {
+		fmt.Println("Error: --metric is required to set metadata")
+		return
+	}
+
+	jsonData, _ := json.Marshal(map[string]string{"type": metricType, "unit": unit, "help": description})
+	endpoint := fmt.Sprintf("%s/api/v1/metadata/%s", config.ServerURL, url.PathEscape(metric))
+	req, err := http.NewRequest("PUT", endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Printf("Error setting metadata: %v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("Error setting metadata: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Failed to set metadata: %s\n", strings.TrimSpace(string(body)))
+		return
+	}
+	fmt.Printf("✅ Metadata set for %s\n", metric)
+}
+
 func handleStats(config CLIConfig) {
 	url := fmt.Sprintf("%s/api/v1/stats", config.ServerURL)
 
@@ -544,7 +789,7 @@ func handleBenchmark(config CLIConfig, args []string) {
 		metricName  = getArg(args, "--metric", "benchmark.test")
 	)
 
-	dur, err := time.ParseDuration(duration)
+	dur, err := timeexpr.ParseDuration(duration)
 	if err != nil {
 		fmt.Printf("Error: Invalid duration '%s': %v\n", duration, err)
 		return
@@ -625,6 +870,77 @@ func sendMetric(config CLIConfig, data MetricData) error {
 	return nil
 }
 
+// fetchJSON performs a GET request and decodes a JSON object response
+func fetchJSON(endpoint string) (map[string]interface{}, error) {
+	resp, err := http.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("error parsing response: %w", err)
+	}
+	return result, nil
+}
+
+// resolveTimes evaluates time arguments such as -7d, now-1d/d or unix
+// timestamps on the client, so that relative times use the local clock and
+// time zone, and rewrites them as RFC3339. It reports errors and returns false.
+func resolveTimes(tz string, values ...*string) bool {
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			fmt.Printf("Error: Invalid time zone '%s': %v\n", tz, err)
+			return false
+		}
+	}
+
+	now := time.Now()
+	for _, value := range values {
+		if *value == "" {
+			continue
+		}
+		t, err := timeexpr.Parse(*value, now, loc)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return false
+		}
+		*value = t.Format(time.RFC3339Nano)
+	}
+	return true
+}
+
+// parseFieldValue reads a field value as in the Influx line protocol:
+// 42i is an integer, true and false are booleans, numbers are floats and
+// anything else, optionally quoted, is a string
+func parseFieldValue(s string) interface{} {
+	if i, err := strconv.ParseInt(strings.TrimSuffix(s, "i"), 10, 64); err == nil && strings.HasSuffix(s, "i") {
+		return map[string]interface{}{"type": "int", "value": i}
+	}
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return strings.Trim(s, `"`)
+}
+
 func getArg(args []string, flag, defaultValue string) string {
 	for i, arg := range args {
 		if arg == flag && i+1 < len(args) {
@@ -9,10 +9,11 @@ import (
 
 // Config represents the complete system configuration
 type Config struct {
-	Server    ServerConfig    `json:"server"`
-	Storage   StorageConfig   `json:"storage"`
-	Ingestion IngestionConfig `json:"ingestion"`
-	Analytics AnalyticsConfig `json:"analytics"`
+	Server      ServerConfig      `json:"server"`
+	Storage     StorageConfig     `json:"storage"`
+	Ingestion   IngestionConfig   `json:"ingestion"`
+	Analytics   AnalyticsConfig   `json:"analytics"`
+	Performance PerformanceConfig `json:"performance"`
 }
 
 // ServerConfig contains HTTP server settings
@@ -36,6 +37,8 @@ type HotStorageConfig struct {
 	MaxPointsPerSeries int      `json:"max_points_per_series"`
 	RetentionPeriod    Duration `json:"retention_period"`
 	CleanupInterval    Duration `json:"cleanup_interval"`
+	// StaleAfter marks series stale once they stop receiving points; zero disables
+	StaleAfter Duration `json:"stale_after"`
 }
 
 // WarmStorageConfig contains warm storage settings
@@ -57,13 +60,134 @@ type ColdStorageConfig struct {
 	CompressionLevel int      `json:"compression_level"`
 }
 
-// IngestionConfig contains data ingestion settings
+// IngestionConfig contains data ingestion settings. Rate limits are in
+// samples per second, zero meaning unlimited; tenants are told apart by
+// the tenant label. Saturated requests wait up to block_timeout before
+// being answered with 429.
 type IngestionConfig struct {
-	BufferSize      int              `json:"buffer_size"`
-	BatchSize       int              `json:"batch_size"`
-	FlushInterval   Duration         `json:"flush_interval"`
-	WorkerPoolSize  int              `json:"worker_pool_size"`
-	ValidationRules ValidationConfig `json:"validation"`
+	BufferSize               int              `json:"buffer_size"`
+	BatchSize                int              `json:"batch_size"`
+	FlushInterval            Duration         `json:"flush_interval"`
+	WorkerPoolSize           int              `json:"worker_pool_size"`
+	RateLimitPerSecond       float64          `json:"rate_limit_per_second"`
+	RateLimitBurst           int              `json:"rate_limit_burst"`
+	TenantRateLimitPerSecond float64          `json:"tenant_rate_limit_per_second"`
+	TenantRateLimitBurst     int              `json:"tenant_rate_limit_burst"`
+	TenantLabel              string           `json:"tenant_label"`
+	BlockTimeout             Duration         `json:"block_timeout"`
+	ValidationRules          ValidationConfig `json:"validation"`
+	StatsD                   StatsDConfig     `json:"statsd"`
+	Graphite                 GraphiteConfig   `json:"graphite"`
+	Scrape                   ScrapeConfig     `json:"scrape"`
+	Kafka                    KafkaConfig      `json:"kafka"`
+	MQTT                     MQTTConfig       `json:"mqtt"`
+}
+
+// KafkaConfig contains the Kafka consumer settings. Format is "json",
+// "line_protocol" or "otlp_proto"; precision applies to line protocol.
+//
+// Offsets are committed every commit interval once the records before them
+// have been written to the in-memory hot tier, not to disk. Points lost in
+// a crash before they are tiered to warm storage are not redelivered, so
+// consuming from Kafka does not make them survive a crash.
+type KafkaConfig struct {
+	Enabled        bool     `json:"enabled"`
+	Brokers        []string `json:"brokers"`
+	Group          string   `json:"group"`
+	Topics         []string `json:"topics"`
+	Format         string   `json:"format"`
+	Precision      string   `json:"precision"`
+	CommitInterval Duration `json:"commit_interval"`
+}
+
+// MQTTConfig contains the MQTT subscriber settings. A persistent session
+// (clean_session false) keeps QoS 1 messages published while disconnected.
+type MQTTConfig struct {
+	Enabled       bool                     `json:"enabled"`
+	Broker        string                   `json:"broker"`
+	ClientID      string                   `json:"client_id"`
+	Username      string                   `json:"username"`
+	Password      string                   `json:"password"`
+	CleanSession  bool                     `json:"clean_session"`
+	Subscriptions []MQTTSubscriptionConfig `json:"subscriptions"`
+	MinBackoff    Duration                 `json:"min_backoff"`
+	MaxBackoff    Duration                 `json:"max_backoff"`
+}
+
+// MQTTSubscriptionConfig is a topic filter with the format of its payloads,
+// "raw", "json" or "senml", and an optional topic template such as
+// "site/+/sensor/+/# -> site, sensor"
+type MQTTSubscriptionConfig struct {
+	Topic    string `json:"topic"`
+	Format   string `json:"format"`
+	Template string `json:"template"`
+}
+
+// ScrapeConfig contains the Prometheus scrape manager settings
+type ScrapeConfig struct {
+	Enabled bool              `json:"enabled"`
+	Jobs    []ScrapeJobConfig `json:"jobs"`
+}
+
+// ScrapeJobConfig configures the scraping of a set of targets, listed
+// statically or in JSON files of target groups that are reread every
+// refresh interval. Zero values take the scrape manager's defaults.
+type ScrapeJobConfig struct {
+	JobName              string              `json:"job_name"`
+	ScrapeInterval       Duration            `json:"scrape_interval"`
+	ScrapeTimeout        Duration            `json:"scrape_timeout"`
+	MetricsPath          string              `json:"metrics_path"`
+	Scheme               string              `json:"scheme"`
+	HonorLabels          bool                `json:"honor_labels"`
+	IgnoreTimestamps     bool                `json:"ignore_timestamps"`
+	SampleLimit          int                 `json:"sample_limit"`
+	StaticConfigs        []TargetGroupConfig `json:"static_configs"`
+	FileSDConfig         FileSDConfig        `json:"file_sd_config"`
+	RelabelConfigs       []RelabelConfig     `json:"relabel_configs"`
+	MetricRelabelConfigs []RelabelConfig     `json:"metric_relabel_configs"`
+}
+
+// TargetGroupConfig is a set of scrape targets sharing labels
+type TargetGroupConfig struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// FileSDConfig lists the target files of a scrape job, as glob patterns
+type FileSDConfig struct {
+	Files           []string `json:"files"`
+	RefreshInterval Duration `json:"refresh_interval"`
+}
+
+// RelabelConfig is a Prometheus-style relabeling rule
+type RelabelConfig struct {
+	SourceLabels []string `json:"source_labels"`
+	Separator    string   `json:"separator"`
+	Regex        string   `json:"regex"`
+	TargetLabel  string   `json:"target_label"`
+	Replacement  string   `json:"replacement"`
+	Modulus      uint64   `json:"modulus"`
+	Action       string   `json:"action"` // "replace", "keep", "drop", "hashmod", "labelmap", "labeldrop", "labelkeep"
+}
+
+// GraphiteConfig contains the Graphite listener settings. Templates map
+// dotted paths to metric names and labels, e.g. "servers.*.cpu.* -> host, cpu".
+type GraphiteConfig struct {
+	Enabled          bool     `json:"enabled"`
+	PlaintextAddress string   `json:"plaintext_address"`
+	PickleAddress    string   `json:"pickle_address"` // Empty disables pickle
+	Templates        []string `json:"templates"`
+}
+
+// StatsDConfig contains the StatsD listener settings
+type StatsDConfig struct {
+	Enabled       bool      `json:"enabled"`
+	UDPAddress    string    `json:"udp_address"`
+	TCPAddress    string    `json:"tcp_address"` // Empty disables TCP
+	FlushInterval Duration  `json:"flush_interval"`
+	Percentiles   []float64 `json:"percentiles"`
+	// GaugeExpiry is how long gauges that are no longer updated are kept
+	GaugeExpiry Duration `json:"gauge_expiry"`
 }
 
 // ValidationConfig contains data validation rules
@@ -100,6 +224,17 @@ type ForecastingConfig struct {
 	DefaultHorizon Duration `json:"default_horizon"`
 }
 
+// PerformanceConfig contains query performance settings
+type PerformanceConfig struct {
+	MaxConcurrentQueries int      `json:"max_concurrent_queries"`
+	QueryTimeout         Duration `json:"query_timeout"`
+	MaxQueryRange        Duration `json:"max_query_range"`
+	MaxQueryPoints       int      `json:"max_query_points"`
+	EnableQueryCache     bool     `json:"enable_query_cache"`
+	CacheSizeMB          int      `json:"cache_size_mb"`
+	CacheTTL             Duration `json:"cache_ttl"`
+}
+
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
@@ -115,6 +250,7 @@ func DefaultConfig() *Config {
 				MaxPointsPerSeries: 10000,
 				RetentionPeriod:    Duration{6 * time.Hour},
 				CleanupInterval:    Duration{30 * time.Minute},
+				StaleAfter:         Duration{5 * time.Minute},
 			},
 			Warm: WarmStorageConfig{
 				Enabled:            true,
@@ -137,6 +273,7 @@ func DefaultConfig() *Config {
 			BatchSize:      100,
 			FlushInterval:  Duration{5 * time.Second},
 			WorkerPoolSize: 4,
+			TenantLabel:    "tenant_id",
 			ValidationRules: ValidationConfig{
 				MaxValueRange:            1e12,
 				AllowedMetrics:           []string{}, // Empty means allow all
@@ -146,6 +283,40 @@ func DefaultConfig() *Config {
 				FutureTimestampThreshold: Duration{time.Hour},
 				PastTimestampThreshold:   Duration{7 * 24 * time.Hour},
 			},
+			StatsD: StatsDConfig{
+				Enabled:       false,
+				UDPAddress:    ":8125",
+				FlushInterval: Duration{10 * time.Second},
+				Percentiles:   []float64{50, 90, 95, 99},
+				GaugeExpiry:   Duration{5 * time.Minute},
+			},
+			Graphite: GraphiteConfig{
+				Enabled:          false,
+				PlaintextAddress: ":2003",
+				PickleAddress:    ":2004",
+				Templates:        []string{},
+			},
+			Scrape: ScrapeConfig{
+				Enabled: false,
+				Jobs:    []ScrapeJobConfig{},
+			},
+			Kafka: KafkaConfig{
+				Enabled:        false,
+				Brokers:        []string{"localhost:9092"},
+				Group:          "time-series-engine",
+				Topics:         []string{"metrics"},
+				Format:         "json",
+				Precision:      "ns",
+				CommitInterval: Duration{5 * time.Second},
+			},
+			MQTT: MQTTConfig{
+				Enabled:       false,
+				Broker:        "tcp://localhost:1883",
+				ClientID:      "time-series-engine",
+				Subscriptions: []MQTTSubscriptionConfig{},
+				MinBackoff:    Duration{time.Second},
+				MaxBackoff:    Duration{2 * time.Minute},
+			},
 		},
 		Analytics: AnalyticsConfig{
 			AnomalyDetection: AnomalyDetectionConfig{
@@ -162,6 +333,15 @@ func DefaultConfig() *Config {
 				DefaultHorizon: Duration{24 * time.Hour},
 			},
 		},
+		Performance: PerformanceConfig{
+			MaxConcurrentQueries: 100,
+			QueryTimeout:         Duration{30 * time.Second},
+			MaxQueryRange:        Duration{30 * 24 * time.Hour},
+			MaxQueryPoints:       1000000,
+			EnableQueryCache:     true,
+			CacheSizeMB:          128,
+			CacheTTL:             Duration{time.Hour},
+		},
 	}
 }
 
@@ -275,6 +455,90 @@ func (c *Config) Validate() error {
 	if c.Ingestion.WorkerPoolSize <= 0 {
 		return fmt.Errorf("ingestion worker pool size must be positive")
 	}
+	if c.Ingestion.RateLimitPerSecond < 0 || c.Ingestion.TenantRateLimitPerSecond < 0 {
+		return fmt.Errorf("ingestion rate limits cannot be negative")
+	}
+	if c.Ingestion.RateLimitBurst < 0 || c.Ingestion.TenantRateLimitBurst < 0 {
+		return fmt.Errorf("ingestion rate limit bursts cannot be negative")
+	}
+	if c.Ingestion.BlockTimeout.Duration < 0 {
+		return fmt.Errorf("ingestion block timeout cannot be negative")
+	}
+	if statsd := c.Ingestion.StatsD; statsd.Enabled {
+		if statsd.UDPAddress == "" && statsd.TCPAddress == "" {
+			return fmt.Errorf("statsd needs a UDP or TCP address when enabled")
+		}
+		if statsd.FlushInterval.Duration <= 0 {
+			return fmt.Errorf("statsd flush interval must be positive")
+		}
+		if statsd.GaugeExpiry.Duration < 0 {
+			return fmt.Errorf("statsd gauge expiry cannot be negative")
+		}
+		for _, p := range statsd.Percentiles {
+			if p <= 0 || p > 100 {
+				return fmt.Errorf("statsd percentile %v must be in (0, 100]", p)
+			}
+		}
+	}
+
+	if graphite := c.Ingestion.Graphite; graphite.Enabled && graphite.PlaintextAddress == "" && graphite.PickleAddress == "" {
+		return fmt.Errorf("graphite needs a plaintext or pickle address when enabled")
+	}
+	if scrape := c.Ingestion.Scrape; scrape.Enabled {
+		jobs := make(map[string]bool)
+		for _, job := range scrape.Jobs {
+			if job.JobName == "" {
+				return fmt.Errorf("scrape jobs need a job name")
+			}
+			if jobs[job.JobName] {
+				return fmt.Errorf("duplicate scrape job %q", job.JobName)
+			}
+			jobs[job.JobName] = true
+			if job.ScrapeInterval.Duration < 0 || job.ScrapeTimeout.Duration < 0 {
+				return fmt.Errorf("scrape job %q: interval and timeout cannot be negative", job.JobName)
+			}
+			if len(job.StaticConfigs) == 0 && len(job.FileSDConfig.Files) == 0 {
+				return fmt.Errorf("scrape job %q has no static or file targets", job.JobName)
+			}
+		}
+	}
+	if kafka := c.Ingestion.Kafka; kafka.Enabled {
+		if len(kafka.Brokers) == 0 || len(kafka.Topics) == 0 || kafka.Group == "" {
+			return fmt.Errorf("kafka needs brokers, topics and a consumer group when enabled")
+		}
+		switch kafka.Format {
+		case "json", "line_protocol", "otlp_proto":
+		default:
+			return fmt.Errorf("unsupported kafka format %q", kafka.Format)
+		}
+		if kafka.CommitInterval.Duration <= 0 {
+			return fmt.Errorf("kafka commit interval must be positive")
+		}
+	}
+	if mqtt := c.Ingestion.MQTT; mqtt.Enabled {
+		if mqtt.Broker == "" || mqtt.ClientID == "" {
+			return fmt.Errorf("mqtt needs a broker and a client ID when enabled")
+		}
+		if len(mqtt.Subscriptions) == 0 {
+			return fmt.Errorf("mqtt needs at least one subscription when enabled")
+		}
+		for _, sub := range mqtt.Subscriptions {
+			if sub.Topic == "" {
+				return fmt.Errorf("mqtt subscriptions need a topic")
+			}
+		}
+		if mqtt.MinBackoff.Duration < 0 || mqtt.MaxBackoff.Duration < 0 {
+			return fmt.Errorf("mqtt backoff cannot be negative")
+		}
+	}
+
+	// Validate performance config
+	if c.Performance.MaxConcurrentQueries < 0 || c.Performance.MaxQueryPoints < 0 {
+		return fmt.Errorf("query limits cannot be negative")
+	}
+	if c.Performance.EnableQueryCache && c.Performance.CacheSizeMB <= 0 {
+		return fmt.Errorf("query cache size must be positive when enabled")
+	}
 
 	return nil
 }
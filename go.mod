@@ -8,6 +8,19 @@ require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/golang-jwt/jwt/v5 v5.2.0
 	github.com/go-redis/redis/v8 v8.11.5
+	github.com/golang/snappy v0.0.4
 	github.com/stretchr/testify v1.8.4
+	github.com/twmb/franz-go v1.17.1
+	github.com/twmb/franz-go/pkg/kmsg v1.8.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	golang.org/x/time v0.5.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/klauspost/compress v1.17.8 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	golang.org/x/net v0.24.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
 )
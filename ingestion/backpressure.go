@@ -0,0 +1,348 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DefaultTenantLabel is the label identifying the tenant of a metric for
+// per-tenant rate limits
+const DefaultTenantLabel = "tenant_id"
+
+// tenantLimiterTTL is how long the limiter of a tenant that stopped sending
+// is kept
+const tenantLimiterTTL = 10 * time.Minute
+
+// queueRetryAfter is the retry delay suggested when the queue is full
+const queueRetryAfter = time.Second
+
+// ErrSaturated is wrapped by the errors returned when metrics exceed a rate
+// limit or find the queue full. None of the metrics were ingested, and they
+// may be sent again after the SaturationError's RetryAfter.
+var ErrSaturated = errors.New("ingestion saturated")
+
+// SaturationError is returned when ingestion is saturated, with the delay
+// after which the metrics are likely to be accepted
+type SaturationError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *SaturationError) Error() string {
+	return fmt.Sprintf("%v: %s, retry after %v", ErrSaturated, e.Reason, e.RetryAfter)
+}
+
+func (e *SaturationError) Unwrap() error {
+	return ErrSaturated
+}
+
+// RetryAfter returns the delay suggested by a SaturationError in err
+func RetryAfter(err error) (time.Duration, bool) {
+	var saturated *SaturationError
+	if errors.As(err, &saturated) {
+		return saturated.RetryAfter, true
+	}
+	return 0, false
+}
+
+// BackpressureConfig limits the rate at which metrics are accepted, over
+// all metrics and per tenant. A zero rate is unlimited, and a burst below
+// one defaults to one second's rate. A request larger than a burst is let
+// in on a full bucket and the requests after it wait for the excess.
+// Requests wait up to BlockTimeout for the limits and for queue space
+// before failing with ErrSaturated; with no timeout they fail at once.
+type BackpressureConfig struct {
+	RatePerSecond       float64
+	Burst               int
+	TenantRatePerSecond float64
+	TenantBurst         int
+	TenantLabel         string
+	BlockTimeout        time.Duration
+}
+
+// BackpressureStats counts the ingest calls turned away while saturated
+type BackpressureStats struct {
+	RateLimited       int64 `json:"rate_limited"`
+	TenantRateLimited int64 `json:"tenant_rate_limited"`
+	QueueFull         int64 `json:"queue_full"`
+}
+
+// SetBackpressure sets the rate limits and block timeout, which take effect
+// when the processor is next started
+func (sp *StreamProcessor) SetBackpressure(config BackpressureConfig) {
+	sp.lifecycleMu.Lock()
+	defer sp.lifecycleMu.Unlock()
+	if config.TenantLabel == "" {
+		config.TenantLabel = DefaultTenantLabel
+	}
+	sp.backpressure = config
+}
+
+// ingestLimiter is a token bucket over all metrics with one per tenant
+type ingestLimiter struct {
+	global      *rate.Limiter
+	tenantRate  rate.Limit
+	tenantBurst int
+	tenantLabel string
+
+	mu        sync.Mutex
+	tenants   map[string]*tenantLimiter
+	lastPrune time.Time
+}
+
+type tenantLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// newIngestLimiter returns the limiter for config, or nil if it is unlimited
+func newIngestLimiter(config BackpressureConfig) *ingestLimiter {
+	if config.RatePerSecond <= 0 && config.TenantRatePerSecond <= 0 {
+		return nil
+	}
+	l := &ingestLimiter{tenantLabel: config.TenantLabel, tenants: make(map[string]*tenantLimiter)}
+	if config.RatePerSecond > 0 {
+		l.global = rate.NewLimiter(rate.Limit(config.RatePerSecond), burstFor(config.RatePerSecond, config.Burst))
+	}
+	if config.TenantRatePerSecond > 0 {
+		l.tenantRate = rate.Limit(config.TenantRatePerSecond)
+		l.tenantBurst = burstFor(config.TenantRatePerSecond, config.TenantBurst)
+	}
+	return l
+}
+
+func burstFor(perSecond float64, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+	return int(math.Max(1, math.Ceil(perSecond)))
+}
+
+// limitReservation holds the tokens taken for a request
+type limitReservation struct {
+	reservations []*rate.Reservation
+	// debts are the tokens beyond the bursts of the buckets, charged once
+	// the request is admitted
+	debts []limitDebt
+	now   time.Time
+	// delay is the wait for the slowest bucket, which is a tenant's when
+	// tenant is set
+	delay  time.Duration
+	tenant *string
+}
+
+func (r *limitReservation) reason() string {
+	if r.tenant != nil {
+		return fmt.Sprintf("rate limit of tenant %q", *r.tenant)
+	}
+	return "rate limit"
+}
+
+// cancel gives the tokens back
+func (r *limitReservation) cancel() {
+	for _, reservation := range r.reservations {
+		reservation.CancelAt(r.now)
+	}
+}
+
+// limitDebt is a number of tokens to take from a bucket beyond its burst
+type limitDebt struct {
+	limiter *rate.Limiter
+	n       int
+}
+
+// chargeDebts takes the tokens of an admitted request beyond the bursts of
+// its buckets. The limiter reserves at most a burst at a time, and the
+// requests after this one wait for the tokens to be paid off.
+func (r *limitReservation) chargeDebts() {
+	now := time.Now()
+	for _, debt := range r.debts {
+		burst := debt.limiter.Burst()
+		for n := debt.n; n > 0; n -= burst {
+			debt.limiter.ReserveN(now, min(n, burst))
+		}
+	}
+}
+
+// reserve takes tokens for metrics from the global bucket and those of
+// their tenants. A request larger than a bucket's burst waits for the
+// bucket to be full, and the rest of its tokens are left as debts for
+// chargeDebts, so large batches are held to the rate too.
+func (l *ingestLimiter) reserve(metrics []MetricData, now time.Time) *limitReservation {
+	res := &limitReservation{now: now}
+	take := func(limiter *rate.Limiter, n int, tenant *string) {
+		if burst := limiter.Burst(); n > burst {
+			res.debts = append(res.debts, limitDebt{limiter: limiter, n: n - burst})
+			n = burst
+		}
+		r := limiter.ReserveN(now, n)
+		res.reservations = append(res.reservations, r)
+		if d := r.DelayFrom(now); d > res.delay {
+			res.delay, res.tenant = d, tenant
+		}
+	}
+
+	if l.global != nil {
+		take(l.global, len(metrics), nil)
+	}
+	if l.tenantRate > 0 {
+		counts := make(map[string]int)
+		for _, metric := range metrics {
+			if tenant, ok := metric.Labels[l.tenantLabel]; ok {
+				counts[tenant]++
+			}
+		}
+		for tenant, n := range counts {
+			tenant := tenant
+			take(l.tenant(tenant, now), n, &tenant)
+		}
+	}
+	return res
+}
+
+func (l *ingestLimiter) tenant(tenant string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastPrune) > tenantLimiterTTL {
+		for name, t := range l.tenants {
+			if now.Sub(t.lastUsed) > tenantLimiterTTL {
+				delete(l.tenants, name)
+			}
+		}
+		l.lastPrune = now
+	}
+	t, ok := l.tenants[tenant]
+	if !ok {
+		t = &tenantLimiter{limiter: rate.NewLimiter(l.tenantRate, l.tenantBurst)}
+		l.tenants[tenant] = t
+	}
+	t.lastUsed = now
+	return t.limiter
+}
+
+// requestContext bounds the wait of an ingest request by the block timeout
+func (sp *StreamProcessor) requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), sp.blockTimeout)
+}
+
+// admit waits for metrics to pass the rate limits and for space in the
+// shards they are routed to, until ctx is done or the processor stops.
+// Once it returns nil the caller holds slots for all of the metrics.
+func (sp *StreamProcessor) admit(ctx context.Context, metrics []MetricData, routed [][]pipelineItem) error {
+	if sp.limiter != nil {
+		res := sp.limiter.reserve(metrics, time.Now())
+		if res.delay > 0 {
+			ready := res.now.Add(res.delay)
+			if deadline, ok := ctx.Deadline(); ok && ready.After(deadline) {
+				res.cancel()
+				return sp.rateLimited(res, res.delay)
+			}
+			timer := time.NewTimer(res.delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				res.cancel()
+				return sp.rateLimited(res, time.Until(ready))
+			case <-sp.draining:
+				res.cancel()
+				return fmt.Errorf("%d samples not ingested: %w", len(metrics), ErrNotRunning)
+			}
+		}
+		res.chargeDebts()
+	}
+
+	if sp.reserveSlots(routed) {
+		return nil
+	}
+	sp.spaceWaiters.Add(1)
+	defer sp.spaceWaiters.Add(-1)
+	for {
+		// Take the channel before trying, so that space freed in between
+		// closes it
+		sp.spaceMu.Lock()
+		space := sp.space
+		sp.spaceMu.Unlock()
+		if sp.reserveSlots(routed) {
+			return nil
+		}
+		select {
+		case <-space:
+		case <-ctx.Done():
+			sp.saturation.queueFull.Add(1)
+			return &SaturationError{Reason: "queue full", RetryAfter: queueRetryAfter}
+		case <-sp.draining:
+			return fmt.Errorf("%d samples not ingested: %w", len(metrics), ErrNotRunning)
+		}
+	}
+}
+
+// reserveSlots takes the slots for the routed metrics in every shard, or
+// none if a shard lacks space
+func (sp *StreamProcessor) reserveSlots(routed [][]pipelineItem) bool {
+	reserved := false
+	for i, items := range routed {
+		if len(items) == 0 {
+			continue
+		}
+		if sp.shards[i].reserve(int64(len(items))) {
+			reserved = true
+			continue
+		}
+		if !reserved {
+			return false
+		}
+		// Another request may have found those slots taken meanwhile
+		for j := 0; j < i; j++ {
+			if n := len(routed[j]); n > 0 {
+				sp.shards[j].slots.Add(-int64(n))
+			}
+		}
+		sp.notifySpace()
+		return false
+	}
+	return true
+}
+
+// notifySpace wakes the requests waiting for space
+func (sp *StreamProcessor) notifySpace() {
+	if sp.spaceWaiters.Load() > 0 {
+		sp.spaceMu.Lock()
+		close(sp.space)
+		sp.space = make(chan struct{})
+		sp.spaceMu.Unlock()
+	}
+}
+
+// rateLimited counts a request turned away by a rate limit and returns its
+// error
+func (sp *StreamProcessor) rateLimited(res *limitReservation, retryAfter time.Duration) error {
+	if res.tenant != nil {
+		sp.saturation.tenantRateLimited.Add(1)
+	} else {
+		sp.saturation.rateLimited.Add(1)
+	}
+	return &SaturationError{Reason: res.reason(), RetryAfter: retryAfter}
+}
+
+// backpressureCounter accumulates BackpressureStats without locking
+type backpressureCounter struct {
+	rateLimited       atomic.Int64
+	tenantRateLimited atomic.Int64
+	queueFull         atomic.Int64
+}
+
+func (c *backpressureCounter) snapshot() BackpressureStats {
+	return BackpressureStats{
+		RateLimited:       c.rateLimited.Load(),
+		TenantRateLimited: c.tenantRateLimited.Load(),
+		QueueFull:         c.queueFull.Load(),
+	}
+}
@@ -0,0 +1,272 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// stalledWriter blocks writes until released, so the queue fills up
+type stalledWriter struct {
+	release chan struct{}
+}
+
+func (w *stalledWriter) AddPoint(seriesID string, labels map[string]string, timestamp time.Time, value float64) error {
+	<-w.release
+	return nil
+}
+
+func tenantMetric(tenant string) MetricData {
+	return MetricData{
+		Name:      "requests",
+		Value:     1,
+		Timestamp: time.Now(),
+		Labels:    map[string]string{"tenant_id": tenant},
+	}
+}
+
+func TestStreamProcessor_RateLimits(t *testing.T) {
+	sp := NewStreamProcessor(storage.NewHotStorage(1000, 10000), 100, 10, time.Hour)
+	sp.SetBackpressure(BackpressureConfig{RatePerSecond: 1, Burst: 5, TenantRatePerSecond: 1, TenantBurst: 3})
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	// Tenant a has a burst of 3
+	for i := 0; i < 3; i++ {
+		if err := sp.IngestMetric(tenantMetric("a")); err != nil {
+			t.Fatalf("Expected metric %d of tenant a to be accepted: %v", i, err)
+		}
+	}
+	err := sp.IngestMetric(tenantMetric("a"))
+	retryAfter, ok := RetryAfter(err)
+	if !errors.Is(err, ErrSaturated) || !IsRetryable(err) || !ok || retryAfter <= 0 {
+		t.Fatalf("Expected tenant a to be rate limited with a retry delay, got %v", err)
+	}
+
+	// Tenant b has its own bucket, until the global burst of 5 is used up
+	if err := sp.IngestBatch([]MetricData{tenantMetric("b"), tenantMetric("b")}); err != nil {
+		t.Fatalf("Expected tenant b to be accepted: %v", err)
+	}
+	if err := sp.IngestMetric(tenantMetric("c")); !errors.Is(err, ErrSaturated) {
+		t.Fatalf("Expected the global rate limit to apply, got %v", err)
+	}
+
+	stats := sp.GetStats()
+	if stats.Backpressure.TenantRateLimited != 1 || stats.Backpressure.RateLimited != 1 {
+		t.Errorf("Expected one rejection by each limit, got %+v", stats.Backpressure)
+	}
+	if stats.Intake.Count != 5 {
+		t.Errorf("Expected 5 metrics accepted, got %d", stats.Intake.Count)
+	}
+}
+
+func TestStreamProcessor_RateLimitBlocksUntilDeadline(t *testing.T) {
+	sp := NewStreamProcessor(storage.NewHotStorage(1000, 10000), 100, 10, time.Hour)
+	sp.SetBackpressure(BackpressureConfig{RatePerSecond: 20, Burst: 1, BlockTimeout: time.Second})
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := sp.IngestMetric(tenantMetric("a")); err != nil {
+			t.Fatalf("Expected metric %d to wait for the rate limit: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Expected 3 metrics at 20/s to take about 100ms, took %v", elapsed)
+	}
+}
+
+func TestStreamProcessor_RateLimitChargesLargeBatches(t *testing.T) {
+	sp := NewStreamProcessor(storage.NewHotStorage(1000, 10000), 1000, 100, time.Hour)
+	sp.SetBackpressure(BackpressureConfig{RatePerSecond: 10, Burst: 10})
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	batch := make([]MetricData, 100)
+	for i := range batch {
+		batch[i] = tenantMetric("a")
+	}
+	if err := sp.IngestBatch(batch); err != nil {
+		t.Fatalf("Expected a batch larger than the burst to be accepted on a full bucket: %v", err)
+	}
+
+	// The batch of 10 bursts used 10 seconds' worth of the rate, so the
+	// next request is throttled until that is paid off
+	err := sp.IngestBatch(batch)
+	if retryAfter, ok := RetryAfter(err); !errors.Is(err, ErrSaturated) || !ok || retryAfter < 8*time.Second {
+		t.Fatalf("Expected the next batch to be throttled for about 9s, got %v", err)
+	}
+	// The rejected batch gave its tokens back, so only the debt is left
+	err = sp.IngestMetric(tenantMetric("a"))
+	if retryAfter, ok := RetryAfter(err); !ok || retryAfter < 8*time.Second || retryAfter > 10*time.Second {
+		t.Errorf("Expected a single metric to wait for the debt as well, got %v", err)
+	}
+	if stats := sp.GetStats(); stats.Intake.Count != 100 || stats.Backpressure.RateLimited != 2 {
+		t.Errorf("Expected only the first batch accepted, got %+v", stats)
+	}
+}
+
+func TestStreamProcessor_QueueFull(t *testing.T) {
+	writer := &stalledWriter{release: make(chan struct{})}
+	sp := NewStreamProcessor(writer, 4, 1, time.Hour)
+	sp.SetWorkerCount(1)
+	sp.Start(context.Background())
+
+	// The worker holds one metric in its stalled write and the queue the
+	// next 4, so the queue is full until the write is released
+	metrics := make([]MetricData, 5)
+	for i := range metrics {
+		metrics[i] = tenantMetric("a")
+	}
+	if err := sp.IngestBatch(metrics[:1]); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for sp.GetStats().Queue.Count == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := sp.IngestBatch(metrics[1:]); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	err := sp.IngestMetric(tenantMetric("a"))
+	if retryAfter, ok := RetryAfter(err); !ok || retryAfter != queueRetryAfter {
+		t.Fatalf("Expected the full queue to be reported, got %v", err)
+	}
+	if full := sp.GetStats().Backpressure.QueueFull; full != 1 {
+		t.Errorf("Expected 1 request turned away by the full queue, got %d", full)
+	}
+
+	// Sources wait for space instead
+	done := make(chan error)
+	go func() {
+		_, err := sp.ingestMetrics(context.Background(), metrics[:1])
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the source to wait for queue space, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(writer.release)
+	if err := <-done; err != nil {
+		t.Errorf("Expected the source's metric to be queued once space was freed: %v", err)
+	}
+	sp.Stop()
+
+	if written := sp.GetStats().Write.Count; written != 6 {
+		t.Errorf("Expected 6 metrics written, got %d", written)
+	}
+}
+
+func TestStreamProcessor_SkewedShardFull(t *testing.T) {
+	writer := &stalledWriter{release: make(chan struct{})}
+	sp := NewStreamProcessor(writer, 8, 1, time.Hour)
+	sp.SetWorkerCount(4)
+	sp.SetBackpressure(BackpressureConfig{BlockTimeout: 50 * time.Millisecond})
+	sp.Start(context.Background())
+	defer func() {
+		close(writer.release)
+		sp.Stop()
+	}()
+
+	// Every metric goes to the shard of one series, which holds 2 of the
+	// 8 slots besides the one in its stalled write
+	hot := tenantMetric("a")
+	if err := sp.IngestMetric(hot); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for sp.GetStats().Queue.Count == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := sp.IngestBatch([]MetricData{hot, hot}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	start := time.Now()
+	err := sp.IngestMetric(hot)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to give up after the block timeout, took %v", elapsed)
+	}
+	if retryAfter, ok := RetryAfter(err); !ok || retryAfter != queueRetryAfter {
+		t.Fatalf("Expected the full shard to be reported, got %v", err)
+	}
+
+	// Series of other shards are still admitted
+	for i := 0; ; i++ {
+		other := tenantMetric(fmt.Sprint("b", i))
+		seriesID := storage.SeriesKey(other.Name, other.Labels)
+		if shardIndex(seriesID, 4) == shardIndex(storage.SeriesKey(hot.Name, hot.Labels), 4) {
+			continue
+		}
+		if err := sp.IngestMetric(other); err != nil {
+			t.Errorf("Expected another shard's series to be accepted: %v", err)
+		}
+		break
+	}
+}
+
+func TestStreamProcessor_StopWhileSaturated(t *testing.T) {
+	writer := &stalledWriter{release: make(chan struct{})}
+	sp := NewStreamProcessor(writer, 1, 1, time.Hour)
+	sp.SetWorkerCount(1)
+	sp.Start(context.Background())
+
+	// One metric in the stalled write and one filling the queue
+	if err := sp.IngestMetric(tenantMetric("a")); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for sp.GetStats().Queue.Count == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := sp.IngestMetric(tenantMetric("a")); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+
+	waiting := make(chan error)
+	go func() {
+		_, err := sp.ingestMetrics(context.Background(), []MetricData{tenantMetric("a")})
+		waiting <- err
+	}()
+	flushed := make(chan error)
+	go func() { flushed <- sp.Flush() }()
+	time.Sleep(20 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		sp.Stop()
+		close(stopped)
+	}()
+
+	// Stop turns the waiting source away, then writes what was queued
+	select {
+	case err := <-waiting:
+		if !errors.Is(err, ErrNotRunning) {
+			t.Errorf("Expected the waiting source to be turned away, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Stop to release the source waiting for space")
+	}
+	close(writer.release)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Stop to return once the writes finished")
+	}
+	select {
+	case err := <-flushed:
+		if err != nil {
+			t.Errorf("Expected the flush to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the pending flush to be answered by the stopping worker")
+	}
+	if written := sp.GetStats().Write.Count; written != 2 {
+		t.Errorf("Expected the 2 queued metrics written, got %d", written)
+	}
+}
@@ -0,0 +1,475 @@
+package ingestion
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxPickleMessageSize bounds the length of one pickle protocol message.
+// Carbon itself rejects messages over 1 MiB, so senders keep below it.
+const MaxPickleMessageSize = 1 << 20
+
+// maxGraphiteLineLength bounds the length of one plaintext line
+const maxGraphiteLineLength = 64 << 10
+
+// graphiteBatchSize is the number of plaintext lines read from a connection
+// before they are ingested, when more data is already waiting
+const graphiteBatchSize = 1000
+
+// GraphiteTemplate maps Graphite paths matching a filter to a metric name
+// and labels. A rule is written as
+//
+//	servers.*.cpu.* -> host, cpu
+//
+// Each node of the filter is a glob matching one node of the path. The path
+// nodes matched by wildcard nodes become labels, named in order by the
+// labels after the arrow; a label named _ drops its node. The remaining
+// nodes, including any beyond the filter, form the metric name, so
+// servers.web1.cpu.0.user is written as servers.cpu.user{host="web1",cpu="0"}.
+type GraphiteTemplate struct {
+	filter []string
+	labels []string // label name of each filter node, "" for literal nodes
+}
+
+// ParseGraphiteTemplate parses a template rule
+func ParseGraphiteTemplate(rule string) (*GraphiteTemplate, error) {
+	filter, names, ok := strings.Cut(rule, "->")
+	filter = strings.TrimSpace(filter)
+	if !ok || filter == "" {
+		return nil, fmt.Errorf("invalid graphite template %q: expected 'filter -> labels'", rule)
+	}
+
+	var labels []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			labels = append(labels, name)
+		}
+	}
+
+	t := &GraphiteTemplate{filter: strings.Split(filter, ".")}
+	t.labels = make([]string, len(t.filter))
+	wildcards := 0
+	for i, node := range t.filter {
+		if _, err := path.Match(node, ""); err != nil {
+			return nil, fmt.Errorf("invalid graphite template %q: %w", rule, err)
+		}
+		if !strings.ContainsAny(node, "*?[") {
+			continue
+		}
+		if wildcards < len(labels) {
+			t.labels[i] = labels[wildcards]
+		}
+		wildcards++
+	}
+	if wildcards != len(labels) {
+		return nil, fmt.Errorf("invalid graphite template %q: %d wildcards but %d labels", rule, wildcards, len(labels))
+	}
+	return t, nil
+}
+
+// Apply maps a path to a metric name and labels, if the path matches
+func (t *GraphiteTemplate) Apply(nodes []string) (string, map[string]string, bool) {
+	if len(nodes) < len(t.filter) {
+		return "", nil, false
+	}
+	for i, pattern := range t.filter {
+		if matched, _ := path.Match(pattern, nodes[i]); !matched {
+			return "", nil, false
+		}
+	}
+
+	labels := make(map[string]string)
+	var name []string
+	for i, node := range nodes {
+		switch {
+		case i >= len(t.filter) || t.labels[i] == "":
+			name = append(name, node)
+		case t.labels[i] != "_":
+			labels[t.labels[i]] = node
+		}
+	}
+	return strings.Join(name, "."), labels, true
+}
+
+// GraphiteParser parses the Graphite plaintext and pickle protocols,
+// mapping paths with the first matching template. Paths matching no
+// template keep the whole path as their name. Graphite 1.1 tags, as in
+// cpu.load;host=web1 value timestamp, are added as labels.
+type GraphiteParser struct {
+	templates []*GraphiteTemplate
+}
+
+// NewGraphiteParser creates a parser with the given template rules, tried in
+// order
+func NewGraphiteParser(rules []string) (*GraphiteParser, error) {
+	parser := &GraphiteParser{}
+	for _, rule := range rules {
+		template, err := ParseGraphiteTemplate(rule)
+		if err != nil {
+			return nil, err
+		}
+		parser.templates = append(parser.templates, template)
+	}
+	return parser, nil
+}
+
+// ParseLine parses a plaintext line, path value timestamp. The timestamp is
+// in seconds; a missing or negative timestamp means now.
+func (p *GraphiteParser) ParseLine(line string, now time.Time) (MetricData, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return MetricData{}, fmt.Errorf("invalid graphite line %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return MetricData{}, fmt.Errorf("invalid value %q", fields[1])
+	}
+	timestamp := now
+	if len(fields) == 3 {
+		seconds, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return MetricData{}, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+		if seconds >= 0 {
+			timestamp = graphiteTime(seconds)
+		}
+	}
+	return p.Metric(fields[0], value, timestamp)
+}
+
+// ParsePickle parses the payload of a pickle protocol message: a pickled
+// list of (path, (timestamp, value)) tuples. Invalid entries are skipped
+// and reported along with the valid metrics.
+func (p *GraphiteParser) ParsePickle(payload []byte, now time.Time) ([]MetricData, []error) {
+	decoded, err := unpickle(payload)
+	if err != nil {
+		return nil, []error{err}
+	}
+	entries, ok := decoded.([]interface{})
+	if !ok {
+		return nil, []error{fmt.Errorf("expected a list of metrics, got %T", decoded)}
+	}
+
+	var metrics []MetricData
+	var errs []error
+	for _, entry := range entries {
+		metric, err := p.pickleEntry(entry, now)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, errs
+}
+
+func (p *GraphiteParser) pickleEntry(entry interface{}, now time.Time) (MetricData, error) {
+	tuple, ok := entry.([]interface{})
+	if !ok || len(tuple) != 2 {
+		return MetricData{}, fmt.Errorf("expected (path, (timestamp, value)), got %v", entry)
+	}
+	metricPath, ok := tuple[0].(string)
+	datapoint, ok2 := tuple[1].([]interface{})
+	if !ok || !ok2 || len(datapoint) != 2 {
+		return MetricData{}, fmt.Errorf("expected (path, (timestamp, value)), got %v", entry)
+	}
+	seconds, err := pickleNumber(datapoint[0])
+	if err != nil {
+		return MetricData{}, fmt.Errorf("%s: invalid timestamp: %w", metricPath, err)
+	}
+	value, err := pickleNumber(datapoint[1])
+	if err != nil {
+		return MetricData{}, fmt.Errorf("%s: invalid value: %w", metricPath, err)
+	}
+	timestamp := now
+	if seconds >= 0 {
+		timestamp = graphiteTime(seconds)
+	}
+	return p.Metric(metricPath, value, timestamp)
+}
+
+// Metric maps a Graphite path and its sample to a metric
+func (p *GraphiteParser) Metric(metricPath string, value float64, timestamp time.Time) (MetricData, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return MetricData{}, fmt.Errorf("%s: invalid value %v", metricPath, value)
+	}
+
+	tags := strings.Split(metricPath, ";")
+	metricPath = tags[0]
+	if metricPath == "" || strings.Contains(metricPath, "..") {
+		return MetricData{}, fmt.Errorf("invalid graphite path %q", metricPath)
+	}
+	nodes := strings.Split(strings.Trim(metricPath, "."), ".")
+
+	name, labels := metricPath, map[string]string{}
+	for _, template := range p.templates {
+		if n, l, ok := template.Apply(nodes); ok {
+			name, labels = n, l
+			break
+		}
+	}
+	if name == "" {
+		return MetricData{}, fmt.Errorf("template leaves no metric name for %q", metricPath)
+	}
+	for _, tag := range tags[1:] {
+		key, tagValue, ok := strings.Cut(tag, "=")
+		if !ok || key == "" {
+			return MetricData{}, fmt.Errorf("invalid graphite tag %q", tag)
+		}
+		labels[key] = tagValue
+	}
+	return MetricData{Name: name, Value: value, Timestamp: timestamp, Labels: labels}, nil
+}
+
+func graphiteTime(seconds float64) time.Time {
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+// GraphiteServerConfig configures a GraphiteServer
+type GraphiteServerConfig struct {
+	// PlaintextAddress and PickleAddress are the TCP addresses to listen on;
+	// an empty address disables that protocol
+	PlaintextAddress string
+	PickleAddress    string
+	Templates        []string
+}
+
+// GraphiteServer receives metrics in the Graphite plaintext and pickle
+// protocols over TCP and ingests them through the stream processor. While
+// ingestion is saturated a connection is not read, so senders are slowed
+// down by TCP flow control.
+type GraphiteServer struct {
+	processor *StreamProcessor
+	parser    *GraphiteParser
+	config    GraphiteServerConfig
+
+	plaintext net.Listener
+	pickle    net.Listener
+	conns     map[net.Conn]struct{}
+	connsMu   sync.Mutex
+	wg        sync.WaitGroup
+
+	received    int64
+	parseErrors int64
+	statsMu     sync.Mutex
+}
+
+// NewGraphiteServer creates a Graphite server writing to processor. It
+// fails when a template rule is invalid.
+func NewGraphiteServer(processor *StreamProcessor, config GraphiteServerConfig) (*GraphiteServer, error) {
+	parser, err := NewGraphiteParser(config.Templates)
+	if err != nil {
+		return nil, err
+	}
+	return &GraphiteServer{
+		processor: processor,
+		parser:    parser,
+		config:    config,
+		conns:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Start opens the listeners
+func (s *GraphiteServer) Start() error {
+	if s.config.PlaintextAddress == "" && s.config.PickleAddress == "" {
+		return fmt.Errorf("graphite server needs a plaintext or pickle address")
+	}
+	if s.config.PlaintextAddress != "" {
+		listener, err := net.Listen("tcp", s.config.PlaintextAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", s.config.PlaintextAddress, err)
+		}
+		s.plaintext = listener
+	}
+	if s.config.PickleAddress != "" {
+		listener, err := net.Listen("tcp", s.config.PickleAddress)
+		if err != nil {
+			if s.plaintext != nil {
+				s.plaintext.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", s.config.PickleAddress, err)
+		}
+		s.pickle = listener
+	}
+
+	if s.plaintext != nil {
+		s.wg.Add(1)
+		go s.serve(s.plaintext, s.handlePlaintext)
+	}
+	if s.pickle != nil {
+		s.wg.Add(1)
+		go s.serve(s.pickle, s.handlePickle)
+	}
+	return nil
+}
+
+// Stop closes the listeners and open connections, and waits for metrics
+// already read to be ingested
+func (s *GraphiteServer) Stop() {
+	if s.plaintext != nil {
+		s.plaintext.Close()
+	}
+	if s.pickle != nil {
+		s.pickle.Close()
+	}
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMu.Unlock()
+	s.wg.Wait()
+}
+
+// PlaintextAddr returns the address of the plaintext listener, or nil
+func (s *GraphiteServer) PlaintextAddr() net.Addr {
+	if s.plaintext == nil {
+		return nil
+	}
+	return s.plaintext.Addr()
+}
+
+// PickleAddr returns the address of the pickle listener, or nil
+func (s *GraphiteServer) PickleAddr() net.Addr {
+	if s.pickle == nil {
+		return nil
+	}
+	return s.pickle.Addr()
+}
+
+// Stats returns the number of metrics received and of lines or entries that
+// failed to parse
+func (s *GraphiteServer) Stats() (received, parseErrors int64) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.received, s.parseErrors
+}
+
+func (s *GraphiteServer) serve(listener net.Listener, handle func(net.Conn)) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Graphite accept error: %v", err)
+			continue
+		}
+		s.connsMu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connsMu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.connsMu.Lock()
+				delete(s.conns, conn)
+				s.connsMu.Unlock()
+				conn.Close()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// handlePlaintext reads lines from a connection, ingesting them in batches
+// whenever the lines received so far have been read. A line longer than
+// maxGraphiteLineLength closes the connection.
+func (s *GraphiteServer) handlePlaintext(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, maxGraphiteLineLength)
+	var batch []MetricData
+	for {
+		raw, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			s.record(1, fmt.Errorf("line from %s exceeds %d bytes, closing connection", conn.RemoteAddr(), maxGraphiteLineLength))
+			break
+		}
+		if line := strings.TrimSpace(string(raw)); line != "" {
+			metric, parseErr := s.parser.ParseLine(line, time.Now())
+			s.record(1, parseErr)
+			if parseErr == nil {
+				batch = append(batch, metric)
+			}
+		}
+		if len(batch) > 0 && (err != nil || reader.Buffered() == 0 || len(batch) >= graphiteBatchSize) {
+			s.ingest(batch)
+			batch = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if len(batch) > 0 {
+		s.ingest(batch)
+	}
+}
+
+// handlePickle reads length-prefixed pickle messages from a connection,
+// ingesting each message as a batch
+func (s *GraphiteServer) handlePickle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return
+		}
+		if length > MaxPickleMessageSize {
+			log.Printf("Graphite pickle message of %d bytes exceeds the limit, closing connection", length)
+			return
+		}
+		// The payload grows as it arrives, so a length prefix alone does
+		// not allocate its size
+		payload, err := io.ReadAll(io.LimitReader(reader, int64(length)))
+		if err != nil || len(payload) < int(length) {
+			return
+		}
+
+		metrics, errs := s.parser.ParsePickle(payload, time.Now())
+		for _, err := range errs {
+			s.record(1, err)
+		}
+		if len(metrics) > 0 {
+			s.record(len(metrics), nil)
+			s.ingest(metrics)
+		}
+	}
+}
+
+// ingest writes a batch through the stream processor, waiting while
+// ingestion is saturated
+func (s *GraphiteServer) ingest(metrics []MetricData) {
+	invalid, err := s.processor.ingestMetrics(context.Background(), metrics)
+	for _, err := range invalid {
+		log.Printf("Graphite: %v", err)
+	}
+	if err != nil {
+		log.Printf("Graphite: %v", err)
+	}
+}
+
+func (s *GraphiteServer) record(n int, err error) {
+	s.statsMu.Lock()
+	if err != nil {
+		s.parseErrors += int64(n)
+	} else {
+		s.received += int64(n)
+	}
+	s.statsMu.Unlock()
+	if err != nil {
+		log.Printf("Graphite: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestGraphiteTemplates(t *testing.T) {
+	parser, err := NewGraphiteParser([]string{
+		"servers.*.cpu.* -> host, cpu",
+		"stats.*.*.requests -> _, region",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create parser: %v", err)
+	}
+
+	now := time.Now()
+	for line, expected := range map[string]struct {
+		name   string
+		labels map[string]string
+	}{
+		"servers.web1.cpu.0.user 12.5 1700000000": {"servers.cpu.user", map[string]string{"host": "web1", "cpu": "0"}},
+		"stats.prod.eu.requests 3 1700000000":     {"stats.requests", map[string]string{"region": "eu"}},
+		"other.metric 1 1700000000":               {"other.metric", map[string]string{}},
+		"disk.used;host=db1;mount=/ 1 1700000000": {"disk.used", map[string]string{"host": "db1", "mount": "/"}},
+	} {
+		metric, err := parser.ParseLine(line, now)
+		if err != nil {
+			t.Errorf("%s: %v", line, err)
+			continue
+		}
+		if metric.Name != expected.name || fmt.Sprint(metric.Labels) != fmt.Sprint(expected.labels) {
+			t.Errorf("%s: expected %s%v, got %s%v", line, expected.name, expected.labels, metric.Name, metric.Labels)
+		}
+		if metric.Timestamp.Unix() != 1700000000 {
+			t.Errorf("%s: unexpected timestamp %v", line, metric.Timestamp)
+		}
+	}
+
+	if metric, _ := parser.ParseLine("a.b 1 -1", now); !metric.Timestamp.Equal(now) {
+		t.Errorf("Expected a negative timestamp to mean now, got %v", metric.Timestamp)
+	}
+	for _, invalid := range []string{"a.b", "a.b x 1", "a..b 1 1", "a.b 1 x", "a.b NaN 1"} {
+		if _, err := parser.ParseLine(invalid, now); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+	for _, invalid := range []string{"servers.*.cpu", "servers.*.cpu.* -> host", "a.[ -> x"} {
+		if _, err := ParseGraphiteTemplate(invalid); err == nil {
+			t.Errorf("Expected template %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestGraphitePickle(t *testing.T) {
+	// pickle.dumps([("servers.web1.cpu.0.user", (1700000000, 12.5)),
+	//     ("servers.web2.cpu.1.idle", (1700000010.5, "87")), ("bad", ("x", 1))], protocol)
+	pickles := map[int]string{
+		0: "(lp0\x0a(Vservers.web1.cpu.0.user\x0ap1\x0a(I1700000000\x0aF12.5\x0atp2\x0atp3\x0aa(Vservers.web2.cpu.1.idle\x0ap4\x0a(F1700000010.5\x0aV87\x0ap5\x0atp6\x0atp7\x0aa(Vbad\x0ap8\x0a(Vx\x0ap9\x0aI1\x0atp10\x0atp11\x0aa.",
+		2: "\x80\x02]q\x00(X\x17\x00\x00\x00servers.web1.cpu.0.userq\x01J\x00\xf1SeG@)\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x17\x00\x00\x00servers.web2.cpu.1.idleq\x04GA\xd9T\xfcB\xa0\x00\x00X\x02\x00\x00\x0087q\x05\x86q\x06\x86q\x07X\x03\x00\x00\x00badq\x08X\x01\x00\x00\x00xq\x09K\x01\x86q\x0a\x86q\x0be.",
+		4: "\x80\x04\x95m\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x17servers.web1.cpu.0.user\x94J\x00\xf1SeG@)\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x17servers.web2.cpu.1.idle\x94GA\xd9T\xfcB\xa0\x00\x00\x8c\x0287\x94\x86\x94\x86\x94\x8c\x03bad\x94\x8c\x01x\x94K\x01\x86\x94\x86\x94e.",
+	}
+	parser, _ := NewGraphiteParser([]string{"servers.*.cpu.* -> host, cpu"})
+	for protocol, payload := range pickles {
+		metrics, errs := parser.ParsePickle([]byte(payload), time.Now())
+		if len(metrics) != 2 || len(errs) != 1 {
+			t.Errorf("protocol %d: expected 2 metrics and 1 error, got %+v %v", protocol, metrics, errs)
+			continue
+		}
+		if m := metrics[0]; m.Name != "servers.cpu.user" || m.Labels["host"] != "web1" || m.Value != 12.5 || m.Timestamp.Unix() != 1700000000 {
+			t.Errorf("protocol %d: unexpected first metric %+v", protocol, m)
+		}
+		if m := metrics[1]; m.Value != 87 || m.Timestamp.UnixMilli() != 1700000010500 {
+			t.Errorf("protocol %d: unexpected second metric %+v", protocol, m)
+		}
+	}
+
+	// Pickles that would construct objects are refused
+	malicious := "cos\nsystem\n(S'echo hi'\ntR."
+	if _, errs := parser.ParsePickle([]byte(malicious), time.Now()); len(errs) != 1 || !strings.Contains(errs[0].Error(), "opcode") {
+		t.Errorf("Expected the GLOBAL opcode to be rejected, got %v", errs)
+	}
+
+	// A list appended to itself, or lists shared until the value is huge,
+	// must be rejected rather than recursed into
+	nested := "]q\x00"
+	for i := 0; i < 30; i++ {
+		nested += "]h\x00h\x00\x86aq\x00"
+	}
+	for name, payload := range map[string]string{
+		"self-reference": "]q\x00h\x00a.",
+		"deep":           strings.Repeat("]", maxPickleDepth+2) + strings.Repeat("a", maxPickleDepth+1) + ".",
+		"shared":         nested + ".",
+	} {
+		if _, errs := parser.ParsePickle([]byte(payload), time.Now()); len(errs) != 1 || !strings.Contains(errs[0].Error(), "pickle") {
+			t.Errorf("%s: expected the pickle to be rejected, got %v", name, errs)
+		}
+	}
+}
+
+func TestGraphiteServer(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 10, time.Second)
+	sp.Start(context.Background())
+	server, err := NewGraphiteServer(sp, GraphiteServerConfig{
+		PlaintextAddress: "127.0.0.1:0",
+		PickleAddress:    "127.0.0.1:0",
+		Templates:        []string{"servers.*.cpu.* -> host, cpu"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+
+	plaintext, err := net.Dial("tcp", server.PlaintextAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(plaintext, "servers.web1.cpu.0.user 12.5 %d\nbroken\n", time.Now().Unix())
+	plaintext.Close()
+
+	// [("app.requests;env=prod", (-1, 5))] with its length header
+	pickle, err := net.Dial("tcp", server.PickleAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(pickle, "\x00\x00\x000\x80\x02]q\x00X\x15\x00\x00\x00app.requests;env=prodq\x01J\xff\xff\xff\xffK\x05\x86q\x02\x86q\x03a.")
+	pickle.Close()
+
+	// Over-long lines and oversized pickle messages close the connection;
+	// the lines before them are still ingested
+	long, err := net.Dial("tcp", server.PlaintextAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(long, "servers.web2.cpu.0.user 7 %d\n%s", time.Now().Unix(), strings.Repeat("x", maxGraphiteLineLength+1))
+	oversized, err := net.Dial("tcp", server.PickleAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(oversized, "\x00\x20\x00\x00")
+	for _, conn := range []net.Conn{long, oversized} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		// Closing with unread data may reset the connection instead of EOF
+		var netErr net.Error
+		if _, err := conn.Read(make([]byte, 1)); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+			t.Errorf("Expected the server to close the connection, got %v", err)
+		}
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		received, parseErrors := server.Stats()
+		if received == 3 && parseErrors == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 metrics and 2 errors, got %d and %d", received, parseErrors)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Stop()
+	sp.Stop()
+
+	for key, expected := range map[string]float64{
+		storage.SeriesKey("servers.cpu.user", map[string]string{"host": "web1", "cpu": "0"}): 12.5,
+		storage.SeriesKey("servers.cpu.user", map[string]string{"host": "web2", "cpu": "0"}): 7,
+		storage.SeriesKey("app.requests", map[string]string{"env": "prod"}):                  5,
+	} {
+		series, ok := hot.GetSeries(key)
+		if !ok || series.GetLatest(1)[0].Value != expected {
+			t.Errorf("%s: expected %v", key, expected)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package ingestion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// KafkaFormat is the encoding of Kafka message values
+type KafkaFormat string
+
+const (
+	// KafkaFormatJSON is a MetricData object or an array of them
+	KafkaFormatJSON KafkaFormat = "json"
+	// KafkaFormatLineProtocol is InfluxDB line protocol, one or more lines
+	KafkaFormatLineProtocol KafkaFormat = "line_protocol"
+	// KafkaFormatOTLP is a protobuf OTLP ExportMetricsServiceRequest, as
+	// sent by the OpenTelemetry Collector's Kafka exporter
+	KafkaFormatOTLP KafkaFormat = "otlp_proto"
+)
+
+const (
+	DefaultKafkaCommitInterval = 5 * time.Second
+	kafkaCommitTimeout         = 10 * time.Second
+	kafkaPollErrorBackoff      = time.Second
+	kafkaWriteRetryBackoff     = time.Second
+)
+
+// KafkaPartition identifies a partition of a topic
+type KafkaPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// KafkaRecord is a message consumed from a partition
+type KafkaRecord struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time
+}
+
+// KafkaRebalance holds the callbacks a KafkaClient makes when the consumer
+// group's partitions are reassigned. Revoked is called before partitions
+// move to another member, while offsets may still be committed; Lost when
+// they were taken away without that chance, e.g. after a session timeout.
+type KafkaRebalance struct {
+	Assigned func(partitions []KafkaPartition)
+	Revoked  func(partitions []KafkaPartition)
+	Lost     func(partitions []KafkaPartition)
+}
+
+// KafkaClient is a consumer group member. Rebalance callbacks are only made
+// while Poll is blocked, or from Close, so they never run while a polled
+// batch is being processed.
+type KafkaClient interface {
+	// SetRebalance sets the callbacks for partition reassignments
+	SetRebalance(rebalance KafkaRebalance)
+	// Poll returns the next records, waiting until some are available or
+	// ctx is done. It may return records along with an error.
+	Poll(ctx context.Context) ([]KafkaRecord, error)
+	// Commit commits, for each partition, the offset of the next record
+	// to consume
+	Commit(ctx context.Context, offsets map[KafkaPartition]int64) error
+	// Seek makes Poll return the records of each partition from the given
+	// offset on, discarding records already fetched
+	Seek(offsets map[KafkaPartition]int64)
+	// HighWatermarks returns the latest known end offset of each partition
+	HighWatermarks() map[KafkaPartition]int64
+	// Close leaves the group
+	Close()
+}
+
+// KafkaConsumerConfig contains the settings of a KafkaConsumer
+type KafkaConsumerConfig struct {
+	// Group is the consumer group, used to label the lag series
+	Group  string
+	Format KafkaFormat
+	// Precision is the timestamp precision of line protocol messages
+	Precision string
+	// CommitInterval is how often consumed offsets are committed
+	CommitInterval time.Duration
+}
+
+// KafkaConsumerStats counts a KafkaConsumer's work
+type KafkaConsumerStats struct {
+	Consumed     int64
+	DecodeErrors int64
+	// WriteErrors counts the times records of a partition failed to be
+	// written to storage and were consumed again
+	WriteErrors int64
+	// Skipped counts metrics dropped because writing them can never
+	// succeed, such as values of another type than their series holds
+	Skipped      int64
+	Commits      int64
+	CommitErrors int64
+	// Lag is the number of records after the last one consumed, by
+	// partition, as of the last commit
+	Lag map[KafkaPartition]int64
+}
+
+// KafkaConsumer ingests metrics from Kafka with at-least-once delivery:
+// offsets are committed only after the records before them have been
+// flushed to storage, so records are redelivered rather than lost when the
+// consumer stops or its partitions move. Records that cannot be decoded or
+// validated are logged and skipped, as are metrics that storage rejects
+// for good, such as values of another type than their series holds.
+//
+// The write failures of each partition's records are tracked apart from
+// those of other partitions and sources. When writing a partition's
+// records failed for another reason, its offset is not committed and it
+// is consumed again from the first uncommitted record after a backoff.
+//
+// Flushed means written to the storage the processor writes to. With a
+// StorageEngine that is the in-memory hot tier; points only reach disk
+// when they are tiered to warm storage, so records whose points are lost
+// in a crash before then are not redelivered.
+//
+// After each commit it writes a kafka_consumer_lag series per assigned
+// partition, labeled with the group, topic and partition.
+type KafkaConsumer struct {
+	processor *StreamProcessor
+	client    KafkaClient
+	config    KafkaConsumerConfig
+	otlp      *OTLPReceiver
+	precision time.Duration
+
+	mu sync.Mutex
+	// pending holds the offsets to commit of partitions with records
+	// ingested since their last commit, and first the offset of the first
+	// of those records; position the next offset to consume of every
+	// assigned partition
+	pending  map[KafkaPartition]int64
+	first    map[KafkaPartition]int64
+	position map[KafkaPartition]int64
+	// trackers collect the write failures of each partition's records
+	trackers   map[KafkaPartition]*writeTracker
+	lastCommit time.Time
+	stats      KafkaConsumerStats
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewKafkaConsumer creates a consumer reading through client
+func NewKafkaConsumer(processor *StreamProcessor, client KafkaClient, config KafkaConsumerConfig) (*KafkaConsumer, error) {
+	if config.Format == "" {
+		config.Format = KafkaFormatJSON
+	}
+	if config.CommitInterval <= 0 {
+		config.CommitInterval = DefaultKafkaCommitInterval
+	}
+	c := &KafkaConsumer{
+		processor: processor,
+		client:    client,
+		config:    config,
+		pending:   make(map[KafkaPartition]int64),
+		first:     make(map[KafkaPartition]int64),
+		position:  make(map[KafkaPartition]int64),
+		trackers:  make(map[KafkaPartition]*writeTracker),
+	}
+	switch config.Format {
+	case KafkaFormatJSON:
+	case KafkaFormatLineProtocol:
+		precision, err := ParsePrecision(config.Precision)
+		if err != nil {
+			return nil, err
+		}
+		c.precision = precision
+	case KafkaFormatOTLP:
+		c.otlp = NewOTLPReceiver(processor)
+	default:
+		return nil, fmt.Errorf("unsupported kafka message format %q", config.Format)
+	}
+	c.stats.Lag = make(map[KafkaPartition]int64)
+
+	client.SetRebalance(KafkaRebalance{
+		Assigned: c.assigned,
+		Revoked:  c.revoked,
+		Lost:     c.lost,
+	})
+	return c, nil
+}
+
+// Start starts consuming
+func (c *KafkaConsumer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.lastCommit = time.Now()
+	go c.run(ctx)
+}
+
+// Stop stops consuming, commits what has been ingested and leaves the group
+func (c *KafkaConsumer) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+	c.mu.Lock()
+	c.commit(nil)
+	c.mu.Unlock()
+	c.client.Close()
+}
+
+// Stats returns the consumer's counters and partition lag
+func (c *KafkaConsumer) Stats() KafkaConsumerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Lag = make(map[KafkaPartition]int64, len(c.stats.Lag))
+	for partition, lag := range c.stats.Lag {
+		stats.Lag[partition] = lag
+	}
+	return stats
+}
+
+func (c *KafkaConsumer) run(ctx context.Context) {
+	defer close(c.done)
+	for ctx.Err() == nil {
+		// Wake up at least every commit interval to commit what was
+		// consumed before the topic went quiet
+		pollCtx, cancel := context.WithTimeout(ctx, c.config.CommitInterval)
+		records, err := c.client.Poll(pollCtx)
+		cancel()
+
+		c.mu.Lock()
+		stopped := c.ingest(records)
+		var failed map[KafkaPartition]int64
+		if !stopped && time.Since(c.lastCommit) >= c.config.CommitInterval {
+			failed = c.commit(nil)
+			if len(failed) > 0 {
+				c.client.Seek(failed)
+			}
+		}
+		c.mu.Unlock()
+		if stopped {
+			log.Printf("Kafka consumer stopped: %v", ErrNotRunning)
+			return
+		}
+
+		// Give storage time to recover before writing the records again
+		if len(failed) > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(kafkaWriteRetryBackoff):
+			}
+		}
+
+		if err != nil && ctx.Err() == nil && !errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Kafka poll error: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(kafkaPollErrorBackoff):
+			}
+		}
+	}
+}
+
+// ingest decodes and ingests records, tracking their offsets for commit.
+// It returns true if the stream processor has stopped, in which case the
+// remaining records are left uncommitted to be redelivered.
+func (c *KafkaConsumer) ingest(records []KafkaRecord) bool {
+	for _, record := range records {
+		partition := KafkaPartition{Topic: record.Topic, Partition: record.Partition}
+		tracker := c.trackers[partition]
+		if tracker == nil {
+			tracker = &writeTracker{}
+			c.trackers[partition] = tracker
+		}
+		err := c.ingestRecord(withWriteTracker(context.Background(), tracker), record)
+		if errors.Is(err, ErrNotRunning) {
+			return true
+		}
+		if err != nil {
+			c.stats.DecodeErrors++
+			log.Printf("Kafka record %s/%d@%d: %v", record.Topic, record.Partition, record.Offset, err)
+		}
+		if _, ok := c.pending[partition]; !ok {
+			c.first[partition] = record.Offset
+		}
+		c.pending[partition] = record.Offset + 1
+		c.position[partition] = record.Offset + 1
+		c.stats.Consumed++
+	}
+	return false
+}
+
+// ingestRecord ingests the metrics of one record, reporting their write
+// failures to the tracker in ctx. An error wrapping ErrNotRunning means
+// none of them were ingested.
+func (c *KafkaConsumer) ingestRecord(ctx context.Context, record KafkaRecord) error {
+	var metrics []MetricData
+	switch c.config.Format {
+	case KafkaFormatJSON:
+		value := bytes.TrimSpace(record.Value)
+		if len(value) > 0 && value[0] == '[' {
+			if err := json.Unmarshal(value, &metrics); err != nil {
+				return fmt.Errorf("invalid JSON: %w", err)
+			}
+		} else {
+			var metric MetricData
+			if err := json.Unmarshal(value, &metric); err != nil {
+				return fmt.Errorf("invalid JSON: %w", err)
+			}
+			metrics = []MetricData{metric}
+		}
+	case KafkaFormatLineProtocol:
+		// Lines without a timestamp take the record's, which brokers set
+		// when producers do not
+		defaultTime := record.Timestamp
+		if defaultTime.IsZero() {
+			defaultTime = time.Now()
+		}
+		var lineErrors LineErrors
+		var err error
+		metrics, lineErrors, err = ParseLineProtocol(bytes.NewReader(record.Value), c.precision, defaultTime)
+		if err != nil {
+			return err
+		}
+		if len(lineErrors) > 0 {
+			defer log.Printf("Kafka record %s/%d@%d: %v", record.Topic, record.Partition, record.Offset, lineErrors)
+		}
+	case KafkaFormatOTLP:
+		parsed, err := DecodeOTLPProto(record.Value)
+		if err != nil {
+			return err
+		}
+		_, err = c.otlp.ingest(ctx, parsed)
+		return err
+	}
+
+	invalid, err := c.processor.ingestMetrics(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%d metrics rejected, first: %w", len(invalid), invalid[0])
+	}
+	return nil
+}
+
+// commit flushes the stream processor and commits the pending offsets of
+// partitions, or of all partitions when nil. Offsets that fail to commit
+// stay pending. Partitions whose records failed to be written are not
+// committed; they are rewound to their first uncommitted record, and
+// returned with its offset for the caller to consume them again from. The
+// caller holds c.mu.
+func (c *KafkaConsumer) commit(partitions []KafkaPartition) map[KafkaPartition]int64 {
+	c.lastCommit = time.Now()
+	offsets := make(map[KafkaPartition]int64)
+	if partitions == nil {
+		for partition, offset := range c.pending {
+			offsets[partition] = offset
+		}
+	} else {
+		for _, partition := range partitions {
+			if offset, ok := c.pending[partition]; ok {
+				offsets[partition] = offset
+			}
+		}
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	// The error Flush returns covers every source; the trackers tell which
+	// of this consumer's records failed
+	c.processor.Flush()
+	failed := make(map[KafkaPartition]int64)
+	for partition := range offsets {
+		skipped, err := c.trackers[partition].take()
+		if skipped > 0 {
+			c.stats.Skipped += int64(skipped)
+			log.Printf("Kafka %s/%d: %d metrics skipped, storage rejected them", partition.Topic, partition.Partition, skipped)
+		}
+		if err != nil {
+			first := c.first[partition]
+			c.stats.WriteErrors++
+			log.Printf("Kafka %s/%d: records from offset %d failed to be written and will be consumed again: %v",
+				partition.Topic, partition.Partition, first, err)
+			failed[partition] = first
+			delete(offsets, partition)
+			delete(c.pending, partition)
+			delete(c.first, partition)
+			c.position[partition] = first
+		}
+	}
+	if len(offsets) == 0 {
+		return failed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaCommitTimeout)
+	defer cancel()
+	if err := c.client.Commit(ctx, offsets); err != nil {
+		c.stats.CommitErrors++
+		log.Printf("Kafka offset commit failed: %v", err)
+		return failed
+	}
+	c.stats.Commits++
+	for partition, offset := range offsets {
+		if c.pending[partition] == offset {
+			delete(c.pending, partition)
+			delete(c.first, partition)
+		}
+	}
+	c.recordLag()
+	return failed
+}
+
+// recordLag updates the lag of assigned partitions and writes their lag
+// series. The caller holds c.mu.
+func (c *KafkaConsumer) recordLag() {
+	now := time.Now()
+	highWatermarks := c.client.HighWatermarks()
+	var metrics []MetricData
+	for partition, position := range c.position {
+		highWatermark, ok := highWatermarks[partition]
+		if !ok {
+			continue
+		}
+		lag := highWatermark - position
+		if lag < 0 {
+			lag = 0
+		}
+		c.stats.Lag[partition] = lag
+		metrics = append(metrics, MetricData{Name: "kafka_consumer_lag", Labels: c.lagLabels(partition), Value: float64(lag), Timestamp: now})
+	}
+	if _, err := c.processor.ingestMetrics(context.Background(), metrics); err != nil {
+		log.Printf("Kafka consumer lag: %v", err)
+	}
+}
+
+func (c *KafkaConsumer) lagLabels(partition KafkaPartition) map[string]string {
+	return map[string]string{
+		"group":     c.config.Group,
+		"topic":     partition.Topic,
+		"partition": strconv.Itoa(int(partition.Partition)),
+	}
+}
+
+// assigned starts tracking newly assigned partitions
+func (c *KafkaConsumer) assigned(partitions []KafkaPartition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, partition := range partitions {
+		if _, ok := c.position[partition]; !ok {
+			c.position[partition] = 0
+		}
+	}
+}
+
+// revoked commits what has been ingested from partitions about to move to
+// another member, so it does not consume those records again
+func (c *KafkaConsumer) revoked(partitions []KafkaPartition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commit(partitions)
+	c.forget(partitions)
+}
+
+// lost forgets partitions without committing; their records since the last
+// commit are redelivered to the new owner
+func (c *KafkaConsumer) lost(partitions []KafkaPartition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forget(partitions)
+}
+
+// forget stops tracking partitions and marks their lag series stale. The
+// caller holds c.mu.
+func (c *KafkaConsumer) forget(partitions []KafkaPartition) {
+	now := time.Now()
+	var markers []MetricData
+	for _, partition := range partitions {
+		delete(c.pending, partition)
+		delete(c.first, partition)
+		delete(c.position, partition)
+		delete(c.trackers, partition)
+		if _, ok := c.stats.Lag[partition]; ok {
+			delete(c.stats.Lag, partition)
+			markers = append(markers, MetricData{Name: "kafka_consumer_lag", Labels: c.lagLabels(partition), Value: storage.StaleNaN, Timestamp: now})
+		}
+	}
+	if _, err := c.processor.ingestMetrics(context.Background(), markers); err != nil {
+		log.Printf("Kafka consumer lag: %v", err)
+	}
+}
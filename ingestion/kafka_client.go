@@ -0,0 +1,160 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// KafkaGroupClient is a KafkaClient backed by a franz-go consumer group
+// member. Rebalances are blocked while a polled batch is processed, and
+// offsets are only committed through Commit.
+type KafkaGroupClient struct {
+	client *kgo.Client
+
+	mu             sync.Mutex
+	rebalance      KafkaRebalance
+	highWatermarks map[KafkaPartition]int64
+}
+
+// NewKafkaGroupClient joins group to consume topics from brokers
+func NewKafkaGroupClient(brokers []string, group string, topics []string) (*KafkaGroupClient, error) {
+	c := &KafkaGroupClient{highWatermarks: make(map[KafkaPartition]int64)}
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumerGroup(group),
+		kgo.ConsumeTopics(topics...),
+		kgo.DisableAutoCommit(),
+		kgo.BlockRebalanceOnPoll(),
+		kgo.OnPartitionsAssigned(func(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+			c.notify(func(r KafkaRebalance) func([]KafkaPartition) { return r.Assigned }, assigned)
+		}),
+		kgo.OnPartitionsRevoked(func(_ context.Context, _ *kgo.Client, revoked map[string][]int32) {
+			c.notify(func(r KafkaRebalance) func([]KafkaPartition) { return r.Revoked }, revoked)
+		}),
+		kgo.OnPartitionsLost(func(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+			c.notify(func(r KafkaRebalance) func([]KafkaPartition) { return r.Lost }, lost)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	c.client = client
+	return c, nil
+}
+
+func (c *KafkaGroupClient) notify(callback func(KafkaRebalance) func([]KafkaPartition), topics map[string][]int32) {
+	c.mu.Lock()
+	fn := callback(c.rebalance)
+	c.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	var partitions []KafkaPartition
+	for topic, ids := range topics {
+		for _, id := range ids {
+			partitions = append(partitions, KafkaPartition{Topic: topic, Partition: id})
+		}
+	}
+	fn(partitions)
+}
+
+// SetRebalance sets the callbacks for partition reassignments
+func (c *KafkaGroupClient) SetRebalance(rebalance KafkaRebalance) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebalance = rebalance
+}
+
+// Poll allows a pending rebalance to proceed, then returns the next records
+func (c *KafkaGroupClient) Poll(ctx context.Context) ([]KafkaRecord, error) {
+	// The previous batch has been processed, so partitions may now move
+	c.client.AllowRebalance()
+	fetches := c.client.PollFetches(ctx)
+
+	var firstErr error
+	fetches.EachError(func(topic string, partition int32, err error) {
+		if firstErr == nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			firstErr = fmt.Errorf("fetch %s/%d: %w", topic, partition, err)
+		}
+	})
+
+	var records []KafkaRecord
+	c.mu.Lock()
+	fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+		c.highWatermarks[KafkaPartition{Topic: p.Topic, Partition: p.Partition}] = p.HighWatermark
+		for _, r := range p.Records {
+			records = append(records, KafkaRecord{
+				Topic:     r.Topic,
+				Partition: r.Partition,
+				Offset:    r.Offset,
+				Key:       r.Key,
+				Value:     r.Value,
+				Timestamp: r.Timestamp,
+			})
+		}
+	})
+	c.mu.Unlock()
+	return records, firstErr
+}
+
+// Commit synchronously commits the offsets of the next records to consume
+func (c *KafkaGroupClient) Commit(ctx context.Context, offsets map[KafkaPartition]int64) error {
+	uncommitted := make(map[string]map[int32]kgo.EpochOffset)
+	for partition, offset := range offsets {
+		if uncommitted[partition.Topic] == nil {
+			uncommitted[partition.Topic] = make(map[int32]kgo.EpochOffset)
+		}
+		uncommitted[partition.Topic][partition.Partition] = kgo.EpochOffset{Epoch: -1, Offset: offset}
+	}
+
+	var commitErr error
+	c.client.CommitOffsetsSync(ctx, uncommitted, func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+		if err != nil {
+			commitErr = err
+			return
+		}
+		for _, topic := range resp.Topics {
+			for _, partition := range topic.Partitions {
+				if commitErr == nil && partition.ErrorCode != 0 {
+					commitErr = fmt.Errorf("commit %s/%d: %w", topic.Topic, partition.Partition, kerr.ErrorForCode(partition.ErrorCode))
+				}
+			}
+		}
+	})
+	return commitErr
+}
+
+// Seek sets the offsets the next fetches of partitions start from. It is
+// called between polls, while rebalances are blocked.
+func (c *KafkaGroupClient) Seek(offsets map[KafkaPartition]int64) {
+	set := make(map[string]map[int32]kgo.EpochOffset)
+	for partition, offset := range offsets {
+		if set[partition.Topic] == nil {
+			set[partition.Topic] = make(map[int32]kgo.EpochOffset)
+		}
+		set[partition.Topic][partition.Partition] = kgo.EpochOffset{Epoch: -1, Offset: offset}
+	}
+	c.client.SetOffsets(set)
+}
+
+// HighWatermarks returns the end offsets seen in the latest fetches
+func (c *KafkaGroupClient) HighWatermarks() map[KafkaPartition]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	highWatermarks := make(map[KafkaPartition]int64, len(c.highWatermarks))
+	for partition, offset := range c.highWatermarks {
+		highWatermarks[partition] = offset
+	}
+	return highWatermarks
+}
+
+// Close leaves the group, revoking its partitions, and closes connections
+func (c *KafkaGroupClient) Close() {
+	c.client.CloseAllowingRebalance()
+}
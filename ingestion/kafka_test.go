@@ -0,0 +1,285 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// fakeKafkaClient delivers batches and rebalances sent to it from Poll, the
+// way a consumer group member does
+type fakeKafkaClient struct {
+	batches chan []KafkaRecord
+	events  chan func(KafkaRebalance)
+
+	mu             sync.Mutex
+	rebalance      KafkaRebalance
+	commits        []map[KafkaPartition]int64
+	seeks          []map[KafkaPartition]int64
+	onCommit       func()
+	highWatermarks map[KafkaPartition]int64
+	closed         bool
+}
+
+func newFakeKafkaClient() *fakeKafkaClient {
+	return &fakeKafkaClient{
+		batches:        make(chan []KafkaRecord),
+		events:         make(chan func(KafkaRebalance)),
+		highWatermarks: make(map[KafkaPartition]int64),
+	}
+}
+
+func (f *fakeKafkaClient) SetRebalance(rebalance KafkaRebalance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rebalance = rebalance
+}
+
+func (f *fakeKafkaClient) Poll(ctx context.Context) ([]KafkaRecord, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case records := <-f.batches:
+		return records, nil
+	case event := <-f.events:
+		f.mu.Lock()
+		rebalance := f.rebalance
+		f.mu.Unlock()
+		event(rebalance)
+		return nil, nil
+	}
+}
+
+func (f *fakeKafkaClient) Commit(ctx context.Context, offsets map[KafkaPartition]int64) error {
+	if f.onCommit != nil {
+		f.onCommit()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commits = append(f.commits, offsets)
+	return nil
+}
+
+func (f *fakeKafkaClient) Seek(offsets map[KafkaPartition]int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seeks = append(f.seeks, offsets)
+}
+
+func (f *fakeKafkaClient) sought() []map[KafkaPartition]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[KafkaPartition]int64(nil), f.seeks...)
+}
+
+func (f *fakeKafkaClient) HighWatermarks() map[KafkaPartition]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	highWatermarks := make(map[KafkaPartition]int64)
+	for partition, offset := range f.highWatermarks {
+		highWatermarks[partition] = offset
+	}
+	return highWatermarks
+}
+
+func (f *fakeKafkaClient) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+}
+
+func (f *fakeKafkaClient) committed() []map[KafkaPartition]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[KafkaPartition]int64(nil), f.commits...)
+}
+
+func TestKafkaConsumer_CommitsAfterFlush(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	// Nothing reaches storage before an explicit flush
+	sp := NewStreamProcessor(hot, 100, 100, time.Hour)
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	client := newFakeKafkaClient()
+	partition := KafkaPartition{Topic: "metrics", Partition: 0}
+	client.highWatermarks[partition] = 10
+	var flushedAtCommit bool
+	client.onCommit = func() {
+		_, flushedAtCommit = latestValue(hot, "cpu", map[string]string{"host": "b"})
+	}
+
+	consumer, err := NewKafkaConsumer(sp, client, KafkaConsumerConfig{Group: "engine", CommitInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+	consumer.Start()
+	client.events <- func(r KafkaRebalance) { r.Assigned([]KafkaPartition{partition}) }
+
+	now := time.Now().Format(time.RFC3339Nano)
+	client.batches <- []KafkaRecord{
+		{Topic: "metrics", Partition: 0, Offset: 5, Value: []byte(`{"name":"cpu","value":1,"timestamp":"` + now + `","labels":{"host":"a"}}`)},
+		{Topic: "metrics", Partition: 0, Offset: 6, Value: []byte(`[{"name":"cpu","value":2,"timestamp":"` + now + `","labels":{"host":"b"}}]`)},
+		{Topic: "metrics", Partition: 0, Offset: 7, Value: []byte(`not json`)},
+	}
+	waitFor(t, "a commit", func() bool { return len(client.committed()) > 0 })
+	consumer.Stop()
+
+	commits := client.committed()
+	if len(commits) != 1 || commits[0][partition] != 8 {
+		t.Fatalf("Expected offset 8 committed once, got %v", commits)
+	}
+	if !flushedAtCommit {
+		t.Error("Expected the records to be flushed to storage before their offsets were committed")
+	}
+	stats := consumer.Stats()
+	if stats.Consumed != 3 || stats.DecodeErrors != 1 || stats.Commits != 1 || stats.Lag[partition] != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	sp.Flush()
+	lagLabels := map[string]string{"group": "engine", "topic": "metrics", "partition": "0"}
+	if lag, ok := latestValue(hot, "kafka_consumer_lag", lagLabels); !ok || lag != 2 {
+		t.Errorf("Expected a lag of 2, got %v", lag)
+	}
+	if !client.closed {
+		t.Error("Expected the client to be closed")
+	}
+}
+
+// flakyWriter fails every write of the metric named bad, and as many
+// writes of other metrics as failures holds
+type flakyWriter struct {
+	hot      *storage.HotStorage
+	failures atomic.Int32
+}
+
+func (w *flakyWriter) AddPoint(seriesID string, labels map[string]string, timestamp time.Time, value float64) error {
+	if seriesID == "bad" || w.failures.Add(-1) >= 0 {
+		return errors.New("disk full")
+	}
+	return w.hot.AddPoint(seriesID, labels, timestamp, value)
+}
+
+func TestKafkaConsumer_WriteFailureRetries(t *testing.T) {
+	writer := &flakyWriter{hot: storage.NewHotStorage(1000, 10000)}
+	writer.failures.Store(1)
+	sp := NewStreamProcessor(writer, 100, 100, time.Hour)
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	client := newFakeKafkaClient()
+	consumer, err := NewKafkaConsumer(sp, client, KafkaConsumerConfig{CommitInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+	consumer.Start()
+	defer consumer.Stop()
+	partition := KafkaPartition{Topic: "metrics", Partition: 0}
+	now := time.Now().Format(time.RFC3339Nano)
+	records := []KafkaRecord{
+		{Topic: "metrics", Partition: 0, Offset: 3, Value: []byte(`{"name":"cpu","value":1,"timestamp":"` + now + `"}`)},
+		// Storage without typed values can never write a string field
+		{Topic: "metrics", Partition: 0, Offset: 4, Value: []byte(`{"name":"state","fields":{"power":"on"},"timestamp":"` + now + `"}`)},
+	}
+
+	// The failed partition is consumed again from its first uncommitted
+	// record rather than committed
+	client.batches <- records
+	waitFor(t, "a rewind", func() bool { return len(client.sought()) > 0 })
+	if seeks := client.sought(); seeks[0][partition] != 3 || len(client.committed()) != 0 {
+		t.Fatalf("Expected a rewind to offset 3 and no commit, got %v and %v", seeks, client.committed())
+	}
+
+	// Write failures of other sources do not hold the partition
+	if err := sp.IngestMetric(MetricData{Name: "bad", Value: 1, Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	client.batches <- records
+	waitFor(t, "a commit", func() bool { return len(client.committed()) > 0 })
+	if commits := client.committed(); commits[0][partition] != 5 {
+		t.Errorf("Expected offset 5 committed, got %v", commits)
+	}
+	if _, ok := latestValue(writer.hot, "cpu", nil); !ok {
+		t.Error("Expected the retried record to be written")
+	}
+	if stats := consumer.Stats(); stats.WriteErrors != 1 || stats.Skipped != 2 || stats.Commits != 1 || stats.Consumed != 4 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestKafkaConsumer_Rebalance(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 100, time.Hour)
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	client := newFakeKafkaClient()
+	p0 := KafkaPartition{Topic: "metrics", Partition: 0}
+	p1 := KafkaPartition{Topic: "metrics", Partition: 1}
+	client.highWatermarks[p0] = 3
+	consumer, err := NewKafkaConsumer(sp, client, KafkaConsumerConfig{
+		Group:          "engine",
+		Format:         KafkaFormatLineProtocol,
+		Precision:      "s",
+		CommitInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+	consumer.Start()
+	client.events <- func(r KafkaRebalance) { r.Assigned([]KafkaPartition{p0, p1}) }
+	client.batches <- []KafkaRecord{
+		{Topic: "metrics", Partition: 0, Offset: 0, Value: []byte("temperature,room=lab value=21.5")},
+		{Topic: "metrics", Partition: 1, Offset: 4, Value: []byte("temperature,room=hall value=19")},
+	}
+
+	// Revoked partitions are committed before they move; lost ones are not
+	client.events <- func(r KafkaRebalance) { r.Revoked([]KafkaPartition{p0}) }
+	client.events <- func(r KafkaRebalance) { r.Lost([]KafkaPartition{p1}) }
+	consumer.Stop()
+
+	commits := client.committed()
+	if len(commits) != 1 || len(commits[0]) != 1 || commits[0][p0] != 1 {
+		t.Fatalf("Expected only partition 0 committed at offset 1, got %v", commits)
+	}
+	if _, ok := latestValue(hot, "temperature", storage.FieldLabels(map[string]string{"room": "lab"}, "value")); !ok {
+		t.Error("Expected the revoked partition's records to be flushed")
+	}
+	sp.Flush()
+	lagLabels := map[string]string{"group": "engine", "topic": "metrics", "partition": "0"}
+	if lag, _ := latestValue(hot, "kafka_consumer_lag", lagLabels); !storage.IsStaleMarker(lag) {
+		t.Errorf("Expected the revoked partition's lag to be marked stale, got %v", lag)
+	}
+	if stats := consumer.Stats(); len(stats.Lag) != 0 {
+		t.Errorf("Expected no partition lag after the partitions moved, got %v", stats.Lag)
+	}
+}
+
+func TestKafkaConsumer_StoppedProcessor(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 100, time.Hour)
+	sp.Start(context.Background())
+	client := newFakeKafkaClient()
+	consumer, err := NewKafkaConsumer(sp, client, KafkaConsumerConfig{CommitInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+	consumer.Start()
+	sp.Stop()
+
+	// Records that could not be ingested must be redelivered
+	now := time.Now().Format(time.RFC3339Nano)
+	client.batches <- []KafkaRecord{{Topic: "metrics", Partition: 0, Offset: 0, Value: []byte(`{"name":"cpu","value":1,"timestamp":"` + now + `"}`)}}
+	consumer.Stop()
+	if commits := client.committed(); len(commits) != 0 {
+		t.Errorf("Expected nothing committed, got %v", commits)
+	}
+
+	if _, err := NewKafkaConsumer(sp, client, KafkaConsumerConfig{Format: "avro"}); err == nil {
+		t.Error("Expected an error for an unsupported format")
+	}
+}
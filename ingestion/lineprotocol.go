@@ -0,0 +1,321 @@
+package ingestion
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// MaxLineProtocolSize bounds the size of a line protocol write, after
+// decompression
+const MaxLineProtocolSize = 32 << 20
+
+// ErrWriteTooLarge is returned when a line protocol write exceeds
+// MaxLineProtocolSize. None of its lines were ingested.
+var ErrWriteTooLarge = errors.New("line protocol write too large")
+
+// LineError reports a line of line protocol that could not be ingested
+type LineError struct {
+	Line int    `json:"line"`
+	Err  string `json:"error"`
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// LineErrors is returned when some lines of a write are rejected. The other
+// lines are still ingested.
+type LineErrors []LineError
+
+func (e LineErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%d lines rejected, first %s", len(e), e[0].Error())
+}
+
+// ParsePrecision parses the precision of line protocol timestamps, in the
+// forms of both the v2 API (ns, us, ms, s) and the v1 API (n, u, ms, s, m, h).
+// An empty precision means nanoseconds.
+func ParsePrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "ns", "n":
+		return time.Nanosecond, nil
+	case "us", "u", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision %q", precision)
+}
+
+// ParseLineProtocol parses InfluxDB line protocol, e.g.
+//
+//	weather,location=us-midwest temperature=82,humidity=71i,raining=false 1465839830100400200
+//
+// Each line becomes a measurement whose tags are labels and whose fields are
+// typed values. Timestamps are read in units of precision; lines without
+// one are given defaultTime. Lines that fail to parse are reported and
+// skipped.
+func ParseLineProtocol(r io.Reader, precision time.Duration, defaultTime time.Time) ([]MetricData, LineErrors, error) {
+	var metrics []MetricData
+	var lineErrors LineErrors
+	err := scanLines(r, func(lineNumber int, line string) {
+		metric, err := parseLine(line, precision, defaultTime)
+		if err != nil {
+			lineErrors = append(lineErrors, LineError{Line: lineNumber, Err: err.Error()})
+			return
+		}
+		metrics = append(metrics, metric)
+	})
+	return metrics, lineErrors, err
+}
+
+// scanLines calls fn with each line that is not blank or a comment
+func scanLines(r io.Reader, fn func(lineNumber int, line string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fn(lineNumber, line)
+	}
+	return scanner.Err()
+}
+
+// Characters escaped with a backslash in each element of a line
+const (
+	measurementEscapes = ", "
+	keyEscapes         = ",= "
+)
+
+func parseLine(line string, precision time.Duration, defaultTime time.Time) (MetricData, error) {
+	metric := MetricData{Labels: make(map[string]string), Fields: make(map[string]storage.FieldValue), Timestamp: defaultTime}
+
+	name, i := scanToken(line, 0, measurementEscapes)
+	if name == "" {
+		return metric, fmt.Errorf("missing measurement")
+	}
+	metric.Name = name
+
+	// Tags up to the first unescaped space
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = scanToken(line, i+1, keyEscapes)
+		if i >= len(line) || line[i] != '=' || key == "" {
+			return metric, fmt.Errorf("invalid tag in %q", name)
+		}
+		value, i = scanToken(line, i+1, keyEscapes)
+		if value == "" {
+			return metric, fmt.Errorf("tag %s has no value", key)
+		}
+		metric.Labels[key] = value
+	}
+	if i >= len(line) || line[i] != ' ' {
+		return metric, fmt.Errorf("missing fields")
+	}
+	i = skipSpaces(line, i)
+
+	// Fields up to the next unescaped space outside a string
+	for {
+		var key string
+		key, i = scanToken(line, i, keyEscapes)
+		if i >= len(line) || line[i] != '=' || key == "" {
+			return metric, fmt.Errorf("invalid field in %q", line)
+		}
+		value, next, err := scanFieldValue(line, i+1)
+		if err != nil {
+			return metric, fmt.Errorf("field %s: %w", key, err)
+		}
+		metric.Fields[key] = value
+		i = next
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+		i++
+	}
+
+	if i < len(line) {
+		if line[i] != ' ' {
+			return metric, fmt.Errorf("unexpected %q after fields", line[i:])
+		}
+		timestamp := strings.TrimSpace(line[i:])
+		if timestamp != "" {
+			t, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return metric, fmt.Errorf("invalid timestamp %q", timestamp)
+			}
+			if t > math.MaxInt64/int64(precision) || t < math.MinInt64/int64(precision) {
+				return metric, fmt.Errorf("timestamp %d out of range", t)
+			}
+			metric.Timestamp = time.Unix(0, t*int64(precision))
+		}
+	}
+	return metric, nil
+}
+
+// scanToken reads an unquoted element up to an unescaped comma, space or
+// equals sign, removing the backslashes before escaped characters
+func scanToken(line string, i int, escapes string) (string, int) {
+	var b strings.Builder
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && (strings.IndexByte(escapes, line[i+1]) >= 0 || line[i+1] == '\\') {
+			i++
+			b.WriteByte(line[i])
+			continue
+		}
+		if c == ',' || c == ' ' || (c == '=' && strings.IndexByte(escapes, '=') >= 0) {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), i
+}
+
+func skipSpaces(line string, i int) int {
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+// scanFieldValue reads a field value: a double-quoted string, an integer
+// with an i or u suffix, a boolean or a float
+func scanFieldValue(line string, i int) (storage.FieldValue, int, error) {
+	if i < len(line) && line[i] == '"' {
+		var b strings.Builder
+		for i++; i < len(line); i++ {
+			c := line[i]
+			if c == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+				i++
+				b.WriteByte(line[i])
+				continue
+			}
+			if c == '"' {
+				return storage.StringValue(b.String()), i + 1, nil
+			}
+			b.WriteByte(c)
+		}
+		return storage.FieldValue{}, i, fmt.Errorf("unterminated string")
+	}
+
+	end := i
+	for end < len(line) && line[end] != ',' && line[end] != ' ' {
+		end++
+	}
+	raw := line[i:end]
+	if raw == "" {
+		return storage.FieldValue{}, end, fmt.Errorf("missing value")
+	}
+
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return storage.BoolValue(true), end, nil
+	case "f", "F", "false", "False", "FALSE":
+		return storage.BoolValue(false), end, nil
+	}
+	switch raw[len(raw)-1] {
+	case 'i':
+		value, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return storage.FieldValue{}, end, fmt.Errorf("invalid integer %q", raw)
+		}
+		return storage.IntValue(value), end, nil
+	case 'u':
+		value, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil || value > math.MaxInt64 {
+			return storage.FieldValue{}, end, fmt.Errorf("invalid unsigned integer %q", raw)
+		}
+		return storage.IntValue(int64(value)), end, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return storage.FieldValue{}, end, fmt.Errorf("invalid value %q", raw)
+	}
+	return storage.FloatValue(value), end, nil
+}
+
+// sizeLimitedReader fails with ErrWriteTooLarge once more than limit bytes
+// have been read
+type sizeLimitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.read += int64(n); l.read > l.limit {
+		return n, ErrWriteTooLarge
+	}
+	return n, err
+}
+
+// IngestLineProtocol ingests InfluxDB line protocol with timestamps in the
+// given precision. Lines that fail to parse or validate are returned as
+// LineErrors; the other lines are still ingested. The lines are queued
+// together once ingestion admits them, waiting up to the block timeout, so
+// an error for which IsRetryable is true means none were ingested. Writes
+// larger than MaxLineProtocolSize fail with ErrWriteTooLarge.
+func (sp *StreamProcessor) IngestLineProtocol(r io.Reader, precision string) error {
+	unit, err := ParsePrecision(precision)
+	if err != nil {
+		return err
+	}
+	r = &sizeLimitedReader{r: io.LimitReader(r, MaxLineProtocolSize+1), limit: MaxLineProtocolSize}
+
+	now := time.Now()
+	var metrics []MetricData
+	var lineErrors LineErrors
+	err = scanLines(r, func(lineNumber int, line string) {
+		metric, err := parseLine(line, unit, now)
+		if err == nil {
+			if err = sp.validator.ValidateMetric(metric); err != nil {
+				err = fmt.Errorf("validation failed: %w", err)
+			}
+		}
+		if err != nil {
+			sp.incrementErrorCount()
+			lineErrors = append(lineErrors, LineError{Line: lineNumber, Err: err.Error()})
+			return
+		}
+		metrics = append(metrics, metric)
+	})
+	if err != nil {
+		sp.incrementErrorCount()
+		return fmt.Errorf("line protocol parsing failed: %w", err)
+	}
+
+	if len(metrics) > 0 {
+		ctx, cancel := sp.requestContext()
+		defer cancel()
+		start := time.Now()
+		err = sp.enqueue(ctx, metrics)
+		sp.intake.observe(time.Since(start))
+		if err != nil {
+			return err
+		}
+	}
+	if len(lineErrors) > 0 {
+		return lineErrors
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	input := `# Telegraf output
+weather,location=us-midwest,season=summer temperature=82,humidity=71i,raining=false,station="north \"A\"" 1465839830100400200
+cpu\,load,host=server\ 01,region\=x=eu\,west usage_idle=98.5,count=3u
+
+bad line without fields
+disk,path=/ free=1i,free_pct= 1465839830
+disk,path=/ used="unterminated
+`
+	now := time.Now()
+	metrics, lineErrors, err := ParseLineProtocol(strings.NewReader(input), time.Nanosecond, now)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Expected 2 measurements, got %+v", metrics)
+	}
+
+	weather := metrics[0]
+	if weather.Name != "weather" || weather.Labels["location"] != "us-midwest" || weather.Labels["season"] != "summer" {
+		t.Errorf("Unexpected measurement: %+v", weather)
+	}
+	if weather.Timestamp.UnixNano() != 1465839830100400200 {
+		t.Errorf("Unexpected timestamp %v", weather.Timestamp.UnixNano())
+	}
+	expected := map[string]storage.FieldValue{
+		"temperature": storage.FloatValue(82),
+		"humidity":    storage.IntValue(71),
+		"raining":     storage.BoolValue(false),
+		"station":     storage.StringValue(`north "A"`),
+	}
+	for field, value := range expected {
+		if weather.Fields[field] != value {
+			t.Errorf("%s: expected %+v, got %+v", field, value, weather.Fields[field])
+		}
+	}
+
+	cpu := metrics[1]
+	if cpu.Name != "cpu,load" || cpu.Labels["host"] != "server 01" || cpu.Labels["region=x"] != "eu,west" {
+		t.Errorf("Unexpected unescaping: %q %q", cpu.Name, cpu.Labels)
+	}
+	if cpu.Fields["count"] != storage.IntValue(3) || !cpu.Timestamp.Equal(now) {
+		t.Errorf("Unexpected unsigned field or default time: %+v", cpu)
+	}
+
+	if len(lineErrors) != 3 || lineErrors[0].Line != 5 || lineErrors[1].Line != 6 || lineErrors[2].Line != 7 {
+		t.Errorf("Expected lines 5 to 7 to be rejected, got %+v", lineErrors)
+	}
+
+	for precision, expected := range map[string]time.Duration{"ns": time.Nanosecond, "us": time.Microsecond, "ms": time.Millisecond, "s": time.Second} {
+		unit, err := ParsePrecision(precision)
+		if err != nil || unit != expected {
+			t.Errorf("%s: expected %v, got %v (%v)", precision, expected, unit, err)
+		}
+		metrics, _, _ := ParseLineProtocol(strings.NewReader("m v=1 1465839830"), unit, now)
+		if len(metrics) != 1 || !metrics[0].Timestamp.Equal(time.Unix(0, 1465839830*int64(expected))) {
+			t.Errorf("%s: unexpected timestamp %+v", precision, metrics)
+		}
+	}
+	if _, err := ParsePrecision("weeks"); err == nil {
+		t.Error("Expected an invalid precision to be rejected")
+	}
+
+	// Integers beyond 2^53 are kept exactly
+	metrics, _, _ = ParseLineProtocol(strings.NewReader("m count=9007199254740993i"), time.Nanosecond, now)
+	if len(metrics) != 1 || metrics[0].Fields["count"] != storage.IntValue(9007199254740993) {
+		t.Errorf("Unexpected integer field %+v", metrics)
+	}
+}
+
+func TestStreamProcessor_IngestLineProtocol(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 10, time.Second)
+	sp.Start(context.Background())
+
+	now := time.Now().Unix()
+	input := fmt.Sprintf("mem,host=a used=10i,free=2.5 %d\nmem,host=a used=\n", now)
+	err := sp.IngestLineProtocol(strings.NewReader(input), "s")
+	lineErrors, ok := err.(LineErrors)
+	if !ok || len(lineErrors) != 1 || lineErrors[0].Line != 2 {
+		t.Fatalf("Expected line 2 to be rejected, got %v", err)
+	}
+	sp.Stop()
+
+	for field, expected := range map[string]float64{"used": 10, "free": 2.5} {
+		key := storage.SeriesKey("mem", storage.FieldLabels(map[string]string{"host": "a"}, field))
+		series, ok := hot.GetSeries(key)
+		if !ok || series.Size() != 1 || series.GetLatest(1)[0].Value != expected {
+			t.Errorf("%s: expected a single point of %v", field, expected)
+		}
+	}
+
+	if err := sp.IngestLineProtocol(strings.NewReader("m v=1"), "d"); err == nil {
+		t.Error("Expected an invalid precision to be rejected")
+	}
+}
@@ -0,0 +1,592 @@
+package ingestion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// MQTTFormat is the encoding of MQTT message payloads
+type MQTTFormat string
+
+const (
+	// MQTTFormatRaw is a bare number, or true or false
+	MQTTFormatRaw MQTTFormat = "raw"
+	// MQTTFormatJSON is a number, an object whose scalar members are the
+	// fields of a measurement, or an array of such objects
+	MQTTFormatJSON MQTTFormat = "json"
+	// MQTTFormatSenML is a SenML (RFC 8428) JSON pack
+	MQTTFormatSenML MQTTFormat = "senml"
+)
+
+const (
+	DefaultMQTTMinBackoff = time.Second
+	DefaultMQTTMaxBackoff = 2 * time.Minute
+)
+
+// senmlRelativeTime is the bound below which SenML times are relative to now
+const senmlRelativeTime = 1 << 28
+
+// MQTTTopicTemplate maps MQTT topics matching a filter to a metric name and
+// labels. A rule is written as
+//
+//	site/+/sensor/+/# -> site, sensor
+//
+// The filter is an MQTT topic filter. The levels matched by + wildcards
+// become labels, named in order by the labels after the arrow; a label
+// named _ drops its level. The remaining levels, including those matched
+// by #, are joined with underscores to form the metric name, so
+// site/berlin/sensor/t1/temperature is written as
+// site_sensor_temperature{site="berlin",sensor="t1"}.
+type MQTTTopicTemplate struct {
+	filter []string
+	labels []string // label name of each + level, "" for other levels
+}
+
+// ParseMQTTTopicTemplate parses a template rule
+func ParseMQTTTopicTemplate(rule string) (*MQTTTopicTemplate, error) {
+	filter, names, _ := strings.Cut(rule, "->")
+	filter = strings.TrimSpace(filter)
+	if err := validateMQTTFilter(filter); err != nil {
+		return nil, fmt.Errorf("invalid mqtt template %q: %w", rule, err)
+	}
+
+	var labels []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			labels = append(labels, name)
+		}
+	}
+
+	t := &MQTTTopicTemplate{filter: strings.Split(filter, "/")}
+	t.labels = make([]string, len(t.filter))
+	wildcards := 0
+	for i, level := range t.filter {
+		if level != "+" {
+			continue
+		}
+		if wildcards < len(labels) {
+			t.labels[i] = labels[wildcards]
+		}
+		wildcards++
+	}
+	if wildcards != len(labels) {
+		return nil, fmt.Errorf("invalid mqtt template %q: %d + wildcards but %d labels", rule, wildcards, len(labels))
+	}
+	return t, nil
+}
+
+// Filter returns the template's topic filter
+func (t *MQTTTopicTemplate) Filter() string {
+	return strings.Join(t.filter, "/")
+}
+
+// Apply maps a topic's levels to a metric name and labels, if the topic
+// matches
+func (t *MQTTTopicTemplate) Apply(levels []string) (string, map[string]string, bool) {
+	if !matchMQTTFilter(t.filter, levels) {
+		return "", nil, false
+	}
+	labels := make(map[string]string)
+	var name []string
+	for i, level := range levels {
+		switch {
+		case i >= len(t.filter) || t.labels[i] == "":
+			name = append(name, level)
+		case t.labels[i] != "_":
+			labels[t.labels[i]] = level
+		}
+	}
+	return strings.Join(name, "_"), labels, true
+}
+
+// validateMQTTFilter checks a topic filter: + must be a whole level and #
+// a whole last level
+func validateMQTTFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty topic filter")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("+ must occupy a whole level")
+		}
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("# must be the whole last level")
+		}
+	}
+	return nil
+}
+
+// matchMQTTFilter reports whether topic levels match a topic filter's
+func matchMQTTFilter(filter, levels []string) bool {
+	for i, level := range filter {
+		if level == "#" {
+			return true
+		}
+		if i >= len(levels) || (level != "+" && level != levels[i]) {
+			return false
+		}
+	}
+	return len(levels) == len(filter)
+}
+
+// MQTTSubscription is a topic filter subscribed to with QoS 1, with the
+// format of its payloads and an optional template for its topics. Topics
+// the template does not match keep all their levels as the metric name.
+type MQTTSubscription struct {
+	Filter   string
+	Format   MQTTFormat
+	Template string
+}
+
+// MQTTMessage is a message received on a subscription. Ack acknowledges a
+// QoS 1 message; unacknowledged messages are redelivered by the broker when
+// the session resumes.
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+	Ack     func()
+}
+
+// MQTTClient is a connection to an MQTT broker
+type MQTTClient interface {
+	// Connect connects to the broker. onLost is called if the connection
+	// is later lost.
+	Connect(ctx context.Context, onLost func(error)) error
+	// Subscribe subscribes to topic filters with QoS 1, delivering their
+	// messages to handler one at a time
+	Subscribe(ctx context.Context, filters []string, handler func(MQTTMessage)) error
+	// Disconnect closes the connection
+	Disconnect()
+}
+
+// MQTTSubscriberConfig contains the settings of an MQTTSubscriber
+type MQTTSubscriberConfig struct {
+	Subscriptions []MQTTSubscription
+	// MinBackoff and MaxBackoff bound the wait before reconnecting, which
+	// doubles after each failed attempt
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// MQTTSubscriberStats counts an MQTTSubscriber's work
+type MQTTSubscriberStats struct {
+	Received     int64
+	DecodeErrors int64
+	Connects     int64
+	Connected    bool
+}
+
+// MQTTSubscriber ingests metrics published to an MQTT broker, typically by
+// IoT devices. Messages are acknowledged once their metrics are buffered
+// by the stream processor, or when they cannot be decoded; messages that
+// arrive while the processor is stopped are left for the broker to
+// redeliver. Lost connections are retried with exponential backoff and
+// the subscriptions renewed.
+type MQTTSubscriber struct {
+	processor     *StreamProcessor
+	client        MQTTClient
+	config        MQTTSubscriberConfig
+	subscriptions []mqttSubscription
+
+	mu    sync.Mutex
+	stats MQTTSubscriberStats
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type mqttSubscription struct {
+	filter   []string
+	format   MQTTFormat
+	template *MQTTTopicTemplate
+}
+
+// NewMQTTSubscriber creates a subscriber receiving through client. It fails
+// when a subscription is invalid.
+func NewMQTTSubscriber(processor *StreamProcessor, client MQTTClient, config MQTTSubscriberConfig) (*MQTTSubscriber, error) {
+	if len(config.Subscriptions) == 0 {
+		return nil, fmt.Errorf("mqtt subscriber needs at least one subscription")
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultMQTTMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = DefaultMQTTMaxBackoff
+		if config.MaxBackoff < config.MinBackoff {
+			config.MaxBackoff = config.MinBackoff
+		}
+	}
+
+	s := &MQTTSubscriber{processor: processor, client: client, config: config}
+	for _, sub := range config.Subscriptions {
+		if err := validateMQTTFilter(sub.Filter); err != nil {
+			return nil, fmt.Errorf("invalid mqtt subscription %q: %w", sub.Filter, err)
+		}
+		parsed := mqttSubscription{filter: strings.Split(sub.Filter, "/"), format: sub.Format}
+		switch parsed.format {
+		case "":
+			parsed.format = MQTTFormatJSON
+		case MQTTFormatRaw, MQTTFormatJSON, MQTTFormatSenML:
+		default:
+			return nil, fmt.Errorf("invalid mqtt subscription %q: unsupported format %q", sub.Filter, sub.Format)
+		}
+		if sub.Template != "" {
+			template, err := ParseMQTTTopicTemplate(sub.Template)
+			if err != nil {
+				return nil, err
+			}
+			parsed.template = template
+		}
+		s.subscriptions = append(s.subscriptions, parsed)
+	}
+	return s, nil
+}
+
+// Start connects and subscribes in the background
+func (s *MQTTSubscriber) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go s.run(ctx)
+}
+
+// Stop disconnects from the broker
+func (s *MQTTSubscriber) Stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+// Stats returns the subscriber's counters
+func (s *MQTTSubscriber) Stats() MQTTSubscriberStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *MQTTSubscriber) run(ctx context.Context) {
+	defer close(s.done)
+	filters := make([]string, len(s.config.Subscriptions))
+	for i, sub := range s.config.Subscriptions {
+		filters[i] = sub.Filter
+	}
+
+	backoff := s.config.MinBackoff
+	for {
+		lost := make(chan error, 1)
+		err := s.client.Connect(ctx, func(err error) {
+			select {
+			case lost <- err:
+			default:
+			}
+		})
+		if err == nil {
+			if err = s.client.Subscribe(ctx, filters, s.handle); err != nil {
+				s.client.Disconnect()
+				err = fmt.Errorf("subscribe: %w", err)
+			}
+		}
+
+		if err == nil {
+			backoff = s.config.MinBackoff
+			s.setConnected(true)
+			select {
+			case <-ctx.Done():
+				s.client.Disconnect()
+				s.setConnected(false)
+				return
+			case err = <-lost:
+				s.setConnected(false)
+				log.Printf("MQTT connection lost: %v", err)
+			}
+		} else if ctx.Err() == nil {
+			log.Printf("MQTT connect failed, retrying in %v: %v", backoff, err)
+		}
+
+		// Jitter spreads the reconnects of many engines after a broker
+		// restart
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > s.config.MaxBackoff {
+			backoff = s.config.MaxBackoff
+		}
+	}
+}
+
+func (s *MQTTSubscriber) setConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Connected = connected
+	if connected {
+		s.stats.Connects++
+	}
+}
+
+// handle decodes and ingests a message with the first subscription whose
+// filter matches its topic
+func (s *MQTTSubscriber) handle(message MQTTMessage) {
+	s.mu.Lock()
+	s.stats.Received++
+	s.mu.Unlock()
+
+	err := s.ingest(message)
+	if errors.Is(err, ErrNotRunning) {
+		// Leave the message for the broker to redeliver
+		return
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.stats.DecodeErrors++
+		s.mu.Unlock()
+		log.Printf("MQTT message on %s: %v", message.Topic, err)
+	}
+	if message.Ack != nil {
+		message.Ack()
+	}
+}
+
+func (s *MQTTSubscriber) ingest(message MQTTMessage) error {
+	levels := strings.Split(message.Topic, "/")
+	for _, sub := range s.subscriptions {
+		if !matchMQTTFilter(sub.filter, levels) {
+			continue
+		}
+		name, labels := strings.Join(levels, "_"), map[string]string{}
+		if sub.template != nil {
+			if n, l, ok := sub.template.Apply(levels); ok {
+				name, labels = n, l
+			}
+		}
+		metrics, err := DecodeMQTTPayload(sub.format, name, labels, message.Payload, time.Now())
+		if err != nil {
+			return err
+		}
+		invalid, err := s.processor.ingestMetrics(context.Background(), metrics)
+		if err != nil {
+			return err
+		}
+		if len(invalid) > 0 {
+			return fmt.Errorf("%d metrics rejected, first: %w", len(invalid), invalid[0])
+		}
+		return nil
+	}
+	return fmt.Errorf("no subscription matches the topic")
+}
+
+// DecodeMQTTPayload decodes a message payload into metrics with the given
+// name and labels. SenML records are named by their own names instead.
+func DecodeMQTTPayload(format MQTTFormat, name string, labels map[string]string, payload []byte, now time.Time) ([]MetricData, error) {
+	if name == "" && format != MQTTFormatSenML {
+		return nil, fmt.Errorf("template leaves no metric name")
+	}
+	switch format {
+	case MQTTFormatRaw:
+		value, err := parseMQTTNumber(string(bytes.TrimSpace(payload)))
+		if err != nil {
+			return nil, err
+		}
+		return []MetricData{{Name: name, Value: value, Timestamp: now, Labels: labels}}, nil
+	case MQTTFormatJSON:
+		return decodeMQTTJSON(name, labels, payload, now)
+	case MQTTFormatSenML:
+		return decodeSenML(labels, payload, now)
+	}
+	return nil, fmt.Errorf("unsupported format %q", format)
+}
+
+func parseMQTTNumber(s string) (float64, error) {
+	if b, err := strconv.ParseBool(s); err == nil {
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return value, nil
+}
+
+// decodeMQTTJSON decodes a JSON number or boolean as a single value, and
+// objects as measurements whose number, boolean and string members are
+// fields. A timestamp or time member, in Unix seconds or RFC 3339, sets
+// the measurement's time; other members are ignored.
+func decodeMQTTJSON(name string, labels map[string]string, payload []byte, now time.Time) ([]MetricData, error) {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	var objects []map[string]interface{}
+	switch v := value.(type) {
+	case json.Number, bool:
+		number, err := parseMQTTNumber(fmt.Sprint(v))
+		if err != nil {
+			return nil, err
+		}
+		return []MetricData{{Name: name, Value: number, Timestamp: now, Labels: labels}}, nil
+	case map[string]interface{}:
+		objects = append(objects, v)
+	case []interface{}:
+		for _, element := range v {
+			object, ok := element.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected an array of objects")
+			}
+			objects = append(objects, object)
+		}
+	default:
+		return nil, fmt.Errorf("expected a number, an object or an array of objects")
+	}
+
+	metrics := make([]MetricData, 0, len(objects))
+	for _, object := range objects {
+		metric := MetricData{Name: name, Timestamp: now, Labels: labels, Fields: make(map[string]storage.FieldValue)}
+		for key, member := range object {
+			if key == "timestamp" || key == "time" {
+				t, err := parseMQTTTime(member)
+				if err != nil {
+					return nil, err
+				}
+				metric.Timestamp = t
+				continue
+			}
+			switch v := member.(type) {
+			case json.Number:
+				number, err := v.Float64()
+				if err != nil {
+					return nil, fmt.Errorf("field %s: invalid number %s", key, v)
+				}
+				metric.Fields[key] = storage.FloatValue(number)
+			case bool:
+				metric.Fields[key] = storage.BoolValue(v)
+			case string:
+				metric.Fields[key] = storage.StringValue(v)
+			}
+		}
+		if len(metric.Fields) == 0 {
+			return nil, fmt.Errorf("object has no number, boolean or string members")
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+func parseMQTTTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case json.Number:
+		seconds, err := v.Float64()
+		if err == nil {
+			return graphiteTime(seconds), nil
+		}
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %v", value)
+}
+
+// senmlRecord is a SenML record, with base fields applying to it and the
+// records after it
+type senmlRecord struct {
+	BaseName  string   `json:"bn"`
+	BaseTime  float64  `json:"bt"`
+	BaseUnit  string   `json:"bu"`
+	BaseValue float64  `json:"bv"`
+	Name      string   `json:"n"`
+	Unit      string   `json:"u"`
+	Value     *float64 `json:"v"`
+	BoolValue *bool    `json:"vb"`
+	Time      float64  `json:"t"`
+}
+
+// decodeSenML resolves a SenML pack into one metric per record with a
+// numeric or boolean value, named by the base name and record name and
+// labeled with its unit. Times below 2^28 are relative to now, as RFC 8428
+// specifies. Records with only string or data values are skipped.
+func decodeSenML(labels map[string]string, payload []byte, now time.Time) ([]MetricData, error) {
+	var records []senmlRecord
+	if err := json.Unmarshal(payload, &records); err != nil {
+		return nil, fmt.Errorf("invalid SenML: %w", err)
+	}
+
+	var metrics []MetricData
+	var base senmlRecord
+	for i, record := range records {
+		if record.BaseName != "" {
+			base.BaseName = record.BaseName
+		}
+		if record.BaseTime != 0 {
+			base.BaseTime = record.BaseTime
+		}
+		if record.BaseUnit != "" {
+			base.BaseUnit = record.BaseUnit
+		}
+		if record.BaseValue != 0 {
+			base.BaseValue = record.BaseValue
+		}
+
+		var value float64
+		switch {
+		case record.Value != nil:
+			value = base.BaseValue + *record.Value
+		case record.BoolValue != nil:
+			if *record.BoolValue {
+				value = 1
+			}
+		default:
+			continue
+		}
+		name := base.BaseName + record.Name
+		if name == "" {
+			return nil, fmt.Errorf("SenML record %d has no name", i)
+		}
+
+		timestamp := now
+		if t := base.BaseTime + record.Time; t >= senmlRelativeTime {
+			timestamp = graphiteTime(t)
+		} else if t != 0 {
+			timestamp = now.Add(time.Duration(t * float64(time.Second)))
+		}
+
+		recordLabels := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			recordLabels[k] = v
+		}
+		unit := record.Unit
+		if unit == "" {
+			unit = base.BaseUnit
+		}
+		if unit != "" {
+			recordLabels["unit"] = unit
+		}
+		metrics = append(metrics, MetricData{Name: name, Value: value, Timestamp: timestamp, Labels: recordLabels})
+	}
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("SenML pack has no numeric or boolean values")
+	}
+	return metrics, nil
+}
@@ -0,0 +1,109 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttDisconnectQuiesce is how long Disconnect waits for in-flight work
+const mqttDisconnectQuiesce = 250 // milliseconds
+
+// MQTTBrokerConfig contains the connection settings of an MQTTBrokerClient
+type MQTTBrokerConfig struct {
+	// Broker is the broker URL, e.g. tcp://localhost:1883 or
+	// ssl://broker:8883
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// CleanSession discards the broker's session on connect. A persistent
+	// session keeps QoS 1 messages published while disconnected.
+	CleanSession   bool
+	KeepAlive      time.Duration
+	ConnectTimeout time.Duration
+}
+
+// MQTTBrokerClient is an MQTTClient backed by the Eclipse Paho client.
+// Paho's own reconnection is disabled so the subscriber controls backoff,
+// and messages are only acknowledged through MQTTMessage.Ack.
+type MQTTBrokerClient struct {
+	config MQTTBrokerConfig
+	client mqtt.Client
+}
+
+// NewMQTTBrokerClient creates a client for a broker
+func NewMQTTBrokerClient(config MQTTBrokerConfig) (*MQTTBrokerClient, error) {
+	if config.Broker == "" {
+		return nil, fmt.Errorf("mqtt client needs a broker URL")
+	}
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("mqtt client needs a client ID")
+	}
+	return &MQTTBrokerClient{config: config}, nil
+}
+
+// Connect connects to the broker, giving up when ctx is done
+func (c *MQTTBrokerClient) Connect(ctx context.Context, onLost func(error)) error {
+	options := mqtt.NewClientOptions().
+		AddBroker(c.config.Broker).
+		SetClientID(c.config.ClientID).
+		SetUsername(c.config.Username).
+		SetPassword(c.config.Password).
+		SetCleanSession(c.config.CleanSession).
+		SetAutoReconnect(false).
+		SetAutoAckDisabled(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) { onLost(err) })
+	if c.config.KeepAlive > 0 {
+		options.SetKeepAlive(c.config.KeepAlive)
+	}
+	if c.config.ConnectTimeout > 0 {
+		options.SetConnectTimeout(c.config.ConnectTimeout)
+	}
+
+	c.client = mqtt.NewClient(options)
+	if err := waitMQTT(ctx, c.client.Connect()); err != nil {
+		return fmt.Errorf("connect to %s: %w", c.config.Broker, err)
+	}
+	return nil
+}
+
+// Subscribe subscribes to filters with QoS 1
+func (c *MQTTBrokerClient) Subscribe(ctx context.Context, filters []string, handler func(MQTTMessage)) error {
+	qos := make(map[string]byte, len(filters))
+	for _, filter := range filters {
+		qos[filter] = 1
+	}
+	token := c.client.SubscribeMultiple(qos, func(_ mqtt.Client, m mqtt.Message) {
+		handler(MQTTMessage{Topic: m.Topic(), Payload: m.Payload(), Ack: m.Ack})
+	})
+	if err := waitMQTT(ctx, token); err != nil {
+		return err
+	}
+	// The broker grants each filter a QoS, or 0x80 to refuse it
+	for filter, granted := range token.(*mqtt.SubscribeToken).Result() {
+		if granted == 0x80 {
+			return fmt.Errorf("broker refused subscription to %s", filter)
+		}
+	}
+	return nil
+}
+
+// Disconnect closes the connection
+func (c *MQTTBrokerClient) Disconnect() {
+	if c.client != nil {
+		c.client.Disconnect(mqttDisconnectQuiesce)
+	}
+}
+
+// waitMQTT waits for a Paho token to complete or ctx to be done
+func waitMQTT(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
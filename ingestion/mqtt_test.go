@@ -0,0 +1,244 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestMQTTTopicTemplate(t *testing.T) {
+	tests := []struct {
+		rule   string
+		topic  []string
+		name   string
+		labels map[string]string
+		match  bool
+	}{
+		{"site/+/sensor/+/temperature -> site, sensor", []string{"site", "berlin", "sensor", "t1", "temperature"},
+			"site_sensor_temperature", map[string]string{"site": "berlin", "sensor": "t1"}, true},
+		{"devices/+/+/# -> device, _", []string{"devices", "d7", "v2", "power", "watts"},
+			"devices_power_watts", map[string]string{"device": "d7"}, true},
+		{"devices/+ -> device", []string{"devices", "d7", "extra"}, "", nil, false},
+		{"devices/#", []string{"other", "d7"}, "", nil, false},
+	}
+	for _, tt := range tests {
+		template, err := ParseMQTTTopicTemplate(tt.rule)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.rule, err)
+		}
+		name, labels, ok := template.Apply(tt.topic)
+		if ok != tt.match || name != tt.name || (ok && !reflect.DeepEqual(labels, tt.labels)) {
+			t.Errorf("%q applied to %v: got %q %v %v", tt.rule, tt.topic, name, labels, ok)
+		}
+	}
+
+	for _, rule := range []string{"", "a/+ -> x, y", "a/b+/c", "a/#/b", "-> x"} {
+		if _, err := ParseMQTTTopicTemplate(rule); err == nil {
+			t.Errorf("Expected an error for %q", rule)
+		}
+	}
+}
+
+func TestDecodeMQTTPayload(t *testing.T) {
+	now := time.Now()
+	labels := map[string]string{"site": "lab"}
+
+	metrics, err := DecodeMQTTPayload(MQTTFormatRaw, "temperature", labels, []byte(" 21.5\n"), now)
+	if err != nil || len(metrics) != 1 || metrics[0].Value != 21.5 || !metrics[0].Timestamp.Equal(now) {
+		t.Errorf("Unexpected raw result %+v, %v", metrics, err)
+	}
+	if _, err := DecodeMQTTPayload(MQTTFormatRaw, "temperature", labels, []byte("warm"), now); err == nil {
+		t.Error("Expected an error for a non-numeric raw payload")
+	}
+
+	metrics, err = DecodeMQTTPayload(MQTTFormatJSON, "env", labels,
+		[]byte(`{"temperature": 21.5, "door_open": true, "state": "ok", "nested": {"x": 1}, "timestamp": 1700000000.5}`), now)
+	if err != nil || len(metrics) != 1 {
+		t.Fatalf("Unexpected JSON result %+v, %v", metrics, err)
+	}
+	fields := metrics[0].Fields
+	if len(fields) != 3 || fields["temperature"] != storage.FloatValue(21.5) || fields["door_open"] != storage.BoolValue(true) ||
+		fields["state"] != storage.StringValue("ok") {
+		t.Errorf("Unexpected fields %+v", fields)
+	}
+	if want := time.Unix(1700000000, 5e8); !metrics[0].Timestamp.Equal(want) {
+		t.Errorf("Expected timestamp %v, got %v", want, metrics[0].Timestamp)
+	}
+	metrics, err = DecodeMQTTPayload(MQTTFormatJSON, "env", labels, []byte(`[{"a": 1}, {"a": 2, "time": "2024-01-02T03:04:05Z"}]`), now)
+	if err != nil || len(metrics) != 2 || metrics[1].Timestamp.Year() != 2024 {
+		t.Errorf("Unexpected JSON array result %+v, %v", metrics, err)
+	}
+	if _, err := DecodeMQTTPayload(MQTTFormatJSON, "env", labels, []byte(`"text"`), now); err == nil {
+		t.Error("Expected an error for a JSON string")
+	}
+
+	// Base fields carry over to later records; small times are relative
+	senml := `[
+		{"bn": "urn:dev:mac:0024befffe804ff1/", "bt": 1700000000, "bu": "Cel", "n": "temp", "v": 21.5},
+		{"n": "humidity", "u": "%RH", "v": 40, "t": 10},
+		{"n": "label", "vs": "kitchen"},
+		{"bn": "", "bt": 0, "n": "door", "vb": true, "t": -5}
+	]`
+	metrics, err = DecodeMQTTPayload(MQTTFormatSenML, "", labels, []byte(senml), now)
+	if err != nil || len(metrics) != 3 {
+		t.Fatalf("Unexpected SenML result %+v, %v", metrics, err)
+	}
+	if m := metrics[0]; m.Name != "urn:dev:mac:0024befffe804ff1/temp" || m.Value != 21.5 || m.Labels["unit"] != "Cel" ||
+		m.Labels["site"] != "lab" || !m.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Unexpected first record %+v", m)
+	}
+	if m := metrics[1]; m.Labels["unit"] != "%RH" || !m.Timestamp.Equal(time.Unix(1700000010, 0)) {
+		t.Errorf("Unexpected second record %+v", m)
+	}
+	if m := metrics[2]; m.Name != "urn:dev:mac:0024befffe804ff1/door" || m.Value != 1 || !m.Timestamp.Equal(time.Unix(1699999995, 0)) {
+		t.Errorf("Unexpected boolean record %+v", m)
+	}
+	metrics, err = DecodeMQTTPayload(MQTTFormatSenML, "", nil, []byte(`[{"n": "uptime", "v": 5, "t": -60}]`), now)
+	if err != nil || !metrics[0].Timestamp.Equal(now.Add(-time.Minute)) {
+		t.Errorf("Expected a time relative to now, got %+v, %v", metrics, err)
+	}
+	if _, err := DecodeMQTTPayload(MQTTFormatSenML, "", nil, []byte(`[{"v": 1}]`), now); err == nil {
+		t.Error("Expected an error for a SenML record without a name")
+	}
+}
+
+// fakeMQTTClient fails its first connects, then delivers messages sent
+// through deliver to the subscribed handler
+type fakeMQTTClient struct {
+	mu          sync.Mutex
+	failures    int
+	connects    int
+	subscribed  []string
+	handler     func(MQTTMessage)
+	onLost      func(error)
+	disconnects int
+}
+
+func (f *fakeMQTTClient) Connect(ctx context.Context, onLost func(error)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connects++
+	if f.connects <= f.failures {
+		return errors.New("connection refused")
+	}
+	f.onLost = onLost
+	return nil
+}
+
+func (f *fakeMQTTClient) Subscribe(ctx context.Context, filters []string, handler func(MQTTMessage)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subscribed = filters
+	f.handler = handler
+	return nil
+}
+
+func (f *fakeMQTTClient) Disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.disconnects++
+	f.handler = nil
+}
+
+// deliver sends a message and reports whether it was acknowledged
+func (f *fakeMQTTClient) deliver(topic, payload string) bool {
+	f.mu.Lock()
+	handler := f.handler
+	f.mu.Unlock()
+	acked := false
+	handler(MQTTMessage{Topic: topic, Payload: []byte(payload), Ack: func() { acked = true }})
+	return acked
+}
+
+func (f *fakeMQTTClient) lose() {
+	f.mu.Lock()
+	onLost := f.onLost
+	f.handler = nil
+	f.mu.Unlock()
+	onLost(errors.New("connection reset"))
+}
+
+func (f *fakeMQTTClient) isSubscribed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.handler != nil
+}
+
+func TestMQTTSubscriber(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 1, time.Second)
+	sp.Start(context.Background())
+
+	client := &fakeMQTTClient{failures: 2}
+	subscriber, err := NewMQTTSubscriber(sp, client, MQTTSubscriberConfig{
+		Subscriptions: []MQTTSubscription{
+			{Filter: "site/+/sensor/+/temperature", Format: MQTTFormatRaw, Template: "site/+/sensor/+/temperature -> site, sensor"},
+			{Filter: "senml/#", Format: MQTTFormatSenML},
+		},
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create subscriber: %v", err)
+	}
+	subscriber.Start()
+	defer subscriber.Stop()
+
+	// Connecting is retried until the broker accepts
+	waitFor(t, "the subscription", client.isSubscribed)
+	if !reflect.DeepEqual(client.subscribed, []string{"site/+/sensor/+/temperature", "senml/#"}) {
+		t.Errorf("Unexpected subscriptions %v", client.subscribed)
+	}
+
+	if !client.deliver("site/berlin/sensor/t1/temperature", "21.5") {
+		t.Error("Expected the message to be acknowledged")
+	}
+	if !client.deliver("site/berlin/sensor/t1/temperature", "warm") {
+		t.Error("Expected an undecodable message to be acknowledged")
+	}
+	client.deliver("senml/kitchen", `[{"n": "humidity", "v": 40}]`)
+
+	// The subscriptions are renewed after the connection is lost
+	client.lose()
+	waitFor(t, "the subscription to be renewed", func() bool {
+		return client.isSubscribed() && subscriber.Stats().Connects == 2
+	})
+	sp.Stop()
+	if client.deliver("site/berlin/sensor/t2/temperature", "19") {
+		t.Error("Expected a message to be left unacknowledged while the processor is stopped")
+	}
+
+	labels := map[string]string{"site": "berlin", "sensor": "t1"}
+	if value, ok := latestValue(hot, "site_sensor_temperature", labels); !ok || value != 21.5 {
+		t.Errorf("Expected the raw value to be stored, got %v", value)
+	}
+	if value, ok := latestValue(hot, "humidity", map[string]string{}); !ok || value != 40 {
+		t.Errorf("Expected the SenML value to be stored, got %v", value)
+	}
+	stats := subscriber.Stats()
+	if stats.Received != 4 || stats.DecodeErrors != 1 || !stats.Connected {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	subscriber.Stop()
+	if client.disconnects != 1 {
+		t.Errorf("Expected a disconnect on stop, got %d", client.disconnects)
+	}
+}
+
+func TestNewMQTTSubscriber_Invalid(t *testing.T) {
+	for name, subscriptions := range map[string][]MQTTSubscription{
+		"none":     nil,
+		"filter":   {{Filter: "a/#/b"}},
+		"format":   {{Filter: "a", Format: "xml"}},
+		"template": {{Filter: "a/+", Template: "a/+ -> x, y"}},
+	} {
+		if _, err := NewMQTTSubscriber(nil, &fakeMQTTClient{}, MQTTSubscriberConfig{Subscriptions: subscriptions}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
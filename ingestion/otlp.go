@@ -0,0 +1,506 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// OTLPKind is the data type of an OTLP metric
+type OTLPKind int
+
+const (
+	OTLPGauge OTLPKind = iota
+	OTLPSum
+	OTLPHistogram
+	OTLPExponentialHistogram
+	OTLPSummary
+)
+
+// OTLPTemporality is the aggregation temporality of sums and histograms
+type OTLPTemporality int
+
+const (
+	OTLPTemporalityUnspecified OTLPTemporality = 0
+	OTLPTemporalityDelta       OTLPTemporality = 1
+	OTLPTemporalityCumulative  OTLPTemporality = 2
+)
+
+// otlpNoRecordedValue is the data point flag marking a series as ended
+const otlpNoRecordedValue = 1
+
+// OTLPMetric is a metric of an OTLP export request. Labels holds the
+// attributes of its resource and instrumentation scope, which each data
+// point's attributes are added to.
+type OTLPMetric struct {
+	Name        string
+	Description string
+	Unit        string
+	Labels      map[string]string
+	Kind        OTLPKind
+	Monotonic   bool
+	Temporality OTLPTemporality
+	Points      []OTLPPoint
+}
+
+// OTLPPoint is a data point of any kind of OTLP metric
+type OTLPPoint struct {
+	Attributes map[string]string
+	StartTime  time.Time
+	Time       time.Time
+	Flags      uint32
+
+	// Value of gauge and sum points
+	Value float64
+
+	// Count and sum of histogram, exponential histogram and summary points
+	Count float64
+	Sum   float64
+
+	// Explicit histogram buckets: BucketCounts[i] observations in
+	// (Bounds[i-1], Bounds[i]], the last bucket being unbounded
+	Bounds       []float64
+	BucketCounts []float64
+
+	// Exponential histogram buckets: bucket i covers (base^i, base^(i+1)]
+	// with base = 2^(2^-Scale); Positive and Negative hold the counts of
+	// buckets starting at their offsets
+	Scale          int32
+	ZeroCount      float64
+	PositiveOffset int32
+	Positive       []float64
+	NegativeOffset int32
+	Negative       []float64
+
+	// Quantiles of summary points
+	Quantiles []OTLPQuantile
+}
+
+// OTLPQuantile is a quantile of a summary point
+type OTLPQuantile struct {
+	Quantile float64
+	Value    float64
+}
+
+// OTLPReceiver maps OTLP metrics onto series, keeping the state needed to
+// convert between temporalities:
+//
+//   - sums are stored cumulatively, as counters are, so delta sums are added
+//     to a running total per series
+//   - histograms are stored as a sketch of each interval's observations, so
+//     cumulative histograms are differenced with the previous point
+//
+// A cumulative series first seen after a restart gives no interval until
+// its second point, unless it started after the receiver did.
+type OTLPReceiver struct {
+	processor *StreamProcessor
+	started   time.Time
+
+	mu         sync.Mutex
+	sums       map[string]*otlpSumState
+	histograms map[string]*otlpHistogramState
+	lastPrune  time.Time
+	// undo holds the state changed by the export being ingested
+	undo *otlpUndo
+}
+
+// otlpUndo records the temporality state of series as it was before an
+// export, so that state can be restored when the export is not ingested
+// and will be retried. A nil entry means the series had no state.
+type otlpUndo struct {
+	sums       map[string]*otlpSumState
+	histograms map[string]*otlpHistogramState
+}
+
+func (u *otlpUndo) saveSum(key string, state *otlpSumState) {
+	if _, ok := u.sums[key]; ok {
+		return
+	}
+	if state != nil {
+		saved := *state
+		state = &saved
+	}
+	u.sums[key] = state
+}
+
+// saveHistogram records a histogram's state, which is replaced rather than
+// changed in place
+func (u *otlpUndo) saveHistogram(key string, state *otlpHistogramState) {
+	if _, ok := u.histograms[key]; !ok {
+		u.histograms[key] = state
+	}
+}
+
+// restore puts the recorded state back into the receiver
+func (u *otlpUndo) restore(r *OTLPReceiver) {
+	for key, state := range u.sums {
+		if state == nil {
+			delete(r.sums, key)
+		} else {
+			r.sums[key] = state
+		}
+	}
+	for key, state := range u.histograms {
+		if state == nil {
+			delete(r.histograms, key)
+		} else {
+			r.histograms[key] = state
+		}
+	}
+}
+
+// otlpStateTTL is how long temporality state is kept for a series that
+// stopped reporting
+const otlpStateTTL = time.Hour
+
+type otlpSumState struct {
+	total    float64
+	lastSeen time.Time
+}
+
+type otlpHistogramState struct {
+	start    time.Time
+	point    OTLPPoint
+	lastSeen time.Time
+}
+
+// NewOTLPReceiver creates a receiver writing through processor
+func NewOTLPReceiver(processor *StreamProcessor) *OTLPReceiver {
+	now := time.Now()
+	return &OTLPReceiver{
+		processor:  processor,
+		started:    now,
+		sums:       make(map[string]*otlpSumState),
+		histograms: make(map[string]*otlpHistogramState),
+		lastPrune:  now,
+	}
+}
+
+// Ingest writes the data points of OTLP metrics and records their metadata,
+// waiting up to the processor's block timeout while ingestion is saturated.
+// It returns the number of points rejected along with the first reason; an
+// error for which IsRetryable is true means the export may be retried.
+func (r *OTLPReceiver) Ingest(metrics []OTLPMetric) (int, error) {
+	ctx, cancel := r.processor.requestContext()
+	defer cancel()
+	return r.ingest(ctx, metrics)
+}
+
+// ingest writes the data points of OTLP metrics, waiting for admission
+// until ctx is done
+func (r *OTLPReceiver) ingest(ctx context.Context, metrics []OTLPMetric) (int, error) {
+	if !r.processor.IsRunning() {
+		return 0, fmt.Errorf("export not ingested: %w", ErrNotRunning)
+	}
+	now := time.Now()
+	var batch []MetricData
+	var rejected int
+	var firstErr error
+	reject := func(err error) {
+		rejected++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	writer, _ := r.processor.storage.(MetadataWriter)
+	// The lock is held until the points are queued, so that the state
+	// changes of an export that is not ingested can be undone
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.undo = &otlpUndo{sums: make(map[string]*otlpSumState), histograms: make(map[string]*otlpHistogramState)}
+	defer func() { r.undo = nil }()
+	for _, metric := range metrics {
+		if metric.Name == "" {
+			rejected += len(metric.Points)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("metric without a name")
+			}
+			continue
+		}
+		if writer != nil {
+			if err := writer.MergeMetadata(metric.Name, otlpMetadata(metric)); err != nil {
+				reject(fmt.Errorf("%s: metadata: %w", metric.Name, err))
+			}
+		}
+		for _, point := range metric.Points {
+			if point.Time.IsZero() {
+				point.Time = now
+			}
+			metrics, err := r.convert(metric, point, now)
+			if err != nil {
+				reject(fmt.Errorf("%s: %w", metric.Name, err))
+				continue
+			}
+			batch = append(batch, metrics...)
+		}
+	}
+
+	invalid, err := r.processor.ingestMetrics(ctx, batch)
+	if err != nil {
+		// Converting temporalities updated per-series state, which the
+		// retried export must not be added to twice
+		r.undo.restore(r)
+		return 0, fmt.Errorf("export not ingested: %w", err)
+	}
+	for _, e := range invalid {
+		reject(e)
+	}
+	if now.Sub(r.lastPrune) > otlpStateTTL {
+		r.prune(now)
+	}
+	if rejected > 0 {
+		return rejected, fmt.Errorf("%d data points rejected, first: %w", rejected, firstErr)
+	}
+	return 0, nil
+}
+
+// convert maps one data point to the samples written for it
+func (r *OTLPReceiver) convert(metric OTLPMetric, point OTLPPoint, now time.Time) ([]MetricData, error) {
+	labels := make(map[string]string, len(metric.Labels)+len(point.Attributes))
+	for name, value := range metric.Labels {
+		labels[name] = value
+	}
+	for name, value := range point.Attributes {
+		labels[name] = value
+	}
+	sample := func(name string, labels map[string]string, value float64) MetricData {
+		return MetricData{Name: name, Value: value, Timestamp: point.Time, Labels: labels}
+	}
+	stale := point.Flags&otlpNoRecordedValue != 0
+
+	switch metric.Kind {
+	case OTLPGauge:
+		if stale {
+			return []MetricData{sample(metric.Name, labels, storage.StaleNaN)}, nil
+		}
+		return []MetricData{sample(metric.Name, labels, point.Value)}, nil
+
+	case OTLPSum:
+		key := storage.SeriesKey(metric.Name, labels)
+		r.undo.saveSum(key, r.sums[key])
+		if stale {
+			delete(r.sums, key)
+			return []MetricData{sample(metric.Name, labels, storage.StaleNaN)}, nil
+		}
+		value := point.Value
+		if metric.Temporality == OTLPTemporalityDelta {
+			state, ok := r.sums[key]
+			if !ok {
+				state = &otlpSumState{}
+				r.sums[key] = state
+			}
+			state.total += point.Value
+			state.lastSeen = now
+			value = state.total
+		}
+		return []MetricData{sample(metric.Name, labels, value)}, nil
+
+	case OTLPHistogram, OTLPExponentialHistogram:
+		key := storage.SeriesKey(metric.Name, labels)
+		r.undo.saveHistogram(key, r.histograms[key])
+		if stale {
+			delete(r.histograms, key)
+			return nil, nil
+		}
+		if metric.Temporality == OTLPTemporalityCumulative {
+			var ok bool
+			if point, ok = r.histogramDelta(key, point, now); !ok {
+				return nil, nil
+			}
+		}
+		if point.Count == 0 {
+			return nil, nil
+		}
+		sketch, err := otlpSketch(metric.Kind, point)
+		if err != nil {
+			return nil, err
+		}
+		return []MetricData{{Name: metric.Name, Timestamp: point.Time, Labels: labels, Sketch: sketch}}, nil
+
+	case OTLPSummary:
+		if stale {
+			return nil, nil
+		}
+		metrics := []MetricData{
+			sample(metric.Name+"_sum", labels, point.Sum),
+			sample(metric.Name+"_count", labels, point.Count),
+		}
+		for _, q := range point.Quantiles {
+			quantileLabels := make(map[string]string, len(labels)+1)
+			for name, value := range labels {
+				quantileLabels[name] = value
+			}
+			quantileLabels["quantile"] = fmt.Sprint(q.Quantile)
+			metrics = append(metrics, sample(metric.Name, quantileLabels, q.Value))
+		}
+		return metrics, nil
+	}
+	return nil, fmt.Errorf("unsupported metric kind %d", metric.Kind)
+}
+
+// histogramDelta returns the observations of a cumulative histogram point
+// since the series' previous point. A point whose counts went down, whose
+// buckets changed or whose start time moved is a reset and counts from its
+// start. The first point of a series is only used as a baseline unless the
+// series started after the receiver.
+func (r *OTLPReceiver) histogramDelta(key string, point OTLPPoint, now time.Time) (OTLPPoint, bool) {
+	state, ok := r.histograms[key]
+	r.histograms[key] = &otlpHistogramState{start: point.StartTime, point: point, lastSeen: now}
+	if !ok {
+		return point, !point.StartTime.IsZero() && !point.StartTime.Before(r.started)
+	}
+	if !point.StartTime.Equal(state.start) {
+		return point, true
+	}
+	delta, ok := subtractHistogram(point, state.point)
+	if !ok {
+		return point, true
+	}
+	return delta, true
+}
+
+// subtractHistogram returns the counts of a minus those of b, or false when
+// b is not an earlier state of the same histogram
+func subtractHistogram(a, b OTLPPoint) (OTLPPoint, bool) {
+	if a.Count < b.Count || len(a.Bounds) != len(b.Bounds) || a.Scale != b.Scale {
+		return a, false
+	}
+	for i := range a.Bounds {
+		if a.Bounds[i] != b.Bounds[i] {
+			return a, false
+		}
+	}
+
+	delta := a
+	delta.Count -= b.Count
+	delta.Sum -= b.Sum
+	delta.ZeroCount -= b.ZeroCount
+	if delta.ZeroCount < 0 {
+		return a, false
+	}
+	var ok bool
+	if delta.BucketCounts, ok = subtractCounts(a.BucketCounts, 0, b.BucketCounts, 0); !ok {
+		return a, false
+	}
+	if delta.Positive, ok = subtractCounts(a.Positive, a.PositiveOffset, b.Positive, b.PositiveOffset); !ok {
+		return a, false
+	}
+	if delta.Negative, ok = subtractCounts(a.Negative, a.NegativeOffset, b.Negative, b.NegativeOffset); !ok {
+		return a, false
+	}
+	return delta, true
+}
+
+// subtractCounts subtracts bucket counts b, starting at bucket offsetB,
+// from counts a starting at offsetA. The result starts at offsetA; b must
+// not have counts outside a's buckets.
+func subtractCounts(a []float64, offsetA int32, b []float64, offsetB int32) ([]float64, bool) {
+	result := append([]float64(nil), a...)
+	for i, count := range b {
+		j := int(offsetB) + i - int(offsetA)
+		if j < 0 || j >= len(result) {
+			if count != 0 {
+				return nil, false
+			}
+			continue
+		}
+		if result[j] -= count; result[j] < 0 {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+// otlpSketch builds a sketch of a histogram point's observations
+func otlpSketch(kind OTLPKind, point OTLPPoint) (*storage.Sketch, error) {
+	sketch, err := storage.NewSketch(storage.DefaultSketchAccuracy)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == OTLPHistogram {
+		if len(point.BucketCounts) != len(point.Bounds)+1 {
+			return nil, fmt.Errorf("%d bucket counts for %d bounds", len(point.BucketCounts), len(point.Bounds))
+		}
+		for i, n := range point.BucketCounts {
+			lower, upper := math.Inf(-1), math.Inf(1)
+			if i > 0 {
+				lower = point.Bounds[i-1]
+			}
+			if i < len(point.Bounds) {
+				upper = point.Bounds[i]
+			}
+			if n > 0 && len(point.Bounds) == 0 {
+				// A single unbounded bucket says nothing of the values;
+				// place them at their mean
+				if err := sketch.AddCount(point.Sum/point.Count, n); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := sketch.AddBucket(lower, upper, n); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		base := math.Exp2(math.Exp2(-float64(point.Scale)))
+		for i, n := range point.Positive {
+			index := float64(int(point.PositiveOffset) + i)
+			if err := sketch.AddBucket(math.Pow(base, index), math.Pow(base, index+1), n); err != nil {
+				return nil, err
+			}
+		}
+		for i, n := range point.Negative {
+			index := float64(int(point.NegativeOffset) + i)
+			if err := sketch.AddBucket(-math.Pow(base, index+1), -math.Pow(base, index), n); err != nil {
+				return nil, err
+			}
+		}
+		if err := sketch.AddCount(0, point.ZeroCount); err != nil {
+			return nil, err
+		}
+	}
+	sketch.SetSum(point.Sum)
+	return sketch, nil
+}
+
+// otlpMetadata returns the metadata recorded for an OTLP metric
+func otlpMetadata(metric OTLPMetric) storage.Metadata {
+	md := storage.Metadata{Help: metric.Description}
+	if metric.Unit != "1" {
+		md.Unit = metric.Unit
+	}
+	switch metric.Kind {
+	case OTLPGauge:
+		md.Type = storage.MetricTypeGauge
+	case OTLPSum:
+		md.Type = storage.MetricTypeGauge
+		if metric.Monotonic {
+			md.Type = storage.MetricTypeCounter
+		}
+	case OTLPHistogram, OTLPExponentialHistogram:
+		md.Type = storage.MetricTypeHistogram
+	case OTLPSummary:
+		md.Type = storage.MetricTypeSummary
+	}
+	return md
+}
+
+// prune drops the state of series not seen for otlpStateTTL
+func (r *OTLPReceiver) prune(now time.Time) {
+	for key, state := range r.sums {
+		if now.Sub(state.lastSeen) > otlpStateTTL {
+			delete(r.sums, key)
+		}
+	}
+	for key, state := range r.histograms {
+		if now.Sub(state.lastSeen) > otlpStateTTL {
+			delete(r.histograms, key)
+		}
+	}
+	r.lastPrune = now
+}
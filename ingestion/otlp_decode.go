@@ -0,0 +1,729 @@
+package ingestion
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MaxOTLPRequestSize is the largest OTLP export request accepted, after
+// decompression
+const MaxOTLPRequestSize = 32 << 20
+
+// DecodeOTLPProto decodes a protobuf ExportMetricsServiceRequest of the
+// opentelemetry.proto.collector.metrics.v1 package
+func DecodeOTLPProto(data []byte) ([]OTLPMetric, error) {
+	var metrics []OTLPMetric
+	err := parseProtoFields(data, func(f protoField) error {
+		if f.num != 1 || f.typ != protowire.BytesType {
+			return nil
+		}
+		resourceMetrics, err := decodeOTLPResourceMetrics(f.bytes)
+		if err != nil {
+			return fmt.Errorf("resource_metrics: %w", err)
+		}
+		metrics = append(metrics, resourceMetrics...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid export request: %w", err)
+	}
+	return metrics, nil
+}
+
+func decodeOTLPResourceMetrics(data []byte) ([]OTLPMetric, error) {
+	resource := make(map[string]string)
+	var scopes [][]byte
+	err := parseProtoFields(data, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			return parseProtoFields(f.bytes, func(f protoField) error {
+				if f.num == 1 && f.typ == protowire.BytesType {
+					return decodeOTLPKeyValue(f.bytes, resource)
+				}
+				return nil
+			})
+		case 2:
+			scopes = append(scopes, f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []OTLPMetric
+	for _, scope := range scopes {
+		labels := make(map[string]string, len(resource)+2)
+		for name, value := range resource {
+			labels[name] = value
+		}
+		var encoded [][]byte
+		err := parseProtoFields(scope, func(f protoField) error {
+			if f.typ != protowire.BytesType {
+				return nil
+			}
+			switch f.num {
+			case 1:
+				return decodeOTLPScope(f.bytes, labels)
+			case 2:
+				encoded = append(encoded, f.bytes)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scope_metrics: %w", err)
+		}
+		for _, data := range encoded {
+			metric, err := decodeOTLPMetric(data)
+			if err != nil {
+				return nil, fmt.Errorf("metric %q: %w", metric.Name, err)
+			}
+			metric.Labels = labels
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics, nil
+}
+
+func decodeOTLPScope(data []byte, labels map[string]string) error {
+	return parseProtoFields(data, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			setOTLPLabel(labels, "otel_scope_name", string(f.bytes))
+		case 2:
+			setOTLPLabel(labels, "otel_scope_version", string(f.bytes))
+		case 3:
+			return decodeOTLPKeyValue(f.bytes, labels)
+		}
+		return nil
+	})
+}
+
+func decodeOTLPMetric(data []byte) (OTLPMetric, error) {
+	var metric OTLPMetric
+	var points [][]byte
+	err := parseProtoFields(data, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			metric.Name = string(f.bytes)
+		case 2:
+			metric.Description = string(f.bytes)
+		case 3:
+			metric.Unit = string(f.bytes)
+		case 5, 7, 9, 10, 11:
+			metric.Kind = map[protowire.Number]OTLPKind{
+				5: OTLPGauge, 7: OTLPSum, 9: OTLPHistogram, 10: OTLPExponentialHistogram, 11: OTLPSummary,
+			}[f.num]
+			points = nil
+			return parseProtoFields(f.bytes, func(f protoField) error {
+				switch {
+				case f.num == 1 && f.typ == protowire.BytesType:
+					points = append(points, f.bytes)
+				case f.num == 2 && f.typ == protowire.VarintType && metric.Kind != OTLPGauge && metric.Kind != OTLPSummary:
+					metric.Temporality = OTLPTemporality(f.number)
+				case f.num == 3 && f.typ == protowire.VarintType && metric.Kind == OTLPSum:
+					metric.Monotonic = f.number != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return metric, err
+	}
+
+	for _, data := range points {
+		var point OTLPPoint
+		var err error
+		switch metric.Kind {
+		case OTLPGauge, OTLPSum:
+			point, err = decodeOTLPNumberPoint(data)
+		case OTLPHistogram:
+			point, err = decodeOTLPHistogramPoint(data)
+		case OTLPExponentialHistogram:
+			point, err = decodeOTLPExponentialPoint(data)
+		case OTLPSummary:
+			point, err = decodeOTLPSummaryPoint(data)
+		}
+		if err != nil {
+			return metric, fmt.Errorf("data point %d: %w", len(metric.Points), err)
+		}
+		metric.Points = append(metric.Points, point)
+	}
+	return metric, nil
+}
+
+// decodeOTLPPointCommon decodes the start and end times, which all kinds of
+// data point number alike
+func decodeOTLPPointCommon(point *OTLPPoint, f protoField) {
+	if f.typ != protowire.Fixed64Type {
+		return
+	}
+	switch f.num {
+	case 2:
+		point.StartTime = otlpTime(f.number)
+	case 3:
+		point.Time = otlpTime(f.number)
+	}
+}
+
+func decodeOTLPNumberPoint(data []byte) (OTLPPoint, error) {
+	point := OTLPPoint{Attributes: make(map[string]string)}
+	err := parseProtoFields(data, func(f protoField) error {
+		decodeOTLPPointCommon(&point, f)
+		switch {
+		case f.num == 7 && f.typ == protowire.BytesType:
+			return decodeOTLPKeyValue(f.bytes, point.Attributes)
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			point.Value = math.Float64frombits(f.number)
+		case f.num == 6 && f.typ == protowire.Fixed64Type:
+			point.Value = float64(int64(f.number))
+		case f.num == 8 && f.typ == protowire.VarintType:
+			point.Flags = uint32(f.number)
+		}
+		return nil
+	})
+	return point, err
+}
+
+func decodeOTLPHistogramPoint(data []byte) (OTLPPoint, error) {
+	point := OTLPPoint{Attributes: make(map[string]string)}
+	err := parseProtoFields(data, func(f protoField) error {
+		decodeOTLPPointCommon(&point, f)
+		switch {
+		case f.num == 9 && f.typ == protowire.BytesType:
+			return decodeOTLPKeyValue(f.bytes, point.Attributes)
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			point.Count = float64(f.number)
+		case f.num == 5 && f.typ == protowire.Fixed64Type:
+			point.Sum = math.Float64frombits(f.number)
+		case f.num == 6:
+			counts, err := protoRepeated(f, protowire.Fixed64Type)
+			for _, n := range counts {
+				point.BucketCounts = append(point.BucketCounts, float64(n))
+			}
+			return err
+		case f.num == 7:
+			bounds, err := protoRepeated(f, protowire.Fixed64Type)
+			for _, bits := range bounds {
+				point.Bounds = append(point.Bounds, math.Float64frombits(bits))
+			}
+			return err
+		case f.num == 10 && f.typ == protowire.VarintType:
+			point.Flags = uint32(f.number)
+		}
+		return nil
+	})
+	return point, err
+}
+
+func decodeOTLPExponentialPoint(data []byte) (OTLPPoint, error) {
+	point := OTLPPoint{Attributes: make(map[string]string)}
+	err := parseProtoFields(data, func(f protoField) error {
+		decodeOTLPPointCommon(&point, f)
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			return decodeOTLPKeyValue(f.bytes, point.Attributes)
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			point.Count = float64(f.number)
+		case f.num == 5 && f.typ == protowire.Fixed64Type:
+			point.Sum = math.Float64frombits(f.number)
+		case f.num == 6 && f.typ == protowire.VarintType:
+			point.Scale = int32(protowire.DecodeZigZag(f.number))
+		case f.num == 7 && f.typ == protowire.Fixed64Type:
+			point.ZeroCount = float64(f.number)
+		case f.num == 8 && f.typ == protowire.BytesType:
+			var err error
+			point.PositiveOffset, point.Positive, err = decodeOTLPBuckets(f.bytes)
+			return err
+		case f.num == 9 && f.typ == protowire.BytesType:
+			var err error
+			point.NegativeOffset, point.Negative, err = decodeOTLPBuckets(f.bytes)
+			return err
+		case f.num == 10 && f.typ == protowire.VarintType:
+			point.Flags = uint32(f.number)
+		}
+		return nil
+	})
+	return point, err
+}
+
+func decodeOTLPBuckets(data []byte) (int32, []float64, error) {
+	var offset int32
+	var counts []float64
+	err := parseProtoFields(data, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.VarintType:
+			offset = int32(protowire.DecodeZigZag(f.number))
+		case f.num == 2:
+			values, err := protoRepeated(f, protowire.VarintType)
+			for _, n := range values {
+				counts = append(counts, float64(n))
+			}
+			return err
+		}
+		return nil
+	})
+	return offset, counts, err
+}
+
+func decodeOTLPSummaryPoint(data []byte) (OTLPPoint, error) {
+	point := OTLPPoint{Attributes: make(map[string]string)}
+	err := parseProtoFields(data, func(f protoField) error {
+		decodeOTLPPointCommon(&point, f)
+		switch {
+		case f.num == 7 && f.typ == protowire.BytesType:
+			return decodeOTLPKeyValue(f.bytes, point.Attributes)
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			point.Count = float64(f.number)
+		case f.num == 5 && f.typ == protowire.Fixed64Type:
+			point.Sum = math.Float64frombits(f.number)
+		case f.num == 6 && f.typ == protowire.BytesType:
+			var q OTLPQuantile
+			err := parseProtoFields(f.bytes, func(f protoField) error {
+				switch {
+				case f.num == 1 && f.typ == protowire.Fixed64Type:
+					q.Quantile = math.Float64frombits(f.number)
+				case f.num == 2 && f.typ == protowire.Fixed64Type:
+					q.Value = math.Float64frombits(f.number)
+				}
+				return nil
+			})
+			point.Quantiles = append(point.Quantiles, q)
+			return err
+		case f.num == 8 && f.typ == protowire.VarintType:
+			point.Flags = uint32(f.number)
+		}
+		return nil
+	})
+	return point, err
+}
+
+// protoRepeated returns the values of a repeated scalar field of wire type
+// typ, which encoders may send packed or as one field per value
+func protoRepeated(f protoField, typ protowire.Type) ([]uint64, error) {
+	if f.typ == typ {
+		return []uint64{f.number}, nil
+	}
+	if f.typ != protowire.BytesType {
+		return nil, nil
+	}
+	var values []uint64
+	data := f.bytes
+	for len(data) > 0 {
+		var v uint64
+		var n int
+		if typ == protowire.Fixed64Type {
+			v, n = protowire.ConsumeFixed64(data)
+		} else {
+			v, n = protowire.ConsumeVarint(data)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+// decodeOTLPKeyValue decodes an attribute into labels
+func decodeOTLPKeyValue(data []byte, labels map[string]string) error {
+	var key string
+	var value interface{}
+	err := parseProtoFields(data, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			key = string(f.bytes)
+		case 2:
+			var err error
+			value, err = decodeOTLPAnyValue(f.bytes)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	setOTLPLabel(labels, key, otlpAttributeString(value))
+	return nil
+}
+
+// decodeOTLPAnyValue decodes an AnyValue to a string, bool, int64, float64,
+// []byte, []interface{} or map[string]interface{}
+func decodeOTLPAnyValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := parseProtoFields(data, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			value = string(f.bytes)
+		case f.num == 2 && f.typ == protowire.VarintType:
+			value = f.number != 0
+		case f.num == 3 && f.typ == protowire.VarintType:
+			value = int64(f.number)
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			value = math.Float64frombits(f.number)
+		case f.num == 5 && f.typ == protowire.BytesType:
+			values := []interface{}{}
+			err := parseProtoFields(f.bytes, func(f protoField) error {
+				if f.num != 1 || f.typ != protowire.BytesType {
+					return nil
+				}
+				v, err := decodeOTLPAnyValue(f.bytes)
+				values = append(values, v)
+				return err
+			})
+			value = values
+			return err
+		case f.num == 6 && f.typ == protowire.BytesType:
+			values := make(map[string]interface{})
+			err := parseProtoFields(f.bytes, func(f protoField) error {
+				if f.num != 1 || f.typ != protowire.BytesType {
+					return nil
+				}
+				var key string
+				var v interface{}
+				err := parseProtoFields(f.bytes, func(f protoField) error {
+					if f.typ != protowire.BytesType {
+						return nil
+					}
+					var err error
+					switch f.num {
+					case 1:
+						key = string(f.bytes)
+					case 2:
+						v, err = decodeOTLPAnyValue(f.bytes)
+					}
+					return err
+				})
+				values[key] = v
+				return err
+			})
+			value = values
+			return err
+		case f.num == 7 && f.typ == protowire.BytesType:
+			value = append([]byte{}, f.bytes...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// otlpAttributeString renders an attribute value as a label value; arrays
+// and maps are rendered as JSON and bytes as base64
+func otlpAttributeString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+// setOTLPLabel sets a label unless its name or value is empty
+func setOTLPLabel(labels map[string]string, name, value string) {
+	if name != "" && value != "" {
+		labels[name] = value
+	}
+}
+
+// otlpTime converts a time in nanoseconds since the epoch; zero means unset
+func otlpTime(nanos uint64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(nanos))
+}
+
+// OTLP JSON follows the protobuf JSON mapping: camelCase field names, 64-bit
+// integers as strings or numbers and non-finite doubles as strings
+
+type otlpJSONRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Scope struct {
+				Name       string             `json:"name"`
+				Version    string             `json:"version"`
+				Attributes []otlpJSONKeyValue `json:"attributes"`
+			} `json:"scope"`
+			Metrics []otlpJSONMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONAnyValue struct {
+	StringValue *string        `json:"stringValue"`
+	BoolValue   *bool          `json:"boolValue"`
+	IntValue    *otlpJSONInt   `json:"intValue"`
+	DoubleValue *otlpJSONFloat `json:"doubleValue"`
+	BytesValue  []byte         `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []otlpJSONAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+type otlpJSONMetric struct {
+	Name                 string        `json:"name"`
+	Description          string        `json:"description"`
+	Unit                 string        `json:"unit"`
+	Gauge                *otlpJSONData `json:"gauge"`
+	Sum                  *otlpJSONData `json:"sum"`
+	Histogram            *otlpJSONData `json:"histogram"`
+	ExponentialHistogram *otlpJSONData `json:"exponentialHistogram"`
+	Summary              *otlpJSONData `json:"summary"`
+}
+
+type otlpJSONData struct {
+	DataPoints             []otlpJSONPoint     `json:"dataPoints"`
+	AggregationTemporality otlpJSONTemporality `json:"aggregationTemporality"`
+	IsMonotonic            bool                `json:"isMonotonic"`
+}
+
+type otlpJSONPoint struct {
+	Attributes        []otlpJSONKeyValue `json:"attributes"`
+	StartTimeUnixNano otlpJSONInt        `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpJSONInt        `json:"timeUnixNano"`
+	AsDouble          *otlpJSONFloat     `json:"asDouble"`
+	AsInt             *otlpJSONInt       `json:"asInt"`
+	Flags             uint32             `json:"flags"`
+	Count             otlpJSONInt        `json:"count"`
+	Sum               otlpJSONFloat      `json:"sum"`
+	BucketCounts      []otlpJSONInt      `json:"bucketCounts"`
+	ExplicitBounds    []otlpJSONFloat    `json:"explicitBounds"`
+	Scale             int32              `json:"scale"`
+	ZeroCount         otlpJSONInt        `json:"zeroCount"`
+	Positive          otlpJSONBuckets    `json:"positive"`
+	Negative          otlpJSONBuckets    `json:"negative"`
+	QuantileValues    []struct {
+		Quantile otlpJSONFloat `json:"quantile"`
+		Value    otlpJSONFloat `json:"value"`
+	} `json:"quantileValues"`
+}
+
+type otlpJSONBuckets struct {
+	Offset       int32         `json:"offset"`
+	BucketCounts []otlpJSONInt `json:"bucketCounts"`
+}
+
+// otlpJSONInt is a 64-bit integer sent as a JSON string or number
+type otlpJSONInt int64
+
+func (i *otlpJSONInt) UnmarshalJSON(data []byte) error {
+	s := string(bytes.Trim(data, `"`))
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*i = otlpJSONInt(v)
+		return nil
+	}
+	if v, err := strconv.ParseUint(s, 10, 64); err == nil {
+		*i = otlpJSONInt(v)
+		return nil
+	}
+	return fmt.Errorf("invalid integer %s", data)
+}
+
+// otlpJSONFloat is a double sent as a JSON number, or as the strings "NaN",
+// "Infinity" and "-Infinity"
+type otlpJSONFloat float64
+
+func (f *otlpJSONFloat) UnmarshalJSON(data []byte) error {
+	s := string(bytes.Trim(data, `"`))
+	switch s {
+	case "NaN":
+		*f = otlpJSONFloat(math.NaN())
+	case "Infinity":
+		*f = otlpJSONFloat(math.Inf(1))
+	case "-Infinity":
+		*f = otlpJSONFloat(math.Inf(-1))
+	default:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %s", data)
+		}
+		*f = otlpJSONFloat(v)
+	}
+	return nil
+}
+
+// otlpJSONTemporality is an aggregation temporality sent as its number or
+// its enum value name
+type otlpJSONTemporality OTLPTemporality
+
+func (t *otlpJSONTemporality) UnmarshalJSON(data []byte) error {
+	switch string(bytes.Trim(data, `"`)) {
+	case "AGGREGATION_TEMPORALITY_UNSPECIFIED", "0":
+		*t = otlpJSONTemporality(OTLPTemporalityUnspecified)
+	case "AGGREGATION_TEMPORALITY_DELTA", "1":
+		*t = otlpJSONTemporality(OTLPTemporalityDelta)
+	case "AGGREGATION_TEMPORALITY_CUMULATIVE", "2":
+		*t = otlpJSONTemporality(OTLPTemporalityCumulative)
+	default:
+		return fmt.Errorf("invalid aggregation temporality %s", data)
+	}
+	return nil
+}
+
+// DecodeOTLPJSON decodes a JSON ExportMetricsServiceRequest
+func DecodeOTLPJSON(data []byte) ([]OTLPMetric, error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("invalid export request: %w", err)
+	}
+
+	var metrics []OTLPMetric
+	for _, rm := range req.ResourceMetrics {
+		resource := make(map[string]string)
+		addOTLPJSONAttributes(resource, rm.Resource.Attributes)
+		for _, sm := range rm.ScopeMetrics {
+			labels := make(map[string]string, len(resource)+2)
+			for name, value := range resource {
+				labels[name] = value
+			}
+			setOTLPLabel(labels, "otel_scope_name", sm.Scope.Name)
+			setOTLPLabel(labels, "otel_scope_version", sm.Scope.Version)
+			addOTLPJSONAttributes(labels, sm.Scope.Attributes)
+
+			for _, m := range sm.Metrics {
+				metric := OTLPMetric{Name: m.Name, Description: m.Description, Unit: m.Unit, Labels: labels}
+				var data *otlpJSONData
+				switch {
+				case m.Gauge != nil:
+					metric.Kind, data = OTLPGauge, m.Gauge
+				case m.Sum != nil:
+					metric.Kind, data = OTLPSum, m.Sum
+				case m.Histogram != nil:
+					metric.Kind, data = OTLPHistogram, m.Histogram
+				case m.ExponentialHistogram != nil:
+					metric.Kind, data = OTLPExponentialHistogram, m.ExponentialHistogram
+				case m.Summary != nil:
+					metric.Kind, data = OTLPSummary, m.Summary
+				default:
+					continue
+				}
+				metric.Temporality = OTLPTemporality(data.AggregationTemporality)
+				metric.Monotonic = data.IsMonotonic
+				for _, p := range data.DataPoints {
+					metric.Points = append(metric.Points, p.point())
+				}
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+func (p otlpJSONPoint) point() OTLPPoint {
+	point := OTLPPoint{
+		Attributes:     make(map[string]string),
+		StartTime:      otlpTime(uint64(p.StartTimeUnixNano)),
+		Time:           otlpTime(uint64(p.TimeUnixNano)),
+		Flags:          p.Flags,
+		Count:          float64(p.Count),
+		Sum:            float64(p.Sum),
+		Scale:          p.Scale,
+		ZeroCount:      float64(p.ZeroCount),
+		PositiveOffset: p.Positive.Offset,
+		NegativeOffset: p.Negative.Offset,
+	}
+	addOTLPJSONAttributes(point.Attributes, p.Attributes)
+	switch {
+	case p.AsDouble != nil:
+		point.Value = float64(*p.AsDouble)
+	case p.AsInt != nil:
+		point.Value = float64(*p.AsInt)
+	}
+	for _, n := range p.BucketCounts {
+		point.BucketCounts = append(point.BucketCounts, float64(n))
+	}
+	for _, bound := range p.ExplicitBounds {
+		point.Bounds = append(point.Bounds, float64(bound))
+	}
+	for _, n := range p.Positive.BucketCounts {
+		point.Positive = append(point.Positive, float64(n))
+	}
+	for _, n := range p.Negative.BucketCounts {
+		point.Negative = append(point.Negative, float64(n))
+	}
+	for _, q := range p.QuantileValues {
+		point.Quantiles = append(point.Quantiles, OTLPQuantile{Quantile: float64(q.Quantile), Value: float64(q.Value)})
+	}
+	return point
+}
+
+func addOTLPJSONAttributes(labels map[string]string, attributes []otlpJSONKeyValue) {
+	for _, kv := range attributes {
+		setOTLPLabel(labels, kv.Key, otlpAttributeString(kv.Value.value()))
+	}
+}
+
+// value converts a JSON AnyValue to the types decodeOTLPAnyValue returns
+func (v otlpJSONAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return float64(*v.DoubleValue)
+	case v.BytesValue != nil:
+		return v.BytesValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, len(v.ArrayValue.Values))
+		for i, item := range v.ArrayValue.Values {
+			values[i] = item.value()
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.value()
+		}
+		return values
+	}
+	return nil
+}
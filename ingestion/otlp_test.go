@@ -0,0 +1,217 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func protoKeyValue(key, value string) []byte {
+	anyValue := protowire.AppendTag(nil, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+	return protoMessage(1, []byte(key), 2, anyValue)
+}
+
+func protoFixed64(b []byte, num int, v uint64) []byte {
+	b = protowire.AppendTag(b, protowire.Number(num), protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func TestDecodeOTLPProto(t *testing.T) {
+	now := uint64(time.Now().UnixNano())
+
+	gaugePoint := protoMessage(7, protoKeyValue("cpu", "0"))
+	gaugePoint = protoFixed64(gaugePoint, 3, now)
+	gaugePoint = protoFixed64(gaugePoint, 4, math.Float64bits(0.75))
+	gauge := protoMessage(1, []byte("system.cpu.utilization"), 2, []byte("CPU use"), 3, []byte("1"),
+		5, protoMessage(1, gaugePoint))
+
+	// Bucket counts packed, bounds one field per value
+	var packed []byte
+	for _, n := range []uint64{1, 2, 3} {
+		packed = protowire.AppendFixed64(packed, n)
+	}
+	histogramPoint := protoFixed64(nil, 3, now)
+	histogramPoint = protoFixed64(histogramPoint, 4, 6)
+	histogramPoint = protoFixed64(histogramPoint, 5, math.Float64bits(42))
+	histogramPoint = append(histogramPoint, protoMessage(6, packed)...)
+	histogramPoint = protoFixed64(histogramPoint, 7, math.Float64bits(1))
+	histogramPoint = protoFixed64(histogramPoint, 7, math.Float64bits(10))
+	histogramData := protoMessage(1, histogramPoint)
+	histogramData = protowire.AppendTag(histogramData, 2, protowire.VarintType)
+	histogramData = protowire.AppendVarint(histogramData, uint64(OTLPTemporalityDelta))
+	histogram := protoMessage(1, []byte("request.duration"), 9, histogramData)
+
+	scope := protoMessage(1, []byte("meter"), 2, []byte("1.2.0"), 3, protoKeyValue("cpu", "scope"))
+	resource := protoMessage(1, protoKeyValue("service.name", "api"))
+	request := protoMessage(1, protoMessage(1, resource, 2, protoMessage(1, scope, 2, gauge, 2, histogram)))
+
+	metrics, err := DecodeOTLPProto(request)
+	if err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Expected 2 metrics, got %d", len(metrics))
+	}
+
+	g := metrics[0]
+	if g.Name != "system.cpu.utilization" || g.Kind != OTLPGauge || g.Description != "CPU use" || len(g.Points) != 1 {
+		t.Fatalf("Unexpected gauge %+v", g)
+	}
+	if g.Labels["service.name"] != "api" || g.Labels["otel_scope_name"] != "meter" || g.Labels["otel_scope_version"] != "1.2.0" {
+		t.Errorf("Expected resource and scope labels, got %v", g.Labels)
+	}
+	if g.Points[0].Value != 0.75 || g.Points[0].Attributes["cpu"] != "0" || g.Points[0].Time.UnixNano() != int64(now) {
+		t.Errorf("Unexpected gauge point %+v", g.Points[0])
+	}
+
+	h := metrics[1]
+	if h.Kind != OTLPHistogram || h.Temporality != OTLPTemporalityDelta || len(h.Points) != 1 {
+		t.Fatalf("Unexpected histogram %+v", h)
+	}
+	p := h.Points[0]
+	if p.Count != 6 || p.Sum != 42 || len(p.BucketCounts) != 3 || p.BucketCounts[2] != 3 || len(p.Bounds) != 2 || p.Bounds[1] != 10 {
+		t.Errorf("Unexpected histogram point %+v", p)
+	}
+
+	if _, err := DecodeOTLPProto([]byte{0x0a, 0x05, 0x01}); err == nil {
+		t.Error("Expected an error for a truncated request")
+	}
+}
+
+func TestDecodeOTLPJSON(t *testing.T) {
+	body := `{"resourceMetrics":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}},{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"intValue":"2"}]}}}]},
+		"scopeMetrics":[{"scope":{"name":"meter"},"metrics":[
+			{"name":"requests","unit":"1","sum":{"aggregationTemporality":"AGGREGATION_TEMPORALITY_DELTA","isMonotonic":true,
+				"dataPoints":[{"attributes":[{"key":"code","value":{"intValue":200}}],"timeUnixNano":"1700000000000000000","asInt":"5"}]}},
+			{"name":"latency","exponentialHistogram":{"aggregationTemporality":2,
+				"dataPoints":[{"count":"3","sum":"NaN","scale":1,"zeroCount":"1","positive":{"offset":-1,"bucketCounts":["1","1"]}}]}}
+		]}]
+	}]}`
+	metrics, err := DecodeOTLPJSON([]byte(body))
+	if err != nil {
+		t.Fatalf("Failed to decode request: %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Expected 2 metrics, got %d", len(metrics))
+	}
+
+	sum := metrics[0]
+	if sum.Kind != OTLPSum || !sum.Monotonic || sum.Temporality != OTLPTemporalityDelta {
+		t.Errorf("Unexpected sum %+v", sum)
+	}
+	if sum.Labels["tags"] != `["a",2]` || sum.Labels["otel_scope_name"] != "meter" {
+		t.Errorf("Unexpected labels %v", sum.Labels)
+	}
+	if p := sum.Points[0]; p.Value != 5 || p.Attributes["code"] != "200" || p.Time.Unix() != 1700000000 {
+		t.Errorf("Unexpected sum point %+v", p)
+	}
+
+	exp := metrics[1]
+	if p := exp.Points[0]; exp.Kind != OTLPExponentialHistogram || exp.Temporality != OTLPTemporalityCumulative ||
+		p.Count != 3 || !math.IsNaN(p.Sum) || p.Scale != 1 || p.PositiveOffset != -1 || len(p.Positive) != 2 {
+		t.Errorf("Unexpected exponential histogram %+v", exp)
+	}
+
+	if _, err := DecodeOTLPJSON([]byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"x","sum":{"aggregationTemporality":"BAD"}}]}]}]}`)); err == nil {
+		t.Error("Expected an error for an invalid temporality")
+	}
+}
+
+func TestOTLPReceiver_Temporality(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 10, time.Second)
+	sp.Start(context.Background())
+	receiver := NewOTLPReceiver(sp)
+
+	start := time.Now().Add(-time.Minute)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	resource := map[string]string{"service.name": "api"}
+
+	sums := OTLPMetric{Name: "requests", Labels: resource, Kind: OTLPSum, Monotonic: true, Temporality: OTLPTemporalityDelta,
+		Points: []OTLPPoint{{Time: at(1), Value: 3}, {Time: at(2), Value: 4}}}
+	histogram := OTLPMetric{Name: "latency", Labels: resource, Kind: OTLPHistogram, Temporality: OTLPTemporalityCumulative,
+		Points: []OTLPPoint{
+			// The series started before the receiver, so its first point
+			// is only a baseline
+			{StartTime: start.Add(-time.Hour), Time: at(1), Count: 2, Sum: 3, Bounds: []float64{1, 10}, BucketCounts: []float64{1, 1, 0}},
+			{StartTime: start.Add(-time.Hour), Time: at(2), Count: 5, Sum: 30, Bounds: []float64{1, 10}, BucketCounts: []float64{1, 3, 1}},
+			// A reset: counts start over
+			{StartTime: at(2), Time: at(3), Count: 1, Sum: 0.5, Bounds: []float64{1, 10}, BucketCounts: []float64{1, 0, 0}},
+		}}
+	exponential := OTLPMetric{Name: "size", Labels: resource, Kind: OTLPExponentialHistogram, Temporality: OTLPTemporalityDelta,
+		Points: []OTLPPoint{{Time: at(1), Count: 4, Sum: 10, Scale: 0, ZeroCount: 1, PositiveOffset: 1, Positive: []float64{1, 1}, NegativeOffset: 0, Negative: []float64{1}}}}
+	gauge := OTLPMetric{Name: "temperature", Labels: resource, Kind: OTLPGauge,
+		Points: []OTLPPoint{{Time: at(1), Value: 21}, {Time: at(2), Flags: otlpNoRecordedValue}}}
+
+	if rejected, err := receiver.Ingest([]OTLPMetric{sums, histogram, exponential, gauge}); err != nil || rejected != 0 {
+		t.Fatalf("Expected all points ingested, got %d rejected: %v", rejected, err)
+	}
+	sp.Stop()
+
+	series, ok := hot.GetSeries(storage.SeriesKey("requests", resource))
+	if !ok || series.Size() != 2 || series.GetLatest(1)[0].Value != 7 {
+		t.Fatalf("Expected delta sums stored as a running total of 7")
+	}
+
+	series, ok = hot.GetSeries(storage.SeriesKey("latency", resource))
+	if !ok || series.Size() != 2 {
+		t.Fatalf("Expected 2 histogram intervals after the baseline")
+	}
+	points := series.GetLatest(2)
+	if first := points[0].Sketch; first == nil || first.Count() != 3 || first.Sum() != 27 {
+		t.Errorf("Expected the first interval to hold the 3 new observations, got %+v", first)
+	}
+	if reset := points[1].Sketch; reset == nil || reset.Count() != 1 {
+		t.Errorf("Expected the reset to count from its start, got %+v", reset)
+	}
+
+	series, ok = hot.GetSeries(storage.SeriesKey("size", resource))
+	if !ok || series.Size() != 1 {
+		t.Fatalf("Expected the exponential histogram to be stored")
+	}
+	sketch := series.GetLatest(1)[0].Sketch
+	// Buckets (2,4] and (4,8] hold one observation each, placed at their
+	// midpoints; (-2,-1] and the zero bucket one more each
+	if sketch.Count() != 4 || math.Abs(sketch.Quantile(1)-6) > 0.1 || math.Abs(sketch.Quantile(0)+1.5) > 0.1 {
+		t.Errorf("Unexpected exponential histogram sketch: count %v, min %v, max %v", sketch.Count(), sketch.Quantile(0), sketch.Quantile(1))
+	}
+
+	series, _ = hot.GetSeries(storage.SeriesKey("temperature", resource))
+	if latest := series.GetLatest(1)[0]; !storage.IsStaleMarker(latest.Value) {
+		t.Errorf("Expected a point without a recorded value to mark the series stale, got %v", latest.Value)
+	}
+
+	// A stopped processor must not advance the running totals
+	if _, err := receiver.Ingest([]OTLPMetric{sums}); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning, got %v", err)
+	}
+	if total := receiver.sums[storage.SeriesKey("requests", resource)].total; total != 7 {
+		t.Errorf("Expected the running total to stay 7, got %v", total)
+	}
+}
+
+func TestOTLPReceiver_Rejected(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 10, time.Second)
+	sp.Start(context.Background())
+	defer sp.Stop()
+	receiver := NewOTLPReceiver(sp)
+
+	metrics := []OTLPMetric{
+		{Name: "ok", Kind: OTLPGauge, Points: []OTLPPoint{{Value: 1}}},
+		{Name: "", Kind: OTLPGauge, Points: []OTLPPoint{{Value: 1}}},
+		{Name: "bad_buckets", Kind: OTLPHistogram, Temporality: OTLPTemporalityDelta,
+			Points: []OTLPPoint{{Count: 1, Bounds: []float64{1, 2}, BucketCounts: []float64{1}}}},
+	}
+	rejected, err := receiver.Ingest(metrics)
+	if rejected != 2 || err == nil || IsRetryable(err) {
+		t.Errorf("Expected 2 points rejected without retry, got %d: %v", rejected, err)
+	}
+}
@@ -0,0 +1,421 @@
+package ingestion
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Limits on the structure of an unpickled value. A list can be appended to
+// itself or shared through the memo, so without them a few bytes could
+// describe a value that is infinitely deep or exponentially large.
+const (
+	maxPickleDepth = 64
+	maxPickleItems = 1 << 20
+)
+
+// pickleMark separates the items of a list or tuple under construction on
+// the unpickler's stack
+type pickleMark struct{}
+
+// unpickle decodes a Python pickle holding plain data: lists, tuples,
+// strings, numbers, booleans and None, as sent by Graphite's pickle
+// protocol. Opcodes that build objects or call functions are rejected, so
+// a pickle from the network cannot run code.
+//
+// Lists and tuples decode to []interface{}, strings and bytes to string,
+// integers to int64 (or *big.Int when larger) and floats to float64.
+func unpickle(data []byte) (interface{}, error) {
+	var stack []interface{}
+	memo := make(map[int]interface{})
+
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("pickle stack underflow")
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return top, nil
+	}
+	// popMark pops the items above the topmost mark
+	popMark := func() ([]interface{}, error) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if _, ok := stack[i].(pickleMark); ok {
+				items := append([]interface{}{}, stack[i+1:]...)
+				stack = stack[:i]
+				return items, nil
+			}
+		}
+		return nil, fmt.Errorf("pickle mark not found")
+	}
+	read := func(n int) ([]byte, error) {
+		if n < 0 || n > len(data) {
+			return nil, fmt.Errorf("truncated pickle")
+		}
+		b := data[:n]
+		data = data[n:]
+		return b, nil
+	}
+	readLine := func() (string, error) {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return "", fmt.Errorf("truncated pickle")
+		}
+		line := string(data[:i])
+		data = data[i+1:]
+		return line, nil
+	}
+	readUint := func(n int) (int, error) {
+		b, err := read(n)
+		if err != nil {
+			return 0, err
+		}
+		var v uint64
+		for i := n - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		if v > uint64(len(data)) {
+			return 0, fmt.Errorf("truncated pickle")
+		}
+		return int(v), nil
+	}
+	appendTo := func(list interface{}, items ...interface{}) error {
+		l, ok := list.(*[]interface{})
+		if !ok {
+			return fmt.Errorf("pickle append to a non-list")
+		}
+		*l = append(*l, items...)
+		return nil
+	}
+
+	for len(data) > 0 {
+		op := data[0]
+		data = data[1:]
+		switch op {
+		case 0x80: // PROTO
+			if _, err := read(1); err != nil {
+				return nil, err
+			}
+		case 0x95: // FRAME
+			if _, err := read(8); err != nil {
+				return nil, err
+			}
+		case '.': // STOP
+			result, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			items := 0
+			return resolvePickleLists(result, make(map[*[]interface{}]bool), 0, &items)
+		case '(': // MARK
+			stack = append(stack, pickleMark{})
+		case ']': // EMPTY_LIST
+			stack = append(stack, &[]interface{}{})
+		case 'l': // LIST
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, &items)
+		case 'a': // APPEND
+			item, err := pop()
+			if err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle stack underflow")
+			}
+			if err := appendTo(stack[len(stack)-1], item); err != nil {
+				return nil, err
+			}
+		case 'e': // APPENDS
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle stack underflow")
+			}
+			if err := appendTo(stack[len(stack)-1], items...); err != nil {
+				return nil, err
+			}
+		case ')': // EMPTY_TUPLE
+			stack = append(stack, []interface{}{})
+		case 't': // TUPLE
+			items, err := popMark()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, items)
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			n := int(op - 0x84)
+			if len(stack) < n {
+				return nil, fmt.Errorf("pickle stack underflow")
+			}
+			items := append([]interface{}{}, stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], items)
+		case 'N': // NONE
+			stack = append(stack, nil)
+		case 0x88: // NEWTRUE
+			stack = append(stack, true)
+		case 0x89: // NEWFALSE
+			stack = append(stack, false)
+		case 'J': // BININT
+			b, err := read(4)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(int32(binary.LittleEndian.Uint32(b))))
+		case 'K': // BININT1
+			b, err := read(1)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(b[0]))
+		case 'M': // BININT2
+			b, err := read(2)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, int64(binary.LittleEndian.Uint16(b)))
+		case 0x8a: // LONG1
+			n, err := readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(n)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, decodePickleLong(b))
+		case 'I', 'L': // INT, LONG
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			line = strings.TrimSuffix(line, "L")
+			switch line {
+			case "00":
+				stack = append(stack, false)
+			case "01":
+				stack = append(stack, true)
+			default:
+				v, ok := new(big.Int).SetString(line, 10)
+				if !ok {
+					return nil, fmt.Errorf("invalid pickle integer %q", line)
+				}
+				stack = append(stack, simplifyBigInt(v))
+			}
+		case 'F': // FLOAT
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			v, err := strconv.ParseFloat(line, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pickle float %q", line)
+			}
+			stack = append(stack, v)
+		case 'G': // BINFLOAT
+			b, err := read(8)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case 'S': // STRING
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			s, err := strconv.Unquote(pickleQuote(line))
+			if err != nil {
+				return nil, fmt.Errorf("invalid pickle string %s", line)
+			}
+			stack = append(stack, s)
+		case 'V': // UNICODE
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, line)
+		case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			n, err := readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(n)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+		case 'T', 'X', 'B': // BINSTRING, BINUNICODE, BINBYTES
+			n, err := readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(n)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+		case 0x8d, 0x8e: // BINUNICODE8, BINBYTES8
+			n, err := readUint(8)
+			if err != nil {
+				return nil, err
+			}
+			b, err := read(n)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(b))
+		case 'p': // PUT
+			line, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			index, err := strconv.Atoi(line)
+			if err != nil || len(stack) == 0 {
+				return nil, fmt.Errorf("invalid pickle memo %q", line)
+			}
+			memo[index] = stack[len(stack)-1]
+		case 'q', 'r': // BINPUT, LONG_BINPUT
+			size := 1
+			if op == 'r' {
+				size = 4
+			}
+			b, err := read(size)
+			if err != nil || len(stack) == 0 {
+				return nil, fmt.Errorf("invalid pickle memo")
+			}
+			index := int(b[0])
+			if size == 4 {
+				index = int(binary.LittleEndian.Uint32(b))
+			}
+			memo[index] = stack[len(stack)-1]
+		case 0x94: // MEMOIZE
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle stack underflow")
+			}
+			memo[len(memo)] = stack[len(stack)-1]
+		case 'g', 'h', 'j': // GET, BINGET, LONG_BINGET
+			var index int
+			switch op {
+			case 'g':
+				line, err := readLine()
+				if err != nil {
+					return nil, err
+				}
+				if index, err = strconv.Atoi(line); err != nil {
+					return nil, fmt.Errorf("invalid pickle memo %q", line)
+				}
+			case 'h':
+				b, err := read(1)
+				if err != nil {
+					return nil, err
+				}
+				index = int(b[0])
+			default:
+				b, err := read(4)
+				if err != nil {
+					return nil, err
+				}
+				index = int(binary.LittleEndian.Uint32(b))
+			}
+			value, ok := memo[index]
+			if !ok {
+				return nil, fmt.Errorf("pickle memo %d not found", index)
+			}
+			stack = append(stack, value)
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode 0x%02x", op)
+		}
+	}
+	return nil, fmt.Errorf("truncated pickle")
+}
+
+// resolvePickleLists replaces the list pointers used while unpickling, so
+// that lists can be appended to in place, with plain slices. Lists that
+// contain themselves, values nested deeper than maxPickleDepth and values
+// of more than maxPickleItems items in all are rejected; open holds the
+// lists being resolved and items counts the items resolved so far.
+func resolvePickleLists(v interface{}, open map[*[]interface{}]bool, depth int, items *int) (interface{}, error) {
+	if depth > maxPickleDepth {
+		return nil, fmt.Errorf("pickle nested deeper than %d", maxPickleDepth)
+	}
+	switch value := v.(type) {
+	case *[]interface{}:
+		if open[value] {
+			return nil, fmt.Errorf("pickle list contains itself")
+		}
+		open[value] = true
+		defer delete(open, value)
+		return resolvePickleLists(*value, open, depth, items)
+	case []interface{}:
+		if *items += len(value); *items > maxPickleItems {
+			return nil, fmt.Errorf("pickle holds more than %d items", maxPickleItems)
+		}
+		result := make([]interface{}, len(value))
+		for i, item := range value {
+			resolved, err := resolvePickleLists(item, open, depth+1, items)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = resolved
+		}
+		return result, nil
+	}
+	return v, nil
+}
+
+// decodePickleLong decodes a little-endian two's complement integer
+func decodePickleLong(b []byte) interface{} {
+	if len(b) == 0 {
+		return int64(0)
+	}
+	bigEndian := make([]byte, len(b))
+	for i := range b {
+		bigEndian[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(bigEndian)
+	if b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	return simplifyBigInt(v)
+}
+
+func simplifyBigInt(v *big.Int) interface{} {
+	if v.IsInt64() {
+		return v.Int64()
+	}
+	return v
+}
+
+// pickleQuote converts a Python string literal from a STRING opcode to a Go
+// one; single-quoted literals are requoted with double quotes
+func pickleQuote(literal string) string {
+	if len(literal) >= 2 && literal[0] == '\'' && literal[len(literal)-1] == '\'' {
+		inner := strings.ReplaceAll(literal[1:len(literal)-1], `\'`, `'`)
+		return `"` + strings.ReplaceAll(inner, `"`, `\"`) + `"`
+	}
+	return literal
+}
+
+// pickleNumber converts an unpickled number or numeric string to a float
+func pickleNumber(v interface{}) (float64, error) {
+	switch value := v.(type) {
+	case int64:
+		return float64(value), nil
+	case float64:
+		return value, nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(value).Float64()
+		return f, nil
+	case string:
+		return strconv.ParseFloat(value, 64)
+	}
+	return 0, fmt.Errorf("expected a number, got %T", v)
+}
@@ -0,0 +1,414 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// DefaultWorkerCount is the number of storage writers a StreamProcessor
+// runs unless SetWorkerCount is called
+const DefaultWorkerCount = 4
+
+// BatchWriter is implemented by storage that writes many points in one
+// call, returning nil or the error of each sample. Workers then write a
+// batch at once rather than a point at a time; the storage must accept
+// every point type.
+type BatchWriter interface {
+	AddBatch(samples []storage.Sample) []error
+}
+
+// errUnsupportedValue is wrapped by write errors for values the storage
+// cannot keep
+var errUnsupportedValue = errors.New("storage does not support")
+
+// isPermanentWriteError reports whether writing a metric failed because of
+// the metric itself, such as a value of another type than its series
+// holds, so that writing it again would fail again
+func isPermanentWriteError(err error) bool {
+	return errors.Is(err, storage.ErrTypeConflict) || errors.Is(err, errUnsupportedValue)
+}
+
+// writeTracker collects the write failures of the metrics ingested on
+// behalf of one source, such as a Kafka partition, so the source can tell
+// them apart from other sources' failures. Permanent failures are only
+// counted, as writing the metrics again would not help.
+type writeTracker struct {
+	mu        sync.Mutex
+	err       error
+	permanent int
+}
+
+// failed records a write failure, keeping the first retryable error
+func (t *writeTracker) failed(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if isPermanentWriteError(err) {
+		t.permanent++
+	} else if t.err == nil {
+		t.err = err
+	}
+}
+
+// take returns the number of permanent failures and the first retryable
+// error since the last call, and clears them
+func (t *writeTracker) take() (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	permanent, err := t.permanent, t.err
+	t.permanent, t.err = 0, nil
+	return permanent, err
+}
+
+type writeTrackerKey struct{}
+
+// withWriteTracker returns a context whose ingested metrics report their
+// write failures to tracker
+func withWriteTracker(ctx context.Context, tracker *writeTracker) context.Context {
+	return context.WithValue(ctx, writeTrackerKey{}, tracker)
+}
+
+// pipelineItem is a metric queued for a worker, or a flush marker
+type pipelineItem struct {
+	metric   MetricData
+	seriesID string
+	queued   time.Time
+	// tracker, if set, is told when writing the metric fails
+	tracker *writeTracker
+	// flushed is set on flush markers. Once everything queued before the
+	// marker has been written, it receives the first write error since the
+	// previous marker, or nil.
+	flushed chan<- error
+}
+
+// shard is the queue of one worker. Metrics are routed to shards by series,
+// so the points of a series are written in the order they were ingested.
+// Its size is bounded by the slots reserved on admission rather than by
+// the queue itself, so queueing admitted metrics never blocks.
+type shard struct {
+	mu    sync.Mutex
+	items []pipelineItem
+	// ready is signalled when items are queued
+	ready chan struct{}
+
+	// slots counts the metrics admitted but not yet taken by the worker,
+	// against capacity
+	slots    atomic.Int64
+	capacity int64
+	// pending counts metrics taken from the queue but not yet written
+	pending atomic.Int64
+	// writeErr is the first write error since the last flush, guarded by mu
+	writeErr error
+}
+
+func newShard(capacity int) *shard {
+	return &shard{ready: make(chan struct{}, 1), capacity: int64(capacity)}
+}
+
+// push queues items and wakes the worker
+func (s *shard) push(items ...pipelineItem) {
+	s.mu.Lock()
+	s.items = append(s.items, items...)
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// takeAll removes and returns the queued items
+func (s *shard) takeAll() []pipelineItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := s.items
+	s.items = nil
+	return items
+}
+
+// failed records a write error, keeping the first since the last flush
+func (s *shard) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr == nil {
+		s.writeErr = err
+	}
+}
+
+// takeError returns the first write error since the last flush and clears it
+func (s *shard) takeError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.writeErr
+	s.writeErr = nil
+	return err
+}
+
+// reserve takes n slots if they are free. A request larger than the shard
+// is let in when the shard is empty.
+func (s *shard) reserve(n int64) bool {
+	for {
+		slots := s.slots.Load()
+		if slots > 0 && slots+n > s.capacity {
+			return false
+		}
+		if s.slots.CompareAndSwap(slots, slots+n) {
+			return true
+		}
+	}
+}
+
+func shardIndex(seriesID string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(seriesID))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// StageStats describes one stage of the ingestion pipeline. Latencies are
+// averaged over the processor's lifetime.
+type StageStats struct {
+	Count       int64         `json:"count"`
+	Errors      int64         `json:"errors"`
+	MeanLatency time.Duration `json:"mean_latency_ns"`
+	MaxLatency  time.Duration `json:"max_latency_ns"`
+}
+
+// QueueStats describes the shard queues between intake and the workers
+type QueueStats struct {
+	StageStats
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+	// MaxShardDepth is the depth of the fullest queue. One much fuller than
+	// the others points to a few series receiving most of the load.
+	MaxShardDepth int `json:"max_shard_depth"`
+}
+
+// PipelineStats contains the statistics of each stage of a StreamProcessor:
+//   - Intake counts metrics accepted and rejected by validation or parsing,
+//     with the latency of each ingest call, including waits for queue space
+//   - Queue counts metrics taken by workers, with the time they waited
+//   - Write counts metrics written and failed, with the latency of each
+//     batch written to storage
+type PipelineStats struct {
+	Running bool       `json:"is_running"`
+	Workers int        `json:"workers"`
+	Intake  StageStats `json:"intake"`
+	Queue   QueueStats `json:"queue"`
+	Write   StageStats `json:"write"`
+	Batches int64      `json:"batches"`
+	// Pending counts metrics batched by workers but not yet written
+	Pending      int               `json:"pending"`
+	Backpressure BackpressureStats `json:"backpressure"`
+}
+
+// stageCounter accumulates StageStats without locking
+type stageCounter struct {
+	count      atomic.Int64
+	errors     atomic.Int64
+	samples    atomic.Int64
+	totalNanos atomic.Int64
+	maxNanos   atomic.Int64
+}
+
+func (c *stageCounter) observe(d time.Duration) {
+	c.samples.Add(1)
+	c.totalNanos.Add(int64(d))
+	for {
+		max := c.maxNanos.Load()
+		if int64(d) <= max || c.maxNanos.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (c *stageCounter) snapshot() StageStats {
+	stats := StageStats{
+		Count:      c.count.Load(),
+		Errors:     c.errors.Load(),
+		MaxLatency: time.Duration(c.maxNanos.Load()),
+	}
+	if samples := c.samples.Load(); samples > 0 {
+		stats.MeanLatency = time.Duration(c.totalNanos.Load() / samples)
+	}
+	return stats
+}
+
+// enqueue routes metrics to their shards once admitted by the rate limits
+// and by space in each of their shards, waiting until ctx is done. Either
+// all are queued or, with ErrNotRunning or ErrSaturated, none.
+func (sp *StreamProcessor) enqueue(ctx context.Context, metrics []MetricData) error {
+	// Stop waits for enqueues in flight, so once running has been seen the
+	// workers outlive the sends below
+	sp.intakeMu.RLock()
+	defer sp.intakeMu.RUnlock()
+	if !sp.running.Load() {
+		return fmt.Errorf("%d samples not ingested: %w", len(metrics), ErrNotRunning)
+	}
+
+	tracker, _ := ctx.Value(writeTrackerKey{}).(*writeTracker)
+	routed := make([][]pipelineItem, len(sp.shards))
+	for _, metric := range metrics {
+		seriesID := storage.SeriesKey(metric.Name, metric.Labels)
+		i := shardIndex(seriesID, len(sp.shards))
+		routed[i] = append(routed[i], pipelineItem{metric: metric, seriesID: seriesID, tracker: tracker})
+	}
+	if err := sp.admit(ctx, metrics, routed); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, items := range routed {
+		if len(items) == 0 {
+			continue
+		}
+		for j := range items {
+			items[j].queued = now
+		}
+		sp.shards[i].push(items...)
+	}
+	sp.intake.count.Add(int64(len(metrics)))
+	return nil
+}
+
+// runWorker batches the metrics of a shard and writes a batch when it is
+// full, when the flush interval passes, or when a flush marker arrives
+func (sp *StreamProcessor) runWorker(shard *shard, stop <-chan struct{}) {
+	defer sp.wg.Done()
+	ticker := time.NewTicker(sp.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]pipelineItem, 0, sp.batchSize)
+	write := func() {
+		if err := sp.writeBatch(batch); err != nil {
+			shard.failed(err)
+		}
+		shard.pending.Add(-int64(len(batch)))
+		batch = batch[:0]
+	}
+	take := func(item pipelineItem) {
+		if item.flushed != nil {
+			write()
+			item.flushed <- shard.takeError()
+			return
+		}
+		sp.queueStage.count.Add(1)
+		sp.queueStage.observe(time.Since(item.queued))
+		batch = append(batch, item)
+		shard.pending.Add(1)
+		if len(batch) >= sp.batchSize {
+			write()
+		}
+	}
+
+	for {
+		select {
+		case <-shard.ready:
+			for _, item := range sp.takeQueued(shard) {
+				take(item)
+			}
+		case <-ticker.C:
+			write()
+		case <-stop:
+			// Intake has stopped, so the queue holds all that is left
+			for _, item := range sp.takeQueued(shard) {
+				take(item)
+			}
+			write()
+			return
+		}
+	}
+}
+
+// takeQueued takes a shard's queued items, freeing their slots
+func (sp *StreamProcessor) takeQueued(s *shard) []pipelineItem {
+	items := s.takeAll()
+	metrics := 0
+	for _, item := range items {
+		if item.flushed == nil {
+			metrics++
+		}
+	}
+	if metrics > 0 {
+		s.slots.Add(-int64(metrics))
+		sp.notifySpace()
+	}
+	return items
+}
+
+// writeBatch writes a batch to storage, in one call when the storage is a
+// BatchWriter. Metrics that fail are logged, counted and reported to their
+// tracker, and the first failure is returned.
+func (sp *StreamProcessor) writeBatch(batch []pipelineItem) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	start := time.Now()
+	errs := make([]error, len(batch))
+	if writer, ok := sp.storage.(BatchWriter); ok {
+		var samples []storage.Sample
+		var owners []int // index in batch of each sample's metric
+		for i, item := range batch {
+			metric := item.metric
+			switch {
+			case len(metric.Fields) > 0:
+				for _, field := range storage.SortedFields(metric.Fields) {
+					labels := storage.FieldLabels(metric.Labels, field)
+					samples = append(samples, storage.Sample{
+						SeriesID: storage.SeriesKey(metric.Name, labels),
+						Labels:   labels,
+						Point:    metric.Fields[field].Point(metric.Timestamp),
+					})
+					owners = append(owners, i)
+				}
+			case metric.Sketch != nil:
+				samples = append(samples, storage.Sample{
+					SeriesID: item.seriesID,
+					Labels:   metric.Labels,
+					Point:    storage.DataPoint{Timestamp: metric.Timestamp, Value: metric.Sketch.Count(), Sketch: metric.Sketch},
+				})
+				owners = append(owners, i)
+			default:
+				samples = append(samples, storage.Sample{
+					SeriesID: item.seriesID,
+					Labels:   metric.Labels,
+					Point:    storage.DataPoint{Timestamp: metric.Timestamp, Value: metric.Value},
+				})
+				owners = append(owners, i)
+			}
+		}
+		for j, err := range writer.AddBatch(samples) {
+			if err != nil && errs[owners[j]] == nil {
+				errs[owners[j]] = err
+			}
+		}
+	} else {
+		for i, item := range batch {
+			errs[i] = sp.storeMetric(item.metric, item.seriesID)
+		}
+	}
+
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("Error storing metric %s: %v", batch[i].metric.Name, err)
+			sp.writeStage.errors.Add(1)
+			err = fmt.Errorf("storing metric %s: %w", batch[i].metric.Name, err)
+			if batch[i].tracker != nil {
+				batch[i].tracker.failed(err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			sp.writeStage.count.Add(1)
+		}
+	}
+	sp.writeStage.observe(time.Since(start))
+	sp.batches.Add(1)
+	return firstErr
+}
@@ -0,0 +1,115 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// orderRecorder records the values written to each series, in order
+type orderRecorder struct {
+	mu     sync.Mutex
+	values map[string][]float64
+}
+
+func (r *orderRecorder) AddPoint(seriesID string, labels map[string]string, timestamp time.Time, value float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[seriesID] = append(r.values[seriesID], value)
+	return nil
+}
+
+func TestStreamProcessor_PerSeriesOrder(t *testing.T) {
+	recorder := &orderRecorder{values: make(map[string][]float64)}
+	sp := NewStreamProcessor(recorder, 16, 5, time.Hour)
+	sp.SetWorkerCount(4)
+	sp.SetBackpressure(BackpressureConfig{BlockTimeout: time.Minute})
+	sp.Start(context.Background())
+
+	// Concurrent writers, each owning some series
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				sp.IngestMetric(MetricData{
+					Name:      "order.test",
+					Value:     float64(i),
+					Timestamp: time.Now(),
+					Labels:    map[string]string{"series": fmt.Sprint(w*2 + i%2)},
+				})
+			}
+		}(w)
+	}
+	wg.Wait()
+	sp.Stop()
+
+	if len(recorder.values) != 8 {
+		t.Fatalf("Expected 8 series, got %d", len(recorder.values))
+	}
+	for seriesID, values := range recorder.values {
+		if len(values) != 100 {
+			t.Errorf("Expected 100 values in %s, got %d", seriesID, len(values))
+		}
+		for i := 1; i < len(values); i++ {
+			if values[i] <= values[i-1] {
+				t.Errorf("Values of %s written out of order: %v after %v", seriesID, values[i], values[i-1])
+				break
+			}
+		}
+	}
+
+	stats := sp.GetStats()
+	if stats.Intake.Count != 800 || stats.Queue.Count != 800 || stats.Write.Count != 800 {
+		t.Errorf("Expected 800 metrics through each stage, got %+v", stats)
+	}
+	if stats.Queue.Depth != 0 || stats.Pending != 0 {
+		t.Errorf("Expected nothing left queued after stop, got %+v", stats.Queue)
+	}
+}
+
+func TestStreamProcessor_FlushWritesBatches(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 50, time.Hour)
+	sp.SetWorkerCount(2)
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	now := time.Now()
+	metrics := make([]MetricData, 10)
+	for i := range metrics {
+		metrics[i] = MetricData{
+			Name:      "flush.test",
+			Value:     float64(i),
+			Timestamp: now.Add(time.Duration(i-10) * time.Second),
+			Labels:    map[string]string{"host": fmt.Sprint(i % 3)},
+		}
+	}
+	sp.IngestBatch(metrics)
+	if stats := sp.GetStats(); stats.Workers != 2 || stats.Queue.Capacity != 100 {
+		t.Errorf("Expected 2 workers sharing 100 slots, got %+v", stats)
+	}
+
+	// Batches are not full and the interval is long, so only Flush writes
+	sp.Flush()
+	if size := sp.GetBufferSize(); size != 0 {
+		t.Errorf("Expected an empty buffer after flush, got %d", size)
+	}
+	total := 0
+	for host := 0; host < 3; host++ {
+		series, ok := hot.GetSeries(storage.SeriesKey("flush.test", map[string]string{"host": fmt.Sprint(host)}))
+		if ok {
+			total += series.Size()
+		}
+	}
+	if total != 10 {
+		t.Errorf("Expected 10 points stored after flush, got %d", total)
+	}
+	if batches := sp.GetStats().Batches; batches < 1 || batches > 2 {
+		t.Errorf("Expected one batch per worker, got %d", batches)
+	}
+}
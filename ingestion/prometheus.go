@@ -0,0 +1,248 @@
+package ingestion
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// MetadataWriter is implemented by storage that keeps metric metadata. When
+// the processor's storage implements it, metadata reported by sources such
+// as Prometheus # HELP and # TYPE lines is recorded.
+type MetadataWriter interface {
+	MergeMetadata(metric string, md storage.Metadata) error
+}
+
+// PrometheusText is the result of parsing the Prometheus text exposition
+// format: its samples and the metadata of each metric family
+type PrometheusText struct {
+	Metrics  []MetricData
+	Metadata map[string]storage.Metadata
+}
+
+// ParsePrometheusText parses the Prometheus text exposition format, along
+// with the # UNIT lines of OpenMetrics. Samples without a timestamp are
+// given defaultTime.
+func ParsePrometheusText(r io.Reader, defaultTime time.Time) (*PrometheusText, error) {
+	return parseExposition(r, defaultTime, false)
+}
+
+// ParseOpenMetricsText parses the OpenMetrics text format, which differs
+// from the Prometheus one in giving timestamps in seconds, allowing an
+// exemplar after each sample and ending with # EOF. Exemplars are skipped.
+func ParseOpenMetricsText(r io.Reader, defaultTime time.Time) (*PrometheusText, error) {
+	return parseExposition(r, defaultTime, true)
+}
+
+func parseExposition(r io.Reader, defaultTime time.Time, openMetrics bool) (*PrometheusText, error) {
+	result := &PrometheusText{Metadata: make(map[string]storage.Metadata)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	eof := false
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if eof {
+			return nil, fmt.Errorf("line %d: content after # EOF", lineNumber)
+		}
+		if strings.HasPrefix(line, "#") {
+			if openMetrics && line == "# EOF" {
+				eof = true
+				continue
+			}
+			if err := parsePrometheusComment(line, result.Metadata, openMetrics); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			continue
+		}
+		metric, err := parsePrometheusSample(line, defaultTime, openMetrics)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		result.Metrics = append(result.Metrics, metric)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if openMetrics && !eof {
+		return nil, fmt.Errorf("missing # EOF")
+	}
+	return result, nil
+}
+
+// parsePrometheusComment records HELP, TYPE and UNIT lines; other comments
+// are ignored
+func parsePrometheusComment(line string, metadata map[string]storage.Metadata, openMetrics bool) error {
+	fields := strings.SplitN(strings.TrimSpace(line[1:]), " ", 3)
+	if len(fields) < 2 {
+		return nil
+	}
+	keyword, name, text := fields[0], fields[1], ""
+	if len(fields) == 3 {
+		text = strings.TrimSpace(fields[2])
+	}
+
+	md := metadata[name]
+	switch keyword {
+	case "HELP":
+		md.Help = strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(text)
+	case "TYPE":
+		if openMetrics {
+			// Map the OpenMetrics-only types onto the closest stored one
+			switch text {
+			case "info", "stateset":
+				text = "gauge"
+			case "gaugehistogram":
+				text = "unknown"
+			}
+		}
+		metricType, err := storage.ParseMetricType(text)
+		if err != nil {
+			return err
+		}
+		md.Type = metricType
+	case "UNIT":
+		md.Unit = text
+	default:
+		return nil
+	}
+	metadata[name] = md
+	return nil
+}
+
+// parsePrometheusSample parses a line such as
+// http_requests_total{method="post",code="200"} 1027 1395066363000
+func parsePrometheusSample(line string, defaultTime time.Time, openMetrics bool) (MetricData, error) {
+	metric := MetricData{Labels: make(map[string]string), Timestamp: defaultTime}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return metric, fmt.Errorf("invalid sample %q", line)
+	}
+	metric.Name = line[:end]
+	rest := line[end:]
+
+	if rest[0] == '{' {
+		var err error
+		if rest, err = parsePrometheusLabels(rest[1:], metric.Labels); err != nil {
+			return metric, err
+		}
+	}
+
+	if i := strings.IndexByte(rest, '#'); openMetrics && i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return metric, fmt.Errorf("invalid sample %q", line)
+	}
+	value, err := parsePrometheusValue(fields[0])
+	if err != nil {
+		return metric, err
+	}
+	metric.Value = value
+	if len(fields) == 2 && openMetrics {
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return metric, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		metric.Timestamp = time.Unix(0, int64(seconds*1e9))
+	} else if len(fields) == 2 {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return metric, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		metric.Timestamp = time.UnixMilli(ms)
+	}
+	return metric, nil
+}
+
+// parsePrometheusLabels parses label pairs up to the closing brace and
+// returns the rest of the line
+func parsePrometheusLabels(s string, labels map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return "", fmt.Errorf("unterminated label set")
+		}
+		if s[0] == '}' {
+			return s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return "", fmt.Errorf("invalid label in %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if s == "" || s[0] != '"' {
+			return "", fmt.Errorf("label %s: value must be quoted", name)
+		}
+
+		var value strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return "", fmt.Errorf("label %s: unterminated value", name)
+		}
+		labels[name] = value.String()
+		s = s[i+1:]
+	}
+}
+
+func parsePrometheusValue(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return value, nil
+}
+
+// IngestPrometheusText ingests a scrape in the Prometheus text exposition
+// format, recording the metadata of its metric families when the storage
+// supports it
+func (sp *StreamProcessor) IngestPrometheusText(r io.Reader) error {
+	parsed, err := ParsePrometheusText(r, time.Now())
+	if err != nil {
+		sp.incrementErrorCount()
+		return fmt.Errorf("prometheus parsing failed: %w", err)
+	}
+
+	if writer, ok := sp.storage.(MetadataWriter); ok {
+		for name, md := range parsed.Metadata {
+			if err := writer.MergeMetadata(name, md); err != nil {
+				return fmt.Errorf("failed to record metadata for %s: %w", name, err)
+			}
+		}
+	}
+	return sp.IngestBatch(parsed.Metrics)
+}
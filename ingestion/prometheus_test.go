@@ -0,0 +1,96 @@
+package ingestion
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestParsePrometheusText(t *testing.T) {
+	input := `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# A comment that is not metadata
+# TYPE process_resident_memory_bytes gauge
+# UNIT process_resident_memory_bytes bytes
+process_resident_memory_bytes 2.5e+07
+msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\""} 1.458255915e9
+rpc_duration_seconds{quantile="0.99"} NaN
+`
+	now := time.Now()
+	parsed, err := ParsePrometheusText(strings.NewReader(input), now)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if len(parsed.Metrics) != 5 {
+		t.Fatalf("Expected 5 samples, got %d", len(parsed.Metrics))
+	}
+	first := parsed.Metrics[0]
+	if first.Name != "http_requests_total" || first.Labels["code"] != "200" || first.Value != 1027 || first.Timestamp.UnixMilli() != 1395066363000 {
+		t.Errorf("Unexpected first sample: %+v", first)
+	}
+	if parsed.Metrics[2].Value != 2.5e7 || !parsed.Metrics[2].Timestamp.Equal(now) {
+		t.Errorf("Expected a sample without timestamp to use the default time, got %+v", parsed.Metrics[2])
+	}
+	if labels := parsed.Metrics[3].Labels; labels["path"] != `C:\DIR\FILE.TXT` || labels["error"] != "Cannot find file:\n\"FILE.TXT\"" {
+		t.Errorf("Unexpected unescaped labels: %q", labels)
+	}
+	if !math.IsNaN(parsed.Metrics[4].Value) {
+		t.Errorf("Expected NaN, got %v", parsed.Metrics[4].Value)
+	}
+
+	expected := map[string]storage.Metadata{
+		"http_requests_total":           {Type: storage.MetricTypeCounter, Help: "The total number of HTTP requests."},
+		"process_resident_memory_bytes": {Type: storage.MetricTypeGauge, Unit: "bytes"},
+	}
+	if len(parsed.Metadata) != len(expected) {
+		t.Errorf("Expected metadata for %d metrics, got %+v", len(expected), parsed.Metadata)
+	}
+	for name, md := range expected {
+		if parsed.Metadata[name] != md {
+			t.Errorf("%s: expected %+v, got %+v", name, md, parsed.Metadata[name])
+		}
+	}
+
+	for _, invalid := range []string{`metric{a="b" 1`, `metric{a=b} 1`, `metric one`, "# TYPE metric widget"} {
+		if _, err := ParsePrometheusText(strings.NewReader(invalid), now); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseOpenMetricsText(t *testing.T) {
+	input := `# TYPE requests counter
+# HELP requests Requests served.
+requests_total{path="/"} 12 1700000000.5 # {trace_id="abc"} 1.0 1700000000.4
+requests_created{path="/"} 1699990000
+# TYPE build info
+build_info{version="1.2"} 1
+# EOF
+`
+	parsed, err := ParseOpenMetricsText(strings.NewReader(input), time.Now())
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(parsed.Metrics) != 3 {
+		t.Fatalf("Expected 3 samples, got %d", len(parsed.Metrics))
+	}
+	if first := parsed.Metrics[0]; first.Value != 12 || first.Timestamp.UnixMilli() != 1700000000500 {
+		t.Errorf("Expected the exemplar skipped and the timestamp read in seconds, got %+v", first)
+	}
+	if parsed.Metadata["requests"].Type != storage.MetricTypeCounter || parsed.Metadata["build"].Type != storage.MetricTypeGauge {
+		t.Errorf("Unexpected metadata %+v", parsed.Metadata)
+	}
+
+	if _, err := ParseOpenMetricsText(strings.NewReader("up 1\n"), time.Now()); err == nil {
+		t.Error("Expected an error for a missing # EOF")
+	}
+	if _, err := ParseOpenMetricsText(strings.NewReader("# EOF\nup 1\n"), time.Now()); err == nil {
+		t.Error("Expected an error for content after # EOF")
+	}
+}
@@ -0,0 +1,178 @@
+package ingestion
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RelabelAction is what a relabeling rule does with the labels it matches
+type RelabelAction string
+
+const (
+	// RelabelReplace sets TargetLabel to Replacement, expanded with the
+	// regex's groups, when the source value matches
+	RelabelReplace RelabelAction = "replace"
+	// RelabelKeep drops the label set unless the source value matches
+	RelabelKeep RelabelAction = "keep"
+	// RelabelDrop drops the label set when the source value matches
+	RelabelDrop RelabelAction = "drop"
+	// RelabelHashMod sets TargetLabel to a hash of the source value modulo
+	// Modulus, to shard targets between scrapers
+	RelabelHashMod RelabelAction = "hashmod"
+	// RelabelLabelMap copies labels whose names match to the names given by
+	// Replacement
+	RelabelLabelMap RelabelAction = "labelmap"
+	// RelabelLabelDrop removes labels whose names match
+	RelabelLabelDrop RelabelAction = "labeldrop"
+	// RelabelLabelKeep removes labels whose names do not match
+	RelabelLabelKeep RelabelAction = "labelkeep"
+)
+
+// RelabelConfig is a relabeling rule, with the semantics of Prometheus'
+// relabel_configs. The values of SourceLabels are joined with Separator
+// (default ";") and matched against Regex (default "(.*)"), which is
+// anchored at both ends. An empty Replacement means "$1".
+type RelabelConfig struct {
+	SourceLabels []string      `json:"source_labels"`
+	Separator    string        `json:"separator"`
+	Regex        string        `json:"regex"`
+	TargetLabel  string        `json:"target_label"`
+	Replacement  string        `json:"replacement"`
+	Modulus      uint64        `json:"modulus"`
+	Action       RelabelAction `json:"action"`
+}
+
+// RelabelRule is a compiled RelabelConfig
+type RelabelRule struct {
+	config RelabelConfig
+	regex  *regexp.Regexp
+}
+
+// CompileRelabelConfigs checks relabeling rules and fills in their defaults
+func CompileRelabelConfigs(configs []RelabelConfig) ([]*RelabelRule, error) {
+	rules := make([]*RelabelRule, 0, len(configs))
+	for i, config := range configs {
+		if config.Separator == "" {
+			config.Separator = ";"
+		}
+		if config.Regex == "" {
+			config.Regex = "(.*)"
+		}
+		if config.Replacement == "" {
+			config.Replacement = "$1"
+		}
+		if config.Action == "" {
+			config.Action = RelabelReplace
+		}
+		regex, err := regexp.Compile("^(?:" + config.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex: %w", i, err)
+		}
+
+		switch config.Action {
+		case RelabelReplace:
+			if config.TargetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %d: replace needs a target label", i)
+			}
+		case RelabelHashMod:
+			if config.TargetLabel == "" || config.Modulus == 0 {
+				return nil, fmt.Errorf("relabel rule %d: hashmod needs a target label and a modulus", i)
+			}
+		case RelabelKeep, RelabelDrop:
+			if len(config.SourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel rule %d: %s needs source labels", i, config.Action)
+			}
+		case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %q", i, config.Action)
+		}
+		rules = append(rules, &RelabelRule{config: config, regex: regex})
+	}
+	return rules, nil
+}
+
+// Relabel applies rules to a copy of labels in order. It returns false when
+// a rule drops the label set.
+func Relabel(labels map[string]string, rules []*RelabelRule) (map[string]string, bool) {
+	result := make(map[string]string, len(labels))
+	for name, value := range labels {
+		result[name] = value
+	}
+
+	for _, rule := range rules {
+		config := rule.config
+		values := make([]string, len(config.SourceLabels))
+		for i, name := range config.SourceLabels {
+			values[i] = result[name]
+		}
+		value := strings.Join(values, config.Separator)
+
+		switch config.Action {
+		case RelabelKeep:
+			if !rule.regex.MatchString(value) {
+				return nil, false
+			}
+		case RelabelDrop:
+			if rule.regex.MatchString(value) {
+				return nil, false
+			}
+		case RelabelReplace:
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, config.TargetLabel, value, match))
+			if !isValidLabelName(target) {
+				continue
+			}
+			if replaced := string(rule.regex.ExpandString(nil, config.Replacement, value, match)); replaced != "" {
+				result[target] = replaced
+			} else {
+				delete(result, target)
+			}
+		case RelabelHashMod:
+			sum := md5.Sum([]byte(value))
+			result[config.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % config.Modulus)
+		case RelabelLabelMap:
+			// Map from a sorted snapshot so the result does not depend on
+			// map order or on labels the rule itself adds
+			names := make([]string, 0, len(result))
+			for name := range result {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			mapped := make(map[string]string)
+			for _, name := range names {
+				if rule.regex.MatchString(name) {
+					mapped[rule.regex.ReplaceAllString(name, config.Replacement)] = result[name]
+				}
+			}
+			for name, value := range mapped {
+				result[name] = value
+			}
+		case RelabelLabelDrop, RelabelLabelKeep:
+			for name := range result {
+				if rule.regex.MatchString(name) == (config.Action == RelabelLabelDrop) {
+					delete(result, name)
+				}
+			}
+		}
+	}
+	return result, true
+}
+
+func isValidLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package ingestion
+
+import (
+	"testing"
+)
+
+func TestRelabel(t *testing.T) {
+	rules, err := CompileRelabelConfigs([]RelabelConfig{
+		{SourceLabels: []string{"__meta_env"}, Regex: "staging", Action: RelabelDrop},
+		{SourceLabels: []string{"__address__"}, Regex: "([^:]+):\\d+", TargetLabel: "host"},
+		{Regex: "__meta_(.+)", Action: RelabelLabelMap},
+		{SourceLabels: []string{"__address__"}, TargetLabel: "shard", Modulus: 4, Action: RelabelHashMod},
+		{Regex: "__meta_.*", Action: RelabelLabelDrop},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	labels, keep := Relabel(map[string]string{"__address__": "db1:9100", "__meta_env": "prod", "__meta_zone": "a"}, rules)
+	if !keep {
+		t.Fatal("Expected the production target to be kept")
+	}
+	if labels["host"] != "db1" || labels["env"] != "prod" || labels["zone"] != "a" || labels["shard"] == "" {
+		t.Errorf("Unexpected labels %v", labels)
+	}
+	if _, ok := labels["__meta_env"]; ok {
+		t.Errorf("Expected __meta labels to be dropped, got %v", labels)
+	}
+
+	if _, keep := Relabel(map[string]string{"__address__": "db2:9100", "__meta_env": "staging"}, rules); keep {
+		t.Error("Expected the staging target to be dropped")
+	}
+
+	// The regex is anchored, so a partial match does not keep
+	keepRules, _ := CompileRelabelConfigs([]RelabelConfig{{SourceLabels: []string{"job"}, Regex: "node", Action: RelabelKeep}})
+	if _, keep := Relabel(map[string]string{"job": "node_exporter"}, keepRules); keep {
+		t.Error("Expected a partial match not to keep the label set")
+	}
+
+	for _, invalid := range []RelabelConfig{
+		{Regex: "("},
+		{Action: RelabelReplace},
+		{Action: RelabelHashMod, TargetLabel: "shard"},
+		{Action: "rewrite"},
+	} {
+		if _, err := CompileRelabelConfigs([]RelabelConfig{invalid}); err == nil {
+			t.Errorf("Expected an error for %+v", invalid)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"time-series-analytics-engine/storage"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MaxRemoteWriteSize bounds the decompressed size of a remote write request
+const MaxRemoteWriteSize = 32 << 20
+
+// ExemplarWriter is implemented by storage that keeps exemplars. Exemplars
+// sent by Prometheus are dropped when the storage does not.
+type ExemplarWriter interface {
+	AddExemplar(seriesID string, exemplar storage.Exemplar) error
+}
+
+// RemoteWriteRequest is a decoded Prometheus remote write request
+type RemoteWriteRequest struct {
+	Timeseries []RemoteTimeSeries
+	Metadata   []RemoteMetadata
+}
+
+// RemoteTimeSeries is a series of a remote write request. Its labels
+// include __name__, the metric name.
+type RemoteTimeSeries struct {
+	Labels    map[string]string
+	Samples   []RemoteSample
+	Exemplars []storage.Exemplar
+	// Histograms counts native histogram samples, which are not supported
+	Histograms int
+}
+
+// RemoteSample is a sample with a timestamp in milliseconds
+type RemoteSample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// RemoteMetadata is the metadata of a metric family
+type RemoteMetadata struct {
+	Family string
+	Type   storage.MetricType
+	Help   string
+	Unit   string
+}
+
+// remoteMetricTypes maps the MetricType enum of remote write metadata
+var remoteMetricTypes = map[uint64]storage.MetricType{
+	1: storage.MetricTypeCounter,
+	2: storage.MetricTypeGauge,
+	3: storage.MetricTypeHistogram,
+	4: storage.MetricTypeHistogram, // gauge histogram
+	5: storage.MetricTypeSummary,
+}
+
+// DecodeRemoteWrite decodes the body of a Prometheus remote write request: a
+// snappy-compressed protobuf WriteRequest of the prometheus.prompb package
+func DecodeRemoteWrite(body []byte) (*RemoteWriteRequest, error) {
+	size, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy data: %w", err)
+	}
+	if size > MaxRemoteWriteSize {
+		return nil, fmt.Errorf("request of %d bytes exceeds the %d byte limit", size, MaxRemoteWriteSize)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy data: %w", err)
+	}
+
+	req := &RemoteWriteRequest{}
+	err = parseProtoFields(data, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			series, err := decodeRemoteTimeSeries(f.bytes)
+			if err != nil {
+				return fmt.Errorf("timeseries %d: %w", len(req.Timeseries), err)
+			}
+			req.Timeseries = append(req.Timeseries, series)
+		case f.num == 3 && f.typ == protowire.BytesType:
+			md, err := decodeRemoteMetadata(f.bytes)
+			if err != nil {
+				return fmt.Errorf("metadata: %w", err)
+			}
+			req.Metadata = append(req.Metadata, md)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid write request: %w", err)
+	}
+	return req, nil
+}
+
+func decodeRemoteTimeSeries(data []byte) (RemoteTimeSeries, error) {
+	series := RemoteTimeSeries{Labels: make(map[string]string)}
+	err := parseProtoFields(data, func(f protoField) error {
+		if f.typ != protowire.BytesType {
+			return nil
+		}
+		switch f.num {
+		case 1:
+			return decodeRemoteLabel(f.bytes, series.Labels)
+		case 2:
+			var sample RemoteSample
+			err := parseProtoFields(f.bytes, func(f protoField) error {
+				switch {
+				case f.num == 1 && f.typ == protowire.Fixed64Type:
+					sample.Value = math.Float64frombits(f.number)
+				case f.num == 2 && f.typ == protowire.VarintType:
+					sample.Timestamp = int64(f.number)
+				}
+				return nil
+			})
+			series.Samples = append(series.Samples, sample)
+			return err
+		case 3:
+			exemplar := storage.Exemplar{Labels: make(map[string]string)}
+			err := parseProtoFields(f.bytes, func(f protoField) error {
+				switch {
+				case f.num == 1 && f.typ == protowire.BytesType:
+					return decodeRemoteLabel(f.bytes, exemplar.Labels)
+				case f.num == 2 && f.typ == protowire.Fixed64Type:
+					exemplar.Value = math.Float64frombits(f.number)
+				case f.num == 3 && f.typ == protowire.VarintType:
+					exemplar.Timestamp = time.UnixMilli(int64(f.number))
+				}
+				return nil
+			})
+			series.Exemplars = append(series.Exemplars, exemplar)
+			return err
+		case 4:
+			series.Histograms++
+		}
+		return nil
+	})
+	return series, err
+}
+
+func decodeRemoteLabel(data []byte, labels map[string]string) error {
+	var name, value string
+	err := parseProtoFields(data, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			name = string(f.bytes)
+		case f.num == 2 && f.typ == protowire.BytesType:
+			value = string(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("label with empty name")
+	}
+	labels[name] = value
+	return nil
+}
+
+func decodeRemoteMetadata(data []byte) (RemoteMetadata, error) {
+	var md RemoteMetadata
+	err := parseProtoFields(data, func(f protoField) error {
+		switch {
+		case f.num == 1 && f.typ == protowire.VarintType:
+			md.Type = remoteMetricTypes[f.number]
+		case f.num == 2 && f.typ == protowire.BytesType:
+			md.Family = string(f.bytes)
+		case f.num == 4 && f.typ == protowire.BytesType:
+			md.Help = string(f.bytes)
+		case f.num == 5 && f.typ == protowire.BytesType:
+			md.Unit = string(f.bytes)
+		}
+		return nil
+	})
+	return md, err
+}
+
+// protoField is a field of a protobuf message. Varint and fixed64 values
+// are held in number; length-delimited values in bytes.
+type protoField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	number uint64
+	bytes  []byte
+}
+
+// parseProtoFields calls fn with each field of a protobuf message. Fields
+// of other wire types are skipped, so unknown fields are ignored as
+// protobuf requires.
+func parseProtoFields(data []byte, fn func(f protoField) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.number, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed64Type:
+			f.number, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IngestRemoteWrite ingests a Prometheus remote write request. The samples
+// of the request are admitted as a whole, and exemplars and metadata are
+// recorded once they are, when the storage supports them, so that a
+// rejected request can be retried without recording them twice. Invalid
+// series and samples are skipped and reported in the returned error; an
+// error for which IsRetryable is true means the request may be retried.
+func (sp *StreamProcessor) IngestRemoteWrite(req *RemoteWriteRequest) error {
+	var rejected int
+	var firstErr error
+	reject := func(err error) {
+		rejected++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var metrics []MetricData
+	type seriesExemplars struct {
+		name, seriesID string
+		exemplars      []storage.Exemplar
+	}
+	var exemplars []seriesExemplars
+	for _, series := range req.Timeseries {
+		name := series.Labels["__name__"]
+		if name == "" {
+			sp.incrementErrorCount()
+			reject(fmt.Errorf("series without __name__ label"))
+			continue
+		}
+		if series.Histograms > 0 {
+			reject(fmt.Errorf("%s: native histograms are not supported", name))
+		}
+		labels := make(map[string]string, len(series.Labels)-1)
+		for label, value := range series.Labels {
+			if label != "__name__" {
+				labels[label] = value
+			}
+		}
+		for _, sample := range series.Samples {
+			metrics = append(metrics, MetricData{
+				Name:      name,
+				Value:     sample.Value,
+				Timestamp: time.UnixMilli(sample.Timestamp),
+				Labels:    labels,
+			})
+		}
+		if len(series.Exemplars) > 0 {
+			exemplars = append(exemplars, seriesExemplars{name, storage.SeriesKey(name, labels), series.Exemplars})
+		}
+	}
+
+	ctx, cancel := sp.requestContext()
+	defer cancel()
+	invalid, err := sp.ingestMetrics(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	for _, err := range invalid {
+		reject(err)
+	}
+
+	if writer, ok := sp.storage.(ExemplarWriter); ok {
+		for _, series := range exemplars {
+			for _, exemplar := range series.exemplars {
+				if err := writer.AddExemplar(series.seriesID, exemplar); err != nil {
+					reject(fmt.Errorf("%s: exemplar: %w", series.name, err))
+				}
+			}
+		}
+	}
+	if writer, ok := sp.storage.(MetadataWriter); ok {
+		for _, md := range req.Metadata {
+			if md.Family == "" {
+				continue
+			}
+			err := writer.MergeMetadata(md.Family, storage.Metadata{Type: md.Type, Help: md.Help, Unit: md.Unit})
+			if err != nil {
+				reject(fmt.Errorf("failed to record metadata for %s: %w", md.Family, err))
+			}
+		}
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d samples rejected, first: %w", rejected, firstErr)
+	}
+	return nil
+}
+
+// ingestMetrics validates metrics and queues the valid ones for the
+// workers, waiting for admission until ctx is done. Invalid metrics are
+// skipped and their validation errors returned. Sources that can hold back
+// their input, such as consumers and TCP listeners, pass a context without
+// deadline so that a saturated pipeline slows them down.
+func (sp *StreamProcessor) ingestMetrics(ctx context.Context, metrics []MetricData) ([]error, error) {
+	start := time.Now()
+	defer func() { sp.intake.observe(time.Since(start)) }()
+
+	var invalid []error
+	valid := make([]MetricData, 0, len(metrics))
+	for _, metric := range metrics {
+		if err := sp.validator.ValidateMetric(metric); err != nil {
+			sp.incrementErrorCount()
+			invalid = append(invalid, fmt.Errorf("%s: validation failed: %w", metric.Name, err))
+			continue
+		}
+		valid = append(valid, metric)
+	}
+	if len(valid) == 0 {
+		return invalid, nil
+	}
+	return invalid, sp.enqueue(ctx, valid)
+}
+
+// IsRetryable reports whether an ingestion error is temporary, so that a
+// sender may retry the same data
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrNotRunning) || errors.Is(err, ErrSaturated)
+}
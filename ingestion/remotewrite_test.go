@@ -0,0 +1,159 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Builders of the protobuf messages of a remote write request
+
+func protoLabel(name, value string) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func protoSample(value float64, timestamp int64) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(value))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(timestamp))
+}
+
+func protoMessage(fields ...interface{}) []byte {
+	var b []byte
+	for i := 0; i < len(fields); i += 2 {
+		b = protowire.AppendTag(b, protowire.Number(fields[i].(int)), protowire.BytesType)
+		b = protowire.AppendBytes(b, fields[i+1].([]byte))
+	}
+	return b
+}
+
+func TestDecodeRemoteWrite(t *testing.T) {
+	now := time.Now().UnixMilli()
+	exemplar := protoMessage(1, protoLabel("trace_id", "abc123"))
+	exemplar = protowire.AppendTag(exemplar, 2, protowire.Fixed64Type)
+	exemplar = protowire.AppendFixed64(exemplar, math.Float64bits(0.42))
+	exemplar = protowire.AppendTag(exemplar, 3, protowire.VarintType)
+	exemplar = protowire.AppendVarint(exemplar, uint64(now))
+
+	series := protoMessage(
+		1, protoLabel("__name__", "http_requests_total"),
+		1, protoLabel("code", "200"),
+		2, protoSample(10, now-1000),
+		2, protoSample(12, now),
+		3, exemplar,
+	)
+	metadata := protowire.AppendTag(nil, 1, protowire.VarintType)
+	metadata = protowire.AppendVarint(metadata, 1)
+	metadata = append(metadata, protoMessage(2, []byte("http_requests_total"), 4, []byte("Requests served."))...)
+	// Unknown fields are skipped
+	unknown := protowire.AppendTag(nil, 9, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, 7)
+	body := snappy.Encode(nil, append(protoMessage(1, series, 3, metadata), unknown...))
+
+	req, err := DecodeRemoteWrite(body)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if len(req.Timeseries) != 1 || len(req.Metadata) != 1 {
+		t.Fatalf("Expected one series and one metadata entry, got %+v", req)
+	}
+	ts := req.Timeseries[0]
+	if ts.Labels["__name__"] != "http_requests_total" || ts.Labels["code"] != "200" || len(ts.Samples) != 2 {
+		t.Errorf("Unexpected series: %+v", ts)
+	}
+	if ts.Samples[1] != (RemoteSample{Value: 12, Timestamp: now}) {
+		t.Errorf("Unexpected sample: %+v", ts.Samples[1])
+	}
+	if len(ts.Exemplars) != 1 || ts.Exemplars[0].Labels["trace_id"] != "abc123" || ts.Exemplars[0].Value != 0.42 {
+		t.Errorf("Unexpected exemplars: %+v", ts.Exemplars)
+	}
+	if md := req.Metadata[0]; md.Family != "http_requests_total" || md.Type != storage.MetricTypeCounter || md.Help != "Requests served." {
+		t.Errorf("Unexpected metadata: %+v", md)
+	}
+
+	for name, invalid := range map[string][]byte{
+		"not snappy":  []byte("plain text"),
+		"truncated":   snappy.Encode(nil, protoMessage(1, series)[:10]),
+		"empty label": snappy.Encode(nil, protoMessage(1, protoMessage(1, protoLabel("", "x")))),
+	} {
+		if _, err := DecodeRemoteWrite(invalid); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// exemplarStorage is hot storage that also keeps exemplars and metadata
+type exemplarStorage struct {
+	*storage.HotStorage
+	exemplars *storage.ExemplarStore
+	metadata  map[string]storage.Metadata
+}
+
+func (s *exemplarStorage) AddExemplar(seriesID string, exemplar storage.Exemplar) error {
+	s.exemplars.Add(seriesID, exemplar)
+	return nil
+}
+
+func (s *exemplarStorage) MergeMetadata(metric string, md storage.Metadata) error {
+	s.metadata[metric] = md
+	return nil
+}
+
+func TestStreamProcessor_IngestRemoteWrite(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	store := &exemplarStorage{HotStorage: hot, exemplars: storage.NewExemplarStore(0), metadata: make(map[string]storage.Metadata)}
+	sp := NewStreamProcessor(store, 100, 2, time.Second)
+	sp.Start(context.Background())
+
+	now := time.Now().UnixMilli()
+	req := &RemoteWriteRequest{Timeseries: []RemoteTimeSeries{
+		{
+			Labels:  map[string]string{"__name__": "up", "job": "node"},
+			Samples: []RemoteSample{{Value: 1, Timestamp: now - 2000}, {Value: 1, Timestamp: now - 1000}, {Value: 0, Timestamp: now}},
+		},
+		{Labels: map[string]string{"job": "nameless"}, Samples: []RemoteSample{{Value: 1, Timestamp: now}}},
+	}, Metadata: []RemoteMetadata{{Family: "up", Type: storage.MetricTypeGauge}}}
+	err := sp.IngestRemoteWrite(req)
+	if err == nil || IsRetryable(err) {
+		t.Errorf("Expected a non-retryable error for the series without a name, got %v", err)
+	}
+	sp.Stop()
+
+	series, ok := hot.GetSeries(storage.SeriesKey("up", map[string]string{"job": "node"}))
+	if !ok || series.Size() != 3 {
+		t.Fatalf("Expected the named series' 3 samples to be stored")
+	}
+	if batches := sp.GetStats().Batches; batches < 2 {
+		t.Errorf("Expected samples to be flushed in batches of 2, got %d batches", batches)
+	}
+	if _, ok := store.metadata["up"]; !ok {
+		t.Error("Expected the metadata of the accepted request to be recorded")
+	}
+	delete(store.metadata, "up")
+
+	// Once stopped, writes should be retried, and nothing of the request
+	// recorded until they are
+	retried := &RemoteWriteRequest{
+		Timeseries: []RemoteTimeSeries{req.Timeseries[0]},
+		Metadata:   []RemoteMetadata{{Family: "up", Type: storage.MetricTypeGauge}},
+	}
+	retried.Timeseries[0].Exemplars = []storage.Exemplar{{Labels: map[string]string{"trace_id": "abc"}, Value: 1, Timestamp: time.UnixMilli(now)}}
+	err = sp.IngestRemoteWrite(retried)
+	if !IsRetryable(err) || !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected a retryable error, got %v", err)
+	}
+	seriesID := storage.SeriesKey("up", map[string]string{"job": "node"})
+	if exemplars := store.exemplars.Range(seriesID, time.Time{}, time.UnixMilli(now)); len(exemplars) != 0 || len(store.metadata) != 0 {
+		t.Errorf("Expected the rejected request's exemplars and metadata to be dropped, got %v and %v", exemplars, store.metadata)
+	}
+}
@@ -0,0 +1,584 @@
+package ingestion
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+const (
+	DefaultScrapeInterval     = time.Minute
+	DefaultScrapeTimeout      = 10 * time.Second
+	DefaultMetricsPath        = "/metrics"
+	DefaultTargetFileInterval = 30 * time.Second
+)
+
+// scrapeAcceptHeader prefers OpenMetrics, as Prometheus does
+const scrapeAcceptHeader = "application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.4,*/*;q=0.1"
+
+// TargetGroup is a set of targets sharing labels, as listed in static
+// configs and in target files
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// ScrapeJob configures the scraping of a set of targets. Targets come from
+// StaticTargets and from the JSON target files matching TargetFiles, which
+// are reread every RefreshInterval.
+//
+// Before scraping, each target's labels are relabeled with RelabelConfigs.
+// They include __address__, __scheme__, __metrics_path__,
+// __scrape_interval__ and __scrape_timeout__, which relabeling may change
+// per target, and __param_<name> labels become URL parameters. Labels
+// starting with __ are then removed. Scraped samples are relabeled with
+// MetricRelabelConfigs, the metric name being __name__.
+type ScrapeJob struct {
+	Name        string
+	Interval    time.Duration
+	Timeout     time.Duration
+	MetricsPath string
+	Scheme      string
+	// HonorLabels keeps scraped labels that clash with target labels; by
+	// default they are renamed exported_<name>
+	HonorLabels bool
+	// IgnoreTimestamps stamps samples with the scrape time even when the
+	// target gives a timestamp
+	IgnoreTimestamps bool
+	// SampleLimit fails scrapes returning more samples; zero means no limit
+	SampleLimit int
+
+	StaticTargets        []TargetGroup
+	TargetFiles          []string
+	RefreshInterval      time.Duration
+	RelabelConfigs       []RelabelConfig
+	MetricRelabelConfigs []RelabelConfig
+}
+
+// ScrapeTarget describes a target and the result of its last scrape
+type ScrapeTarget struct {
+	Job          string            `json:"job"`
+	URL          string            `json:"url"`
+	Labels       map[string]string `json:"labels"`
+	Health       string            `json:"health"` // "up", "down" or "unknown"
+	LastScrape   time.Time         `json:"last_scrape"`
+	LastDuration time.Duration     `json:"last_duration"`
+	LastError    string            `json:"last_error,omitempty"`
+}
+
+// ScrapeManager scrapes Prometheus and OpenMetrics endpoints and writes
+// their samples through a StreamProcessor. Each scrape also writes the
+// target's up, scrape_duration_seconds and scrape_samples_scraped series.
+//
+// Series that disappear from a target's output, and all series of a target
+// that fails to be scraped or is removed from discovery, get stale markers.
+type ScrapeManager struct {
+	jobs []*scrapeJob
+
+	mu     sync.Mutex
+	loops  map[string]*scrapeLoop
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type scrapeJob struct {
+	ScrapeJob
+	processor     *StreamProcessor
+	client        *http.Client
+	relabel       []*RelabelRule
+	metricRelabel []*RelabelRule
+}
+
+// NewScrapeManager checks scrape jobs and fills in their defaults
+func NewScrapeManager(processor *StreamProcessor, jobs []ScrapeJob) (*ScrapeManager, error) {
+	m := &ScrapeManager{loops: make(map[string]*scrapeLoop)}
+	client := &http.Client{}
+	names := make(map[string]bool)
+	for _, job := range jobs {
+		if job.Name == "" {
+			return nil, fmt.Errorf("scrape job needs a name")
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("duplicate scrape job %q", job.Name)
+		}
+		names[job.Name] = true
+
+		if job.Interval <= 0 {
+			job.Interval = DefaultScrapeInterval
+		}
+		if job.Timeout <= 0 {
+			job.Timeout = DefaultScrapeTimeout
+			if job.Timeout > job.Interval {
+				job.Timeout = job.Interval
+			}
+		}
+		if job.Timeout > job.Interval {
+			return nil, fmt.Errorf("scrape job %q: timeout %v exceeds interval %v", job.Name, job.Timeout, job.Interval)
+		}
+		if job.MetricsPath == "" {
+			job.MetricsPath = DefaultMetricsPath
+		}
+		if job.Scheme == "" {
+			job.Scheme = "http"
+		}
+		if job.Scheme != "http" && job.Scheme != "https" {
+			return nil, fmt.Errorf("scrape job %q: unsupported scheme %q", job.Name, job.Scheme)
+		}
+		if job.RefreshInterval <= 0 {
+			job.RefreshInterval = DefaultTargetFileInterval
+		}
+
+		compiled := &scrapeJob{ScrapeJob: job, processor: processor, client: client}
+		var err error
+		if compiled.relabel, err = CompileRelabelConfigs(job.RelabelConfigs); err != nil {
+			return nil, fmt.Errorf("scrape job %q: %w", job.Name, err)
+		}
+		if compiled.metricRelabel, err = CompileRelabelConfigs(job.MetricRelabelConfigs); err != nil {
+			return nil, fmt.Errorf("scrape job %q: metric relabeling: %w", job.Name, err)
+		}
+		m.jobs = append(m.jobs, compiled)
+	}
+	return m, nil
+}
+
+// Start discovers the targets of each job and starts scraping them
+func (m *ScrapeManager) Start() {
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	for _, job := range m.jobs {
+		groups := job.StaticTargets
+		if len(job.TargetFiles) > 0 {
+			fileGroups, err := readTargetFiles(job.TargetFiles)
+			if err != nil {
+				log.Printf("Scrape job %s: %v", job.Name, err)
+			}
+			groups = append(append([]TargetGroup{}, groups...), fileGroups...)
+
+			m.wg.Add(1)
+			go m.refreshTargetFiles(job)
+		}
+		m.sync(job, groups)
+	}
+}
+
+// Stop stops scraping. Unlike targets removed from discovery, the series of
+// scraped targets are not marked stale.
+func (m *ScrapeManager) Stop() {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, loop := range m.loops {
+		loop.stop(false)
+		delete(m.loops, key)
+	}
+}
+
+// Targets returns the current targets, sorted by job and URL
+func (m *ScrapeManager) Targets() []ScrapeTarget {
+	m.mu.Lock()
+	targets := make([]ScrapeTarget, 0, len(m.loops))
+	for _, loop := range m.loops {
+		targets = append(targets, loop.status())
+	}
+	m.mu.Unlock()
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Job != targets[j].Job {
+			return targets[i].Job < targets[j].Job
+		}
+		return targets[i].URL < targets[j].URL
+	})
+	return targets
+}
+
+// refreshTargetFiles rereads a job's target files until the manager stops.
+// If the files cannot be read, the job keeps its current targets.
+func (m *ScrapeManager) refreshTargetFiles(job *scrapeJob) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(job.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			fileGroups, err := readTargetFiles(job.TargetFiles)
+			if err != nil {
+				log.Printf("Scrape job %s: %v", job.Name, err)
+				continue
+			}
+			m.sync(job, append(append([]TargetGroup{}, job.StaticTargets...), fileGroups...))
+		}
+	}
+}
+
+// readTargetFiles reads the target groups of the JSON files matching any of
+// patterns
+func readTargetFiles(patterns []string) ([]TargetGroup, error) {
+	var groups []TargetGroup
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target file pattern %q: %w", pattern, err)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read target file: %w", err)
+			}
+			var fileGroups []TargetGroup
+			if err := json.Unmarshal(data, &fileGroups); err != nil {
+				return nil, fmt.Errorf("invalid target file %s: %w", file, err)
+			}
+			groups = append(groups, fileGroups...)
+		}
+	}
+	return groups, nil
+}
+
+// sync starts scraping a job's new targets and stops scraping those no
+// longer in groups, marking their series stale
+func (m *ScrapeManager) sync(job *scrapeJob, groups []TargetGroup) {
+	targets := job.targets(groups)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx.Err() != nil {
+		return
+	}
+	prefix := job.Name + "\x00"
+	for key, loop := range m.loops {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if _, ok := targets[strings.TrimPrefix(key, prefix)]; !ok {
+			loop.stop(true)
+			delete(m.loops, key)
+		}
+	}
+	for key, loop := range targets {
+		if _, ok := m.loops[prefix+key]; ok {
+			continue
+		}
+		m.loops[prefix+key] = loop
+		loop.start(m.ctx)
+	}
+}
+
+// targets returns scrape loops for the targets of groups, keyed by target
+func (j *scrapeJob) targets(groups []TargetGroup) map[string]*scrapeLoop {
+	loops := make(map[string]*scrapeLoop)
+	for _, group := range groups {
+		for _, address := range group.Targets {
+			labels := make(map[string]string, len(group.Labels)+6)
+			for name, value := range group.Labels {
+				labels[name] = value
+			}
+			labels["__address__"] = address
+			for name, value := range map[string]string{
+				"job":                 j.Name,
+				"__scheme__":          j.Scheme,
+				"__metrics_path__":    j.MetricsPath,
+				"__scrape_interval__": j.Interval.String(),
+				"__scrape_timeout__":  j.Timeout.String(),
+			} {
+				if _, ok := labels[name]; !ok {
+					labels[name] = value
+				}
+			}
+
+			labels, keep := Relabel(labels, j.relabel)
+			if !keep || labels["__address__"] == "" {
+				continue
+			}
+			loop, err := newScrapeLoop(j, labels)
+			if err != nil {
+				log.Printf("Scrape job %s: target %s: %v", j.Name, address, err)
+				continue
+			}
+			loops[loop.url+storage.SeriesKey("", loop.labels)] = loop
+		}
+	}
+	return loops
+}
+
+// scrapeLoop scrapes one target every interval
+type scrapeLoop struct {
+	job      *scrapeJob
+	url      string
+	labels   map[string]string
+	interval time.Duration
+	timeout  time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// series holds the series of the last scrape, to mark those missing
+	// from the next one stale. Only the loop's goroutine uses it until it
+	// is done.
+	series map[string]MetricData
+
+	mu   sync.Mutex
+	last ScrapeTarget
+}
+
+func newScrapeLoop(job *scrapeJob, discovered map[string]string) (*scrapeLoop, error) {
+	interval, err := time.ParseDuration(discovered["__scrape_interval__"])
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid scrape interval %q", discovered["__scrape_interval__"])
+	}
+	timeout, err := time.ParseDuration(discovered["__scrape_timeout__"])
+	if err != nil || timeout <= 0 || timeout > interval {
+		return nil, fmt.Errorf("invalid scrape timeout %q", discovered["__scrape_timeout__"])
+	}
+	address := discovered["__address__"]
+	if strings.Contains(address, "/") {
+		return nil, fmt.Errorf("address %q must be a host and port", address)
+	}
+	target := url.URL{Scheme: discovered["__scheme__"], Host: address, Path: discovered["__metrics_path__"]}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+
+	params := url.Values{}
+	labels := make(map[string]string)
+	for name, value := range discovered {
+		if param := strings.TrimPrefix(name, "__param_"); param != name {
+			params.Set(param, value)
+		}
+		if !strings.HasPrefix(name, "__") {
+			labels[name] = value
+		}
+	}
+	if _, ok := labels["instance"]; !ok {
+		labels["instance"] = address
+	}
+	target.RawQuery = params.Encode()
+
+	loop := &scrapeLoop{
+		job:      job,
+		url:      target.String(),
+		labels:   labels,
+		interval: interval,
+		timeout:  timeout,
+		series:   make(map[string]MetricData),
+	}
+	loop.last = ScrapeTarget{Job: job.Name, URL: loop.url, Labels: labels, Health: "unknown"}
+	return loop, nil
+}
+
+func (l *scrapeLoop) start(ctx context.Context) {
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.done = make(chan struct{})
+	go l.run(ctx)
+}
+
+// stop stops the loop, optionally marking the target's series stale
+func (l *scrapeLoop) stop(markStale bool) {
+	l.cancel()
+	<-l.done
+	if markStale {
+		l.markStale(time.Now())
+	}
+}
+
+func (l *scrapeLoop) status() ScrapeTarget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+func (l *scrapeLoop) run(ctx context.Context) {
+	defer close(l.done)
+
+	// Spread targets over the interval so they are not all scraped at once
+	h := fnv.New64a()
+	h.Write([]byte(l.url + storage.SeriesKey("", l.labels)))
+	offset := time.Duration(h.Sum64() % uint64(l.interval))
+	timer := time.NewTimer(offset)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return
+	case <-timer.C:
+	}
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		l.scrape(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrape scrapes the target once and writes its samples, its report series
+// and stale markers for the series it no longer returns
+func (l *scrapeLoop) scrape(ctx context.Context) {
+	start := time.Now()
+	samples, metadata, err := l.fetch(ctx, start)
+	duration := time.Since(start)
+	if ctx.Err() != nil {
+		// Stopped mid-scrape; the failure says nothing of the target
+		return
+	}
+
+	batch := make([]MetricData, 0, len(samples)+len(l.series)+3)
+	current := make(map[string]MetricData, len(samples))
+	for _, sample := range samples {
+		current[storage.SeriesKey(sample.Name, sample.Labels)] = sample
+		batch = append(batch, sample)
+	}
+	for key, previous := range l.series {
+		if _, ok := current[key]; !ok {
+			batch = append(batch, MetricData{Name: previous.Name, Labels: previous.Labels, Value: storage.StaleNaN, Timestamp: start})
+		}
+	}
+	l.series = current
+
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	report := func(name string, value float64) MetricData {
+		return MetricData{Name: name, Labels: l.labels, Value: value, Timestamp: start}
+	}
+	batch = append(batch,
+		report("up", up),
+		report("scrape_duration_seconds", duration.Seconds()),
+		report("scrape_samples_scraped", float64(len(samples))),
+	)
+
+	if writer, ok := l.job.processor.storage.(MetadataWriter); ok {
+		for name, md := range metadata {
+			if err := writer.MergeMetadata(name, md); err != nil {
+				log.Printf("Scrape %s: metadata for %s: %v", l.url, name, err)
+			}
+		}
+	}
+	if _, err := l.job.processor.ingestMetrics(context.Background(), batch); err != nil {
+		log.Printf("Scrape %s: %v", l.url, err)
+	}
+
+	l.mu.Lock()
+	l.last.Health = "up"
+	l.last.LastError = ""
+	if err != nil {
+		l.last.Health = "down"
+		l.last.LastError = err.Error()
+	}
+	l.last.LastScrape = start
+	l.last.LastDuration = duration
+	l.mu.Unlock()
+}
+
+// fetch scrapes the target, returning its samples with target labels added
+// and metric relabeling applied
+func (l *scrapeLoop) fetch(ctx context.Context, now time.Time) ([]MetricData, map[string]storage.Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", scrapeAcceptHeader)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", strconv.FormatFloat(l.timeout.Seconds(), 'f', -1, 64))
+	resp, err := l.job.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+
+	parse := ParsePrometheusText
+	if contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); contentType == "application/openmetrics-text" {
+		parse = ParseOpenMetricsText
+	}
+	parsed, err := parse(resp.Body, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit := l.job.SampleLimit; limit > 0 && len(parsed.Metrics) > limit {
+		return nil, nil, fmt.Errorf("sample limit of %d exceeded with %d samples", limit, len(parsed.Metrics))
+	}
+
+	samples := make([]MetricData, 0, len(parsed.Metrics))
+	for _, metric := range parsed.Metrics {
+		if sample, ok := l.targetSample(metric, now); ok {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, parsed.Metadata, nil
+}
+
+// targetSample adds the target's labels to a scraped sample and applies
+// metric relabeling, which may drop it
+func (l *scrapeLoop) targetSample(metric MetricData, now time.Time) (MetricData, bool) {
+	labels := make(map[string]string, len(metric.Labels)+len(l.labels))
+	for name, value := range metric.Labels {
+		labels[name] = value
+	}
+	for name, value := range l.labels {
+		if existing, ok := labels[name]; ok {
+			if l.job.HonorLabels {
+				continue
+			}
+			if existing != "" {
+				labels["exported_"+name] = existing
+			}
+		}
+		labels[name] = value
+	}
+
+	if len(l.job.metricRelabel) > 0 {
+		labels["__name__"] = metric.Name
+		var keep bool
+		if labels, keep = Relabel(labels, l.job.metricRelabel); !keep || labels["__name__"] == "" {
+			return metric, false
+		}
+		metric.Name = labels["__name__"]
+		delete(labels, "__name__")
+	}
+	metric.Labels = labels
+	if l.job.IgnoreTimestamps {
+		metric.Timestamp = now
+	}
+	return metric, true
+}
+
+// markStale writes stale markers for the series of the last scrape, and for
+// the target's report series
+func (l *scrapeLoop) markStale(now time.Time) {
+	batch := make([]MetricData, 0, len(l.series)+3)
+	for _, series := range l.series {
+		batch = append(batch, MetricData{Name: series.Name, Labels: series.Labels, Value: storage.StaleNaN, Timestamp: now})
+	}
+	for _, name := range []string{"up", "scrape_duration_seconds", "scrape_samples_scraped"} {
+		batch = append(batch, MetricData{Name: name, Labels: l.labels, Value: storage.StaleNaN, Timestamp: now})
+	}
+	l.series = make(map[string]MetricData)
+	if _, err := l.job.processor.ingestMetrics(context.Background(), batch); err != nil {
+		log.Printf("Scrape %s: %v", l.url, err)
+	}
+}
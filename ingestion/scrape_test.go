@@ -0,0 +1,190 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func latestValue(hot *storage.HotStorage, name string, labels map[string]string) (float64, bool) {
+	series, ok := hot.GetSeries(storage.SeriesKey(name, labels))
+	if !ok || series.Size() == 0 {
+		return 0, false
+	}
+	return series.GetLatest(1)[0].Value, true
+}
+
+func TestScrapeManager(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 1, time.Second)
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	var scrapes atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := scrapes.Add(1)
+		if r.URL.Path != "/custom" || r.URL.Query().Get("module") != "http" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# TYPE jobs_total counter")
+		fmt.Fprintf(w, "jobs_total{instance=\"worker\"} %d\n", n)
+		fmt.Fprintln(w, "debug_value 1")
+		// The temporary series disappears after the first scrape
+		if n == 1 {
+			fmt.Fprintln(w, "temporary 1")
+		}
+	}))
+	defer target.Close()
+	address := strings.TrimPrefix(target.URL, "http://")
+
+	manager, err := NewScrapeManager(sp, []ScrapeJob{{
+		Name:          "app",
+		Interval:      20 * time.Millisecond,
+		MetricsPath:   "/custom",
+		StaticTargets: []TargetGroup{{Targets: []string{address}, Labels: map[string]string{"env": "test"}}},
+		RelabelConfigs: []RelabelConfig{
+			{TargetLabel: "__param_module", Replacement: "http"},
+		},
+		MetricRelabelConfigs: []RelabelConfig{
+			{SourceLabels: []string{"__name__"}, Regex: "debug_.*", Action: RelabelDrop},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create scrape manager: %v", err)
+	}
+	manager.Start()
+
+	targetLabels := map[string]string{"job": "app", "instance": address, "env": "test"}
+	jobsLabels := map[string]string{"job": "app", "instance": address, "env": "test", "exported_instance": "worker"}
+	waitFor(t, "three scrapes", func() bool {
+		series, ok := hot.GetSeries(storage.SeriesKey("jobs_total", jobsLabels))
+		return ok && series.Size() >= 3
+	})
+	manager.Stop()
+
+	if up, ok := latestValue(hot, "up", targetLabels); !ok || up != 1 {
+		t.Errorf("Expected up to be 1, got %v", up)
+	}
+	if _, ok := latestValue(hot, "scrape_duration_seconds", targetLabels); !ok {
+		t.Error("Expected a scrape_duration_seconds series")
+	}
+	if _, ok := latestValue(hot, "debug_value", targetLabels); ok {
+		t.Error("Expected debug_value to be dropped by metric relabeling")
+	}
+	if value, _ := latestValue(hot, "temporary", targetLabels); !storage.IsStaleMarker(value) {
+		t.Errorf("Expected the disappeared series to be marked stale, got %v", value)
+	}
+	targets := manager.Targets()
+	if len(targets) != 0 {
+		t.Errorf("Expected no targets after stopping, got %+v", targets)
+	}
+}
+
+func TestScrapeManager_TargetFiles(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 1, time.Second)
+	sp.Start(context.Background())
+	defer sp.Stop()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0")
+		fmt.Fprint(w, "temperature 21.5\n# EOF\n")
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthyAddress := strings.TrimPrefix(healthy.URL, "http://")
+	failingAddress := strings.TrimPrefix(failing.URL, "http://")
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.json")
+	writeTargets := func(addresses ...string) {
+		content := fmt.Sprintf(`[{"targets": ["%s"], "labels": {"room": "lab"}}]`, strings.Join(addresses, `", "`))
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTargets(healthyAddress, failingAddress)
+
+	manager, err := NewScrapeManager(sp, []ScrapeJob{{
+		Name:            "sensors",
+		Interval:        20 * time.Millisecond,
+		TargetFiles:     []string{filepath.Join(dir, "*.json")},
+		RefreshInterval: 20 * time.Millisecond,
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create scrape manager: %v", err)
+	}
+	manager.Start()
+	defer manager.Stop()
+
+	healthyLabels := map[string]string{"job": "sensors", "instance": healthyAddress, "room": "lab"}
+	failingLabels := map[string]string{"job": "sensors", "instance": failingAddress, "room": "lab"}
+	waitFor(t, "both targets scraped", func() bool {
+		_, healthyOK := latestValue(hot, "temperature", healthyLabels)
+		_, failingOK := latestValue(hot, "up", failingLabels)
+		return healthyOK && failingOK
+	})
+	if up, _ := latestValue(hot, "up", failingLabels); up != 0 {
+		t.Errorf("Expected up to be 0 for the failing target, got %v", up)
+	}
+	targets := manager.Targets()
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %+v", targets)
+	}
+	for _, target := range targets {
+		if (target.Labels["instance"] == failingAddress) != (target.Health == "down") || target.Job != "sensors" {
+			t.Errorf("Unexpected target status %+v", target)
+		}
+	}
+
+	// Removing the healthy target from the file marks its series stale
+	writeTargets(failingAddress)
+	waitFor(t, "the removed target's series to be marked stale", func() bool {
+		value, _ := latestValue(hot, "temperature", healthyLabels)
+		up, _ := latestValue(hot, "up", healthyLabels)
+		return storage.IsStaleMarker(value) && storage.IsStaleMarker(up)
+	})
+	if targets := manager.Targets(); len(targets) != 1 {
+		t.Errorf("Expected 1 target left, got %+v", targets)
+	}
+}
+
+func TestNewScrapeManager_Invalid(t *testing.T) {
+	for name, jobs := range map[string][]ScrapeJob{
+		"missing name":   {{}},
+		"duplicate":      {{Name: "a"}, {Name: "a"}},
+		"timeout":        {{Name: "a", Interval: time.Second, Timeout: 2 * time.Second}},
+		"scheme":         {{Name: "a", Scheme: "ftp"}},
+		"relabel":        {{Name: "a", RelabelConfigs: []RelabelConfig{{Regex: "("}}}},
+		"metric relabel": {{Name: "a", MetricRelabelConfigs: []RelabelConfig{{Action: "bogus"}}}},
+	} {
+		if _, err := NewScrapeManager(nil, jobs); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package ingestion
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// StatsDType is the type of a StatsD metric
+type StatsDType string
+
+const (
+	StatsDCounter      StatsDType = "c"
+	StatsDGauge        StatsDType = "g"
+	StatsDTimer        StatsDType = "ms"
+	StatsDHistogram    StatsDType = "h"
+	StatsDDistribution StatsDType = "d"
+	StatsDSet          StatsDType = "s"
+)
+
+// StatsDMetric is one parsed StatsD metric
+type StatsDMetric struct {
+	Name string
+	Type StatsDType
+	// Value is the numeric value of counters, gauges and timers
+	Value float64
+	// SetValue is the member added to a set
+	SetValue string
+	// Delta marks a gauge value written with a sign, which adjusts the gauge
+	// rather than setting it
+	Delta      bool
+	SampleRate float64
+	// Tags are DogStatsD tags; a tag without a value is given "true"
+	Tags map[string]string
+}
+
+// ParseStatsD parses a StatsD line such as
+//
+//	api.requests:1|c|@0.5|#route:/users,method:get
+//
+// Lines in the format of Etsy's StatsD and of DogStatsD are accepted.
+func ParseStatsD(line string) (StatsDMetric, error) {
+	metric := StatsDMetric{SampleRate: 1}
+
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return metric, fmt.Errorf("invalid statsd line %q", line)
+	}
+	metric.Name = line[:colon]
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return metric, fmt.Errorf("missing type in %q", line)
+	}
+	rawValue := parts[0]
+	metric.Type = StatsDType(parts[1])
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return metric, fmt.Errorf("invalid sample rate %q", part)
+			}
+			metric.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			metric.Tags = parseStatsDTags(part[1:])
+		}
+		// Other DogStatsD extensions such as container IDs are ignored
+	}
+
+	switch metric.Type {
+	case StatsDSet:
+		if rawValue == "" {
+			return metric, fmt.Errorf("empty set value in %q", line)
+		}
+		metric.SetValue = rawValue
+		return metric, nil
+	case StatsDGauge:
+		metric.Delta = strings.HasPrefix(rawValue, "+") || strings.HasPrefix(rawValue, "-")
+	case StatsDCounter, StatsDTimer, StatsDHistogram, StatsDDistribution:
+	default:
+		return metric, fmt.Errorf("unknown metric type %q", metric.Type)
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return metric, fmt.Errorf("invalid value %q", rawValue)
+	}
+	metric.Value = value
+	return metric, nil
+}
+
+func parseStatsDTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		if name, value, ok := strings.Cut(tag, ":"); ok {
+			tags[name] = value
+		} else {
+			tags[tag] = "true"
+		}
+	}
+	return tags
+}
+
+// IngestStatsDFormat ingests the lines of a StatsD packet as they are,
+// without aggregation: counters scaled by their sample rate, gauges and
+// timer values as samples. Sets and gauge deltas need the state kept by a
+// StatsDServer and are rejected. Lines that are rejected are returned as
+// LineErrors; the other lines are still ingested, together, so an error for
+// which IsRetryable is true means none were.
+func (sp *StreamProcessor) IngestStatsDFormat(statsdLine string) error {
+	now := time.Now()
+	var metrics []MetricData
+	var lineErrors LineErrors
+	for i, line := range strings.Split(statsdLine, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		metric, err := parseStatsDSample(line, now)
+		if err == nil {
+			if err = sp.validator.ValidateMetric(metric); err != nil {
+				err = fmt.Errorf("validation failed: %w", err)
+			}
+		}
+		if err != nil {
+			sp.incrementErrorCount()
+			lineErrors = append(lineErrors, LineError{Line: i + 1, Err: err.Error()})
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	if len(metrics) > 0 {
+		ctx, cancel := sp.requestContext()
+		defer cancel()
+		start := time.Now()
+		err := sp.enqueue(ctx, metrics)
+		sp.intake.observe(time.Since(start))
+		if err != nil {
+			return err
+		}
+	}
+	if len(lineErrors) > 0 {
+		return lineErrors
+	}
+	return nil
+}
+
+// parseStatsDSample parses a StatsD line into a sample written as it is
+func parseStatsDSample(line string, now time.Time) (MetricData, error) {
+	metric, err := ParseStatsD(line)
+	if err != nil {
+		return MetricData{}, fmt.Errorf("statsd parsing failed: %w", err)
+	}
+	value := metric.Value
+	switch {
+	case metric.Type == StatsDSet || metric.Delta:
+		return MetricData{}, fmt.Errorf("statsd %s needs aggregation by a StatsD server", metric.Name)
+	case metric.Type == StatsDCounter:
+		value /= metric.SampleRate
+	}
+	return MetricData{Name: metric.Name, Value: value, Timestamp: now, Labels: metric.Tags}, nil
+}
+
+// StatsDAggregator aggregates StatsD metrics over a flush interval, as the
+// StatsD daemon does: counters are summed, timer values summarized by count,
+// sum, mean, min, max and percentiles, and sets reduced to the number of
+// unique members. Gauges keep their value across intervals so that deltas
+// apply to it, but are only written in intervals where they were updated,
+// and are forgotten once not updated for the gauge expiry.
+type StatsDAggregator struct {
+	mu          sync.Mutex
+	percentiles []float64
+	gaugeExpiry time.Duration
+	entries     map[string]*statsdEntry
+}
+
+type statsdEntry struct {
+	name        string
+	labels      map[string]string
+	kind        StatsDType
+	value       float64 // counter sum or gauge value
+	updated     bool
+	lastUpdated time.Time
+	values      []float64
+	count       float64 // timer count, scaled by sample rates
+	set         map[string]struct{}
+}
+
+// DefaultStatsDGaugeExpiry is how long a gauge that is no longer updated is
+// kept for deltas
+const DefaultStatsDGaugeExpiry = 5 * time.Minute
+
+// NewStatsDAggregator creates an aggregator reporting the given timer
+// percentiles, e.g. 50, 90, 99
+func NewStatsDAggregator(percentiles []float64) *StatsDAggregator {
+	return &StatsDAggregator{
+		percentiles: percentiles,
+		gaugeExpiry: DefaultStatsDGaugeExpiry,
+		entries:     make(map[string]*statsdEntry),
+	}
+}
+
+// SetGaugeExpiry sets how long a gauge that is no longer updated is kept.
+// A delta arriving after it expired applies to zero.
+func (a *StatsDAggregator) SetGaugeExpiry(expiry time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.gaugeExpiry = expiry
+}
+
+// Add records a metric in the current interval
+func (a *StatsDAggregator) Add(metric StatsDMetric) {
+	kind := metric.Type
+	if kind == StatsDHistogram || kind == StatsDDistribution {
+		kind = StatsDTimer
+	}
+	key := string(kind) + "|" + storage.SeriesKey(metric.Name, metric.Tags)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.entries[key]
+	if !ok {
+		entry = &statsdEntry{name: metric.Name, labels: metric.Tags, kind: kind}
+		a.entries[key] = entry
+	}
+
+	switch kind {
+	case StatsDCounter:
+		entry.value += metric.Value / metric.SampleRate
+	case StatsDGauge:
+		if metric.Delta {
+			entry.value += metric.Value
+		} else {
+			entry.value = metric.Value
+		}
+	case StatsDTimer:
+		entry.values = append(entry.values, metric.Value)
+		entry.count += 1 / metric.SampleRate
+	case StatsDSet:
+		if entry.set == nil {
+			entry.set = make(map[string]struct{})
+		}
+		entry.set[metric.SetValue] = struct{}{}
+	}
+	entry.updated = true
+	entry.lastUpdated = time.Now()
+}
+
+// Flush returns the aggregates of the interval ending at now and starts a
+// new interval. Counters are written as their sum, under the metric name,
+// and their per-second rate, under name.rate.
+func (a *StatsDAggregator) Flush(now time.Time, interval time.Duration) []MetricData {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var metrics []MetricData
+	emit := func(entry *statsdEntry, suffix string, value float64) {
+		metrics = append(metrics, MetricData{Name: entry.name + suffix, Value: value, Timestamp: now, Labels: entry.labels})
+	}
+	for key, entry := range a.entries {
+		switch entry.kind {
+		case StatsDCounter:
+			emit(entry, "", entry.value)
+			if interval > 0 {
+				emit(entry, ".rate", entry.value/interval.Seconds())
+			}
+		case StatsDGauge:
+			// Other entries only exist once updated
+			if !entry.updated {
+				if now.Sub(entry.lastUpdated) > a.gaugeExpiry {
+					delete(a.entries, key)
+				}
+				continue
+			}
+			emit(entry, "", entry.value)
+			entry.updated = false
+			continue // gauges keep their value for later deltas
+		case StatsDTimer:
+			values := entry.values
+			sort.Float64s(values)
+			var sum float64
+			for _, v := range values {
+				sum += v
+			}
+			emit(entry, ".count", entry.count)
+			emit(entry, ".sum", sum)
+			emit(entry, ".mean", sum/float64(len(values)))
+			emit(entry, ".min", values[0])
+			emit(entry, ".max", values[len(values)-1])
+			for _, p := range a.percentiles {
+				emit(entry, "."+percentileName(p), percentile(values, p))
+			}
+		case StatsDSet:
+			emit(entry, "", float64(len(entry.set)))
+		}
+		delete(a.entries, key)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// percentile returns the nearest-rank percentile p of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// percentileName names a percentile series suffix, e.g. p99 or p99_9
+func percentileName(p float64) string {
+	return "p" + strings.ReplaceAll(strconv.FormatFloat(p, 'f', -1, 64), ".", "_")
+}
+
+// StatsDServerConfig configures a StatsDServer
+type StatsDServerConfig struct {
+	// UDPAddress and TCPAddress are the addresses to listen on; an empty
+	// address disables that protocol
+	UDPAddress    string
+	TCPAddress    string
+	FlushInterval time.Duration
+	Percentiles   []float64
+	// GaugeExpiry is how long gauges that are no longer updated are kept,
+	// DefaultStatsDGaugeExpiry when zero
+	GaugeExpiry time.Duration
+}
+
+// StatsDServer receives StatsD metrics over UDP and TCP, aggregates them
+// and writes the aggregates through the stream processor every flush
+// interval. Over TCP, metrics are newline-separated on a connection.
+// Lines that fail to parse are counted, and summarized in the log once per
+// flush interval.
+type StatsDServer struct {
+	processor  *StreamProcessor
+	aggregator *StatsDAggregator
+	config     StatsDServerConfig
+
+	udp net.PacketConn
+	tcp net.Listener
+	// conns holds the open TCP connections; once stopping is set no more
+	// are accepted
+	conns     map[net.Conn]struct{}
+	stopping  bool
+	connsMu   sync.Mutex
+	lastFlush time.Time
+	stopChan  chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+
+	received    int64
+	parseErrors int64
+	// unlogged counts the parse errors since the last summary, of which
+	// lastParseError is the latest
+	unlogged       int64
+	lastParseError error
+	statsMu        sync.Mutex
+}
+
+// NewStatsDServer creates a StatsD server writing to processor
+func NewStatsDServer(processor *StreamProcessor, config StatsDServerConfig) *StatsDServer {
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 10 * time.Second
+	}
+	aggregator := NewStatsDAggregator(config.Percentiles)
+	if config.GaugeExpiry > 0 {
+		aggregator.SetGaugeExpiry(config.GaugeExpiry)
+	}
+	return &StatsDServer{
+		processor:  processor,
+		aggregator: aggregator,
+		config:     config,
+		conns:      make(map[net.Conn]struct{}),
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// Start opens the listeners and starts the flush routine
+func (s *StatsDServer) Start() error {
+	if s.config.UDPAddress == "" && s.config.TCPAddress == "" {
+		return fmt.Errorf("statsd server needs a UDP or TCP address")
+	}
+	if s.config.UDPAddress != "" {
+		udp, err := net.ListenPacket("udp", s.config.UDPAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen on udp %s: %w", s.config.UDPAddress, err)
+		}
+		s.udp = udp
+	}
+	if s.config.TCPAddress != "" {
+		tcp, err := net.Listen("tcp", s.config.TCPAddress)
+		if err != nil {
+			if s.udp != nil {
+				s.udp.Close()
+			}
+			return fmt.Errorf("failed to listen on tcp %s: %w", s.config.TCPAddress, err)
+		}
+		s.tcp = tcp
+	}
+
+	s.lastFlush = time.Now()
+	if s.udp != nil {
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+	if s.tcp != nil {
+		s.wg.Add(1)
+		go s.serveTCP()
+	}
+	s.wg.Add(1)
+	go s.flushRoutine()
+	return nil
+}
+
+// Stop closes the listeners and connections and writes the aggregates of
+// the last interval. Later calls do nothing.
+func (s *StatsDServer) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+		if s.udp != nil {
+			s.udp.Close()
+		}
+		if s.tcp != nil {
+			s.tcp.Close()
+		}
+		s.connsMu.Lock()
+		s.stopping = true
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsMu.Unlock()
+		s.wg.Wait()
+		s.Flush()
+	})
+}
+
+// UDPAddr returns the address of the UDP listener, or nil
+func (s *StatsDServer) UDPAddr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// TCPAddr returns the address of the TCP listener, or nil
+func (s *StatsDServer) TCPAddr() net.Addr {
+	if s.tcp == nil {
+		return nil
+	}
+	return s.tcp.Addr()
+}
+
+// Stats returns the number of metrics received and of lines that failed to
+// parse
+func (s *StatsDServer) Stats() (received, parseErrors int64) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.received, s.parseErrors
+}
+
+// Flush writes the aggregates of the current interval through the stream
+// processor, waiting while ingestion is saturated, and logs the parse
+// errors of the interval
+func (s *StatsDServer) Flush() {
+	now := time.Now()
+	s.statsMu.Lock()
+	interval := now.Sub(s.lastFlush)
+	s.lastFlush = now
+	unlogged, lastParseError := s.unlogged, s.lastParseError
+	s.unlogged, s.lastParseError = 0, nil
+	s.statsMu.Unlock()
+	if unlogged > 0 {
+		log.Printf("StatsD: %d malformed lines in the last %v, latest: %v", unlogged, interval.Round(time.Millisecond), lastParseError)
+	}
+
+	if metrics := s.aggregator.Flush(now, interval); len(metrics) > 0 {
+		invalid, err := s.processor.ingestMetrics(context.Background(), metrics)
+		for _, err := range invalid {
+			log.Printf("StatsD: %v", err)
+		}
+		if err != nil {
+			log.Printf("StatsD flush: %v", err)
+		}
+	}
+}
+
+func (s *StatsDServer) flushRoutine() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			s.Flush()
+		}
+	}
+}
+
+func (s *StatsDServer) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("StatsD UDP read error: %v", err)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			s.handleLine(line)
+		}
+	}
+}
+
+func (s *StatsDServer) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("StatsD TCP accept error: %v", err)
+			continue
+		}
+		s.connsMu.Lock()
+		if s.stopping {
+			s.connsMu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		// Added under the lock so that Stop, once it has set stopping,
+		// waits for every connection
+		s.wg.Add(1)
+		s.connsMu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.connsMu.Lock()
+				delete(s.conns, conn)
+				s.connsMu.Unlock()
+				conn.Close()
+			}()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				s.handleLine(scanner.Text())
+			}
+		}()
+	}
+}
+
+func (s *StatsDServer) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	metric, err := ParseStatsD(line)
+	s.statsMu.Lock()
+	if err != nil {
+		s.parseErrors++
+		s.unlogged++
+		s.lastParseError = err
+	} else {
+		s.received++
+	}
+	s.statsMu.Unlock()
+	if err != nil {
+		return
+	}
+	s.aggregator.Add(metric)
+}
@@ -0,0 +1,140 @@
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func TestParseStatsD(t *testing.T) {
+	metric, err := ParseStatsD("api.requests:2|c|@0.5|#route:/users,canary")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if metric.Name != "api.requests" || metric.Type != StatsDCounter || metric.Value != 2 || metric.SampleRate != 0.5 {
+		t.Errorf("Unexpected counter: %+v", metric)
+	}
+	if metric.Tags["route"] != "/users" || metric.Tags["canary"] != "true" {
+		t.Errorf("Unexpected tags: %v", metric.Tags)
+	}
+
+	if gauge, _ := ParseStatsD("queue.depth:-3|g"); !gauge.Delta || gauge.Value != -3 {
+		t.Errorf("Expected a gauge delta, got %+v", gauge)
+	}
+	if gauge, _ := ParseStatsD("queue.depth:3|g"); gauge.Delta {
+		t.Errorf("Expected an absolute gauge, got %+v", gauge)
+	}
+	if set, _ := ParseStatsD("users:alice|s"); set.SetValue != "alice" {
+		t.Errorf("Unexpected set: %+v", set)
+	}
+
+	for _, invalid := range []string{"novalue", "x:1", "x:1|q", "x:abc|c", "x:1|c|@2", "x:|s"} {
+		if _, err := ParseStatsD(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestStatsDAggregator(t *testing.T) {
+	aggregator := NewStatsDAggregator([]float64{50, 99.9})
+	for _, line := range []string{
+		"hits:1|c", "hits:1|c|@0.1",
+		"temp:20|g", "temp:+5|g",
+		"latency:10|ms", "latency:30|ms", "latency:20|ms|@0.5", "latency:40|h",
+		"users:a|s", "users:b|s", "users:a|s",
+	} {
+		metric, err := ParseStatsD(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		aggregator.Add(metric)
+	}
+
+	values := func(metrics []MetricData) map[string]float64 {
+		result := make(map[string]float64)
+		for _, m := range metrics {
+			result[m.Name] = m.Value
+		}
+		return result
+	}
+	got := values(aggregator.Flush(time.Now(), 10*time.Second))
+	expected := map[string]float64{
+		"hits": 11, "hits.rate": 1.1,
+		"temp":          25,
+		"latency.count": 5, "latency.sum": 100, "latency.mean": 25, "latency.min": 10, "latency.max": 40,
+		"latency.p50": 20, "latency.p99_9": 40,
+		"users": 2,
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Expected %d aggregates, got %v", len(expected), got)
+	}
+	for name, value := range expected {
+		if v, ok := got[name]; !ok || v != value {
+			t.Errorf("%s: expected %v, got %v", name, value, v)
+		}
+	}
+
+	// Only updated gauges are written, and deltas apply to the kept value
+	if got := aggregator.Flush(time.Now(), 10*time.Second); len(got) != 0 {
+		t.Errorf("Expected an empty interval, got %+v", got)
+	}
+	delta, _ := ParseStatsD("temp:-10|g")
+	aggregator.Add(delta)
+	if got := values(aggregator.Flush(time.Now(), 10*time.Second)); len(got) != 1 || got["temp"] != 15 {
+		t.Errorf("Expected the gauge delta to apply, got %v", got)
+	}
+
+	// Gauges no longer updated expire, so later deltas start from zero
+	aggregator.SetGaugeExpiry(time.Minute)
+	aggregator.Flush(time.Now().Add(2*time.Minute), 10*time.Second)
+	aggregator.Add(delta)
+	if got := values(aggregator.Flush(time.Now(), 10*time.Second)); got["temp"] != -10 {
+		t.Errorf("Expected the expired gauge to be forgotten, got %v", got)
+	}
+}
+
+func TestStatsDServer(t *testing.T) {
+	hot := storage.NewHotStorage(1000, 10000)
+	sp := NewStreamProcessor(hot, 100, 10, time.Second)
+	sp.Start(context.Background())
+	server := NewStatsDServer(sp, StatsDServerConfig{UDPAddress: "127.0.0.1:0", TCPAddress: "127.0.0.1:0", FlushInterval: time.Hour})
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+
+	udp, err := net.Dial("udp", server.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(udp, "jobs:1|c|#queue:mail\njobs:2|c|#queue:mail\nbroken")
+	udp.Close()
+	tcp, err := net.Dial("tcp", server.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(tcp, "jobs:4|c|#queue:mail\n")
+	tcp.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		received, parseErrors := server.Stats()
+		if received == 3 && parseErrors == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 metrics and 1 error, got %d and %d", received, parseErrors)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Stop()
+	server.Stop()
+	sp.Stop()
+
+	series, ok := hot.GetSeries(storage.SeriesKey("jobs", map[string]string{"queue": "mail"}))
+	if !ok || series.Size() != 1 || series.GetLatest(1)[0].Value != 7 {
+		t.Errorf("Expected the counter sum of 7 to be written on stop")
+	}
+}
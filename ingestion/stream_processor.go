@@ -3,11 +3,14 @@ package ingestion
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 	"time-series-analytics-engine/analytics"
+	"time-series-analytics-engine/storage"
 )
 
 // MetricData represents incoming metric data
@@ -16,6 +19,13 @@ type MetricData struct {
 	Value     float64           `json:"value"`
 	Timestamp time.Time         `json:"timestamp"`
 	Labels    map[string]string `json:"labels"`
+	// Sketch makes the metric a histogram sample; Value is then ignored
+	Sketch *storage.Sketch `json:"sketch,omitempty"`
+	// Fields makes the metric a measurement of several named values, such
+	// as the temperature and battery level of one device reading. Each field
+	// is stored as a series labelled with storage.FieldLabel; Value is then
+	// ignored.
+	Fields map[string]storage.FieldValue `json:"fields,omitempty"`
 }
 
 // DataSource represents different ingestion sources
@@ -29,32 +39,71 @@ const (
 	StatsDSource     DataSource = "statsd"
 )
 
+// ErrNotRunning is returned when metrics are ingested while the processor is
+// stopped. Unlike invalid metrics, they may be accepted once it restarts.
+var ErrNotRunning = errors.New("stream processor not running")
+
 // StorageWriter interface for abstracting storage operations
 type StorageWriter interface {
 	AddPoint(seriesID string, labels map[string]string, timestamp time.Time, value float64) error
 }
 
-// StreamProcessor handles real-time data ingestion and processing
+// HistogramWriter is implemented by storage that keeps histogram samples.
+// Metrics carrying a sketch are rejected when the storage does not.
+type HistogramWriter interface {
+	AddHistogram(seriesID string, labels map[string]string, timestamp time.Time, sketch *storage.Sketch) error
+}
+
+// ValueWriter is implemented by storage that keeps integer, boolean and
+// string values. Fields of those types are rejected when the storage does
+// not; float fields only need AddPoint.
+type ValueWriter interface {
+	AddValue(seriesID string, labels map[string]string, timestamp time.Time, value storage.FieldValue) error
+}
+
+// StreamProcessor handles real-time data ingestion and processing. It is a
+// pipeline: ingested metrics are validated and routed to the queue of one
+// of its workers, sharded by series so each series keeps its order, and
+// each worker writes its metrics to storage in batches. Requests only share
+// intakeMu, held for reading while they queue, and contend on a shard's
+// lock only while appending to that shard's queue.
+// Intake is bounded by rate limits and by the buffer size, and requests
+// that cannot be admitted in time fail with ErrSaturated.
 type StreamProcessor struct {
 	storage          StorageWriter
 	bufferSize       int
 	batchSize        int
 	flushInterval    time.Duration
-	dataBuffer       []MetricData
-	bufferMutex      sync.Mutex
-	isRunning        bool
+	workers          int
+	
+	// lifecycleMu serializes Start and Stop. Ingestion holds intakeMu for
+	// reading while it queues, so Stop waits for it by taking it for
+	// writing; the shards are only replaced while nothing is in flight.
+	lifecycleMu      sync.Mutex
+	intakeMu         sync.RWMutex
+	running          atomic.Bool
+	shards           []*shard
 	stopChan         chan struct{}
 	wg               sync.WaitGroup
 	
-	// Statistics
-	stats struct {
-		TotalIngested    int64
-		TotalProcessed   int64
-		TotalErrors      int64
-		BatchesProcessed int64
-		AnomaliesDetected int64
-		mu               sync.RWMutex
-	}
+	// Backpressure: rate limits, and queue slots counted against each
+	// shard's share of the buffer size. Requests waiting for space wait on space, which is
+	// closed and replaced when workers free slots; draining is closed by
+	// Stop to turn waiting requests away.
+	backpressure     BackpressureConfig
+	limiter          *ingestLimiter
+	blockTimeout     time.Duration
+	spaceWaiters     atomic.Int32
+	spaceMu          sync.Mutex
+	space            chan struct{}
+	draining         chan struct{}
+	
+	// Statistics of each pipeline stage
+	intake           stageCounter
+	queueStage       stageCounter
+	writeStage       stageCounter
+	batches          atomic.Int64
+	saturation       backpressureCounter
 	
 	// Data validation and anomaly detection
 	validator       *DataValidator
@@ -109,6 +158,14 @@ func (dv *DataValidator) ValidateMetric(metric MetricData) error {
 	if metric.Value > dv.maxValueRange || metric.Value < -dv.maxValueRange {
 		return fmt.Errorf("value %f outside allowed range", metric.Value)
 	}
+	for field, value := range metric.Fields {
+		if field == "" {
+			return fmt.Errorf("field name must not be empty")
+		}
+		if number := value.Number(); number > dv.maxValueRange || number < -dv.maxValueRange {
+			return fmt.Errorf("field '%s' value %f outside allowed range", field, number)
+		}
+	}
 	
 	// Check timestamp is not too far in future (allow up to 1 hour)
 	now := time.Now()
@@ -131,90 +188,108 @@ func NewStreamProcessor(storage StorageWriter, bufferSize, batchSize int, flushI
 		bufferSize:    bufferSize,
 		batchSize:     batchSize,
 		flushInterval: flushInterval,
-		dataBuffer:    make([]MetricData, 0, bufferSize),
-		stopChan:      make(chan struct{}),
+		workers:       DefaultWorkerCount,
+		backpressure:  BackpressureConfig{TenantLabel: DefaultTenantLabel},
 		validator:     NewDataValidator(),
 	}
 }
 
-// Start begins the stream processing
+// SetWorkerCount sets the number of workers writing to storage, which
+// takes effect when the processor is next started
+func (sp *StreamProcessor) SetWorkerCount(workers int) {
+	sp.lifecycleMu.Lock()
+	defer sp.lifecycleMu.Unlock()
+	if workers > 0 {
+		sp.workers = workers
+	}
+}
+
+// Start starts the workers. The processor runs until Stop is called or ctx
+// is done.
 func (sp *StreamProcessor) Start(ctx context.Context) error {
-	sp.bufferMutex.Lock()
-	if sp.isRunning {
-		sp.bufferMutex.Unlock()
+	sp.lifecycleMu.Lock()
+	defer sp.lifecycleMu.Unlock()
+	if sp.running.Load() {
 		return fmt.Errorf("stream processor already running")
 	}
-	sp.isRunning = true
-	sp.bufferMutex.Unlock()
 	
-	// Start background flush routine
-	sp.wg.Add(1)
-	go sp.flushRoutine(ctx)
+	// The buffer is shared between the shard queues
+	capacity := (sp.bufferSize + sp.workers - 1) / sp.workers
+	if capacity < 1 {
+		capacity = 1
+	}
+	sp.limiter = newIngestLimiter(sp.backpressure)
+	sp.blockTimeout = sp.backpressure.BlockTimeout
+	sp.space = make(chan struct{})
+	sp.draining = make(chan struct{})
+	sp.shards = make([]*shard, sp.workers)
+	sp.stopChan = make(chan struct{})
+	for i := range sp.shards {
+		sp.shards[i] = newShard(capacity)
+		sp.wg.Add(1)
+		go sp.runWorker(sp.shards[i], sp.stopChan)
+	}
+	sp.running.Store(true)
+	
+	go func(stop <-chan struct{}) {
+		select {
+		case <-ctx.Done():
+			sp.Stop()
+		case <-stop:
+		}
+	}(sp.stopChan)
 	
 	return nil
 }
 
-// Stop stops the stream processor
+// Stop stops accepting metrics and returns once the workers have written
+// everything queued
 func (sp *StreamProcessor) Stop() {
-	sp.bufferMutex.Lock()
-	if !sp.isRunning {
-		sp.bufferMutex.Unlock()
+	sp.lifecycleMu.Lock()
+	defer sp.lifecycleMu.Unlock()
+	if !sp.running.Load() {
 		return
 	}
-	sp.isRunning = false
-	sp.bufferMutex.Unlock()
+	sp.running.Store(false)
+	close(sp.draining)
 	
+	// Ingest calls that saw the processor running finish queueing first,
+	// or give up if still waiting for the rate limits or queue space
+	sp.intakeMu.Lock()
 	close(sp.stopChan)
+	sp.intakeMu.Unlock()
 	sp.wg.Wait()
-	
-	// Flush remaining data
-	sp.flushBuffer()
 }
 
-// IngestMetric adds a single metric to the processing buffer
+// IngestMetric validates a metric and queues it for its worker, waiting up
+// to the block timeout while ingestion is saturated
 func (sp *StreamProcessor) IngestMetric(metric MetricData) error {
+	start := time.Now()
+	defer func() { sp.intake.observe(time.Since(start)) }()
+	
 	// Validate metric
 	if err := sp.validator.ValidateMetric(metric); err != nil {
 		sp.incrementErrorCount()
 		return fmt.Errorf("validation failed: %w", err)
 	}
 	
-	sp.bufferMutex.Lock()
-	defer sp.bufferMutex.Unlock()
-	
-	if !sp.isRunning {
-		return fmt.Errorf("stream processor not running")
-	}
-	
-	// Check buffer capacity
-	if len(sp.dataBuffer) >= sp.bufferSize {
-		sp.bufferMutex.Unlock()
-		sp.flushBuffer()
-		sp.bufferMutex.Lock()
-	}
-	
-	sp.dataBuffer = append(sp.dataBuffer, metric)
-	sp.incrementIngestedCount()
-	
-	// Trigger flush if batch size reached
-	if len(sp.dataBuffer) >= sp.batchSize {
-		sp.bufferMutex.Unlock()
-		sp.flushBuffer()
-		sp.bufferMutex.Lock()
-	}
-	
-	return nil
+	ctx, cancel := sp.requestContext()
+	defer cancel()
+	return sp.enqueue(ctx, []MetricData{metric})
 }
 
-// IngestBatch processes multiple metrics at once
+// IngestBatch processes multiple metrics at once, waiting up to the block
+// timeout while ingestion is saturated. Invalid metrics are logged and
+// skipped; an error means none of the metrics were ingested.
 func (sp *StreamProcessor) IngestBatch(metrics []MetricData) error {
-	for _, metric := range metrics {
-		if err := sp.IngestMetric(metric); err != nil {
-			log.Printf("Error ingesting metric %s: %v", metric.Name, err)
-			// Continue processing other metrics
-		}
+	ctx, cancel := sp.requestContext()
+	defer cancel()
+	invalid, err := sp.ingestMetrics(ctx, metrics)
+	for _, err := range invalid {
+		// Continue processing other metrics
+		log.Printf("Error ingesting metric %v", err)
 	}
-	return nil
+	return err
 }
 
 // IngestJSON processes JSON-encoded metric data
@@ -228,95 +303,118 @@ func (sp *StreamProcessor) IngestJSON(jsonData []byte) error {
 	return sp.IngestMetric(metric)
 }
 
-// flushRoutine runs in background to periodically flush the buffer
-func (sp *StreamProcessor) flushRoutine(ctx context.Context) {
-	defer sp.wg.Done()
-	
-	ticker := time.NewTicker(sp.flushInterval)
-	defer ticker.Stop()
-	
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-sp.stopChan:
-			return
-		case <-ticker.C:
-			sp.flushBuffer()
+// Flush writes buffered data to storage, returning once every metric
+// ingested before the call has been written. It returns the first error
+// writing to storage since the previous flush, from any source; consumers
+// that acknowledge data to its source, such as by committing Kafka
+// offsets, tell their own failures apart with a writeTracker.
+func (sp *StreamProcessor) Flush() error {
+	sp.intakeMu.RLock()
+	if !sp.running.Load() {
+		sp.intakeMu.RUnlock()
+		// Stop has written everything
+		return sp.takeWriteError()
+	}
+	// Each worker writes its batch when the marker reaches the front of
+	// its queue, after everything queued before it. Stop only stops the
+	// workers once the markers are queued, and workers answer every marker
+	// they take, stopping or not, into done without blocking.
+	done := make(chan error, len(sp.shards))
+	for _, shard := range sp.shards {
+		shard.push(pipelineItem{flushed: done})
+	}
+	shards := len(sp.shards)
+	sp.intakeMu.RUnlock()
+	var firstErr error
+	for i := 0; i < shards; i++ {
+		if err := <-done; err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
+	return firstErr
 }
 
-// flushBuffer writes buffered data to storage
-func (sp *StreamProcessor) flushBuffer() {
-	sp.bufferMutex.Lock()
-	if len(sp.dataBuffer) == 0 {
-		sp.bufferMutex.Unlock()
-		return
+// takeWriteError returns and clears the first write error of each shard
+// left by a stopped processor
+func (sp *StreamProcessor) takeWriteError() error {
+	sp.lifecycleMu.Lock()
+	defer sp.lifecycleMu.Unlock()
+	var firstErr error
+	for _, shard := range sp.shards {
+		if err := shard.takeError(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	
-	// Copy buffer for processing
-	batch := make([]MetricData, len(sp.dataBuffer))
-	copy(batch, sp.dataBuffer)
-	
-	// Clear buffer
-	sp.dataBuffer = sp.dataBuffer[:0]
-	sp.bufferMutex.Unlock()
-	
-	// Process batch
-	sp.processBatch(batch)
-	sp.incrementBatchCount()
+	return firstErr
 }
 
-// processBatch writes a batch of metrics to storage
-func (sp *StreamProcessor) processBatch(batch []MetricData) {
-	for _, metric := range batch {
-		err := sp.storage.AddPoint(
-			metric.Name,
-			metric.Labels,
-			metric.Timestamp,
-			metric.Value,
-		)
-		
-		if err != nil {
-			log.Printf("Error storing metric %s: %v", metric.Name, err)
-			sp.incrementErrorCount()
-		} else {
-			sp.incrementProcessedCount()
+// storeMetric writes a metric to storage that is not a BatchWriter
+func (sp *StreamProcessor) storeMetric(metric MetricData, seriesID string) error {
+	if len(metric.Fields) > 0 {
+		return sp.storeFields(metric)
+	}
+	if metric.Sketch != nil {
+		if writer, ok := sp.storage.(HistogramWriter); ok {
+			return writer.AddHistogram(seriesID, metric.Labels, metric.Timestamp, metric.Sketch)
 		}
+		return fmt.Errorf("%w histograms", errUnsupportedValue)
 	}
+	return sp.storage.AddPoint(seriesID, metric.Labels, metric.Timestamp, metric.Value)
 }
 
-// Statistics methods
-func (sp *StreamProcessor) incrementIngestedCount() {
-	sp.stats.mu.Lock()
-	sp.stats.TotalIngested++
-	sp.stats.mu.Unlock()
-}
-
-func (sp *StreamProcessor) incrementProcessedCount() {
-	sp.stats.mu.Lock()
-	sp.stats.TotalProcessed++
-	sp.stats.mu.Unlock()
+// storeFields writes each field of a measurement to its own series. Every
+// field is attempted; the first failure is returned.
+func (sp *StreamProcessor) storeFields(metric MetricData) error {
+	var firstErr error
+	for _, field := range storage.SortedFields(metric.Fields) {
+		value := metric.Fields[field]
+		labels := storage.FieldLabels(metric.Labels, field)
+		seriesID := storage.SeriesKey(metric.Name, labels)
+
+		var err error
+		if writer, ok := sp.storage.(ValueWriter); ok {
+			err = writer.AddValue(seriesID, labels, metric.Timestamp, value)
+		} else if value.Type == storage.ValueFloat {
+			err = sp.storage.AddPoint(seriesID, labels, metric.Timestamp, value.Float)
+		} else {
+			err = fmt.Errorf("%w %s values", errUnsupportedValue, value.Type)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("field %s: %w", field, err)
+		}
+	}
+	return firstErr
 }
 
+// incrementErrorCount counts a metric rejected at intake
 func (sp *StreamProcessor) incrementErrorCount() {
-	sp.stats.mu.Lock()
-	sp.stats.TotalErrors++
-	sp.stats.mu.Unlock()
+	sp.intake.errors.Add(1)
 }
 
-func (sp *StreamProcessor) incrementBatchCount() {
-	sp.stats.mu.Lock()
-	sp.stats.BatchesProcessed++
-	sp.stats.mu.Unlock()
-}
-
-// GetStats returns current processing statistics
-func (sp *StreamProcessor) GetStats() (int64, int64, int64, int64) {
-	sp.stats.mu.RLock()
-	defer sp.stats.mu.RUnlock()
-	return sp.stats.TotalIngested, sp.stats.TotalProcessed, sp.stats.TotalErrors, sp.stats.BatchesProcessed
+// GetStats returns the statistics of each pipeline stage
+func (sp *StreamProcessor) GetStats() PipelineStats {
+	stats := PipelineStats{
+		Running: sp.running.Load(),
+		Intake:  sp.intake.snapshot(),
+		Write:   sp.writeStage.snapshot(),
+		Batches: sp.batches.Load(),
+	}
+	stats.Queue.StageStats = sp.queueStage.snapshot()
+	stats.Backpressure = sp.saturation.snapshot()
+	
+	sp.lifecycleMu.Lock()
+	defer sp.lifecycleMu.Unlock()
+	stats.Workers = len(sp.shards)
+	for _, shard := range sp.shards {
+		depth := int(shard.slots.Load())
+		stats.Queue.Depth += depth
+		stats.Queue.Capacity += int(shard.capacity)
+		if depth > stats.Queue.MaxShardDepth {
+			stats.Queue.MaxShardDepth = depth
+		}
+		stats.Pending += int(shard.pending.Load())
+	}
+	return stats
 }
 
 // HTTP endpoint handler for metric ingestion
@@ -347,32 +445,16 @@ func (sp *StreamProcessor) IngestPrometheusFormat(metricName string, labels map[
 	return sp.IngestMetric(metric)
 }
 
-// Simulate StatsD format ingestion
-func (sp *StreamProcessor) IngestStatsDFormat(statsdLine string) error {
-	// Simple StatsD parser (gauge format: metric_name:value|g)
-	// This is a simplified implementation for testing
-	metric := MetricData{
-		Name:      "statsd.metric", // Would parse from statsdLine
-		Value:     42.0,            // Would parse from statsdLine
-		Timestamp: time.Now(),
-		Labels:    map[string]string{"source": "statsd"},
-	}
-	
-	return sp.IngestMetric(metric)
-}
-
-// GetBufferSize returns current buffer utilization
+// GetBufferSize returns the number of metrics queued or batched but not
+// yet written
 func (sp *StreamProcessor) GetBufferSize() int {
-	sp.bufferMutex.Lock()
-	defer sp.bufferMutex.Unlock()
-	return len(sp.dataBuffer)
+	stats := sp.GetStats()
+	return stats.Queue.Depth + stats.Pending
 }
 
 // IsRunning returns whether the processor is active
 func (sp *StreamProcessor) IsRunning() bool {
-	sp.bufferMutex.Lock()
-	defer sp.bufferMutex.Unlock()
-	return sp.isRunning
+	return sp.running.Load()
 }
 
 // GetValidator returns the data validator for configuration
@@ -2,6 +2,7 @@ package ingestion
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 	"time-series-analytics-engine/storage"
@@ -136,7 +137,8 @@ func TestStreamProcessor_IngestSingleMetric(t *testing.T) {
 	// Wait a bit for processing
 	time.Sleep(150 * time.Millisecond)
 	
-	ingested, processed, errors, _ := processor.GetStats()
+	stats := processor.GetStats()
+	ingested, processed, errors := stats.Intake.Count, stats.Write.Count, stats.Intake.Errors+stats.Write.Errors
 	if ingested != 1 {
 		t.Errorf("Expected 1 ingested metric, got %d", ingested)
 	}
@@ -171,7 +173,8 @@ func TestStreamProcessor_IngestBatch(t *testing.T) {
 	// Wait for processing
 	time.Sleep(150 * time.Millisecond)
 	
-	ingested, processed, errors, _ := processor.GetStats()
+	stats := processor.GetStats()
+	ingested, processed, errors := stats.Intake.Count, stats.Write.Count, stats.Intake.Errors+stats.Write.Errors
 	if ingested != 3 {
 		t.Errorf("Expected 3 ingested metrics, got %d", ingested)
 	}
@@ -212,7 +215,8 @@ func TestStreamProcessor_BatchFlush(t *testing.T) {
 		t.Errorf("Buffer should be empty after batch flush, got size %d", processor.GetBufferSize())
 	}
 	
-	ingested, processed, errors, batches := processor.GetStats()
+	stats := processor.GetStats()
+	ingested, processed, errors, batches := stats.Intake.Count, stats.Write.Count, stats.Intake.Errors+stats.Write.Errors, stats.Batches
 	if ingested != 3 {
 		t.Errorf("Expected 3 ingested metrics, got %d", ingested)
 	}
@@ -251,7 +255,8 @@ func TestStreamProcessor_TimeBasedFlush(t *testing.T) {
 	// Wait for time-based flush
 	time.Sleep(100 * time.Millisecond)
 	
-	ingested, processed, _, batches := processor.GetStats()
+	stats := processor.GetStats()
+	ingested, processed, batches := stats.Intake.Count, stats.Write.Count, stats.Batches
 	if ingested != 1 {
 		t.Errorf("Expected 1 ingested metric, got %d", ingested)
 	}
@@ -285,7 +290,8 @@ func TestStreamProcessor_JSONIngestion(t *testing.T) {
 	
 	time.Sleep(150 * time.Millisecond)
 	
-	ingested, processed, errors, _ := processor.GetStats()
+	stats := processor.GetStats()
+	ingested, processed, errors := stats.Intake.Count, stats.Write.Count, stats.Intake.Errors+stats.Write.Errors
 	if ingested != 1 {
 		t.Errorf("Expected 1 ingested metric, got %d", ingested)
 	}
@@ -312,7 +318,7 @@ func TestStreamProcessor_InvalidJSON(t *testing.T) {
 		t.Error("Invalid JSON should return error")
 	}
 	
-	_, _, errors, _ := processor.GetStats()
+	errors := processor.GetStats().Intake.Errors
 	if errors == 0 {
 		t.Error("Expected error count to increment for invalid JSON")
 	}
@@ -338,7 +344,8 @@ func TestStreamProcessor_PrometheusFormat(t *testing.T) {
 	
 	time.Sleep(150 * time.Millisecond)
 	
-	ingested, processed, _, _ := processor.GetStats()
+	stats := processor.GetStats()
+	ingested, processed := stats.Intake.Count, stats.Write.Count
 	if ingested != 1 {
 		t.Errorf("Expected 1 ingested metric, got %d", ingested)
 	}
@@ -360,14 +367,22 @@ func TestStreamProcessor_StatsDFormat(t *testing.T) {
 		t.Errorf("Failed to ingest StatsD format: %v", err)
 	}
 	
+	// Bad lines are reported without stopping the others
+	err = processor.IngestStatsDFormat("broken\ntest.users:a|s\ntest.counter:2|c|@0.5")
+	var lineErrors LineErrors
+	if !errors.As(err, &lineErrors) || len(lineErrors) != 2 || lineErrors[0].Line != 1 || lineErrors[1].Line != 2 {
+		t.Errorf("Expected lines 1 and 2 to be reported, got %v", err)
+	}
+	
 	time.Sleep(150 * time.Millisecond)
 	
-	ingested, processed, _, _ := processor.GetStats()
-	if ingested != 1 {
-		t.Errorf("Expected 1 ingested metric, got %d", ingested)
+	stats := processor.GetStats()
+	ingested, processed := stats.Intake.Count, stats.Write.Count
+	if ingested != 2 {
+		t.Errorf("Expected 2 ingested metrics, got %d", ingested)
 	}
-	if processed != 1 {
-		t.Errorf("Expected 1 processed metric, got %d", processed)
+	if processed != 2 {
+		t.Errorf("Expected 2 processed metrics, got %d", processed)
 	}
 }
 
@@ -397,7 +412,7 @@ func TestStreamProcessor_ValidationErrors(t *testing.T) {
 	
 	time.Sleep(50 * time.Millisecond)
 	
-	_, _, errors, _ := processor.GetStats()
+	errors := processor.GetStats().Intake.Errors
 	if errors == 0 {
 		t.Error("Expected error count to increment for validation failure")
 	}
@@ -440,4 +455,58 @@ func BenchmarkDataValidator_ValidateMetric(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		validator.ValidateMetric(metric)
 	}
-}
\ No newline at end of file
+}
+
+func TestStreamProcessor_IngestFields(t *testing.T) {
+	hotStorage := storage.NewHotStorage(1000, 10000)
+	processor := NewStreamProcessor(hotStorage, 100, 10, time.Second)
+	processor.Start(context.Background())
+
+	now := time.Now()
+	metric := MetricData{
+		Name:      "sensor",
+		Timestamp: now,
+		Labels:    map[string]string{"device": "d1"},
+		Fields: map[string]storage.FieldValue{
+			"temperature": storage.FloatValue(21.5),
+			"battery":     storage.IntValue(87),
+			"charging":    storage.BoolValue(true),
+			"status":      storage.StringValue("ok"),
+		},
+	}
+	if err := processor.IngestMetric(metric); err != nil {
+		t.Fatalf("Failed to ingest measurement: %v", err)
+	}
+	// A string where an integer was written before is a type conflict
+	metric.Timestamp = now.Add(time.Second)
+	metric.Fields = map[string]storage.FieldValue{"battery": storage.StringValue("full")}
+	processor.IngestMetric(metric)
+	processor.Stop()
+
+	point := func(field string) storage.DataPoint {
+		labels := storage.FieldLabels(map[string]string{"device": "d1"}, field)
+		series, ok := hotStorage.GetSeries(storage.SeriesKey("sensor", labels))
+		if !ok || series.Size() != 1 {
+			t.Fatalf("Expected one point for field %s", field)
+		}
+		return series.GetLatest(1)[0]
+	}
+	if p := point("temperature"); p.Type != storage.ValueFloat || p.Value != 21.5 {
+		t.Errorf("Unexpected temperature: %+v", p)
+	}
+	if p := point("battery"); p.Type != storage.ValueInt || p.Value != 87 {
+		t.Errorf("Unexpected battery: %+v", p)
+	}
+	if p := point("charging"); p.Type != storage.ValueBool || p.Value != 1 {
+		t.Errorf("Unexpected charging: %+v", p)
+	}
+	if p := point("status"); p.Type != storage.ValueString || p.Text != "ok" {
+		t.Errorf("Unexpected status: %+v", p)
+	}
+
+	stats := processor.GetStats()
+	processed, errors := stats.Write.Count, stats.Write.Errors
+	if processed != 1 || errors != 1 {
+		t.Errorf("Expected 1 processed measurement and 1 conflict, got %d and %d", processed, errors)
+	}
+}
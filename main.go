@@ -34,6 +34,7 @@ func main() {
 			MaxPointsPerSeries: cfg.Storage.Hot.MaxPointsPerSeries,
 			RetentionPeriod:    cfg.Storage.Hot.RetentionPeriod.Duration,
 			CleanupInterval:    cfg.Storage.Hot.CleanupInterval.Duration,
+			StaleAfter:         cfg.Storage.Hot.StaleAfter.Duration,
 		},
 		Warm: storage.WarmStorageConfig{
 			Enabled:            cfg.Storage.Warm.Enabled,
@@ -80,13 +81,22 @@ func main() {
 		cfg.Ingestion.BatchSize,
 		cfg.Ingestion.FlushInterval.Duration,
 	)
+	streamProcessor.SetWorkerCount(cfg.Ingestion.WorkerPoolSize)
+	streamProcessor.SetBackpressure(ingestion.BackpressureConfig{
+		RatePerSecond:       cfg.Ingestion.RateLimitPerSecond,
+		Burst:               cfg.Ingestion.RateLimitBurst,
+		TenantRatePerSecond: cfg.Ingestion.TenantRateLimitPerSecond,
+		TenantBurst:         cfg.Ingestion.TenantRateLimitBurst,
+		TenantLabel:         cfg.Ingestion.TenantLabel,
+		BlockTimeout:        cfg.Ingestion.BlockTimeout.Duration,
+	})
 
 	// Configure data validation rules
 	streamProcessor.GetValidator().SetAllowedMetrics(cfg.Ingestion.ValidationRules.AllowedMetrics)
 	streamProcessor.GetValidator().SetRequiredLabels(cfg.Ingestion.ValidationRules.RequiredLabels)
 
-	log.Printf("Stream processor initialized (buffer: %d, batch: %d, flush: %v)", 
-		cfg.Ingestion.BufferSize, cfg.Ingestion.BatchSize, cfg.Ingestion.FlushInterval.Duration)
+	log.Printf("Stream processor initialized (buffer: %d, batch: %d, flush: %v, workers: %d)", 
+		cfg.Ingestion.BufferSize, cfg.Ingestion.BatchSize, cfg.Ingestion.FlushInterval.Duration, cfg.Ingestion.WorkerPoolSize)
 
 	// Start stream processor
 	ctx, cancel := context.WithCancel(context.Background())
@@ -97,8 +107,122 @@ func main() {
 	}
 	log.Println("Stream processor started")
 
+	// Start the StatsD listener, which writes its aggregates through the
+	// stream processor
+	var statsdServer *ingestion.StatsDServer
+	if statsdCfg := cfg.Ingestion.StatsD; statsdCfg.Enabled {
+		statsdServer = ingestion.NewStatsDServer(streamProcessor, ingestion.StatsDServerConfig{
+			UDPAddress:    statsdCfg.UDPAddress,
+			TCPAddress:    statsdCfg.TCPAddress,
+			FlushInterval: statsdCfg.FlushInterval.Duration,
+			Percentiles:   statsdCfg.Percentiles,
+			GaugeExpiry:   statsdCfg.GaugeExpiry.Duration,
+		})
+		if err := statsdServer.Start(); err != nil {
+			log.Fatalf("Failed to start StatsD server: %v", err)
+		}
+		log.Printf("StatsD server listening (udp: %q, tcp: %q, flush: %v)",
+			statsdCfg.UDPAddress, statsdCfg.TCPAddress, statsdCfg.FlushInterval.Duration)
+	}
+
+	// Start the Graphite plaintext and pickle listeners
+	var graphiteServer *ingestion.GraphiteServer
+	if graphiteCfg := cfg.Ingestion.Graphite; graphiteCfg.Enabled {
+		graphiteServer, err = ingestion.NewGraphiteServer(streamProcessor, ingestion.GraphiteServerConfig{
+			PlaintextAddress: graphiteCfg.PlaintextAddress,
+			PickleAddress:    graphiteCfg.PickleAddress,
+			Templates:        graphiteCfg.Templates,
+		})
+		if err != nil {
+			log.Fatalf("Invalid Graphite configuration: %v", err)
+		}
+		if err := graphiteServer.Start(); err != nil {
+			log.Fatalf("Failed to start Graphite server: %v", err)
+		}
+		log.Printf("Graphite server listening (plaintext: %q, pickle: %q, %d templates)",
+			graphiteCfg.PlaintextAddress, graphiteCfg.PickleAddress, len(graphiteCfg.Templates))
+	}
+
+	// Start the scrape manager, which pulls metrics from Prometheus targets
+	var scrapeManager *ingestion.ScrapeManager
+	if scrapeCfg := cfg.Ingestion.Scrape; scrapeCfg.Enabled {
+		scrapeManager, err = ingestion.NewScrapeManager(streamProcessor, scrapeJobs(scrapeCfg.Jobs))
+		if err != nil {
+			log.Fatalf("Invalid scrape configuration: %v", err)
+		}
+		scrapeManager.Start()
+		log.Printf("Scrape manager started (%d jobs)", len(scrapeCfg.Jobs))
+	}
+
+	// Start the Kafka consumer, which commits offsets once the stream
+	// processor has flushed what it consumed
+	var kafkaConsumer *ingestion.KafkaConsumer
+	if kafkaCfg := cfg.Ingestion.Kafka; kafkaCfg.Enabled {
+		client, err := ingestion.NewKafkaGroupClient(kafkaCfg.Brokers, kafkaCfg.Group, kafkaCfg.Topics)
+		if err != nil {
+			log.Fatalf("Failed to create Kafka client: %v", err)
+		}
+		kafkaConsumer, err = ingestion.NewKafkaConsumer(streamProcessor, client, ingestion.KafkaConsumerConfig{
+			Group:          kafkaCfg.Group,
+			Format:         ingestion.KafkaFormat(kafkaCfg.Format),
+			Precision:      kafkaCfg.Precision,
+			CommitInterval: kafkaCfg.CommitInterval.Duration,
+		})
+		if err != nil {
+			log.Fatalf("Invalid Kafka configuration: %v", err)
+		}
+		kafkaConsumer.Start()
+		log.Printf("Kafka consumer started (group: %q, topics: %v, format: %s)", kafkaCfg.Group, kafkaCfg.Topics, kafkaCfg.Format)
+	}
+
+	// Start the MQTT subscriber for IoT devices
+	var mqttSubscriber *ingestion.MQTTSubscriber
+	if mqttCfg := cfg.Ingestion.MQTT; mqttCfg.Enabled {
+		client, err := ingestion.NewMQTTBrokerClient(ingestion.MQTTBrokerConfig{
+			Broker:       mqttCfg.Broker,
+			ClientID:     mqttCfg.ClientID,
+			Username:     mqttCfg.Username,
+			Password:     mqttCfg.Password,
+			CleanSession: mqttCfg.CleanSession,
+		})
+		if err != nil {
+			log.Fatalf("Invalid MQTT configuration: %v", err)
+		}
+		subscriptions := make([]ingestion.MQTTSubscription, len(mqttCfg.Subscriptions))
+		for i, sub := range mqttCfg.Subscriptions {
+			subscriptions[i] = ingestion.MQTTSubscription{
+				Filter:   sub.Topic,
+				Format:   ingestion.MQTTFormat(sub.Format),
+				Template: sub.Template,
+			}
+		}
+		mqttSubscriber, err = ingestion.NewMQTTSubscriber(streamProcessor, client, ingestion.MQTTSubscriberConfig{
+			Subscriptions: subscriptions,
+			MinBackoff:    mqttCfg.MinBackoff.Duration,
+			MaxBackoff:    mqttCfg.MaxBackoff.Duration,
+		})
+		if err != nil {
+			log.Fatalf("Invalid MQTT configuration: %v", err)
+		}
+		mqttSubscriber.Start()
+		log.Printf("MQTT subscriber started (broker: %s, %d subscriptions)", mqttCfg.Broker, len(subscriptions))
+	}
+
 	// Initialize HTTP API
 	apiServer := api.NewServer(storageEngine, streamProcessor)
+	apiServer.SetQueryLimits(api.QueryLimits{
+		Timeout:       cfg.Performance.QueryTimeout.Duration,
+		MaxRange:      cfg.Performance.MaxQueryRange.Duration,
+		MaxPoints:     cfg.Performance.MaxQueryPoints,
+		MaxConcurrent: cfg.Performance.MaxConcurrentQueries,
+	})
+	if cfg.Performance.EnableQueryCache {
+		queryCache := api.NewQueryCache(int64(cfg.Performance.CacheSizeMB)<<20, cfg.Performance.CacheTTL.Duration)
+		storageEngine.AddChangeWatcher(queryCache.Invalidate)
+		apiServer.SetQueryCache(queryCache)
+		log.Printf("Query cache enabled (%d MB, ttl: %v)", cfg.Performance.CacheSizeMB, cfg.Performance.CacheTTL.Duration)
+	}
+	apiServer.SetAnnotationStore(storageEngine.Annotations())
 	log.Println("HTTP API server initialized")
 
 	// Create HTTP server with configuration
@@ -129,6 +253,28 @@ func main() {
 	<-quit
 	log.Println("Shutting down server...")
 
+	// Stop the StatsD server first so its last interval is written
+	if statsdServer != nil {
+		statsdServer.Stop()
+		log.Println("StatsD server stopped")
+	}
+	if graphiteServer != nil {
+		graphiteServer.Stop()
+		log.Println("Graphite server stopped")
+	}
+	if scrapeManager != nil {
+		scrapeManager.Stop()
+		log.Println("Scrape manager stopped")
+	}
+	if kafkaConsumer != nil {
+		kafkaConsumer.Stop()
+		log.Println("Kafka consumer stopped")
+	}
+	if mqttSubscriber != nil {
+		mqttSubscriber.Stop()
+		log.Println("MQTT subscriber stopped")
+	}
+
 	// Stop stream processor
 	streamProcessor.Stop()
 	log.Println("Stream processor stopped")
@@ -144,6 +290,49 @@ func main() {
 	log.Println("Server gracefully stopped")
 }
 
+// scrapeJobs converts the configured scrape jobs for the scrape manager
+func scrapeJobs(jobs []config.ScrapeJobConfig) []ingestion.ScrapeJob {
+	relabelConfigs := func(configs []config.RelabelConfig) []ingestion.RelabelConfig {
+		result := make([]ingestion.RelabelConfig, len(configs))
+		for i, c := range configs {
+			result[i] = ingestion.RelabelConfig{
+				SourceLabels: c.SourceLabels,
+				Separator:    c.Separator,
+				Regex:        c.Regex,
+				TargetLabel:  c.TargetLabel,
+				Replacement:  c.Replacement,
+				Modulus:      c.Modulus,
+				Action:       ingestion.RelabelAction(c.Action),
+			}
+		}
+		return result
+	}
+
+	result := make([]ingestion.ScrapeJob, len(jobs))
+	for i, job := range jobs {
+		groups := make([]ingestion.TargetGroup, len(job.StaticConfigs))
+		for j, group := range job.StaticConfigs {
+			groups[j] = ingestion.TargetGroup{Targets: group.Targets, Labels: group.Labels}
+		}
+		result[i] = ingestion.ScrapeJob{
+			Name:                 job.JobName,
+			Interval:             job.ScrapeInterval.Duration,
+			Timeout:              job.ScrapeTimeout.Duration,
+			MetricsPath:          job.MetricsPath,
+			Scheme:               job.Scheme,
+			HonorLabels:          job.HonorLabels,
+			IgnoreTimestamps:     job.IgnoreTimestamps,
+			SampleLimit:          job.SampleLimit,
+			StaticTargets:        groups,
+			TargetFiles:          job.FileSDConfig.Files,
+			RefreshInterval:      job.FileSDConfig.RefreshInterval.Duration,
+			RelabelConfigs:       relabelConfigs(job.RelabelConfigs),
+			MetricRelabelConfigs: relabelConfigs(job.MetricRelabelConfigs),
+		}
+	}
+	return result
+}
+
 func printStartupInfo(port string, cfg *config.Config) {
 	fmt.Println("\n" + strings.Repeat("=", 60))
 	fmt.Println("🚀 Time-Series Analytics Engine Started")
@@ -168,6 +357,8 @@ func printStartupInfo(port string, cfg *config.Config) {
 	fmt.Printf("  POST %s/api/v1/metrics/batch  - Ingest metric batch\n", port)
 	fmt.Printf("  GET  %s/api/v1/series         - List time series\n", port)
 	fmt.Printf("  GET  %s/api/v1/query          - Query time series data\n", port)
+	fmt.Printf("  GET  %s/api/v1/labels         - List label names\n", port)
+	fmt.Printf("  GET  %s/api/v1/metadata       - List metric metadata\n", port)
 	fmt.Printf("  GET  %s/api/v1/stats          - System statistics\n", port)
 	fmt.Printf("  GET  %s/health                - Health check\n", port)
 	
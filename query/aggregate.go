@@ -0,0 +1,176 @@
+package query
+
+import (
+	"math"
+	"sort"
+	"time-series-analytics-engine/storage"
+)
+
+// aggregateGroup accumulates the series of one output group step by step
+type aggregateGroup struct {
+	labels map[string]string
+	count  []int
+	value  []float64
+	mean   []float64
+	m2     []float64
+	// quantile keeps one constant-size estimator per step
+	quantile []quantileEstimator
+	// sketches merges histogram samples for sum, counting the series merged
+	// at each step; a step mixing histograms and plain values has none
+	sketches     []*storage.Sketch
+	sketchCounts []int
+}
+
+// aggregate combines series into groups. Only one accumulator per group is
+// kept, so memory grows with the number of groups rather than input series.
+func (ev *evaluator) aggregate(expr *AggregateExpr, fn func(*Series) error) error {
+	var params []float64
+	switch expr.Op {
+	case "topk", "bottomk":
+		return ev.aggregateRank(expr, fn)
+	case "quantile":
+		var err error
+		if params, err = ev.scalar(expr.Param); err != nil {
+			return err
+		}
+	}
+
+	n := ev.grid.len()
+	groups := make(map[string]*aggregateGroup)
+
+	err := ev.eachSeries(expr.Expr, func(series *Series) error {
+		sig := signature(series.Labels, expr.Grouping, !expr.Without)
+		group, exists := groups[sig]
+		if !exists {
+			group = &aggregateGroup{
+				labels: groupLabels(series.Labels, expr.Grouping, expr.Without),
+				count:  make([]int, n),
+				value:  make([]float64, n),
+			}
+			if expr.Op == "stddev" || expr.Op == "stdvar" {
+				group.mean = make([]float64, n)
+				group.m2 = make([]float64, n)
+			}
+			if expr.Op == "quantile" {
+				group.quantile = make([]quantileEstimator, n)
+				for i := range group.quantile {
+					group.quantile[i].phi = params[i]
+				}
+			}
+			groups[sig] = group
+		}
+
+		for i, present := range series.Present {
+			if !present {
+				continue
+			}
+			value := series.Values[i]
+			group.count[i]++
+			switch expr.Op {
+			case "sum":
+				group.value[i] += value
+				if err := group.addSketch(i, series.sketch(i)); err != nil {
+					return err
+				}
+			case "avg":
+				group.value[i] += value
+			case "min":
+				if group.count[i] == 1 || value < group.value[i] || math.IsNaN(group.value[i]) {
+					group.value[i] = value
+				}
+			case "max":
+				if group.count[i] == 1 || value > group.value[i] || math.IsNaN(group.value[i]) {
+					group.value[i] = value
+				}
+			case "stddev", "stdvar":
+				// Welford's online algorithm
+				delta := value - group.mean[i]
+				group.mean[i] += delta / float64(group.count[i])
+				group.m2[i] += delta * (value - group.mean[i])
+			case "quantile":
+				group.quantile[i].add(value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Emit groups in a stable order
+	keys := make([]string, 0, len(groups))
+	for sig := range groups {
+		keys = append(keys, sig)
+	}
+	sort.Strings(keys)
+
+	for _, sig := range keys {
+		group := groups[sig]
+		series := ev.newSeries(group.labels)
+		for i, count := range group.count {
+			if count == 0 {
+				continue
+			}
+			switch expr.Op {
+			case "avg":
+				series.set(i, group.value[i]/float64(count))
+			case "count":
+				series.set(i, float64(count))
+			case "stdvar":
+				series.set(i, group.m2[i]/float64(count))
+			case "stddev":
+				series.set(i, math.Sqrt(group.m2[i]/float64(count)))
+			case "quantile":
+				series.set(i, group.quantile[i].value())
+			default:
+				series.set(i, group.value[i])
+			}
+			if group.sketches != nil && group.sketchCounts[i] == count {
+				series.setSketch(i, group.sketches[i])
+			}
+		}
+		if err := fn(series); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSketch merges a series' histogram at step i into the group. The first
+// one is copied, as sketches read from storage must not be modified.
+func (group *aggregateGroup) addSketch(i int, sketch *storage.Sketch) error {
+	if sketch == nil {
+		return nil
+	}
+	if group.sketches == nil {
+		group.sketches = make([]*storage.Sketch, len(group.count))
+		group.sketchCounts = make([]int, len(group.count))
+	}
+	group.sketchCounts[i]++
+	if group.sketches[i] == nil {
+		group.sketches[i] = sketch.Copy()
+		return nil
+	}
+	return group.sketches[i].Merge(sketch)
+}
+
+// groupLabels returns the labels identifying an aggregation group
+func groupLabels(labels map[string]string, grouping []string, without bool) map[string]string {
+	result := make(map[string]string)
+	if !without {
+		for _, name := range grouping {
+			if value := labels[name]; value != "" {
+				result[name] = value
+			}
+		}
+		return result
+	}
+
+	for name, value := range dropMetricName(labels) {
+		result[name] = value
+	}
+	for _, name := range grouping {
+		delete(result, name)
+	}
+	return result
+}
@@ -0,0 +1,124 @@
+package query
+
+import (
+	"fmt"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// ValueType is the type an expression evaluates to
+type ValueType string
+
+const (
+	// ValueScalar is one number per step
+	ValueScalar ValueType = "scalar"
+	// ValueVector is a set of labelled series
+	ValueVector ValueType = "vector"
+	// ValueDuration is a window length such as 5m, only valid as a function argument
+	ValueDuration ValueType = "duration"
+)
+
+// Expr is a node of a parsed query expression
+type Expr interface {
+	// Type returns the type the expression evaluates to
+	Type() ValueType
+}
+
+// NumberLiteral is a constant such as 100
+type NumberLiteral struct {
+	Value float64
+}
+
+// DurationLiteral is a window length such as 5m or 1h30m
+type DurationLiteral struct {
+	Duration time.Duration
+}
+
+// VectorSelector selects stored series by label matchers, e.g. cpu.usage{host="a"}
+type VectorSelector struct {
+	Selector string
+	Matchers []*storage.LabelMatcher
+}
+
+// ParenExpr is a parenthesized expression
+type ParenExpr struct {
+	Expr Expr
+}
+
+// UnaryExpr negates an expression
+type UnaryExpr struct {
+	Expr Expr
+}
+
+// VectorMatching describes how series of two vectors are paired by a binary operator
+type VectorMatching struct {
+	// On restricts matching to Labels; otherwise Labels are ignored
+	On     bool
+	Labels []string
+	// Card is "one-to-one", "many-to-one" (group_left) or "one-to-many" (group_right)
+	Card string
+	// Include lists labels copied from the "one" side in group_left/group_right
+	Include []string
+}
+
+// Vector matching cardinalities
+const (
+	CardOneToOne  = "one-to-one"
+	CardManyToOne = "many-to-one"
+	CardOneToMany = "one-to-many"
+)
+
+// BinaryExpr applies an arithmetic or comparison operator to two operands
+type BinaryExpr struct {
+	Op       string
+	LHS, RHS Expr
+	// ReturnBool turns comparisons into 0/1 values instead of filters
+	ReturnBool bool
+	Matching   *VectorMatching
+}
+
+// AggregateExpr aggregates series into groups, e.g. sum by (host) (cpu.usage)
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr
+	Grouping []string
+	Without  bool
+}
+
+// Call is a function call such as abs(x)
+type Call struct {
+	Func *Function
+	Args []Expr
+}
+
+func (e *NumberLiteral) Type() ValueType   { return ValueScalar }
+func (e *DurationLiteral) Type() ValueType { return ValueDuration }
+func (e *VectorSelector) Type() ValueType  { return ValueVector }
+func (e *ParenExpr) Type() ValueType       { return e.Expr.Type() }
+func (e *UnaryExpr) Type() ValueType       { return e.Expr.Type() }
+func (e *AggregateExpr) Type() ValueType   { return ValueVector }
+func (e *Call) Type() ValueType            { return e.Func.ReturnType }
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueScalar && e.RHS.Type() == ValueScalar {
+		return ValueScalar
+	}
+	return ValueVector
+}
+
+// Error is a query that cannot be parsed or evaluated as written
+type Error struct {
+	msg string
+}
+
+func (e *Error) Error() string { return e.msg }
+
+// errorf creates a query error, prefixed with its position when pos >= 0
+func errorf(pos int, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if pos >= 0 {
+		msg = fmt.Sprintf("parse error at position %d: %s", pos+1, msg)
+	}
+	return &Error{msg: msg}
+}
@@ -0,0 +1,163 @@
+package query
+
+import (
+	"time-series-analytics-engine/storage"
+)
+
+// binary evaluates a binary expression with at least one vector operand
+func (ev *evaluator) binary(expr *BinaryExpr, fn func(*Series) error) error {
+	switch {
+	case expr.LHS.Type() == ValueScalar:
+		scalar, err := ev.scalar(expr.LHS)
+		if err != nil {
+			return err
+		}
+		return ev.eachSeries(expr.RHS, func(series *Series) error {
+			return ev.applyScalar(expr, series, scalar, true, fn)
+		})
+	case expr.RHS.Type() == ValueScalar:
+		scalar, err := ev.scalar(expr.RHS)
+		if err != nil {
+			return err
+		}
+		return ev.eachSeries(expr.LHS, func(series *Series) error {
+			return ev.applyScalar(expr, series, scalar, false, fn)
+		})
+	}
+	return ev.vectorBinary(expr, fn)
+}
+
+// applyScalar combines a series with a scalar operand. Comparisons without
+// bool keep the series value only at steps where the comparison holds.
+func (ev *evaluator) applyScalar(expr *BinaryExpr, series *Series, scalar []float64, scalarLeft bool, fn func(*Series) error) error {
+	for i, present := range series.Present {
+		if !present {
+			continue
+		}
+		lhs, rhs := series.Values[i], scalar[i]
+		if scalarLeft {
+			lhs, rhs = rhs, lhs
+		}
+		value, keep := binaryOp(expr.Op, lhs, rhs)
+		switch {
+		case !isComparison(expr.Op):
+			series.Values[i] = value
+		case expr.ReturnBool:
+			series.Values[i] = boolValue(keep)
+		case !keep:
+			series.Present[i] = false
+		}
+	}
+	if !isComparison(expr.Op) || expr.ReturnBool {
+		series.Labels = dropMetricName(series.Labels)
+		series.sketches = nil
+	}
+	return fn(series)
+}
+
+// vectorBinary pairs the series of two vectors by their matching labels. The
+// "one" side is held in memory while the other side is streamed.
+func (ev *evaluator) vectorBinary(expr *BinaryExpr, fn func(*Series) error) error {
+	matching := expr.Matching
+	manyExpr, oneExpr := expr.LHS, expr.RHS
+	swapped := matching.Card == CardOneToMany
+	if swapped {
+		manyExpr, oneExpr = expr.RHS, expr.LHS
+	}
+
+	oneSide, err := ev.collect(oneExpr)
+	if err != nil {
+		return err
+	}
+	bySignature := make(map[string][]*Series)
+	for _, series := range oneSide {
+		sig := signature(series.Labels, matching.Labels, matching.On)
+		bySignature[sig] = append(bySignature[sig], series)
+	}
+
+	seen := make(map[string]bool)
+	return ev.eachSeries(manyExpr, func(many *Series) error {
+		sig := signature(many.Labels, matching.Labels, matching.On)
+		matches := bySignature[sig]
+		if len(matches) == 0 {
+			return nil
+		}
+		if len(matches) > 1 {
+			return errorf(-1, "found %d series matching %s on the %s side; many-to-many matching is not allowed",
+				len(matches), storage.SeriesKey("", many.Labels), sideName(!swapped))
+		}
+		if matching.Card == CardOneToOne {
+			if seen[sig] {
+				return errorf(-1, "multiple series on the left side match %s; use group_left or group_right for many-to-one matching",
+					storage.SeriesKey("", many.Labels))
+			}
+			seen[sig] = true
+		}
+		one := matches[0]
+
+		result := ev.newSeries(resultLabels(expr, many.Labels, one.Labels))
+		for i := range result.Values {
+			if !many.Present[i] || !one.Present[i] {
+				continue
+			}
+			lhs, rhs := many.Values[i], one.Values[i]
+			if swapped {
+				lhs, rhs = rhs, lhs
+			}
+			value, keep := binaryOp(expr.Op, lhs, rhs)
+			switch {
+			case !isComparison(expr.Op):
+				result.set(i, value)
+			case expr.ReturnBool:
+				result.set(i, boolValue(keep))
+			case keep:
+				result.set(i, value)
+			}
+		}
+		return fn(result)
+	})
+}
+
+// resultLabels computes the labels of a series produced by vector matching
+func resultLabels(expr *BinaryExpr, many, one map[string]string) map[string]string {
+	matching := expr.Matching
+	dropName := !isComparison(expr.Op) || expr.ReturnBool
+
+	labels := make(map[string]string, len(many))
+	if matching.Card == CardOneToOne && matching.On {
+		for _, name := range matching.Labels {
+			if value := many[name]; value != "" {
+				labels[name] = value
+			}
+		}
+		return labels
+	}
+
+	ignored := make(map[string]bool)
+	if matching.Card == CardOneToOne {
+		for _, name := range matching.Labels {
+			ignored[name] = true
+		}
+	}
+	for name, value := range many {
+		if ignored[name] || (dropName && name == storage.MetricNameLabel) {
+			continue
+		}
+		labels[name] = value
+	}
+	for _, name := range matching.Include {
+		if value := one[name]; value != "" {
+			labels[name] = value
+		} else {
+			delete(labels, name)
+		}
+	}
+	return labels
+}
+
+func sideName(right bool) string {
+	if right {
+		return "right"
+	}
+	return "left"
+}
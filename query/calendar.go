@@ -0,0 +1,59 @@
+package query
+
+import (
+	"time"
+)
+
+// Calendar steps follow local calendar boundaries in Params.Location, so a
+// day step always runs from midnight to midnight even across DST changes
+const (
+	StepDay     = "day"
+	StepWeek    = "week"
+	StepMonth   = "month"
+	StepQuarter = "quarter"
+)
+
+// calendarSteps maps each calendar step to its nominal length, used to
+// convert window durations to a number of steps
+var calendarSteps = map[string]time.Duration{
+	StepDay:     24 * time.Hour,
+	StepWeek:    7 * 24 * time.Hour,
+	StepMonth:   30 * 24 * time.Hour,
+	StepQuarter: 91 * 24 * time.Hour,
+}
+
+// IsCalendarStep reports whether step names a calendar step
+func IsCalendarStep(step string) bool {
+	_, ok := calendarSteps[step]
+	return ok
+}
+
+// calendarStart returns the start of the calendar period containing t, in
+// t's location. Weeks start on Monday.
+func calendarStart(t time.Time, unit string) time.Time {
+	year, month, day := t.Date()
+	switch unit {
+	case StepWeek:
+		// Monday is 0 days back, Sunday 6
+		day -= (int(t.Weekday()) + 6) % 7
+	case StepMonth:
+		day = 1
+	case StepQuarter:
+		month -= (month - 1) % 3
+		day = 1
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// calendarAdd moves t by n calendar periods, keeping the local wall clock
+func calendarAdd(t time.Time, unit string, n int) time.Time {
+	switch unit {
+	case StepWeek:
+		return t.AddDate(0, 0, 7*n)
+	case StepMonth:
+		return t.AddDate(0, n, 0)
+	case StepQuarter:
+		return t.AddDate(0, 3*n, 0)
+	}
+	return t.AddDate(0, 0, n)
+}
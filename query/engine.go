@@ -0,0 +1,629 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// MaxSteps bounds the number of steps a query is evaluated at
+const MaxSteps = 11000
+
+// defaultSteps is the number of steps used when no step is given
+const defaultSteps = 250
+
+// Storage is the read access the query engine needs
+type Storage interface {
+	Select(matchers []*storage.LabelMatcher, start, end time.Time) []storage.SeriesInfo
+	Iterator(ctx context.Context, seriesID string, start, end time.Time) storage.PointIterator
+}
+
+// Bucket aggregations reducing the raw points of a series within one step
+const (
+	BucketAvg   = "avg"
+	BucketSum   = "sum"
+	BucketMin   = "min"
+	BucketMax   = "max"
+	BucketCount = "count"
+	BucketFirst = "first"
+	BucketLast  = "last"
+)
+
+// Params describes the time range and resolution a query is evaluated over.
+// Raw points are reduced to one value per step using Aggregation.
+type Params struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+	// Calendar selects a calendar step such as StepMonth instead of Step
+	Calendar string
+	// Location is the time zone steps are aligned in, Start's location when nil
+	Location    *time.Location
+	Aggregation string
+}
+
+// Result is one series of a query result
+type Result struct {
+	Labels map[string]string
+	Points []storage.DataPoint
+}
+
+// Evaluate runs an expression against storage over the query's step grid.
+// Scalar expressions produce a single result without labels.
+func Evaluate(ctx context.Context, st Storage, expr Expr, params Params) ([]Result, error) {
+	if params.Aggregation == "" {
+		params.Aggregation = BucketAvg
+	}
+	switch params.Aggregation {
+	case BucketAvg, BucketSum, BucketMin, BucketMax, BucketCount, BucketFirst, BucketLast:
+	default:
+		return nil, errorf(-1, "unknown aggregation %q", params.Aggregation)
+	}
+
+	g, err := newGrid(params)
+	if err != nil {
+		return nil, err
+	}
+	ev := &evaluator{ctx: ctx, storage: st, params: params, grid: g}
+
+	var results []Result
+	if expr.Type() == ValueScalar {
+		values, err := ev.scalar(expr)
+		if err != nil {
+			return nil, err
+		}
+		series := ev.newSeries(map[string]string{})
+		for i, value := range values {
+			series.set(i, value)
+		}
+		return []Result{ev.result(series)}, nil
+	}
+
+	err = ev.eachSeries(expr, func(series *Series) error {
+		if result := ev.result(series); len(result.Points) > 0 {
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// grid holds the step boundaries of a query. Step i covers [edges[i], edges[i+1]).
+type grid struct {
+	edges []time.Time
+	// calendar is set for calendar steps, whose lengths vary
+	calendar string
+}
+
+func newGrid(params Params) (*grid, error) {
+	if params.End.Before(params.Start) {
+		return nil, errorf(-1, "end %s is before start %s", params.End.Format(time.RFC3339), params.Start.Format(time.RFC3339))
+	}
+	loc := params.Location
+	if loc == nil {
+		loc = params.Start.Location()
+	}
+
+	if params.Calendar != "" {
+		if !IsCalendarStep(params.Calendar) {
+			return nil, errorf(-1, "unknown calendar step %q", params.Calendar)
+		}
+		g := &grid{calendar: params.Calendar}
+		start := calendarStart(params.Start.In(loc), params.Calendar)
+		for i := 0; ; i++ {
+			t := calendarAdd(start, params.Calendar, i)
+			if t.After(params.End) {
+				g.edges = append(g.edges, t)
+				break
+			}
+			if i >= MaxSteps {
+				return nil, errorf(-1, "%s steps over %v exceed the maximum of %d steps", params.Calendar, params.End.Sub(params.Start), MaxSteps)
+			}
+			g.edges = append(g.edges, t)
+		}
+		return g, nil
+	}
+
+	step := params.Step
+	if step <= 0 {
+		step = params.End.Sub(params.Start) / defaultSteps
+		if step < time.Second {
+			step = time.Second
+		}
+		step = step.Round(time.Second)
+	}
+	if steps := params.End.Sub(params.Start)/step + 1; steps > MaxSteps {
+		return nil, errorf(-1, "step %v over %v exceeds the maximum of %d steps; use a larger step", step, params.End.Sub(params.Start), MaxSteps)
+	}
+
+	// Steps are aligned to multiples of the step in local time so that
+	// overlapping queries share step boundaries
+	_, offset := params.Start.In(loc).Zone()
+	zoneOffset := time.Duration(offset) * time.Second
+	g := &grid{}
+	for t := params.Start.Add(zoneOffset).Truncate(step).Add(-zoneOffset).In(loc); !t.After(params.End); t = t.Add(step) {
+		g.edges = append(g.edges, t)
+	}
+	g.edges = append(g.edges, g.edges[len(g.edges)-1].Add(step))
+	return g, nil
+}
+
+// AlignParams widens a query's range to whole steps of its grid and resolves
+// the default step, so that queries over the same steps evaluate to the same
+// result. The first and last steps then read all of their raw points.
+func AlignParams(params Params) (Params, error) {
+	g, err := newGrid(params)
+	if err != nil {
+		return params, err
+	}
+	if params.Calendar == "" {
+		params.Step = g.step()
+	}
+	params.Start = g.edges[0]
+	params.End = g.edges[len(g.edges)-1].Add(-time.Nanosecond)
+	return params, nil
+}
+
+func (g *grid) len() int             { return len(g.edges) - 1 }
+func (g *grid) time(i int) time.Time { return g.edges[i] }
+func (g *grid) contains(i int, t time.Time) bool {
+	return !t.Before(g.edges[i]) && t.Before(g.edges[i+1])
+}
+
+// step returns the step length, or the nominal length of calendar steps
+func (g *grid) step() time.Duration {
+	if g.calendar != "" {
+		return calendarSteps[g.calendar]
+	}
+	return g.edges[1].Sub(g.edges[0])
+}
+
+// extend returns the grid with n more steps before its start
+func (g *grid) extend(n int) *grid {
+	extended := &grid{edges: make([]time.Time, 0, len(g.edges)+n), calendar: g.calendar}
+	for i := n; i > 0; i-- {
+		if g.calendar != "" {
+			extended.edges = append(extended.edges, calendarAdd(g.edges[0], g.calendar, -i))
+		} else {
+			extended.edges = append(extended.edges, g.edges[0].Add(-time.Duration(i)*g.step()))
+		}
+	}
+	extended.edges = append(extended.edges, g.edges...)
+	return extended
+}
+
+// shift returns the grid moved by d
+func (g *grid) shift(d time.Duration) *grid {
+	shifted := &grid{edges: make([]time.Time, len(g.edges)), calendar: g.calendar}
+	for i, edge := range g.edges {
+		shifted.edges[i] = edge.Add(d)
+	}
+	return shifted
+}
+
+// Series is a labelled series evaluated at every step of the grid
+type Series struct {
+	Labels  map[string]string
+	Values  []float64
+	Present []bool
+	// stale marks steps where a stored series went stale; nil when it never did
+	stale []bool
+	// sketches holds each step's merged histogram samples; nil for series of
+	// plain values, and dropped by operations that change the values
+	sketches []*storage.Sketch
+}
+
+func (s *Series) set(i int, value float64) {
+	s.Values[i] = value
+	s.Present[i] = true
+}
+
+// setSketch records the histogram behind the value of a step
+func (s *Series) setSketch(i int, sketch *storage.Sketch) {
+	if s.sketches == nil {
+		s.sketches = make([]*storage.Sketch, len(s.Values))
+	}
+	s.sketches[i] = sketch
+}
+
+// sketch returns the histogram of a step, or nil
+func (s *Series) sketch(i int) *storage.Sketch {
+	if s.sketches == nil {
+		return nil
+	}
+	return s.sketches[i]
+}
+
+// evaluator evaluates one expression over a grid
+type evaluator struct {
+	ctx     context.Context
+	storage Storage
+	params  Params
+	grid    *grid
+}
+
+// withGrid returns an evaluator over another grid, reading raw points
+// between start and end
+func (ev *evaluator) withGrid(g *grid, start, end time.Time) *evaluator {
+	params := ev.params
+	params.Start, params.End = start, end
+	return &evaluator{ctx: ev.ctx, storage: ev.storage, params: params, grid: g}
+}
+
+func (ev *evaluator) newSeries(labels map[string]string) *Series {
+	n := ev.grid.len()
+	return &Series{Labels: labels, Values: make([]float64, n), Present: make([]bool, n)}
+}
+
+// result converts a series to its present points
+func (ev *evaluator) result(series *Series) Result {
+	result := Result{Labels: series.Labels}
+	for i, present := range series.Present {
+		if present {
+			result.Points = append(result.Points, storage.DataPoint{Timestamp: ev.grid.time(i), Value: series.Values[i]})
+		}
+	}
+	return result
+}
+
+// eachSeries evaluates a vector expression, passing result series to fn one
+// at a time so that series do not need to be held in memory together
+func (ev *evaluator) eachSeries(expr Expr, fn func(*Series) error) error {
+	switch e := expr.(type) {
+	case *ParenExpr:
+		return ev.eachSeries(e.Expr, fn)
+	case *VectorSelector:
+		return ev.selectSeries(e, fn)
+	case *UnaryExpr:
+		return ev.eachSeries(e.Expr, func(series *Series) error {
+			for i := range series.Values {
+				series.Values[i] = -series.Values[i]
+			}
+			series.sketches = nil
+			series.Labels = dropMetricName(series.Labels)
+			return fn(series)
+		})
+	case *BinaryExpr:
+		return ev.binary(e, fn)
+	case *AggregateExpr:
+		return ev.aggregate(e, fn)
+	case *Call:
+		return ev.call(e, fn)
+	}
+	return errorf(-1, "cannot evaluate %T as a vector", expr)
+}
+
+// collect evaluates a vector expression into memory
+func (ev *evaluator) collect(expr Expr) ([]*Series, error) {
+	var all []*Series
+	err := ev.eachSeries(expr, func(series *Series) error {
+		all = append(all, series)
+		return nil
+	})
+	return all, err
+}
+
+// scalar evaluates a scalar expression to one value per step
+func (ev *evaluator) scalar(expr Expr) ([]float64, error) {
+	n := ev.grid.len()
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		values := make([]float64, n)
+		for i := range values {
+			values[i] = e.Value
+		}
+		return values, nil
+	case *ParenExpr:
+		return ev.scalar(e.Expr)
+	case *UnaryExpr:
+		values, err := ev.scalar(e.Expr)
+		for i := range values {
+			values[i] = -values[i]
+		}
+		return values, err
+	case *BinaryExpr:
+		lhs, err := ev.scalar(e.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.scalar(e.RHS)
+		if err != nil {
+			return nil, err
+		}
+		for i := range lhs {
+			value, keep := binaryOp(e.Op, lhs[i], rhs[i])
+			if isComparison(e.Op) {
+				value = boolValue(keep)
+			}
+			lhs[i] = value
+		}
+		return lhs, nil
+	case *Call:
+		return ev.scalarCall(e)
+	}
+	return nil, errorf(-1, "cannot evaluate %T as a scalar", expr)
+}
+
+// selectSeries reads every series matching a selector and reduces its raw
+// points to one value per step
+func (ev *evaluator) selectSeries(selector *VectorSelector, fn func(*Series) error) error {
+	for _, info := range ev.storage.Select(selector.Matchers, ev.params.Start, ev.params.End) {
+		if err := ev.ctx.Err(); err != nil {
+			return err
+		}
+
+		labels := make(map[string]string, len(info.Labels)+1)
+		for name, value := range info.Labels {
+			labels[name] = value
+		}
+		labels[storage.MetricNameLabel] = storage.MetricName(info.ID, info.Labels)
+
+		series := ev.newSeries(labels)
+		if err := ev.sample(info.ID, series); err != nil {
+			return err
+		}
+		if err := fn(series); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sample reduces a stored series' points in each step to a single value
+func (ev *evaluator) sample(seriesID string, series *Series) error {
+	it := ev.storage.Iterator(ev.ctx, seriesID, ev.params.Start, ev.params.End)
+	defer it.Close()
+
+	var acc bucketAccumulator
+	bucket := -1
+	for it.Next() {
+		point := it.At()
+		if bucket < 0 || !ev.grid.contains(bucket, point.Timestamp) {
+			if bucket >= 0 {
+				ev.closeBucket(series, bucket, &acc)
+			}
+			for bucket < 0 || !ev.grid.contains(bucket, point.Timestamp) {
+				bucket++
+				if bucket >= ev.grid.len() {
+					return it.Err()
+				}
+			}
+			acc = bucketAccumulator{}
+		}
+		if storage.IsStaleMarker(point.Value) {
+			acc.stale = true
+			continue
+		}
+		acc.stale = false
+		if point.Type == storage.ValueString {
+			// Strings have no numeric value to query
+			continue
+		}
+		acc.add(point.Value)
+		if point.Sketch != nil {
+			if err := acc.addSketch(point.Sketch); err != nil {
+				return fmt.Errorf("series %s: %w", seriesID, err)
+			}
+		}
+	}
+	if bucket >= 0 {
+		ev.closeBucket(series, bucket, &acc)
+	}
+	return it.Err()
+}
+
+// closeBucket stores the value of a step. A step whose last point is a
+// stale marker is recorded as the point where the series went stale.
+func (ev *evaluator) closeBucket(series *Series, bucket int, acc *bucketAccumulator) {
+	if acc.count > 0 {
+		series.set(bucket, acc.value(ev.params.Aggregation))
+	}
+	// Histogram samples within a step are merged whatever the aggregation,
+	// so that a quantile covers every observation in the step
+	if acc.sketch != nil && acc.sketches == acc.count {
+		series.setSketch(bucket, acc.sketch)
+	}
+	if acc.stale {
+		if series.stale == nil {
+			series.stale = make([]bool, len(series.Values))
+		}
+		series.stale[bucket] = true
+	}
+}
+
+// bucketAccumulator reduces the points within one step
+type bucketAccumulator struct {
+	// stale is set while the latest point is a stale marker
+	stale       bool
+	count       int
+	sum         float64
+	min, max    float64
+	first, last float64
+	// sketch merges the step's histogram samples; it is shared with storage
+	// until a second one is merged, as stored sketches must not be modified
+	sketch   *storage.Sketch
+	sketches int
+}
+
+func (acc *bucketAccumulator) addSketch(sketch *storage.Sketch) error {
+	acc.sketches++
+	if acc.sketch == nil {
+		acc.sketch = sketch
+		return nil
+	}
+	if acc.sketches == 2 {
+		acc.sketch = acc.sketch.Copy()
+	}
+	return acc.sketch.Merge(sketch)
+}
+
+func (acc *bucketAccumulator) add(value float64) {
+	if acc.count == 0 {
+		acc.min, acc.max, acc.first = value, value, value
+	}
+	acc.count++
+	acc.sum += value
+	acc.min = math.Min(acc.min, value)
+	acc.max = math.Max(acc.max, value)
+	acc.last = value
+}
+
+func (acc *bucketAccumulator) value(aggregation string) float64 {
+	switch aggregation {
+	case BucketSum:
+		return acc.sum
+	case BucketMin:
+		return acc.min
+	case BucketMax:
+		return acc.max
+	case BucketCount:
+		return float64(acc.count)
+	case BucketFirst:
+		return acc.first
+	case BucketLast:
+		return acc.last
+	}
+	return acc.sum / float64(acc.count)
+}
+
+// call evaluates a function returning a vector
+func (ev *evaluator) call(call *Call, fn func(*Series) error) error {
+	switch {
+	case call.Func.window != nil:
+		return ev.windowCall(call, fn)
+	case call.Func.Name == "timeshift":
+		return ev.timeshift(call, fn)
+	case call.Func.Name == "absent":
+		return ev.absent(call, fn)
+	case call.Func.Name == "histogram_quantile":
+		return ev.histogramQuantile(call, fn)
+	}
+	if call.Func.Name == "vector" {
+		values, err := ev.scalar(call.Args[0])
+		if err != nil {
+			return err
+		}
+		series := ev.newSeries(map[string]string{})
+		for i, value := range values {
+			series.set(i, value)
+		}
+		return fn(series)
+	}
+
+	// Remaining arguments are scalars evaluated once for every step
+	args := make([][]float64, len(call.Args)-1)
+	for i, arg := range call.Args[1:] {
+		values, err := ev.scalar(arg)
+		if err != nil {
+			return err
+		}
+		args[i] = values
+	}
+
+	stepArgs := make([]float64, len(args))
+	return ev.eachSeries(call.Args[0], func(series *Series) error {
+		for i := range series.Values {
+			for j := range args {
+				stepArgs[j] = args[j][i]
+			}
+			series.Values[i] = call.Func.apply(series.Values[i], stepArgs)
+		}
+		series.sketches = nil
+		series.Labels = dropMetricName(series.Labels)
+		return fn(series)
+	})
+}
+
+// scalarCall evaluates a function returning a scalar
+func (ev *evaluator) scalarCall(call *Call) ([]float64, error) {
+	values := make([]float64, ev.grid.len())
+	switch call.Func.Name {
+	case "time":
+		for i := range values {
+			values[i] = float64(ev.grid.time(i).UnixNano()) / 1e9
+		}
+	case "scalar":
+		counts := make([]int, len(values))
+		err := ev.eachSeries(call.Args[0], func(series *Series) error {
+			for i, present := range series.Present {
+				if present {
+					counts[i]++
+					values[i] = series.Values[i]
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, count := range counts {
+			if count != 1 {
+				values[i] = math.NaN()
+			}
+		}
+	default:
+		return nil, fmt.Errorf("function %s does not return a scalar", call.Func.Name)
+	}
+	return values, nil
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// dropMetricName returns labels without the metric name, as operators
+// change what a value measures
+func dropMetricName(labels map[string]string) map[string]string {
+	if _, ok := labels[storage.MetricNameLabel]; !ok {
+		return labels
+	}
+	result := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if name != storage.MetricNameLabel {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// signature identifies the label values used to match or group series.
+// With include set only the named labels are used; otherwise they are excluded.
+func signature(labels map[string]string, names []string, include bool) string {
+	var keys []string
+	if include {
+		keys = append(keys, names...)
+	} else {
+		excluded := make(map[string]bool, len(names)+1)
+		for _, name := range names {
+			excluded[name] = true
+		}
+		excluded[storage.MetricNameLabel] = true
+		for name := range labels {
+			if !excluded[name] {
+				keys = append(keys, name)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		if value := labels[key]; value != "" {
+			b.WriteString(key)
+			b.WriteByte(0xff)
+			b.WriteString(value)
+			b.WriteByte(0xff)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,378 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+func newTestStorage(t *testing.T) (*storage.StorageEngine, time.Time) {
+	engine, err := storage.NewStorageEngine(&storage.StorageConfig{
+		Hot: storage.HotStorageConfig{MaxSeries: 1000, MaxPointsPerSeries: 1000},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	base := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	return engine, base
+}
+
+// addSeries writes one point per minute for each value
+func addSeries(engine *storage.StorageEngine, name string, labels map[string]string, base time.Time, values ...float64) {
+	for i, value := range values {
+		engine.AddPoint(storage.SeriesKey(name, labels), labels, base.Add(time.Duration(i)*time.Minute), value)
+	}
+}
+
+func evaluate(t *testing.T, engine *storage.StorageEngine, base time.Time, input string) []Result {
+	expr, err := ParseExpr(input)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %v", input, err)
+	}
+	results, err := Evaluate(context.Background(), engine, expr, Params{
+		Start: base,
+		End:   base.Add(2 * time.Minute),
+		Step:  time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Failed to evaluate %q: %v", input, err)
+	}
+	return results
+}
+
+func TestEvaluate_Arithmetic(t *testing.T) {
+	engine, base := newTestStorage(t)
+	for _, host := range []string{"a", "b"} {
+		addSeries(engine, "errors", map[string]string{"host": host}, base, 1, 2, 3)
+		addSeries(engine, "requests", map[string]string{"host": host}, base, 10, 10, 10)
+	}
+
+	results := evaluate(t, engine, base, `errors / requests * 100`)
+	if len(results) != 2 {
+		t.Fatalf("Expected one result per host, got %d", len(results))
+	}
+	for _, result := range results {
+		if _, ok := result.Labels[storage.MetricNameLabel]; ok {
+			t.Errorf("Expected metric name to be dropped, got %v", result.Labels)
+		}
+		if len(result.Points) != 3 || result.Points[2].Value != 30 {
+			t.Errorf("Expected 10%%, 20%%, 30%% for %v, got %v", result.Labels, result.Points)
+		}
+	}
+
+	results = evaluate(t, engine, base, `sum(errors)`)
+	if len(results) != 1 || len(results[0].Labels) != 0 || results[0].Points[1].Value != 4 {
+		t.Errorf("Expected a single unlabelled sum, got %+v", results)
+	}
+}
+
+func TestEvaluate_GroupLeft(t *testing.T) {
+	engine, base := newTestStorage(t)
+	addSeries(engine, "http.errors", map[string]string{"host": "a", "code": "500"}, base, 1, 1, 1)
+	addSeries(engine, "http.errors", map[string]string{"host": "a", "code": "503"}, base, 3, 3, 3)
+	addSeries(engine, "http.requests", map[string]string{"host": "a", "team": "web"}, base, 4, 4, 4)
+
+	results := evaluate(t, engine, base, `http.errors / on(host) group_left(team) http.requests`)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+	for _, result := range results {
+		if result.Labels["team"] != "web" || result.Labels["code"] == "" {
+			t.Errorf("Expected code and team labels, got %v", result.Labels)
+		}
+	}
+
+	// Without group_left the many side is ambiguous
+	expr, _ := ParseExpr(`http.errors / on(host) http.requests`)
+	if _, err := Evaluate(context.Background(), engine, expr, Params{Start: base, End: base.Add(time.Minute), Step: time.Minute}); err == nil {
+		t.Error("Expected an error for implicit many-to-one matching")
+	}
+}
+
+func TestEvaluate_FiltersAndFunctions(t *testing.T) {
+	engine, base := newTestStorage(t)
+	addSeries(engine, "cpu.usage", map[string]string{"host": "a"}, base, 50, 95, 70)
+
+	results := evaluate(t, engine, base, `cpu.usage > 60`)
+	if len(results) != 1 || len(results[0].Points) != 2 || results[0].Labels[storage.MetricNameLabel] != "cpu.usage" {
+		t.Errorf("Expected comparison to filter steps and keep the metric name, got %+v", results)
+	}
+
+	results = evaluate(t, engine, base, `clamp_max(cpu.usage, 80) - scalar(vector(10))`)
+	if results[0].Points[1].Value != 70 {
+		t.Errorf("Expected clamp then subtract to give 70, got %v", results[0].Points)
+	}
+
+	results = evaluate(t, engine, base, `sqrt(-cpu.usage)`)
+	if !math.IsNaN(results[0].Points[0].Value) {
+		t.Errorf("Expected NaN for sqrt of a negative value, got %v", results[0].Points[0].Value)
+	}
+}
+
+func TestEvaluate_BucketAggregation(t *testing.T) {
+	engine, base := newTestStorage(t)
+	for i := 0; i < 6; i++ {
+		engine.AddPoint("temp", nil, base.Add(time.Duration(i)*20*time.Second), float64(i))
+	}
+
+	expr, _ := ParseExpr(`temp`)
+	for aggregation, expected := range map[string]float64{BucketAvg: 1, BucketMax: 2, BucketCount: 3, BucketLast: 2} {
+		results, err := Evaluate(context.Background(), engine, expr, Params{
+			Start: base, End: base.Add(2 * time.Minute), Step: time.Minute, Aggregation: aggregation,
+		})
+		if err != nil {
+			t.Fatalf("Failed to evaluate with %s: %v", aggregation, err)
+		}
+		if len(results[0].Points) != 2 || results[0].Points[0].Value != expected {
+			t.Errorf("%s: expected first step value %v, got %v", aggregation, expected, results[0].Points)
+		}
+	}
+}
+
+func TestEvaluate_TopK(t *testing.T) {
+	engine, base := newTestStorage(t)
+	addSeries(engine, "cpu.usage", map[string]string{"host": "a"}, base, 90, 10, 50)
+	addSeries(engine, "cpu.usage", map[string]string{"host": "b"}, base, 20, 80, 60)
+	addSeries(engine, "cpu.usage", map[string]string{"host": "c"}, base, 30, 30, 70)
+
+	results := evaluate(t, engine, base, `topk(2, cpu.usage)`)
+	byHost := make(map[string][]storage.DataPoint)
+	for _, result := range results {
+		if result.Labels[storage.MetricNameLabel] != "cpu.usage" {
+			t.Errorf("Expected original labels to be kept, got %v", result.Labels)
+		}
+		byHost[result.Labels["host"]] = result.Points
+	}
+	// a is in the top two only at the first step, b only at the last two
+	if len(byHost["a"]) != 1 || len(byHost["b"]) != 2 || len(byHost["c"]) != 3 {
+		t.Errorf("Unexpected topk selection: %v", byHost)
+	}
+
+	results = evaluate(t, engine, base, `bottomk(1, cpu.usage)`)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 series to be the minimum at some step, got %d", len(results))
+	}
+}
+
+func TestEvaluate_Quantile(t *testing.T) {
+	engine, base := newTestStorage(t)
+	for i := 0; i < 101; i++ {
+		addSeries(engine, "latency", map[string]string{"pod": fmt.Sprintf("pod-%d", i)}, base, float64(i))
+	}
+
+	results := evaluate(t, engine, base, `quantile(0.95, latency)`)
+	if len(results) != 1 || len(results[0].Points) != 1 {
+		t.Fatalf("Expected a single point, got %+v", results)
+	}
+	// Beyond five series the result is a P² estimate
+	if value := results[0].Points[0].Value; math.Abs(value-95) > 3 {
+		t.Errorf("Expected p95 close to 95, got %v", value)
+	}
+
+	// Small inputs are interpolated exactly
+	results = evaluate(t, engine, base, `quantile(0.5, latency{pod=~"pod-[0-3]"})`)
+	if len(results) != 1 || results[0].Points[0].Value != 1.5 {
+		t.Errorf("Expected the median of 4 pods, got %+v", results)
+	}
+}
+
+func TestEvaluate_WindowFunctions(t *testing.T) {
+	engine, base := newTestStorage(t)
+	addSeries(engine, "requests", nil, base, 1, 2, 3, 4, 5)
+
+	// Windows reach back before the query start to fill the first step
+	tests := []struct {
+		input    string
+		expected []float64
+	}{
+		{`moving_avg(requests, 3m)`, []float64{2, 3, 4}},
+		{`moving_max(requests, 2m)`, []float64{3, 4, 5}},
+		{`moving_median(requests, 3m)`, []float64{2, 3, 4}},
+		{`cumsum(requests)`, []float64{3, 7, 12}},
+		{`cumsum(requests, 2m)`, []float64{5, 7, 9}},
+		{`integral(requests, 1m)`, []float64{180, 240, 300}},
+		{`derivative(requests) * 60`, []float64{1, 1, 1}},
+		{`timeshift(requests, 2m)`, []float64{1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		expr, err := ParseExpr(tt.input)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.input, err)
+		}
+		results, err := Evaluate(context.Background(), engine, expr, Params{
+			Start: base.Add(2 * time.Minute),
+			End:   base.Add(4 * time.Minute),
+			Step:  time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("Failed to evaluate %q: %v", tt.input, err)
+		}
+		if len(results) != 1 || len(results[0].Points) != len(tt.expected) {
+			t.Errorf("%s: expected %d points, got %+v", tt.input, len(tt.expected), results)
+			continue
+		}
+		for i, point := range results[0].Points {
+			if math.Abs(point.Value-tt.expected[i]) > 1e-9 {
+				t.Errorf("%s: expected %v at step %d, got %v", tt.input, tt.expected[i], i, point.Value)
+			}
+			if !point.Timestamp.Equal(base.Add(time.Duration(i+2) * time.Minute)) {
+				t.Errorf("%s: unexpected timestamp %v at step %d", tt.input, point.Timestamp, i)
+			}
+		}
+	}
+}
+
+func TestEvaluate_GapsAndAbsent(t *testing.T) {
+	engine, base := newTestStorage(t)
+	labels := map[string]string{"host": "a"}
+	id := storage.SeriesKey("up", labels)
+	for _, minute := range []int{0, 1, 3} {
+		engine.AddPoint(id, labels, base.Add(time.Duration(minute)*time.Minute), 1)
+	}
+	if err := engine.MarkStale(id, base.Add(3*time.Minute+30*time.Second)); err != nil {
+		t.Fatalf("Failed to mark series stale: %v", err)
+	}
+
+	tests := []struct {
+		input    string
+		labels   map[string]string
+		expected map[int]float64
+	}{
+		{`gaps(up)`, labels, map[int]float64{0: 0, 1: 0, 2: 1, 3: 0, 4: 1, 5: 1}},
+		// The window bridges the missing step but not the stale marker
+		{`gaps(up, 2m)`, labels, map[int]float64{0: 0, 1: 0, 2: 0, 3: 0, 4: 1, 5: 1}},
+		{`absent(up{host="a"})`, labels, map[int]float64{2: 1, 4: 1, 5: 1}},
+		{`absent(up{host="b", dc=~"eu.*"})`, map[string]string{"host": "b"}, map[int]float64{0: 1, 1: 1, 2: 1, 3: 1, 4: 1, 5: 1}},
+	}
+
+	for _, tt := range tests {
+		expr, err := ParseExpr(tt.input)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.input, err)
+		}
+		results, err := Evaluate(context.Background(), engine, expr, Params{Start: base, End: base.Add(5 * time.Minute), Step: time.Minute})
+		if err != nil {
+			t.Fatalf("Failed to evaluate %q: %v", tt.input, err)
+		}
+		if len(results) != 1 || len(results[0].Points) != len(tt.expected) {
+			t.Errorf("%s: expected %d points, got %+v", tt.input, len(tt.expected), results)
+			continue
+		}
+		if fmt.Sprint(results[0].Labels) != fmt.Sprint(tt.labels) {
+			t.Errorf("%s: expected labels %v, got %v", tt.input, tt.labels, results[0].Labels)
+		}
+		for _, point := range results[0].Points {
+			step := int(point.Timestamp.Sub(base) / time.Minute)
+			if expected, ok := tt.expected[step]; !ok || point.Value != expected {
+				t.Errorf("%s: unexpected value %v at step %d", tt.input, point.Value, step)
+			}
+		}
+	}
+
+	// Nothing is returned while the series is present at every step
+	expr, _ := ParseExpr(`absent(up)`)
+	results, err := Evaluate(context.Background(), engine, expr, Params{Start: base, End: base.Add(time.Minute), Step: time.Minute})
+	if err != nil || len(results) != 0 {
+		t.Errorf("Expected no result for a present series, got %+v (%v)", results, err)
+	}
+}
+
+func TestEvaluate_EWMA(t *testing.T) {
+	engine, base := newTestStorage(t)
+	addSeries(engine, "temperature", nil, base, 10, 10, 10, 20, 20)
+
+	expr, _ := ParseExpr(`ewma(temperature, 1m)`)
+	results, err := Evaluate(context.Background(), engine, expr, Params{Start: base, End: base.Add(4 * time.Minute), Step: time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %v", err)
+	}
+	points := results[0].Points
+	// After a step change the average moves 1-1/e of the way per window
+	expected := 10 + 10*(1-math.Exp(-1))
+	if points[2].Value != 10 || math.Abs(points[3].Value-expected) > 1e-9 || points[4].Value <= points[3].Value {
+		t.Errorf("Unexpected ewma: %v", points)
+	}
+}
+
+func TestNewGrid_CalendarSteps(t *testing.T) {
+	start := time.Date(2024, 2, 14, 15, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		step  string
+		first time.Time
+		steps int
+	}{
+		{StepWeek, time.Date(2024, 2, 12, 0, 0, 0, 0, time.UTC), 25},
+		{StepMonth, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), 7},
+		{StepQuarter, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 3},
+	}
+	for _, tt := range tests {
+		g, err := newGrid(Params{Start: start, End: end, Calendar: tt.step})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.step, err)
+		}
+		if !g.time(0).Equal(tt.first) || g.len() != tt.steps {
+			t.Errorf("%s: expected %d steps from %v, got %d from %v", tt.step, tt.steps, tt.first, g.len(), g.time(0))
+		}
+	}
+
+	if _, err := newGrid(Params{Start: start, End: end, Calendar: "fortnight"}); err == nil {
+		t.Error("Expected an error for an unknown calendar step")
+	}
+}
+
+func TestEvaluate_HistogramQuantile(t *testing.T) {
+	engine, base := newTestStorage(t)
+	base = base.Truncate(3 * time.Minute)
+	// Host a observes 1..100ms and host b 101..200ms every minute
+	for i := 0; i < 3; i++ {
+		for host, offset := range map[string]float64{"a": 0, "b": 100} {
+			sketch, _ := storage.NewSketch(storage.DefaultSketchAccuracy)
+			for v := 1.0; v <= 100; v++ {
+				sketch.Add(offset + v + float64(i)*1000)
+			}
+			labels := map[string]string{"host": host}
+			engine.AddHistogram(storage.SeriesKey("latency", labels), labels, base.Add(time.Duration(i)*time.Minute), sketch)
+		}
+	}
+	within := func(got, expected float64) bool {
+		return math.Abs(got-expected) <= storage.DefaultSketchAccuracy*expected
+	}
+
+	// Across series: the median of both hosts together
+	results := evaluate(t, engine, base, `histogram_quantile(0.5, sum(latency))`)
+	if len(results) != 1 || len(results[0].Points) != 3 {
+		t.Fatalf("Expected one series with 3 steps, got %+v", results)
+	}
+	if got := results[0].Points[1].Value; !within(got, 1100) {
+		t.Errorf("Expected a median near 1100 in the second step, got %v", got)
+	}
+
+	results = evaluate(t, engine, base, `histogram_quantile(0.9, latency{host="a"})`)
+	if len(results) != 1 || !within(results[0].Points[0].Value, 90) {
+		t.Errorf("Expected a 90th percentile near 90 for host a, got %+v", results)
+	}
+	if _, ok := results[0].Labels[storage.MetricNameLabel]; ok || results[0].Labels["host"] != "a" {
+		t.Errorf("Expected the host label without the metric name, got %v", results[0].Labels)
+	}
+
+	// Across time: a step covering all three minutes merges their samples
+	expr, _ := ParseExpr(`histogram_quantile(0.99, sum(latency))`)
+	results, err := Evaluate(context.Background(), engine, expr, Params{Start: base, End: base.Add(2 * time.Minute), Step: 3 * time.Minute})
+	if err != nil {
+		t.Fatalf("Failed to evaluate: %v", err)
+	}
+	if len(results) != 1 || len(results[0].Points) != 1 || !within(results[0].Points[0].Value, 2194) {
+		t.Errorf("Expected a 99th percentile near 2194 over the whole range, got %+v", results)
+	}
+
+	// Arithmetic changes the values, so no histogram is left to query
+	if results := evaluate(t, engine, base, `histogram_quantile(0.5, latency * 2)`); len(results) != 0 {
+		t.Errorf("Expected no results after arithmetic, got %+v", results)
+	}
+}
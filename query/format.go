@@ -0,0 +1,117 @@
+package query
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time-series-analytics-engine/storage"
+)
+
+// Format returns a normalized form of an expression: binary operations are
+// fully parenthesized, redundant parentheses and whitespace are dropped and
+// matchers and label lists are sorted. Expressions that differ only in those
+// ways format identically, so the result can key cached query results.
+func Format(expr Expr) string {
+	var b strings.Builder
+	format(&b, expr)
+	return b.String()
+}
+
+func format(b *strings.Builder, expr Expr) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		b.WriteString(strconv.FormatFloat(e.Value, 'g', -1, 64))
+	case *DurationLiteral:
+		b.WriteString(e.Duration.String())
+	case *VectorSelector:
+		formatMatchers(b, e.Matchers)
+	case *ParenExpr:
+		format(b, e.Expr)
+	case *UnaryExpr:
+		b.WriteString("-(")
+		format(b, e.Expr)
+		b.WriteByte(')')
+	case *BinaryExpr:
+		b.WriteByte('(')
+		format(b, e.LHS)
+		b.WriteString(" " + e.Op + " ")
+		if e.ReturnBool {
+			b.WriteString("bool ")
+		}
+		if m := e.Matching; m != nil && (m.On || len(m.Labels) > 0 || m.Card != CardOneToOne) {
+			if m.On {
+				b.WriteString("on")
+			} else {
+				b.WriteString("ignoring")
+			}
+			formatLabels(b, m.Labels)
+			switch m.Card {
+			case CardManyToOne:
+				b.WriteString(" group_left")
+				formatLabels(b, m.Include)
+			case CardOneToMany:
+				b.WriteString(" group_right")
+				formatLabels(b, m.Include)
+			}
+			b.WriteByte(' ')
+		}
+		format(b, e.RHS)
+		b.WriteByte(')')
+	case *AggregateExpr:
+		b.WriteString(e.Op)
+		if e.Grouping != nil {
+			if e.Without {
+				b.WriteString(" without")
+			} else {
+				b.WriteString(" by")
+			}
+			formatLabels(b, e.Grouping)
+		}
+		b.WriteByte('(')
+		if e.Param != nil {
+			format(b, e.Param)
+			b.WriteString(", ")
+		}
+		format(b, e.Expr)
+		b.WriteByte(')')
+	case *Call:
+		b.WriteString(e.Func.Name)
+		b.WriteByte('(')
+		for i, arg := range e.Args {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			format(b, arg)
+		}
+		b.WriteByte(')')
+	}
+}
+
+// formatMatchers writes matchers in selector syntax, sorted by label
+func formatMatchers(b *strings.Builder, matchers []*storage.LabelMatcher) {
+	sorted := append([]*storage.LabelMatcher(nil), matchers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		if sorted[i].Type != sorted[j].Type {
+			return sorted[i].Type < sorted[j].Type
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	b.WriteByte('{')
+	for i, m := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(m.Name + m.Type.String() + strconv.Quote(m.Value))
+	}
+	b.WriteByte('}')
+}
+
+// formatLabels writes a sorted, parenthesized label list
+func formatLabels(b *strings.Builder, labels []string) {
+	sorted := append([]string(nil), labels...)
+	sort.Strings(sorted)
+	b.WriteString(" (" + strings.Join(sorted, ", ") + ")")
+}
@@ -0,0 +1,162 @@
+package query
+
+import (
+	"math"
+	"time"
+)
+
+// Function describes a query function
+type Function struct {
+	Name         string
+	ArgTypes     []ValueType
+	OptionalArgs int
+	ReturnType   ValueType
+	// apply computes one output value from the first argument's value and the
+	// values of the remaining scalar arguments at the same step
+	apply func(value float64, args []float64) float64
+	// window is set for functions computing each step from preceding steps
+	window *windowFunction
+}
+
+// mathFunction builds a function applying f to every value of a vector
+func mathFunction(name string, f func(float64) float64) *Function {
+	return &Function{
+		Name:       name,
+		ArgTypes:   []ValueType{ValueVector},
+		ReturnType: ValueVector,
+		apply:      func(value float64, _ []float64) float64 { return f(value) },
+	}
+}
+
+// functions lists the functions callable in query expressions
+var functions = map[string]*Function{
+	"abs":   mathFunction("abs", math.Abs),
+	"ceil":  mathFunction("ceil", math.Ceil),
+	"floor": mathFunction("floor", math.Floor),
+	"sqrt":  mathFunction("sqrt", math.Sqrt),
+	"exp":   mathFunction("exp", math.Exp),
+	"ln":    mathFunction("ln", math.Log),
+	"log2":  mathFunction("log2", math.Log2),
+	"log10": mathFunction("log10", math.Log10),
+	"sgn": mathFunction("sgn", func(v float64) float64 {
+		switch {
+		case v > 0:
+			return 1
+		case v < 0:
+			return -1
+		}
+		return v
+	}),
+	"round": {
+		Name:         "round",
+		ArgTypes:     []ValueType{ValueVector, ValueScalar},
+		OptionalArgs: 1,
+		ReturnType:   ValueVector,
+		apply: func(value float64, args []float64) float64 {
+			toNearest := 1.0
+			if len(args) > 0 {
+				toNearest = args[0]
+			}
+			return math.Floor(value/toNearest+0.5) * toNearest
+		},
+	},
+	"clamp": {
+		Name:       "clamp",
+		ArgTypes:   []ValueType{ValueVector, ValueScalar, ValueScalar},
+		ReturnType: ValueVector,
+		apply: func(value float64, args []float64) float64 {
+			return math.Max(args[0], math.Min(args[1], value))
+		},
+	},
+	"clamp_min": {
+		Name:       "clamp_min",
+		ArgTypes:   []ValueType{ValueVector, ValueScalar},
+		ReturnType: ValueVector,
+		apply:      func(value float64, args []float64) float64 { return math.Max(args[0], value) },
+	},
+	"clamp_max": {
+		Name:       "clamp_max",
+		ArgTypes:   []ValueType{ValueVector, ValueScalar},
+		ReturnType: ValueVector,
+		apply:      func(value float64, args []float64) float64 { return math.Min(args[0], value) },
+	},
+	// scalar returns the value of a single-series vector, or NaN otherwise
+	"scalar": {Name: "scalar", ArgTypes: []ValueType{ValueVector}, ReturnType: ValueScalar},
+	// vector turns a scalar into a series without labels
+	"vector": {Name: "vector", ArgTypes: []ValueType{ValueScalar}, ReturnType: ValueVector},
+	// time returns each step's timestamp in seconds
+	"time": {Name: "time", ReturnType: ValueScalar},
+
+	// Window functions compute each step from the window of steps before it
+	"moving_avg":    movingWindow("moving_avg", meanOf),
+	"moving_min":    movingWindow("moving_min", minOf),
+	"moving_max":    movingWindow("moving_max", maxOf),
+	"moving_median": movingWindow("moving_median", medianOf),
+	"ewma":          windowed("ewma", false, ewmaWindow),
+	// cumsum is the running total over the window, or over the query range
+	"cumsum": cumulativeWindow("cumsum", func(value float64, _ time.Duration) float64 { return value }),
+	// integral treats each step's value as constant over the step, in value-seconds
+	"integral": cumulativeWindow("integral", func(value float64, width time.Duration) float64 {
+		return value * width.Seconds()
+	}),
+	"derivative": windowed("derivative", true, derivativeWindow),
+	// timeshift evaluates a vector as of a duration earlier
+	"timeshift": {Name: "timeshift", ArgTypes: []ValueType{ValueVector, ValueDuration}, ReturnType: ValueVector},
+	// gaps is 1 where a series has no data within the window and 0 elsewhere
+	"gaps": windowed("gaps", true, gapsWindow),
+	// absent is 1 where its argument has no series at all
+	"absent": {Name: "absent", ArgTypes: []ValueType{ValueVector}, ReturnType: ValueVector},
+	// histogram_quantile is the phi-quantile of each step's histogram samples
+	"histogram_quantile": {Name: "histogram_quantile", ArgTypes: []ValueType{ValueScalar, ValueVector}, ReturnType: ValueVector},
+}
+
+// aggregation describes an aggregation operator
+type aggregation struct {
+	hasParam bool
+}
+
+// aggregations lists the operators aggregating across series
+var aggregations = map[string]aggregation{
+	"sum":      {},
+	"avg":      {},
+	"min":      {},
+	"max":      {},
+	"count":    {},
+	"stddev":   {},
+	"stdvar":   {},
+	"topk":     {hasParam: true},
+	"bottomk":  {hasParam: true},
+	"quantile": {hasParam: true},
+}
+
+// binaryOp applies an operator to two values. For comparisons the result
+// reports whether the comparison held.
+func binaryOp(op string, lhs, rhs float64) (float64, bool) {
+	switch op {
+	case "+":
+		return lhs + rhs, true
+	case "-":
+		return lhs - rhs, true
+	case "*":
+		return lhs * rhs, true
+	case "/":
+		return lhs / rhs, true
+	case "%":
+		return math.Mod(lhs, rhs), true
+	case "^":
+		return math.Pow(lhs, rhs), true
+	case "==":
+		return lhs, lhs == rhs
+	case "!=":
+		return lhs, lhs != rhs
+	case ">":
+		return lhs, lhs > rhs
+	case "<":
+		return lhs, lhs < rhs
+	case ">=":
+		return lhs, lhs >= rhs
+	case "<=":
+		return lhs, lhs <= rhs
+	}
+	return math.NaN(), false
+}
@@ -0,0 +1,30 @@
+package query
+
+// histogramQuantile evaluates histogram_quantile(phi, v): the phi-quantile
+// of the histogram samples of each series at every step. A step already
+// merges the samples within it, and sum merges them across series, so
+//
+//	histogram_quantile(0.99, sum by (route) (request_duration))
+//
+// with a one-hour step gives each route's hourly 99th percentile. Steps
+// without a histogram are dropped.
+func (ev *evaluator) histogramQuantile(call *Call, fn func(*Series) error) error {
+	phi, err := ev.scalar(call.Args[0])
+	if err != nil {
+		return err
+	}
+	return ev.eachSeries(call.Args[1], func(series *Series) error {
+		out := ev.newSeries(dropMetricName(series.Labels))
+		found := false
+		for i, present := range series.Present {
+			if sketch := series.sketch(i); present && sketch != nil {
+				out.set(i, sketch.Quantile(phi[i]))
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+		return fn(out)
+	})
+}
@@ -0,0 +1,184 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tokenKind identifies the kind of a lexed token
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenSelector
+	tokenString
+	tokenOperator
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+)
+
+// token is a lexed piece of a query expression
+type token struct {
+	kind  tokenKind
+	text  string
+	value float64
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// operators lists the binary operators, longest first so prefixes do not win
+var operators = []string{"==", "!=", ">=", "<=", "+", "-", "*", "/", "%", "^", ">", "<"}
+
+// lex splits a query expression into tokens. Label selectors in braces are
+// kept whole, including a metric name directly in front of them, so they can
+// be handed to storage.ParseSelector.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	pos := 0
+	for pos < len(input) {
+		c := input[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLeftParen, text: "(", pos: pos})
+			pos++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRightParen, text: ")", pos: pos})
+			pos++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: pos})
+			pos++
+
+		case c == '{':
+			end, err := scanBraces(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenSelector, text: input[pos:end], pos: pos})
+			pos = end
+
+		case c == '"' || c == '\'':
+			end, err := scanString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			value := strings.ReplaceAll(input[pos+1:end-1], `\'`, `'`)
+			if c == '"' {
+				var err error
+				if value, err = strconv.Unquote(input[pos:end]); err != nil {
+					return nil, errorf(pos, "invalid string %s", input[pos:end])
+				}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: value, pos: pos})
+			pos = end
+
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			end := pos
+			for end < len(input) && (isDigit(input[end]) || input[end] == '.' || input[end] == 'e' || input[end] == 'E' ||
+				((input[end] == '+' || input[end] == '-') && (input[end-1] == 'e' || input[end-1] == 'E'))) {
+				end++
+			}
+			// Trailing letters make a duration such as 5m or 1h30m
+			unitEnd := end
+			for unitEnd < len(input) && (isLetter(input[unitEnd]) || (unitEnd > end && isDigit(input[unitEnd]))) {
+				unitEnd++
+			}
+			if unitEnd > end {
+				tokens = append(tokens, token{kind: tokenIdent, text: input[pos:unitEnd], pos: pos})
+				pos = unitEnd
+				continue
+			}
+			value, err := strconv.ParseFloat(input[pos:end], 64)
+			if err != nil {
+				return nil, errorf(pos, "invalid number %q", input[pos:end])
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: input[pos:end], value: value, pos: pos})
+			pos = end
+
+		case isIdentStart(c):
+			end := pos
+			for end < len(input) && isIdentChar(input[end]) {
+				end++
+			}
+			// A metric name directly followed by a brace is one selector
+			if end < len(input) && input[end] == '{' {
+				braceEnd, err := scanBraces(input, end)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, token{kind: tokenSelector, text: input[pos:braceEnd], pos: pos})
+				pos = braceEnd
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: input[pos:end], pos: pos})
+			pos = end
+
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(input[pos:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: pos})
+					pos += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, errorf(pos, "unexpected character %q", c)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(input)}), nil
+}
+
+// scanBraces returns the position after the brace closing the one at start,
+// skipping over quoted label values
+func scanBraces(input string, start int) (int, error) {
+	for pos := start + 1; pos < len(input); pos++ {
+		switch input[pos] {
+		case '"', '\'':
+			end, err := scanString(input, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = end - 1
+		case '}':
+			return pos + 1, nil
+		}
+	}
+	return 0, errorf(start, "unclosed label selector")
+}
+
+// scanString returns the position after the quoted string starting at start
+func scanString(input string, start int) (int, error) {
+	quote := input[start]
+	for pos := start + 1; pos < len(input); pos++ {
+		switch input[pos] {
+		case '\\':
+			pos++
+		case quote:
+			return pos + 1, nil
+		}
+	}
+	return 0, errorf(start, "unterminated string")
+}
+
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+func isIdentStart(c byte) bool { return isLetter(c) || c == '_' || c == ':' }
+
+// isIdentChar allows dots so dotted metric names such as cpu.usage lex as one identifier
+func isIdentChar(c byte) bool { return isIdentStart(c) || isDigit(c) || c == '.' }
@@ -0,0 +1,367 @@
+package query
+
+import (
+	"fmt"
+	"time"
+	"time-series-analytics-engine/storage"
+	"time-series-analytics-engine/timeexpr"
+)
+
+// Operator precedences, lowest first
+const (
+	precComparison = iota + 1
+	precAdditive
+	precMultiplicative
+	precPower
+)
+
+var binaryPrecedence = map[string]int{
+	"==": precComparison, "!=": precComparison, ">": precComparison,
+	"<": precComparison, ">=": precComparison, "<=": precComparison,
+	"+": precAdditive, "-": precAdditive,
+	"*": precMultiplicative, "/": precMultiplicative, "%": precMultiplicative,
+	"^": precPower,
+}
+
+// isComparison reports whether an operator compares its operands
+func isComparison(op string) bool {
+	return binaryPrecedence[op] == precComparison
+}
+
+// parser is a recursive descent parser over lexed tokens
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// ParseExpr parses a query expression such as
+//
+//	sum by (host) (errors / requests * 100)
+//
+// Selectors use the same syntax as the match[] parameter of the discovery
+// endpoints.
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseBinary(precComparison)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, errorf(tok.pos, "unexpected %s", tok)
+	}
+	if expr.Type() == ValueDuration {
+		return nil, errorf(0, "a duration is only valid as a function argument")
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	tok := p.next()
+	if tok.kind != kind {
+		return tok, errorf(tok.pos, "expected %s, got %s", what, tok)
+	}
+	return tok, nil
+}
+
+// peekKeyword reports whether the next token is the given bare identifier
+func (p *parser) peekKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && tok.text == keyword
+}
+
+// parseBinary parses operators binding at least as tightly as minPrec.
+// All operators are left-associative except ^.
+func (p *parser) parseBinary(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		prec, ok := binaryPrecedence[tok.text]
+		if tok.kind != tokenOperator || !ok || prec < minPrec {
+			return lhs, nil
+		}
+		p.next()
+
+		expr := &BinaryExpr{Op: tok.text, LHS: lhs}
+		if p.peekKeyword("bool") {
+			if !isComparison(tok.text) {
+				return nil, errorf(p.peek().pos, "bool modifier can only be used on comparison operators")
+			}
+			p.next()
+			expr.ReturnBool = true
+		}
+		if expr.Matching, err = p.parseVectorMatching(); err != nil {
+			return nil, err
+		}
+
+		nextPrec := prec + 1
+		if tok.text == "^" {
+			nextPrec = prec
+		}
+		if expr.RHS, err = p.parseBinary(nextPrec); err != nil {
+			return nil, err
+		}
+
+		if err := checkBinary(expr, tok.pos); err != nil {
+			return nil, err
+		}
+		lhs = expr
+	}
+}
+
+// parseVectorMatching parses optional on/ignoring and group_left/group_right modifiers
+func (p *parser) parseVectorMatching() (*VectorMatching, error) {
+	if !p.peekKeyword("on") && !p.peekKeyword("ignoring") {
+		return nil, nil
+	}
+	matching := &VectorMatching{On: p.next().text == "on", Card: CardOneToOne}
+
+	labels, err := p.parseLabelList()
+	if err != nil {
+		return nil, err
+	}
+	matching.Labels = labels
+
+	if p.peekKeyword("group_left") || p.peekKeyword("group_right") {
+		matching.Card = CardManyToOne
+		if p.next().text == "group_right" {
+			matching.Card = CardOneToMany
+		}
+		if p.peek().kind == tokenLeftParen {
+			if matching.Include, err = p.parseLabelList(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return matching, nil
+}
+
+// parseLabelList parses a parenthesized, comma-separated list of label names
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokenLeftParen, "'('"); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for p.peek().kind != tokenRightParen {
+		tok, err := p.expect(tokenIdent, "label name")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, tok.text)
+		if p.peek().kind == tokenComma {
+			p.next()
+		} else if p.peek().kind != tokenRightParen {
+			return nil, errorf(p.peek().pos, "expected ',' or ')' in label list, got %s", p.peek())
+		}
+	}
+	p.next()
+	return labels, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	tok := p.peek()
+	if tok.kind == tokenOperator && (tok.text == "-" || tok.text == "+") {
+		p.next()
+		// Unary operators bind more loosely than ^ so -2^2 is -4
+		operand, err := p.parseBinary(precPower)
+		if err != nil {
+			return nil, err
+		}
+		if operand.Type() == ValueDuration {
+			return nil, errorf(tok.pos, "a duration is only valid as a function argument")
+		}
+		if tok.text == "+" {
+			return operand, nil
+		}
+		if number, ok := operand.(*NumberLiteral); ok {
+			return &NumberLiteral{Value: -number.Value}, nil
+		}
+		return &UnaryExpr{Expr: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber:
+		return &NumberLiteral{Value: tok.value}, nil
+
+	case tokenLeftParen:
+		expr, err := p.parseBinary(precComparison)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRightParen, "')'"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+
+	case tokenSelector:
+		return parseVectorSelector(tok)
+
+	case tokenIdent:
+		if _, ok := aggregations[tok.text]; ok {
+			next := p.peek()
+			if next.kind == tokenLeftParen || (next.kind == tokenIdent && (next.text == "by" || next.text == "without")) {
+				return p.parseAggregate(tok)
+			}
+		}
+		if p.peek().kind == tokenLeftParen {
+			return p.parseCall(tok)
+		}
+		if isDigit(tok.text[0]) {
+			d, err := parseDuration(tok.text)
+			if err != nil {
+				return nil, errorf(tok.pos, "%v", err)
+			}
+			return &DurationLiteral{Duration: d}, nil
+		}
+		return parseVectorSelector(tok)
+	}
+	return nil, errorf(tok.pos, "unexpected %s", tok)
+}
+
+func parseVectorSelector(tok token) (Expr, error) {
+	matchers, err := storage.ParseSelector(tok.text)
+	if err != nil {
+		return nil, errorf(tok.pos, "%v", err)
+	}
+	return &VectorSelector{Selector: tok.text, Matchers: matchers}, nil
+}
+
+// parseAggregate parses sum(x), sum by (a) (x) and sum(x) without (a)
+func (p *parser) parseAggregate(op token) (Expr, error) {
+	spec := aggregations[op.text]
+	agg := &AggregateExpr{Op: op.text}
+
+	parseGrouping := func() error {
+		if !p.peekKeyword("by") && !p.peekKeyword("without") {
+			return nil
+		}
+		agg.Without = p.next().text == "without"
+		labels, err := p.parseLabelList()
+		agg.Grouping = labels
+		return err
+	}
+
+	if err := parseGrouping(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenLeftParen, "'('"); err != nil {
+		return nil, err
+	}
+	if spec.hasParam {
+		param, err := p.parseBinary(precComparison)
+		if err != nil {
+			return nil, err
+		}
+		if param.Type() != ValueScalar {
+			return nil, errorf(op.pos, "%s expects a scalar parameter", op.text)
+		}
+		agg.Param = param
+		if _, err := p.expect(tokenComma, "','"); err != nil {
+			return nil, err
+		}
+	}
+	expr, err := p.parseBinary(precComparison)
+	if err != nil {
+		return nil, err
+	}
+	if expr.Type() != ValueVector {
+		return nil, errorf(op.pos, "%s expects a vector expression", op.text)
+	}
+	agg.Expr = expr
+	if _, err := p.expect(tokenRightParen, "')'"); err != nil {
+		return nil, err
+	}
+	if agg.Grouping == nil {
+		if err := parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+// parseCall parses a function call and checks its argument types
+func (p *parser) parseCall(name token) (Expr, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, errorf(name.pos, "unknown function %s", name.text)
+	}
+	p.next()
+
+	call := &Call{Func: fn}
+	for p.peek().kind != tokenRightParen {
+		arg, err := p.parseBinary(precComparison)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.peek().kind == tokenComma {
+			p.next()
+		} else if p.peek().kind != tokenRightParen {
+			return nil, errorf(p.peek().pos, "expected ',' or ')' in call to %s, got %s", fn.Name, p.peek())
+		}
+	}
+	p.next()
+
+	if len(call.Args) < len(fn.ArgTypes)-fn.OptionalArgs || len(call.Args) > len(fn.ArgTypes) {
+		return nil, errorf(name.pos, "wrong number of arguments to %s: got %d", fn.Name, len(call.Args))
+	}
+	for i, arg := range call.Args {
+		if arg.Type() != fn.ArgTypes[i] {
+			return nil, errorf(name.pos, "argument %d of %s must be a %s", i+1, fn.Name, fn.ArgTypes[i])
+		}
+	}
+	return call, nil
+}
+
+// checkBinary validates operand types and modifiers of a binary expression
+func checkBinary(expr *BinaryExpr, pos int) error {
+	if expr.LHS.Type() == ValueDuration || expr.RHS.Type() == ValueDuration {
+		return errorf(pos, "a duration is only valid as a function argument")
+	}
+	bothVectors := expr.LHS.Type() == ValueVector && expr.RHS.Type() == ValueVector
+	if expr.Matching != nil && !bothVectors {
+		return errorf(pos, "vector matching is only allowed between two vectors")
+	}
+	if isComparison(expr.Op) && !expr.ReturnBool && !bothVectors && expr.Type() == ValueScalar {
+		return errorf(pos, "comparisons between scalars must use the bool modifier")
+	}
+	if bothVectors && expr.Matching == nil {
+		expr.Matching = &VectorMatching{Card: CardOneToOne}
+	}
+	return nil
+}
+
+// parseDuration parses a duration literal such as 5m, 1h30m or 7d
+func parseDuration(text string) (time.Duration, error) {
+	d, err := timeexpr.ParseDuration(text)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", text)
+	}
+	return d, nil
+}
@@ -0,0 +1,148 @@
+package query
+
+import (
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	valid := []struct {
+		input    string
+		exprType ValueType
+	}{
+		{`cpu.usage`, ValueVector},
+		{`errors / requests * 100`, ValueVector},
+		{`sum by (host) (cpu.usage{env="prod"})`, ValueVector},
+		{`sum(cpu.usage) without (cpu)`, ValueVector},
+		{`errors / on(host) group_left(team) requests`, ValueVector},
+		{`a / ignoring(code) group_right b`, ValueVector},
+		{`cpu.usage > bool 90`, ValueVector},
+		{`clamp_max(abs(-cpu.usage), 100)`, ValueVector},
+		{`2 ^ 3 ^ 2`, ValueScalar},
+		{`scalar(sum(cpu.usage)) * 2`, ValueScalar},
+		{`{__name__=~"cpu.*", host!="a"}`, ValueVector},
+		{`moving_avg(cpu.usage, 5m)`, ValueVector},
+		{`ewma(sum by (host) (cpu.usage), 1h30m)`, ValueVector},
+		{`cpu.usage - timeshift(cpu.usage, 1w)`, ValueVector},
+		{`gaps(cpu.usage, 5m)`, ValueVector},
+		{`absent(cpu.usage{host="a"})`, ValueVector},
+		{`derivative(bytes.sent)`, ValueVector},
+		{`histogram_quantile(0.99, sum by (route) (request.duration))`, ValueVector},
+	}
+
+	for _, tt := range valid {
+		expr, err := ParseExpr(tt.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.input, err)
+			continue
+		}
+		if expr.Type() != tt.exprType {
+			t.Errorf("%s: expected %s, got %s", tt.input, tt.exprType, expr.Type())
+		}
+	}
+}
+
+func TestParseExpr_Precedence(t *testing.T) {
+	expr, err := ParseExpr(`a + b * c ^ 2`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	add, ok := expr.(*BinaryExpr)
+	if !ok || add.Op != "+" {
+		t.Fatalf("Expected + at the root, got %#v", expr)
+	}
+	mul, ok := add.RHS.(*BinaryExpr)
+	if !ok || mul.Op != "*" {
+		t.Fatalf("Expected * under +, got %#v", add.RHS)
+	}
+	if pow, ok := mul.RHS.(*BinaryExpr); !ok || pow.Op != "^" {
+		t.Errorf("Expected ^ under *, got %#v", mul.RHS)
+	}
+
+	matching := add.Matching
+	if matching == nil || matching.Card != CardOneToOne {
+		t.Errorf("Expected default one-to-one matching between vectors, got %+v", matching)
+	}
+}
+
+func TestParseExpr_Errors(t *testing.T) {
+	invalid := []string{
+		``,
+		`cpu.usage{host="a"`,
+		`sum(`,
+		`1 > 2`,
+		`1 + on(host) 2`,
+		`cpu.usage + bool 1`,
+		`unknown_fn(cpu.usage)`,
+		`abs(1)`,
+		`sum(1)`,
+		`cpu.usage 5`,
+		`5m`,
+		`-5m`,
+		`cpu.usage + 5m`,
+		`moving_avg(cpu.usage)`,
+		`moving_avg(cpu.usage, 5)`,
+		`moving_avg(cpu.usage, 5x)`,
+	}
+
+	for _, input := range invalid {
+		if _, err := ParseExpr(input); err == nil {
+			t.Errorf("Expected error parsing %q", input)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, same := range [][]string{
+		{`errors / requests * 100`, `((errors/requests)) * 100`},
+		{`sum by (host, env) (cpu.usage{env="prod",host=~"a.*"})`, `sum(cpu.usage{host=~'a.*', env="prod"}) by (env,host)`},
+		{`a / on(host) group_left(team) b`, `a/on (host) group_left (team) (b)`},
+		{`cpu.usage`, `{__name__="cpu.usage"}`},
+	} {
+		first, err := ParseExpr(same[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := ParseExpr(same[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Format(first) != Format(second) {
+			t.Errorf("Expected %q and %q to format identically, got %q and %q", same[0], same[1], Format(first), Format(second))
+		}
+	}
+
+	for _, different := range [][]string{
+		{`a - b - c`, `a - (b - c)`},
+		{`sum by (host) (x)`, `sum without (host) (x)`},
+		{`a > b`, `a > bool b`},
+		{`moving_avg(x, 5m)`, `moving_avg(x, 10m)`},
+	} {
+		first, _ := ParseExpr(different[0])
+		second, _ := ParseExpr(different[1])
+		if Format(first) == Format(second) {
+			t.Errorf("Expected %q and %q to format differently, got %q", different[0], different[1], Format(first))
+		}
+	}
+}
+
+func TestSplittable(t *testing.T) {
+	for input, expected := range map[string]bool{
+		`sum by (host) (cpu) * 2`:                  true,
+		`moving_avg(cpu, 5m) - timeshift(cpu, 1d)`: true,
+		`cumsum(cpu, 1h)`:                          true,
+		`derivative(cpu, 5m)`:                      true,
+		`gaps(cpu)`:                                true,
+		`cumsum(cpu)`:                              false,
+		`topk(3, integral(cpu))`:                   false,
+		`derivative(cpu) > 0`:                      false,
+		`abs(ewma(cpu, 5m))`:                       false,
+	} {
+		expr, err := ParseExpr(input)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", input, err)
+		}
+		if Splittable(expr) != expected {
+			t.Errorf("Expected Splittable(%s) to be %v", input, expected)
+		}
+	}
+}
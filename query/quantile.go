@@ -0,0 +1,107 @@
+package query
+
+import (
+	"math"
+	"sort"
+)
+
+// quantileEstimator estimates a quantile of a stream of values with the P²
+// algorithm (Jain and Chlamtac, 1985) in constant memory. The first five
+// values are kept exactly, so small inputs give the same result as sorting.
+type quantileEstimator struct {
+	phi     float64
+	count   int
+	heights [5]float64
+	pos     [5]float64
+	desired [5]float64
+	incr    [5]float64
+}
+
+func (e *quantileEstimator) add(value float64) {
+	if e.count < 5 {
+		e.heights[e.count] = value
+		e.count++
+		if e.count == 5 {
+			e.init()
+		}
+		return
+	}
+	e.count++
+
+	// Find the cell holding the value, widening the extremes if needed
+	var k int
+	switch {
+	case value < e.heights[0]:
+		e.heights[0] = value
+		k = 0
+	case value >= e.heights[4]:
+		e.heights[4] = value
+		k = 3
+	default:
+		for k = 0; k < 3 && value >= e.heights[k+1]; k++ {
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		e.pos[i]++
+	}
+	for i := range e.desired {
+		e.desired[i] += e.incr[i]
+	}
+
+	// Move the middle markers towards their desired positions
+	for i := 1; i <= 3; i++ {
+		d := e.desired[i] - e.pos[i]
+		if (d >= 1 && e.pos[i+1]-e.pos[i] > 1) || (d <= -1 && e.pos[i-1]-e.pos[i] < -1) {
+			sign := math.Copysign(1, d)
+			height := e.parabolic(i, sign)
+			if e.heights[i-1] < height && height < e.heights[i+1] {
+				e.heights[i] = height
+			} else {
+				j := i + int(sign)
+				e.heights[i] += sign * (e.heights[j] - e.heights[i]) / (e.pos[j] - e.pos[i])
+			}
+			e.pos[i] += sign
+		}
+	}
+}
+
+func (e *quantileEstimator) init() {
+	sort.Float64s(e.heights[:])
+	p := e.phi
+	e.pos = [5]float64{0, 1, 2, 3, 4}
+	e.desired = [5]float64{0, 2 * p, 4 * p, 2 + 2*p, 4}
+	e.incr = [5]float64{0, p / 2, p, (1 + p) / 2, 1}
+}
+
+// parabolic is the piecewise-parabolic prediction for marker i moved by d
+func (e *quantileEstimator) parabolic(i int, d float64) float64 {
+	q, n := e.heights, e.pos
+	return q[i] + d/(n[i+1]-n[i-1])*
+		((n[i]-n[i-1]+d)*(q[i+1]-q[i])/(n[i+1]-n[i])+
+			(n[i+1]-n[i]-d)*(q[i]-q[i-1])/(n[i]-n[i-1]))
+}
+
+// value returns the estimate. Out-of-range quantiles give ±Inf.
+func (e *quantileEstimator) value() float64 {
+	switch {
+	case math.IsNaN(e.phi):
+		return math.NaN()
+	case e.phi < 0:
+		return math.Inf(-1)
+	case e.phi > 1:
+		return math.Inf(1)
+	case e.count == 0:
+		return math.NaN()
+	case e.count > 5:
+		return e.heights[2]
+	}
+
+	// Interpolate between the exact values
+	values := append([]float64(nil), e.heights[:e.count]...)
+	sort.Float64s(values)
+	rank := e.phi * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	weight := rank - float64(lower)
+	return values[lower]*(1-weight) + values[upper]*weight
+}
@@ -0,0 +1,123 @@
+package query
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// rankedRef identifies an input series kept by topk or bottomk
+type rankedRef struct {
+	labels map[string]string
+	order  int
+}
+
+type rankedEntry struct {
+	value float64
+	ref   *rankedRef
+}
+
+// rankHeap keeps the k best entries of one step. Its root is the worst
+// entry kept, which is the one evicted when a better value arrives.
+type rankHeap struct {
+	entries []rankedEntry
+	bottom  bool
+}
+
+// worse reports whether a ranks below b. NaN ranks below every number.
+func (h *rankHeap) worse(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && !math.IsNaN(b)
+	}
+	if h.bottom {
+		return a > b
+	}
+	return a < b
+}
+
+func (h *rankHeap) Len() int           { return len(h.entries) }
+func (h *rankHeap) Less(i, j int) bool { return h.worse(h.entries[i].value, h.entries[j].value) }
+func (h *rankHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *rankHeap) Push(x interface{}) { h.entries = append(h.entries, x.(rankedEntry)) }
+
+func (h *rankHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+// offer adds an entry if it ranks among the best k seen so far
+func (h *rankHeap) offer(entry rankedEntry, k int) {
+	switch {
+	case k <= 0:
+	case len(h.entries) < k:
+		heap.Push(h, entry)
+	case h.worse(h.entries[0].value, entry.value):
+		h.entries[0] = entry
+		heap.Fix(h, 0)
+	}
+}
+
+// aggregateRank evaluates topk and bottomk in a single pass over the input
+// series. Each group keeps at most k entries per step, so memory is bounded
+// by k and the number of steps rather than the number of input series.
+func (ev *evaluator) aggregateRank(expr *AggregateExpr, fn func(*Series) error) error {
+	params, err := ev.scalar(expr.Param)
+	if err != nil {
+		return err
+	}
+	n := ev.grid.len()
+	groups := make(map[string][]rankHeap)
+	order := 0
+
+	err = ev.eachSeries(expr.Expr, func(series *Series) error {
+		sig := signature(series.Labels, expr.Grouping, !expr.Without)
+		heaps, exists := groups[sig]
+		if !exists {
+			heaps = make([]rankHeap, n)
+			for i := range heaps {
+				heaps[i].bottom = expr.Op == "bottomk"
+			}
+			groups[sig] = heaps
+		}
+
+		ref := &rankedRef{labels: series.Labels, order: order}
+		order++
+		for i, present := range series.Present {
+			if present && !math.IsNaN(params[i]) {
+				heaps[i].offer(rankedEntry{value: series.Values[i], ref: ref}, int(params[i]))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the selected input series from the entries left in the heaps
+	outputs := make(map[*rankedRef]*Series)
+	for _, heaps := range groups {
+		for i := range heaps {
+			for _, entry := range heaps[i].entries {
+				series, ok := outputs[entry.ref]
+				if !ok {
+					series = ev.newSeries(entry.ref.labels)
+					outputs[entry.ref] = series
+				}
+				series.set(i, entry.value)
+			}
+		}
+	}
+
+	refs := make([]*rankedRef, 0, len(outputs))
+	for ref := range outputs {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].order < refs[j].order })
+	for _, ref := range refs {
+		if err := fn(outputs[ref]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
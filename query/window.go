@@ -0,0 +1,352 @@
+package query
+
+import (
+	"math"
+	"sort"
+	"time"
+	"time-series-analytics-engine/storage"
+)
+
+// windowArgs describes the window a windowed function is evaluated with
+type windowArgs struct {
+	// window is the duration argument, zero when it was omitted
+	window time.Duration
+	// steps is the window length in steps, rounded up
+	steps int
+	// grid is the grid the argument is evaluated over, whose steps may
+	// vary in length for calendar steps
+	grid *grid
+}
+
+// elapsed returns the time between the starts of steps i and j
+func (w windowArgs) elapsed(i, j int) time.Duration {
+	return w.grid.time(j).Sub(w.grid.time(i))
+}
+
+// windowFunction computes each output step from the steps preceding it.
+// The argument is evaluated over a grid extended back by lookback steps, so
+// out step i corresponds to in step i+lookback.
+type windowFunction struct {
+	lookback func(w windowArgs) int
+	apply    func(in, out *Series, lookback int, w windowArgs)
+	// fromStart reports whether steps also depend on values before the
+	// lookback, back to the start of the range; nil means they never do
+	fromStart func(w windowArgs) bool
+}
+
+// windowed builds a function taking a vector and a window length
+func windowed(name string, optionalWindow bool, wf *windowFunction) *Function {
+	fn := &Function{
+		Name:       name,
+		ArgTypes:   []ValueType{ValueVector, ValueDuration},
+		ReturnType: ValueVector,
+		window:     wf,
+	}
+	if optionalWindow {
+		fn.OptionalArgs = 1
+	}
+	return fn
+}
+
+// movingWindow builds a windowed function reducing the present values of
+// the last window steps with reduce
+func movingWindow(name string, reduce func(values []float64) float64) *Function {
+	return windowed(name, false, &windowFunction{
+		lookback: func(w windowArgs) int { return w.steps - 1 },
+		apply: func(in, out *Series, lookback int, w windowArgs) {
+			values := make([]float64, 0, w.steps)
+			for i := range out.Values {
+				j := i + lookback
+				values = values[:0]
+				for k := j - w.steps + 1; k <= j; k++ {
+					if k >= 0 && in.Present[k] {
+						values = append(values, in.Values[k])
+					}
+				}
+				if len(values) > 0 {
+					out.set(i, reduce(values))
+				}
+			}
+		},
+	})
+}
+
+// cumulativeWindow builds a windowed function summing f(value) over the
+// last window steps, or from the start of the query range without a window
+func cumulativeWindow(name string, f func(value float64, width time.Duration) float64) *Function {
+	return windowed(name, true, &windowFunction{
+		lookback: func(w windowArgs) int {
+			if w.steps == 0 {
+				return 0
+			}
+			return w.steps - 1
+		},
+		fromStart: func(w windowArgs) bool { return w.window == 0 },
+		apply: func(in, out *Series, lookback int, w windowArgs) {
+			sum := 0.0
+			for j := range in.Values {
+				if in.Present[j] {
+					sum += f(in.Values[j], w.elapsed(j, j+1))
+				}
+				if w.steps > 0 && j >= w.steps && in.Present[j-w.steps] {
+					sum -= f(in.Values[j-w.steps], w.elapsed(j-w.steps, j-w.steps+1))
+				}
+				if i := j - lookback; i >= 0 && in.Present[j] {
+					out.set(i, sum)
+				}
+			}
+		},
+	})
+}
+
+// Reducers for moving window functions
+func meanOf(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func minOf(values []float64) float64 {
+	min := values[0]
+	for _, v := range values[1:] {
+		min = math.Min(min, v)
+	}
+	return min
+}
+
+func maxOf(values []float64) float64 {
+	max := values[0]
+	for _, v := range values[1:] {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+func medianOf(values []float64) float64 {
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
+
+// ewmaWindow uses the window as its time constant: older values decay by 1/e per
+// window. Three windows of history are read to warm it up.
+var ewmaWindow = &windowFunction{
+	lookback:  func(w windowArgs) int { return 3 * w.steps },
+	fromStart: func(windowArgs) bool { return true },
+	apply: func(in, out *Series, lookback int, w windowArgs) {
+		var average float64
+		last := -1
+		for j := range in.Values {
+			if !in.Present[j] {
+				continue
+			}
+			if last < 0 {
+				average = in.Values[j]
+			} else {
+				// Weight by elapsed time so that gaps decay the average further
+				alpha := 1 - math.Exp(-float64(w.elapsed(last, j))/float64(w.window))
+				average += alpha * (in.Values[j] - average)
+			}
+			last = j
+			if i := j - lookback; i >= 0 {
+				out.set(i, average)
+			}
+		}
+	},
+}
+
+// derivativeWindow is the per-second change from the previous value, or from the
+// earliest value within the window
+var derivativeWindow = &windowFunction{
+	lookback: func(w windowArgs) int {
+		if w.steps == 0 {
+			return 1
+		}
+		return w.steps
+	},
+	// Without a window the previous value may lie anywhere before the step
+	fromStart: func(w windowArgs) bool { return w.window == 0 },
+	apply: func(in, out *Series, lookback int, w windowArgs) {
+		previous := -1
+		for j := range in.Values {
+			if !in.Present[j] {
+				continue
+			}
+			from := previous
+			if w.steps > 0 {
+				from = -1
+				for k := j - w.steps; k < j; k++ {
+					if k >= 0 && in.Present[k] {
+						from = k
+						break
+					}
+				}
+			}
+			if i := j - lookback; i >= 0 && from >= 0 {
+				out.set(i, (in.Values[j]-in.Values[from])/w.elapsed(from, j).Seconds())
+			}
+			previous = j
+		}
+	},
+}
+
+// gapsWindow is 1 at steps where a series has no data within the window and 0
+// where it has. Without a window only the step itself is checked. A stale
+// marker ends coverage at once rather than when the window runs out.
+var gapsWindow = &windowFunction{
+	lookback: func(w windowArgs) int {
+		if w.steps == 0 {
+			return 0
+		}
+		return w.steps - 1
+	},
+	apply: func(in, out *Series, lookback int, w windowArgs) {
+		steps := w.steps
+		if steps == 0 {
+			steps = 1
+		}
+		lastPresent, staleAt := -1, -1
+		for j := range in.Values {
+			if in.Present[j] {
+				lastPresent = j
+			}
+			// A step with both values and a marker went stale after its values
+			if in.stale != nil && in.stale[j] {
+				staleAt = j
+			}
+			covered := in.Present[j] || lastPresent >= 0 && staleAt < lastPresent && j-lastPresent < steps
+			if i := j - lookback; i >= 0 {
+				out.set(i, boolValue(!covered))
+			}
+		}
+	},
+}
+
+// windowCall evaluates a windowed function. The argument is evaluated over a
+// grid extended back far enough to fill the first window, using the same
+// step and bucket aggregation as the query.
+func (ev *evaluator) windowCall(call *Call, fn func(*Series) error) error {
+	var w windowArgs
+	if len(call.Args) > 1 {
+		step := ev.grid.step()
+		w.window = durationArg(call.Args[1])
+		w.steps = int((w.window + step - 1) / step)
+	}
+
+	lookback := call.Func.window.lookback(w)
+	if ev.grid.len()+lookback > MaxSteps {
+		return errorf(-1, "%s window of %v needs more than %d steps; use a larger step", call.Func.Name, w.window, MaxSteps)
+	}
+	w.grid = ev.grid.extend(lookback)
+	extended := ev.withGrid(w.grid, w.grid.time(0), ev.params.End)
+
+	return extended.eachSeries(call.Args[0], func(in *Series) error {
+		out := ev.newSeries(dropMetricName(in.Labels))
+		call.Func.window.apply(in, out, lookback, w)
+		return fn(out)
+	})
+}
+
+// Splittable reports whether the value of an expression at each step is
+// independent of where the range starts, so that results evaluated over
+// adjacent ranges join into the result over both. Running totals without a
+// window and ewma, which warms up from the start of the range, are not.
+func Splittable(expr Expr) bool {
+	switch e := expr.(type) {
+	case *ParenExpr:
+		return Splittable(e.Expr)
+	case *UnaryExpr:
+		return Splittable(e.Expr)
+	case *BinaryExpr:
+		return Splittable(e.LHS) && Splittable(e.RHS)
+	case *AggregateExpr:
+		return (e.Param == nil || Splittable(e.Param)) && Splittable(e.Expr)
+	case *Call:
+		if wf := e.Func.window; wf != nil && wf.fromStart != nil {
+			var w windowArgs
+			if len(e.Args) > 1 {
+				w.window = durationArg(e.Args[1])
+			}
+			if wf.fromStart(w) {
+				return false
+			}
+		}
+		for _, arg := range e.Args {
+			if !Splittable(arg) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// timeshift evaluates its argument as of a duration earlier, so that a
+// series can be compared with itself, e.g. x - timeshift(x, 1w)
+func (ev *evaluator) timeshift(call *Call, fn func(*Series) error) error {
+	offset := durationArg(call.Args[1])
+	shifted := ev.withGrid(ev.grid.shift(-offset), ev.params.Start.Add(-offset), ev.params.End.Add(-offset))
+	return shifted.eachSeries(call.Args[0], fn)
+}
+
+// absent returns a single series that is 1 at the steps where its argument
+// has no series at all, and absent elsewhere. When the argument is a
+// selector its equality matchers become the labels of the result, so that
+// alerts on absent(cpu{host="a"}) know which host went missing.
+func (ev *evaluator) absent(call *Call, fn func(*Series) error) error {
+	found := make([]bool, ev.grid.len())
+	err := ev.eachSeries(call.Args[0], func(series *Series) error {
+		for i, present := range series.Present {
+			found[i] = found[i] || present
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{}
+	if selector, ok := unwrapParens(call.Args[0]).(*VectorSelector); ok {
+		for _, m := range selector.Matchers {
+			if m.Type == storage.MatchEqual && m.Name != storage.MetricNameLabel && m.Value != "" {
+				labels[m.Name] = m.Value
+			}
+		}
+	}
+
+	series := ev.newSeries(labels)
+	missing := false
+	for i, present := range found {
+		if !present {
+			series.set(i, 1)
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+	return fn(series)
+}
+
+// unwrapParens returns the expression inside any parentheses
+func unwrapParens(expr Expr) Expr {
+	for {
+		paren, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
+
+// durationArg returns the value of a duration argument
+func durationArg(expr Expr) time.Duration {
+	if d, ok := unwrapParens(expr).(*DurationLiteral); ok {
+		return d.Duration
+	}
+	return 0
+}
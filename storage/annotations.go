@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrAnnotationNotFound is returned when updating or deleting an unknown annotation
+var ErrAnnotationNotFound = errors.New("annotation not found")
+
+// Annotation is an event such as a deploy or an incident, shown on charts
+// at a time or over a time range
+type Annotation struct {
+	ID      string     `json:"id"`
+	Time    time.Time  `json:"time"`
+	TimeEnd *time.Time `json:"time_end,omitempty"`
+	Title   string     `json:"title"`
+	Text    string     `json:"text,omitempty"`
+	Tags    []string   `json:"tags"`
+	Created time.Time  `json:"created"`
+	Updated time.Time  `json:"updated"`
+}
+
+// end returns the end of the annotation's time range
+func (a *Annotation) end() time.Time {
+	if a.TimeEnd != nil {
+		return *a.TimeEnd
+	}
+	return a.Time
+}
+
+// hasTags reports whether the annotation carries all of the tags, or any of
+// them with matchAny set
+func (a *Annotation) hasTags(tags []string, matchAny bool) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		found := false
+		for _, own := range a.Tags {
+			if own == tag {
+				found = true
+				break
+			}
+		}
+		if found && matchAny {
+			return true
+		}
+		if !found && !matchAny {
+			return false
+		}
+	}
+	return !matchAny
+}
+
+// validate checks the fields set by callers
+func (a *Annotation) validate() error {
+	if a.Time.IsZero() {
+		return fmt.Errorf("annotation time is required")
+	}
+	if a.Title == "" {
+		return fmt.Errorf("annotation title is required")
+	}
+	if a.TimeEnd != nil && a.TimeEnd.Before(a.Time) {
+		return fmt.Errorf("annotation end %v is before its start %v", *a.TimeEnd, a.Time)
+	}
+	return nil
+}
+
+// AnnotationQuery selects annotations overlapping a time range. Zero times
+// leave the range open on that side.
+type AnnotationQuery struct {
+	Start    time.Time
+	End      time.Time
+	Tags     []string
+	MatchAny bool
+	Limit    int
+}
+
+// annotationRecord is one entry of the annotation log. A record without an
+// annotation deletes the ID.
+type annotationRecord struct {
+	ID         string      `json:"id"`
+	Annotation *Annotation `json:"annotation,omitempty"`
+}
+
+// AnnotationStore keeps annotations in memory, backed by an append-only log
+// that is replayed on open. Every change is synced before it is applied.
+type AnnotationStore struct {
+	mu          sync.RWMutex
+	annotations map[string]*Annotation
+	path        string
+	file        *os.File
+	// records counts log entries, so that the log is rewritten once it is
+	// mostly superseded entries
+	records int
+}
+
+// NewAnnotationStore opens the annotation log at path, creating it if
+// needed. An empty path keeps annotations in memory only.
+func NewAnnotationStore(path string) (*AnnotationStore, error) {
+	as := &AnnotationStore{
+		annotations: make(map[string]*Annotation),
+		path:        path,
+	}
+	if path == "" {
+		return as, nil
+	}
+
+	if err := as.load(); err != nil {
+		return nil, err
+	}
+	if as.records > 2*len(as.annotations) {
+		if err := as.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open annotation log: %w", err)
+	}
+	as.file = file
+	return as, nil
+}
+
+// Create stores a new annotation, assigning its ID and creation time
+func (as *AnnotationStore) Create(annotation Annotation) (*Annotation, error) {
+	if err := annotation.validate(); err != nil {
+		return nil, err
+	}
+	id, err := newAnnotationID()
+	if err != nil {
+		return nil, err
+	}
+	annotation.ID = id
+	annotation.Created = time.Now().UTC()
+	annotation.Updated = annotation.Created
+	if annotation.Tags == nil {
+		annotation.Tags = []string{}
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if err := as.append(annotationRecord{ID: id, Annotation: &annotation}); err != nil {
+		return nil, err
+	}
+	as.annotations[id] = &annotation
+	return copyAnnotation(&annotation), nil
+}
+
+// Update replaces the fields of an existing annotation, keeping its ID and
+// creation time
+func (as *AnnotationStore) Update(id string, annotation Annotation) (*Annotation, error) {
+	if err := annotation.validate(); err != nil {
+		return nil, err
+	}
+	if annotation.Tags == nil {
+		annotation.Tags = []string{}
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	existing, ok := as.annotations[id]
+	if !ok {
+		return nil, ErrAnnotationNotFound
+	}
+	annotation.ID = id
+	annotation.Created = existing.Created
+	annotation.Updated = time.Now().UTC()
+	if err := as.append(annotationRecord{ID: id, Annotation: &annotation}); err != nil {
+		return nil, err
+	}
+	as.annotations[id] = &annotation
+	return copyAnnotation(&annotation), nil
+}
+
+// Delete removes an annotation
+func (as *AnnotationStore) Delete(id string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if _, ok := as.annotations[id]; !ok {
+		return ErrAnnotationNotFound
+	}
+	if err := as.append(annotationRecord{ID: id}); err != nil {
+		return err
+	}
+	delete(as.annotations, id)
+	return nil
+}
+
+// Get returns an annotation by ID
+func (as *AnnotationStore) Get(id string) (*Annotation, bool) {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+	annotation, ok := as.annotations[id]
+	if !ok {
+		return nil, false
+	}
+	return copyAnnotation(annotation), true
+}
+
+// Query returns the annotations overlapping the query range and carrying
+// its tags, ordered by time. With a limit the most recent are kept.
+func (as *AnnotationStore) Query(q AnnotationQuery) []*Annotation {
+	as.mu.RLock()
+	var result []*Annotation
+	for _, annotation := range as.annotations {
+		if !q.End.IsZero() && annotation.Time.After(q.End) {
+			continue
+		}
+		if !q.Start.IsZero() && annotation.end().Before(q.Start) {
+			continue
+		}
+		if annotation.hasTags(q.Tags, q.MatchAny) {
+			result = append(result, copyAnnotation(annotation))
+		}
+	}
+	as.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Time.Equal(result[j].Time) {
+			return result[i].Time.Before(result[j].Time)
+		}
+		return result[i].ID < result[j].ID
+	})
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result
+}
+
+// Close closes the annotation log
+func (as *AnnotationStore) Close() error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.file == nil {
+		return nil
+	}
+	err := as.file.Close()
+	as.file = nil
+	return err
+}
+
+// append writes a record to the log and syncs it. Callers hold the lock.
+func (as *AnnotationStore) append(record annotationRecord) error {
+	if as.path == "" {
+		return nil
+	}
+	if as.file == nil {
+		return fmt.Errorf("annotation store is closed")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode annotation: %w", err)
+	}
+	if _, err := as.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write annotation log: %w", err)
+	}
+	if err := as.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync annotation log: %w", err)
+	}
+	as.records++
+	return nil
+}
+
+// load replays the log. A truncated last line, left by a crash during a
+// write, is ignored.
+func (as *AnnotationStore) load() error {
+	file, err := os.Open(as.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open annotation log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record annotationRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			fmt.Printf("Warning: skipping corrupt annotation record in %s: %v\n", as.path, err)
+			continue
+		}
+		if record.Annotation != nil {
+			as.annotations[record.ID] = record.Annotation
+		} else {
+			delete(as.annotations, record.ID)
+		}
+		as.records++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read annotation log: %w", err)
+	}
+	return nil
+}
+
+// rewrite replaces the log with one record per live annotation
+func (as *AnnotationStore) rewrite() error {
+	tmpPath := as.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite annotation log: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for id, annotation := range as.annotations {
+		if err := encoder.Encode(annotationRecord{ID: id, Annotation: annotation}); err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to rewrite annotation log: %w", err)
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, as.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rewrite annotation log: %w", err)
+	}
+	as.records = len(as.annotations)
+	return nil
+}
+
+func newAnnotationID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate annotation ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func copyAnnotation(a *Annotation) *Annotation {
+	c := *a
+	c.Tags = append([]string{}, a.Tags...)
+	if a.TimeEnd != nil {
+		end := *a.TimeEnd
+		c.TimeEnd = &end
+	}
+	return &c
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnnotationStore_QueryByTimeAndTags(t *testing.T) {
+	store, err := NewAnnotationStore("")
+	if err != nil {
+		t.Fatalf("Failed to create annotation store: %v", err)
+	}
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	end := base.Add(2 * time.Hour)
+	store.Create(Annotation{Time: base, Title: "deploy v1", Tags: []string{"deploy", "prod"}})
+	store.Create(Annotation{Time: base.Add(time.Hour), TimeEnd: &end, Title: "incident", Tags: []string{"incident", "prod"}})
+	store.Create(Annotation{Time: base.Add(3 * time.Hour), Title: "deploy v2", Tags: []string{"deploy", "staging"}})
+
+	tests := []struct {
+		name     string
+		query    AnnotationQuery
+		expected []string
+	}{
+		{"all", AnnotationQuery{}, []string{"deploy v1", "incident", "deploy v2"}},
+		{"range overlap", AnnotationQuery{Start: base.Add(90 * time.Minute), End: base.Add(4 * time.Hour)}, []string{"incident", "deploy v2"}},
+		{"all tags", AnnotationQuery{Tags: []string{"deploy", "prod"}}, []string{"deploy v1"}},
+		{"any tag", AnnotationQuery{Tags: []string{"incident", "staging"}, MatchAny: true}, []string{"incident", "deploy v2"}},
+		{"limit keeps latest", AnnotationQuery{Limit: 1}, []string{"deploy v2"}},
+	}
+	for _, tt := range tests {
+		result := store.Query(tt.query)
+		if len(result) != len(tt.expected) {
+			t.Errorf("%s: expected %v, got %d annotations", tt.name, tt.expected, len(result))
+			continue
+		}
+		for i, annotation := range result {
+			if annotation.Title != tt.expected[i] {
+				t.Errorf("%s: expected %q at %d, got %q", tt.name, tt.expected[i], i, annotation.Title)
+			}
+		}
+	}
+
+	if _, err := store.Create(Annotation{Time: base}); err == nil {
+		t.Error("Expected an annotation without a title to be rejected")
+	}
+	if _, err := store.Create(Annotation{Time: end, TimeEnd: &base, Title: "backwards"}); err == nil {
+		t.Error("Expected an annotation ending before it starts to be rejected")
+	}
+}
+
+func TestAnnotationStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "annotations.log")
+	store, err := NewAnnotationStore(path)
+	if err != nil {
+		t.Fatalf("Failed to create annotation store: %v", err)
+	}
+
+	now := time.Now().UTC()
+	kept, _ := store.Create(Annotation{Time: now, Title: "deploy", Tags: []string{"deploy"}})
+	removed, _ := store.Create(Annotation{Time: now, Title: "mistake"})
+	if _, err := store.Update(kept.ID, Annotation{Time: now, Title: "deploy v2", Text: "rolled out"}); err != nil {
+		t.Fatalf("Failed to update annotation: %v", err)
+	}
+	if err := store.Delete(removed.ID); err != nil {
+		t.Fatalf("Failed to delete annotation: %v", err)
+	}
+	if err := store.Delete(removed.ID); err != ErrAnnotationNotFound {
+		t.Errorf("Expected ErrAnnotationNotFound, got %v", err)
+	}
+	store.Close()
+
+	reopened, err := NewAnnotationStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen annotation store: %v", err)
+	}
+	defer reopened.Close()
+
+	all := reopened.Query(AnnotationQuery{})
+	if len(all) != 1 {
+		t.Fatalf("Expected one annotation after reopening, got %d", len(all))
+	}
+	if got := all[0]; got.ID != kept.ID || got.Title != "deploy v2" || got.Text != "rolled out" || !got.Created.Equal(kept.Created) {
+		t.Errorf("Unexpected annotation after reopening: %+v", got)
+	}
+	// Superseded records are dropped when the log is reopened
+	if reopened.records != 1 {
+		t.Errorf("Expected the log to be rewritten to 1 record, got %d", reopened.records)
+	}
+}
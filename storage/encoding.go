@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// columnarBlockMagic starts a warm block in the column encoding. Blocks
+// written before it existed are plain JSON and start with '{'.
+const columnarBlockMagic = 0x01
+
+// encodeBlock serializes a warm block. Blocks of plain values are written as
+// a JSON header followed by the points in the column encoding; blocks with
+// histogram samples are written entirely as JSON.
+func encodeBlock(block *WarmDataBlock) ([]byte, error) {
+	for _, point := range block.Points {
+		if point.Sketch != nil {
+			return json.Marshal(block)
+		}
+	}
+
+	header := *block
+	header.Points = nil
+	headerData, err := json.Marshal(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(columnarBlockMagic)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(headerData))))
+	buf.Write(headerData)
+	buf.Write(encodePoints(block.Points))
+	return buf.Bytes(), nil
+}
+
+// decodeBlock deserializes a warm block in either encoding
+func decodeBlock(data []byte) (*WarmDataBlock, error) {
+	var block WarmDataBlock
+	if len(data) == 0 || data[0] != columnarBlockMagic {
+		if err := json.Unmarshal(data, &block); err != nil {
+			return nil, err
+		}
+		return &block, nil
+	}
+
+	r := bytes.NewReader(data[1:])
+	headerLength, err := binary.ReadUvarint(r)
+	if err != nil || headerLength > uint64(r.Len()) {
+		return nil, fmt.Errorf("invalid block header")
+	}
+	headerData := make([]byte, headerLength)
+	io.ReadFull(r, headerData)
+	if err := json.Unmarshal(headerData, &block); err != nil {
+		return nil, err
+	}
+	if block.Points, err = decodePoints(r); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// encodePoints writes points column by column, each column in an encoding
+// suited to its type:
+//
+//   - timestamps as zigzag varints of the delta of deltas, a byte per point
+//     for regularly spaced samples
+//   - value types as runs, a few bytes per block as a series has one type
+//     apart from stale markers
+//   - floats XORed with the previous value, keeping only the bytes that
+//     differ, after Gorilla
+//   - integers as zigzag varints of the delta to the previous integer
+//   - booleans as a bitmap
+//   - strings as a dictionary of distinct values and a varint index per
+//     point, as status values repeat
+func encodePoints(points []DataPoint) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(points)))
+	if len(points) == 0 {
+		return buf
+	}
+
+	// Timestamps
+	var previous, delta int64
+	for i, point := range points {
+		t := point.Timestamp.UnixNano()
+		switch i {
+		case 0:
+			buf = binary.AppendVarint(buf, t)
+		default:
+			d := t - previous
+			buf = binary.AppendVarint(buf, d-delta)
+			delta = d
+		}
+		previous = t
+	}
+
+	// Type runs
+	for i := 0; i < len(points); {
+		j := i
+		for j < len(points) && points[j].Type == points[i].Type {
+			j++
+		}
+		buf = append(buf, byte(points[i].Type))
+		buf = binary.AppendUvarint(buf, uint64(j-i))
+		i = j
+	}
+
+	// Floats
+	var previousBits uint64
+	for _, point := range points {
+		if point.Type != ValueFloat {
+			continue
+		}
+		valueBits := math.Float64bits(point.Value)
+		buf = appendXOR(buf, previousBits^valueBits)
+		previousBits = valueBits
+	}
+
+	// Integers
+	var previousInt int64
+	for _, point := range points {
+		if point.Type != ValueInt {
+			continue
+		}
+		buf = binary.AppendVarint(buf, point.Int-previousInt)
+		previousInt = point.Int
+	}
+
+	// Booleans
+	var bitmap byte
+	n := 0
+	for _, point := range points {
+		if point.Type != ValueBool {
+			continue
+		}
+		if point.Value != 0 {
+			bitmap |= 1 << (n % 8)
+		}
+		if n++; n%8 == 0 {
+			buf = append(buf, bitmap)
+			bitmap = 0
+		}
+	}
+	if n%8 != 0 {
+		buf = append(buf, bitmap)
+	}
+
+	// Strings
+	dictionary := make(map[string]int)
+	var words []string
+	var indexes []int
+	for _, point := range points {
+		if point.Type != ValueString {
+			continue
+		}
+		index, ok := dictionary[point.Text]
+		if !ok {
+			index = len(words)
+			dictionary[point.Text] = index
+			words = append(words, point.Text)
+		}
+		indexes = append(indexes, index)
+	}
+	if len(indexes) > 0 {
+		buf = binary.AppendUvarint(buf, uint64(len(words)))
+		for _, word := range words {
+			buf = binary.AppendUvarint(buf, uint64(len(word)))
+			buf = append(buf, word...)
+		}
+		for _, index := range indexes {
+			buf = binary.AppendUvarint(buf, uint64(index))
+		}
+	}
+	return buf
+}
+
+// appendXOR writes the XOR of two float values: a header byte holding the
+// number of trailing zero bytes and of remaining bytes, then those bytes.
+// Equal values take a single zero byte.
+func appendXOR(buf []byte, x uint64) []byte {
+	if x == 0 {
+		return append(buf, 0)
+	}
+	trailing := bits.TrailingZeros64(x) / 8
+	n := 8 - bits.LeadingZeros64(x)/8 - trailing
+	buf = append(buf, byte(trailing<<4|n))
+	x >>= 8 * trailing
+	for i := 0; i < n; i++ {
+		buf = append(buf, byte(x>>(8*i)))
+	}
+	return buf
+}
+
+var errCorruptColumns = errors.New("corrupt column data")
+
+// decodePoints reads points written by encodePoints
+func decodePoints(r *bytes.Reader) ([]DataPoint, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > uint64(r.Len()) {
+		return nil, errCorruptColumns
+	}
+	points := make([]DataPoint, count)
+	if count == 0 {
+		return points, nil
+	}
+
+	var t, delta int64
+	for i := range points {
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, errCorruptColumns
+		}
+		if i == 0 {
+			t = v
+		} else {
+			delta += v
+			t += delta
+		}
+		points[i].Timestamp = time.Unix(0, t)
+	}
+
+	typeCounts := make(map[ValueType]int)
+	for i := 0; i < len(points); {
+		typeByte, err := r.ReadByte()
+		if err != nil || ValueType(typeByte) > ValueString {
+			return nil, errCorruptColumns
+		}
+		run, err := binary.ReadUvarint(r)
+		if err != nil || run == 0 || run > uint64(len(points)-i) {
+			return nil, errCorruptColumns
+		}
+		for j := 0; j < int(run); j++ {
+			points[i+j].Type = ValueType(typeByte)
+		}
+		typeCounts[ValueType(typeByte)] += int(run)
+		i += int(run)
+	}
+
+	var previousBits uint64
+	for i := range points {
+		if points[i].Type != ValueFloat {
+			continue
+		}
+		x, err := readXOR(r)
+		if err != nil {
+			return nil, err
+		}
+		previousBits ^= x
+		points[i].Value = math.Float64frombits(previousBits)
+	}
+
+	var previousInt int64
+	for i := range points {
+		if points[i].Type != ValueInt {
+			continue
+		}
+		d, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, errCorruptColumns
+		}
+		previousInt += d
+		points[i].Int = previousInt
+		points[i].Value = float64(previousInt)
+	}
+
+	var bitmap byte
+	n := 0
+	for i := range points {
+		if points[i].Type != ValueBool {
+			continue
+		}
+		if n%8 == 0 {
+			if bitmap, err = r.ReadByte(); err != nil {
+				return nil, errCorruptColumns
+			}
+		}
+		if bitmap&(1<<(n%8)) != 0 {
+			points[i].Value = 1
+		}
+		n++
+	}
+
+	if typeCounts[ValueString] > 0 {
+		size, err := binary.ReadUvarint(r)
+		if err != nil || size > uint64(r.Len()) {
+			return nil, errCorruptColumns
+		}
+		words := make([]string, size)
+		for i := range words {
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > uint64(r.Len()) {
+				return nil, errCorruptColumns
+			}
+			word := make([]byte, length)
+			io.ReadFull(r, word)
+			words[i] = string(word)
+		}
+		for i := range points {
+			if points[i].Type != ValueString {
+				continue
+			}
+			index, err := binary.ReadUvarint(r)
+			if err != nil || index >= uint64(len(words)) {
+				return nil, errCorruptColumns
+			}
+			points[i].Text = words[index]
+			points[i].Value = math.NaN()
+		}
+	}
+	return points, nil
+}
+
+func readXOR(r *bytes.Reader) (uint64, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, errCorruptColumns
+	}
+	if header == 0 {
+		return 0, nil
+	}
+	trailing, n := int(header>>4), int(header&0x0f)
+	if n == 0 || trailing+n > 8 {
+		return 0, errCorruptColumns
+	}
+	var x uint64
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errCorruptColumns
+		}
+		x |= uint64(b) << (8 * i)
+	}
+	return x << (8 * trailing), nil
+}
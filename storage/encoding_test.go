@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEncodePoints_RoundTrip(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	points := []DataPoint{
+		FloatValue(21.5).Point(base),
+		FloatValue(21.5).Point(base.Add(time.Second)),
+		FloatValue(-0.125).Point(base.Add(2 * time.Second)),
+		FloatValue(math.NaN()).Point(base.Add(3 * time.Second)),
+		{Timestamp: base.Add(4 * time.Second), Value: StaleNaN},
+		IntValue(1 << 40).Point(base.Add(5 * time.Second)),
+		IntValue(-3).Point(base.Add(7 * time.Second)),
+		BoolValue(true).Point(base.Add(8 * time.Second)),
+		BoolValue(false).Point(base.Add(9 * time.Second)),
+		StringValue("charging").Point(base.Add(10 * time.Second)),
+		StringValue("").Point(base.Add(11 * time.Second)),
+		StringValue("charging").Point(base.Add(11500 * time.Millisecond)),
+	}
+
+	decoded, err := decodePoints(bytes.NewReader(encodePoints(points)))
+	if err != nil {
+		t.Fatalf("Failed to decode points: %v", err)
+	}
+	if len(decoded) != len(points) {
+		t.Fatalf("Expected %d points, got %d", len(points), len(decoded))
+	}
+	for i, expected := range points {
+		got := decoded[i]
+		sameValue := math.Float64bits(got.Value) == math.Float64bits(expected.Value) ||
+			(expected.Type == ValueString && math.IsNaN(got.Value))
+		if !got.Timestamp.Equal(expected.Timestamp) || got.Type != expected.Type || got.Text != expected.Text || !sameValue {
+			t.Errorf("Point %d: expected %+v, got %+v", i, expected, got)
+		}
+	}
+	if !IsStaleMarker(decoded[4].Value) {
+		t.Error("Expected the stale marker to keep its bit pattern")
+	}
+
+	if _, err := decodePoints(bytes.NewReader(encodePoints(points)[:20])); err == nil {
+		t.Error("Expected truncated data to be rejected")
+	}
+}
+
+func TestEncodeBlock_Compression(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	var points []DataPoint
+	for i := 0; i < 1000; i++ {
+		timestamp := base.Add(time.Duration(i) * 10 * time.Second)
+		points = append(points, IntValue(int64(80+i%3)).Point(timestamp))
+	}
+	block := &WarmDataBlock{SeriesID: "sensor", StartTime: base, EndTime: points[len(points)-1].Timestamp, Count: len(points), Points: points}
+
+	encoded, err := encodeBlock(block)
+	if err != nil {
+		t.Fatalf("Failed to encode block: %v", err)
+	}
+	legacy, _ := json.Marshal(block)
+	// Regular timestamps and small integer deltas take about two bytes a point
+	if len(encoded) > 3*len(points) || len(encoded)*10 > len(legacy) {
+		t.Errorf("Expected a compact encoding, got %d bytes (JSON: %d)", len(encoded), len(legacy))
+	}
+
+	decoded, err := decodeBlock(encoded)
+	if err != nil || len(decoded.Points) != len(points) || decoded.Points[999].Value != 80 || decoded.SeriesID != "sensor" {
+		t.Fatalf("Unexpected round trip: %v", err)
+	}
+
+	// Blocks written before the column encoding are still read
+	decoded, err = decodeBlock(legacy)
+	if err != nil || len(decoded.Points) != len(points) || decoded.Points[1].Type != ValueInt {
+		t.Errorf("Failed to read a JSON block: %v", err)
+	}
+}
+
+func TestFieldValue_TypesAndConflicts(t *testing.T) {
+	var fields map[string]FieldValue
+	body := `{"temperature": 21.5, "online": true, "status": "ok", "battery": {"type": "int", "value": 87}}`
+	if err := json.Unmarshal([]byte(body), &fields); err != nil {
+		t.Fatalf("Failed to decode fields: %v", err)
+	}
+	expected := map[string]FieldValue{
+		"temperature": FloatValue(21.5),
+		"online":      BoolValue(true),
+		"status":      StringValue("ok"),
+		"battery":     IntValue(87),
+	}
+	for name, value := range expected {
+		if fields[name] != value {
+			t.Errorf("%s: expected %+v, got %+v", name, value, fields[name])
+		}
+	}
+
+	hot := NewHotStorage(10, 10)
+	now := time.Now()
+	if err := hot.AddValue("battery", nil, now, IntValue(87)); err != nil {
+		t.Fatalf("Failed to add value: %v", err)
+	}
+	if err := hot.AddPoint("battery", nil, now.Add(time.Second), 0.5); err == nil {
+		t.Error("Expected a float written to an integer series to conflict")
+	}
+	if err := hot.AddPoint("battery", nil, now.Add(2*time.Second), StaleNaN); err != nil {
+		t.Errorf("Expected a stale marker to be accepted for any type, got %v", err)
+	}
+
+	series, _ := hot.GetSeries("battery")
+	data, _ := json.Marshal(series.GetLatest(2))
+	var decoded []DataPoint
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded[0].Type != ValueInt || decoded[0].Value != 87 || !IsStaleMarker(decoded[1].Value) {
+		t.Errorf("Unexpected JSON round trip of %s: %+v (%v)", data, decoded, err)
+	}
+}
+
+func TestIntValue_KeepsFullPrecision(t *testing.T) {
+	// 2^53 + 1 is the smallest integer a float64 cannot hold
+	const big = 9007199254740993
+	var value FieldValue
+	if err := json.Unmarshal([]byte(`{"type": "int", "value": 9007199254740993}`), &value); err != nil || value != IntValue(big) {
+		t.Fatalf("Failed to decode the value: %+v (%v)", value, err)
+	}
+
+	hot := NewHotStorage(10, 10)
+	if err := hot.AddValue("counter", nil, time.Unix(1700000000, 0), value); err != nil {
+		t.Fatalf("Failed to add value: %v", err)
+	}
+	series, _ := hot.GetSeries("counter")
+	points := series.GetLatest(1)
+	if points[0].Int != big {
+		t.Fatalf("Expected %d in hot storage, got %d", int64(big), points[0].Int)
+	}
+
+	decoded, err := decodePoints(bytes.NewReader(encodePoints(points)))
+	if err != nil || decoded[0].Int != big {
+		t.Fatalf("Expected %d after encoding, got %+v (%v)", int64(big), decoded, err)
+	}
+	data, _ := json.Marshal(decoded[0])
+	var fromJSON DataPoint
+	if err := json.Unmarshal(data, &fromJSON); err != nil || fromJSON.Int != big || !bytes.Contains(data, []byte("9007199254740993")) {
+		t.Errorf("Expected %d after a JSON round trip, got %s", int64(big), data)
+	}
+}
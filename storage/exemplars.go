@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultExemplarsPerSeries is the number of exemplars kept for each series
+const DefaultExemplarsPerSeries = 100
+
+// Exemplar is a sample of a series tied to an observation outside the
+// metric, typically the trace_id of a request that was measured
+type Exemplar struct {
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// ExemplarStore keeps the most recent exemplars of each series in memory.
+// Exemplars help find an example of a spike rather than record history, so
+// older ones are dropped once a series has its limit.
+type ExemplarStore struct {
+	mu        sync.RWMutex
+	exemplars map[string][]Exemplar
+	limit     int
+}
+
+// NewExemplarStore creates a store keeping up to limit exemplars per series
+func NewExemplarStore(limit int) *ExemplarStore {
+	if limit <= 0 {
+		limit = DefaultExemplarsPerSeries
+	}
+	return &ExemplarStore{exemplars: make(map[string][]Exemplar), limit: limit}
+}
+
+// Add records an exemplar of a series, keeping exemplars in time order.
+// An exemplar equal to the series' latest one is ignored, as senders repeat
+// an exemplar with every sample until a new one is observed.
+func (es *ExemplarStore) Add(seriesID string, exemplar Exemplar) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	exemplars := es.exemplars[seriesID]
+	if n := len(exemplars); n > 0 {
+		last := exemplars[n-1]
+		if last.Timestamp.Equal(exemplar.Timestamp) && last.Value == exemplar.Value && equalLabels(last.Labels, exemplar.Labels) {
+			return
+		}
+	}
+	i := sort.Search(len(exemplars), func(i int) bool { return exemplars[i].Timestamp.After(exemplar.Timestamp) })
+	exemplars = append(exemplars, Exemplar{})
+	copy(exemplars[i+1:], exemplars[i:])
+	exemplars[i] = exemplar
+	if len(exemplars) > es.limit {
+		exemplars = append(exemplars[:0:0], exemplars[len(exemplars)-es.limit:]...)
+	}
+	es.exemplars[seriesID] = exemplars
+}
+
+// Range returns the exemplars of a series between start and end inclusive.
+// A zero start or end leaves that side of the range open.
+func (es *ExemplarStore) Range(seriesID string, start, end time.Time) []Exemplar {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	var result []Exemplar
+	for _, exemplar := range es.exemplars[seriesID] {
+		if (start.IsZero() || !exemplar.Timestamp.Before(start)) && (end.IsZero() || !exemplar.Timestamp.After(end)) {
+			result = append(result, exemplar)
+		}
+	}
+	return result
+}
+
+// Delete removes the exemplars of a series
+func (es *ExemplarStore) Delete(seriesID string) {
+	es.mu.Lock()
+	delete(es.exemplars, seriesID)
+	es.mu.Unlock()
+}
+
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
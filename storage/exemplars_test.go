@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExemplarStore(t *testing.T) {
+	store := NewExemplarStore(3)
+	base := time.Now().Truncate(time.Second)
+	exemplar := func(offset int, trace string) Exemplar {
+		return Exemplar{Labels: map[string]string{"trace_id": trace}, Value: float64(offset), Timestamp: base.Add(time.Duration(offset) * time.Second)}
+	}
+
+	store.Add("s", exemplar(2, "b"))
+	store.Add("s", exemplar(0, "a"))
+	store.Add("s", exemplar(2, "b")) // repeated with the next sample
+	if all := store.Range("s", time.Time{}, time.Time{}); len(all) != 2 || all[0].Labels["trace_id"] != "a" {
+		t.Fatalf("Expected 2 exemplars in time order, got %+v", all)
+	}
+
+	store.Add("s", exemplar(3, "c"))
+	store.Add("s", exemplar(4, "d"))
+	all := store.Range("s", time.Time{}, time.Time{})
+	if len(all) != 3 || all[0].Labels["trace_id"] != "b" {
+		t.Errorf("Expected the oldest exemplar to be dropped, got %+v", all)
+	}
+	if in := store.Range("s", base.Add(3*time.Second), base.Add(3*time.Second)); len(in) != 1 || in[0].Value != 3 {
+		t.Errorf("Expected one exemplar in range, got %+v", in)
+	}
+
+	store.Delete("s")
+	if all := store.Range("s", time.Time{}, time.Time{}); len(all) != 0 {
+		t.Errorf("Expected no exemplars after delete, got %+v", all)
+	}
+}
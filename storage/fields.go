@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FieldLabel names the field of a multi-field measurement. Each field is
+// stored as its own series carrying this label, so a single field is
+// selected with e.g. sensor{__field__="humidity"}.
+const FieldLabel = "__field__"
+
+// ErrTypeConflict is returned when a value's type differs from the type of
+// the series it is written to
+var ErrTypeConflict = errors.New("value type conflict")
+
+// ValueType is the type of a point's value. A series keeps the type of its
+// first point; writing a value of another type is a conflict.
+type ValueType uint8
+
+const (
+	ValueFloat ValueType = iota
+	ValueInt
+	ValueBool
+	ValueString
+)
+
+var valueTypeNames = []string{"float", "int", "bool", "string"}
+
+func (t ValueType) String() string {
+	if int(t) < len(valueTypeNames) {
+		return valueTypeNames[t]
+	}
+	return fmt.Sprintf("ValueType(%d)", uint8(t))
+}
+
+// ParseValueType parses a value type name. "integer", "boolean" and "float64"
+// style aliases are accepted.
+func ParseValueType(s string) (ValueType, error) {
+	switch s {
+	case "float", "float64", "double", "":
+		return ValueFloat, nil
+	case "int", "int64", "integer":
+		return ValueInt, nil
+	case "bool", "boolean":
+		return ValueBool, nil
+	case "string":
+		return ValueString, nil
+	}
+	return ValueFloat, fmt.Errorf("unknown value type %q", s)
+}
+
+// MarshalText encodes the type by name
+func (t ValueType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText decodes a type name
+func (t *ValueType) UnmarshalText(text []byte) error {
+	parsed, err := ParseValueType(string(text))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// FieldValue is a typed value of one field of a measurement
+type FieldValue struct {
+	Type   ValueType
+	Float  float64
+	Int    int64
+	Bool   bool
+	String string
+}
+
+// FloatValue returns a float field value
+func FloatValue(f float64) FieldValue { return FieldValue{Type: ValueFloat, Float: f} }
+
+// IntValue returns an integer field value
+func IntValue(i int64) FieldValue { return FieldValue{Type: ValueInt, Int: i} }
+
+// BoolValue returns a boolean field value
+func BoolValue(b bool) FieldValue { return FieldValue{Type: ValueBool, Bool: b} }
+
+// StringValue returns a string field value
+func StringValue(s string) FieldValue { return FieldValue{Type: ValueString, String: s} }
+
+// Number returns the value as a float: integers as is, booleans as 0 or 1
+// and strings as NaN
+func (v FieldValue) Number() float64 {
+	switch v.Type {
+	case ValueInt:
+		return float64(v.Int)
+	case ValueBool:
+		if v.Bool {
+			return 1
+		}
+		return 0
+	case ValueString:
+		return math.NaN()
+	}
+	return v.Float
+}
+
+// Point returns a data point holding the value
+func (v FieldValue) Point(timestamp time.Time) DataPoint {
+	point := DataPoint{Timestamp: timestamp, Value: v.Number(), Type: v.Type}
+	switch v.Type {
+	case ValueInt:
+		point.Int = v.Int
+	case ValueString:
+		point.Text = v.String
+	}
+	return point
+}
+
+// fieldValueJSON is the explicit JSON form of a field value, needed for
+// integers as JSON numbers are otherwise read as floats
+type fieldValueJSON struct {
+	Type  ValueType       `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// MarshalJSON encodes floats, booleans and strings as plain JSON values and
+// integers as {"type": "int", "value": 42}
+func (v FieldValue) MarshalJSON() ([]byte, error) {
+	switch v.Type {
+	case ValueInt:
+		return json.Marshal(fieldValueJSON{Type: ValueInt, Value: strconv.AppendInt(nil, v.Int, 10)})
+	case ValueBool:
+		return json.Marshal(v.Bool)
+	case ValueString:
+		return json.Marshal(v.String)
+	}
+	if math.IsNaN(v.Float) || math.IsInf(v.Float, 0) {
+		return []byte("null"), nil
+	}
+	return json.Marshal(v.Float)
+}
+
+// UnmarshalJSON decodes a plain JSON number, boolean or string, or the
+// explicit {"type": ..., "value": ...} form
+func (v *FieldValue) UnmarshalJSON(data []byte) error {
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	switch value := decoded.(type) {
+	case nil:
+		*v = FloatValue(math.NaN())
+	case float64:
+		*v = FloatValue(value)
+	case bool:
+		*v = BoolValue(value)
+	case string:
+		*v = StringValue(value)
+	case map[string]interface{}:
+		var explicit fieldValueJSON
+		if err := json.Unmarshal(data, &explicit); err != nil {
+			return err
+		}
+		return v.decodeTyped(explicit.Type, explicit.Value)
+	default:
+		return fmt.Errorf("invalid field value %s", data)
+	}
+	return nil
+}
+
+func (v *FieldValue) decodeTyped(t ValueType, data json.RawMessage) error {
+	var err error
+	switch t {
+	case ValueInt:
+		var i int64
+		if err = json.Unmarshal(data, &i); err == nil {
+			*v = IntValue(i)
+		}
+	case ValueBool:
+		var b bool
+		if err = json.Unmarshal(data, &b); err == nil {
+			*v = BoolValue(b)
+		}
+	case ValueString:
+		var s string
+		if err = json.Unmarshal(data, &s); err == nil {
+			*v = StringValue(s)
+		}
+	default:
+		var f float64
+		if err = json.Unmarshal(data, &f); err == nil {
+			*v = FloatValue(f)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s value %s", t, data)
+	}
+	return nil
+}
+
+// FieldLabels returns labels with the field label added, for the series of
+// one field of a measurement
+func FieldLabels(labels map[string]string, field string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for name, value := range labels {
+		result[name] = value
+	}
+	result[FieldLabel] = field
+	return result
+}
+
+// SortedFields returns the field names of a measurement in order, so that
+// fields are written deterministically
+func SortedFields(fields map[string]FieldValue) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
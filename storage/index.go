@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LabelIndex is an inverted index from label pairs to series IDs. Every
+// indexed series carries its metric name under MetricNameLabel.
+type LabelIndex struct {
+	postings map[string]map[string]map[string]struct{} // label name -> value -> series IDs
+	series   map[string]map[string]string              // series ID -> indexed labels
+	mu       sync.RWMutex
+}
+
+// NewLabelIndex creates an empty label index
+func NewLabelIndex() *LabelIndex {
+	return &LabelIndex{
+		postings: make(map[string]map[string]map[string]struct{}),
+		series:   make(map[string]map[string]string),
+	}
+}
+
+// MetricName returns the metric name of a series, taken from its labels if
+// present and falling back to the name part of the series ID
+func MetricName(seriesID string, labels map[string]string) string {
+	if name := labels[MetricNameLabel]; name != "" {
+		return name
+	}
+	if brace := strings.IndexByte(seriesID, '{'); brace > 0 {
+		return seriesID[:brace]
+	}
+	return seriesID
+}
+
+// SeriesKey returns the canonical series ID of a metric and label set, in
+// selector form with sorted labels, e.g. `cpu.usage{env="prod",host="a"}`.
+// A metric without labels is identified by its bare name.
+func SeriesKey(name string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for label, value := range labels {
+		if label != MetricNameLabel && value != "" {
+			names = append(names, label)
+		}
+	}
+	if len(names) == 0 {
+		return name
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, label := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[label]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Add indexes a series under its labels and metric name
+func (li *LabelIndex) Add(seriesID string, labels map[string]string) {
+	indexed := make(map[string]string, len(labels)+1)
+	for name, value := range labels {
+		if value != "" {
+			indexed[name] = value
+		}
+	}
+	indexed[MetricNameLabel] = MetricName(seriesID, labels)
+
+	li.mu.Lock()
+	defer li.mu.Unlock()
+
+	if _, exists := li.series[seriesID]; exists {
+		li.removeLocked(seriesID)
+	}
+	li.series[seriesID] = indexed
+	for name, value := range indexed {
+		values, ok := li.postings[name]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			li.postings[name] = values
+		}
+		ids, ok := values[value]
+		if !ok {
+			ids = make(map[string]struct{})
+			values[value] = ids
+		}
+		ids[seriesID] = struct{}{}
+	}
+}
+
+// Remove drops a series from the index
+func (li *LabelIndex) Remove(seriesID string) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	li.removeLocked(seriesID)
+}
+
+func (li *LabelIndex) removeLocked(seriesID string) {
+	indexed, exists := li.series[seriesID]
+	if !exists {
+		return
+	}
+	delete(li.series, seriesID)
+	for name, value := range indexed {
+		values := li.postings[name]
+		delete(values[value], seriesID)
+		if len(values[value]) == 0 {
+			delete(values, value)
+		}
+		if len(values) == 0 {
+			delete(li.postings, name)
+		}
+	}
+}
+
+// Labels returns the indexed labels of a series, including its metric name
+func (li *LabelIndex) Labels(seriesID string) (map[string]string, bool) {
+	li.mu.RLock()
+	defer li.mu.RUnlock()
+	labels, exists := li.series[seriesID]
+	return labels, exists
+}
+
+// Select returns the sorted IDs of series matching every matcher. Candidates
+// are drawn from the postings of the most selective positive matcher, so only
+// those series are checked against the remaining matchers.
+func (li *LabelIndex) Select(matchers []*LabelMatcher) []string {
+	li.mu.RLock()
+	defer li.mu.RUnlock()
+
+	var candidates map[string]struct{}
+	for _, m := range matchers {
+		if m.Matches("") {
+			// Matchers accepting the empty value also match series without the label
+			continue
+		}
+		set := make(map[string]struct{})
+		for value, ids := range li.postings[m.Name] {
+			if m.Matches(value) {
+				for id := range ids {
+					set[id] = struct{}{}
+				}
+			}
+		}
+		if candidates == nil || len(set) < len(candidates) {
+			candidates = set
+		}
+	}
+
+	var result []string
+	if candidates == nil {
+		for id, labels := range li.series {
+			if MatchesLabels(labels, matchers) {
+				result = append(result, id)
+			}
+		}
+	} else {
+		for id := range candidates {
+			if MatchesLabels(li.series[id], matchers) {
+				result = append(result, id)
+			}
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// LabelNames returns all indexed label names in sorted order
+func (li *LabelIndex) LabelNames() []string {
+	li.mu.RLock()
+	defer li.mu.RUnlock()
+
+	names := make([]string, 0, len(li.postings))
+	for name := range li.postings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LabelValues returns all indexed values of a label in sorted order
+func (li *LabelIndex) LabelValues(name string) []string {
+	li.mu.RLock()
+	defer li.mu.RUnlock()
+
+	values := make([]string, 0, len(li.postings[name]))
+	for value := range li.postings[name] {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// Len returns the number of indexed series
+func (li *LabelIndex) Len() int {
+	li.mu.RLock()
+	defer li.mu.RUnlock()
+	return len(li.series)
+}
+
+// overlapsRange reports whether [minTime, maxTime] intersects [start, end].
+// Zero start or end values leave that side of the range unbounded.
+func overlapsRange(minTime, maxTime, start, end time.Time) bool {
+	if !start.IsZero() && maxTime.Before(start) {
+		return false
+	}
+	if !end.IsZero() && minTime.After(end) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSelector(t *testing.T) {
+	matchers, err := ParseSelector(`cpu.usage{host="server1", env=~"prod.*",dc!='eu'}`)
+	if err != nil {
+		t.Fatalf("Failed to parse selector: %v", err)
+	}
+
+	if len(matchers) != 4 {
+		t.Fatalf("Expected 4 matchers, got %d", len(matchers))
+	}
+	if matchers[0].Name != MetricNameLabel || matchers[0].Value != "cpu.usage" {
+		t.Errorf("Expected metric name matcher, got %s", matchers[0])
+	}
+	if matchers[2].Type != MatchRegexp || !matchers[2].Matches("production") {
+		t.Errorf("Expected anchored regexp matcher to match, got %s", matchers[2])
+	}
+	if matchers[2].Matches("preprod") {
+		t.Error("Regexp matcher should be anchored at the start")
+	}
+	if matchers[3].Type != MatchNotEqual || matchers[3].Value != "eu" {
+		t.Errorf("Expected single-quoted not-equal matcher, got %s", matchers[3])
+	}
+}
+
+func TestParseSelector_Invalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"{}",
+		`cpu.usage{host="a"`,
+		`cpu.usage{host}`,
+		`cpu.usage{host="a" env="b"}`,
+		`cpu.usage{host=~"("}`,
+	}
+
+	for _, selector := range invalid {
+		if _, err := ParseSelector(selector); err == nil {
+			t.Errorf("Expected error parsing %q", selector)
+		}
+	}
+}
+
+func TestLabelIndex_Select(t *testing.T) {
+	index := NewLabelIndex()
+	index.Add("cpu.a", map[string]string{MetricNameLabel: "cpu.usage", "host": "a", "env": "prod"})
+	index.Add("cpu.b", map[string]string{MetricNameLabel: "cpu.usage", "host": "b", "env": "dev"})
+	index.Add("mem.a", map[string]string{MetricNameLabel: "mem.usage", "host": "a"})
+
+	tests := []struct {
+		selector string
+		expected []string
+	}{
+		{`cpu.usage`, []string{"cpu.a", "cpu.b"}},
+		{`{host="a"}`, []string{"cpu.a", "mem.a"}},
+		{`cpu.usage{env!="prod"}`, []string{"cpu.b"}},
+		{`{env=""}`, []string{"mem.a"}},
+		{`{__name__=~".*usage",host!~"a|c"}`, []string{"cpu.b"}},
+	}
+
+	for _, tt := range tests {
+		matchers, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.selector, err)
+		}
+		ids := index.Select(matchers)
+		if len(ids) != len(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.selector, tt.expected, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tt.selector, tt.expected, ids)
+			}
+		}
+	}
+
+	index.Remove("cpu.b")
+	if values := index.LabelValues("env"); len(values) != 1 || values[0] != "prod" {
+		t.Errorf("Expected only env=prod after removal, got %v", values)
+	}
+}
+
+func TestHotStorage_SelectTimeRange(t *testing.T) {
+	hs := NewHotStorage(100, 100)
+	now := time.Now()
+
+	hs.AddPoint("old.metric", map[string]string{"host": "a"}, now.Add(-2*time.Hour), 1.0)
+	hs.AddPoint("new.metric", map[string]string{"host": "a"}, now, 2.0)
+
+	matchers, _ := ParseSelector(`{host="a"}`)
+	if series := hs.Select(matchers, time.Time{}, time.Time{}); len(series) != 2 {
+		t.Errorf("Expected 2 series without time range, got %d", len(series))
+	}
+
+	series := hs.Select(matchers, now.Add(-time.Hour), time.Time{})
+	if len(series) != 1 || series[0].ID != "new.metric" {
+		t.Errorf("Expected only new.metric in the last hour, got %v", series)
+	}
+}
+
+func TestStorageEngine_LabelDiscovery(t *testing.T) {
+	engine, err := NewStorageEngine(&StorageConfig{
+		Hot: HotStorageConfig{MaxSeries: 100, MaxPointsPerSeries: 100},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+
+	now := time.Now()
+	engine.AddPoint("cpu.usage", map[string]string{"host": "a", "env": "prod"}, now, 1.0)
+	engine.AddPoint("mem.usage", map[string]string{"host": "b"}, now, 2.0)
+
+	names := engine.LabelNames(nil, time.Time{}, time.Time{})
+	expected := []string{MetricNameLabel, "env", "host"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected label names %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected label names %v, got %v", expected, names)
+		}
+	}
+
+	matchers, _ := ParseSelector(`mem.usage`)
+	values := engine.LabelValues("host", [][]*LabelMatcher{matchers}, time.Time{}, time.Time{})
+	if len(values) != 1 || values[0] != "b" {
+		t.Errorf("Expected host values [b] for mem.usage, got %v", values)
+	}
+
+	metadata := engine.MetricMetadata(nil, now.Add(-time.Minute), now.Add(time.Minute))
+	if len(metadata) != 2 || metadata[0].Metric != "cpu.usage" || metadata[0].SeriesCount != 1 {
+		t.Fatalf("Unexpected metadata: %+v", metadata)
+	}
+	if len(metadata[0].LabelNames) != 2 {
+		t.Errorf("Expected cpu.usage to have 2 label names, got %v", metadata[0].LabelNames)
+	}
+}
+
+func TestWarmStorage_LabelsSurviveReload(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Millisecond)
+
+	ws, err := NewWarmStorage(dir, 10, 6, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create warm storage: %v", err)
+	}
+	labels := map[string]string{"host": "a"}
+	ws.WriteSeriesData("disk.io", labels, []DataPoint{{Timestamp: now.Add(-time.Hour), Value: 1}})
+	ws.WriteSeriesData("disk.io", labels, []DataPoint{{Timestamp: now, Value: 2}})
+	ws.Close()
+
+	reopened, err := NewWarmStorage(dir, 10, 6, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to reopen warm storage: %v", err)
+	}
+	defer reopened.Close()
+
+	matchers, _ := ParseSelector(`disk.io{host="a"}`)
+	if ids := reopened.Select(matchers, now.Add(-time.Minute), time.Time{}); len(ids) != 1 {
+		t.Errorf("Expected reloaded series to match recent range, got %v", ids)
+	}
+	if ids := reopened.Select(matchers, now.Add(time.Minute), time.Time{}); len(ids) != 0 {
+		t.Errorf("Expected no match after the newest block, got %v", ids)
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	labels := map[string]string{"host": "a/b", "env": `pr"od`, "empty": ""}
+	key := SeriesKey("cpu.usage", labels)
+	if key != `cpu.usage{env="pr\"od",host="a/b"}` {
+		t.Fatalf("Unexpected series key %s", key)
+	}
+	if SeriesKey("cpu.usage", nil) != "cpu.usage" {
+		t.Error("Expected an unlabelled series to be keyed by its name")
+	}
+	if MetricName(key, nil) != "cpu.usage" {
+		t.Errorf("Expected metric name cpu.usage, got %s", MetricName(key, nil))
+	}
+
+	// Keys round-trip through selectors and survive warm file naming
+	matchers, err := ParseSelector(key)
+	if err != nil || !MatchesLabels(map[string]string{MetricNameLabel: "cpu.usage", "host": "a/b", "env": `pr"od`}, matchers) {
+		t.Errorf("Expected key to parse as a matching selector, got %v", err)
+	}
+
+	dir := t.TempDir()
+	ws, _ := NewWarmStorage(dir, 10, 6, time.Hour)
+	ws.WriteSeriesData(key, labels, []DataPoint{{Timestamp: time.Now(), Value: 1}})
+	ws.Close()
+	reopened, _ := NewWarmStorage(dir, 10, 6, time.Hour)
+	defer reopened.Close()
+	if _, ok := reopened.seriesInfo(key); !ok {
+		t.Error("Expected series with labelled key to reload from warm storage")
+	}
+}
+
+func TestWarmStorage_MigratesOldFileNames(t *testing.T) {
+	dir := t.TempDir()
+	ws, _ := NewWarmStorage(dir, 10, 6, time.Hour)
+	for _, seriesID := range []string{"disk used", "load 50%", "cpu.usage"} {
+		ws.WriteSeriesData(seriesID, nil, []DataPoint{{Timestamp: time.Now(), Value: 1}})
+	}
+	ws.Close()
+
+	// Files were once named after the raw series ID
+	for _, seriesID := range []string{"disk used", "load 50%"} {
+		if err := os.Rename(filepath.Join(dir, url.PathEscape(seriesID)+".tsw"), filepath.Join(dir, seriesID+".tsw")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, _ := NewWarmStorage(dir, 10, 6, time.Hour)
+	defer reopened.Close()
+	for _, seriesID := range []string{"disk used", "load 50%", "cpu.usage"} {
+		if _, ok := reopened.seriesInfo(seriesID); !ok {
+			t.Errorf("Expected %q to reload from warm storage", seriesID)
+		}
+		if _, err := os.Stat(filepath.Join(dir, url.PathEscape(seriesID)+".tsw")); err != nil {
+			t.Errorf("Expected %q to be renamed to its current file name: %v", seriesID, err)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// hotIteratorChunk is the number of points copied from a hot series per lock acquisition
+const hotIteratorChunk = 1024
+
+// PointIterator iterates over data points in timestamp order without
+// materializing the whole range in memory
+type PointIterator interface {
+	// Next advances to the next point, returning false when exhausted or on error
+	Next() bool
+	// At returns the current point
+	At() DataPoint
+	// Err returns the error that stopped iteration, if any
+	Err() error
+	// Close releases resources held by the iterator
+	Close() error
+}
+
+// Iterator returns an iterator over a series' points within [start, end]
+// across all storage layers. Points present in both layers are taken from
+// the hot layer. Iteration stops with the context's error once it is done.
+func (se *StorageEngine) Iterator(ctx context.Context, seriesID string, start, end time.Time) PointIterator {
+	var hot, warm PointIterator
+	if series, exists := se.hot.GetSeries(seriesID); exists {
+		hot = newHotIterator(ctx, series, start, end)
+	}
+	if se.warm != nil {
+		warm = se.warm.iterator(ctx, seriesID, start, end)
+	}
+
+	switch {
+	case hot == nil && warm == nil:
+		return NewSliceIterator(nil)
+	case warm == nil:
+		return hot
+	case hot == nil:
+		return warm
+	}
+	return newMergeIterator(hot, warm)
+}
+
+// CollectPoints drains an iterator into a slice and closes it
+func CollectPoints(it PointIterator) ([]DataPoint, error) {
+	defer it.Close()
+
+	var points []DataPoint
+	for it.Next() {
+		points = append(points, it.At())
+	}
+	return points, it.Err()
+}
+
+// sliceIterator iterates over an in-memory slice of points
+type sliceIterator struct {
+	points []DataPoint
+	pos    int
+}
+
+// NewSliceIterator returns an iterator over already sorted points
+func NewSliceIterator(points []DataPoint) PointIterator {
+	return &sliceIterator{points: points, pos: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos+1 >= len(it.points) {
+		it.pos = len(it.points)
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *sliceIterator) At() DataPoint { return it.points[it.pos] }
+func (it *sliceIterator) Err() error    { return nil }
+func (it *sliceIterator) Close() error  { return nil }
+
+// hotIterator copies a hot series in small chunks so the series lock is
+// never held for the whole range
+type hotIterator struct {
+	ctx     context.Context
+	series  *Series
+	end     time.Time
+	next    time.Time
+	started bool
+	chunk   []DataPoint
+	pos     int
+	done    bool
+	err     error
+}
+
+func newHotIterator(ctx context.Context, series *Series, start, end time.Time) *hotIterator {
+	return &hotIterator{ctx: ctx, series: series, end: end, next: start, pos: -1}
+}
+
+func (it *hotIterator) Next() bool {
+	if it.pos+1 < len(it.chunk) {
+		it.pos++
+		return true
+	}
+	if it.done {
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		it.done = true
+		return false
+	}
+
+	it.chunk = it.series.rangeChunk(it.next, !it.started, it.end, hotIteratorChunk)
+	it.started = true
+	it.pos = 0
+	if len(it.chunk) < hotIteratorChunk {
+		it.done = true
+	}
+	if len(it.chunk) == 0 {
+		return false
+	}
+	it.next = it.chunk[len(it.chunk)-1].Timestamp
+	return true
+}
+
+func (it *hotIterator) At() DataPoint { return it.chunk[it.pos] }
+func (it *hotIterator) Err() error    { return it.err }
+func (it *hotIterator) Close() error  { return nil }
+
+// rangeChunk copies up to limit points starting at from (inclusive or
+// exclusive) and ending at end
+func (s *Series) rangeChunk(from time.Time, inclusive bool, end time.Time, limit int) []DataPoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	startIdx := sort.Search(len(s.Points), func(i int) bool {
+		if inclusive {
+			return !s.Points[i].Timestamp.Before(from)
+		}
+		return s.Points[i].Timestamp.After(from)
+	})
+
+	var chunk []DataPoint
+	for i := startIdx; i < len(s.Points) && len(chunk) < limit; i++ {
+		if s.Points[i].Timestamp.After(end) {
+			break
+		}
+		chunk = append(chunk, s.Points[i])
+	}
+	return chunk
+}
+
+// warmIterator decodes one block at a time. Blocks are visited in start time
+// order and may overlap, so decoded points are held back until no later
+// block can contain an earlier point.
+type warmIterator struct {
+	ctx     context.Context
+	ws      *WarmStorage
+	file    *WarmFile
+	entries []IndexEntry
+	start   time.Time
+	end     time.Time
+	pending []DataPoint
+	current DataPoint
+	err     error
+}
+
+func (ws *WarmStorage) iterator(ctx context.Context, seriesID string, start, end time.Time) PointIterator {
+	ws.mu.RLock()
+	warmFile, exists := ws.files[seriesID]
+	ws.mu.RUnlock()
+
+	if !exists {
+		return NewSliceIterator(nil)
+	}
+
+	warmFile.mu.RLock()
+	var entries []IndexEntry
+	for _, entry := range warmFile.IndexEntries {
+		if entry.Timestamp.After(end) {
+			break
+		}
+		if !entry.EndTime.IsZero() && entry.EndTime.Before(start) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	warmFile.mu.RUnlock()
+
+	return &warmIterator{ctx: ctx, ws: ws, file: warmFile, entries: entries, start: start, end: end}
+}
+
+func (it *warmIterator) Next() bool {
+	for {
+		// Emit a pending point once no remaining block can precede it
+		if len(it.pending) > 0 && (len(it.entries) == 0 || it.pending[0].Timestamp.Before(it.entries[0].Timestamp)) {
+			it.current = it.pending[0]
+			it.pending = it.pending[1:]
+			return true
+		}
+		if len(it.entries) == 0 || it.err != nil {
+			return false
+		}
+
+		entry := it.entries[0]
+		it.entries = it.entries[1:]
+
+		it.file.mu.RLock()
+		block, err := it.ws.readDataBlock(it.ctx, it.file, entry)
+		it.file.mu.RUnlock()
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		for _, point := range block.Points {
+			if !point.Timestamp.Before(it.start) && !point.Timestamp.After(it.end) {
+				it.pending = append(it.pending, point)
+			}
+		}
+		sort.SliceStable(it.pending, func(i, j int) bool {
+			return it.pending[i].Timestamp.Before(it.pending[j].Timestamp)
+		})
+		it.pending = dedupeSortedPoints(it.pending)
+	}
+}
+
+func (it *warmIterator) At() DataPoint { return it.current }
+func (it *warmIterator) Err() error    { return it.err }
+func (it *warmIterator) Close() error  { return nil }
+
+// dedupeSortedPoints keeps the last written value for each timestamp
+func dedupeSortedPoints(points []DataPoint) []DataPoint {
+	if len(points) < 2 {
+		return points
+	}
+	result := points[:1]
+	for _, point := range points[1:] {
+		if point.Timestamp.Equal(result[len(result)-1].Timestamp) {
+			result[len(result)-1] = point
+			continue
+		}
+		result = append(result, point)
+	}
+	return result
+}
+
+// mergeIterator merges two sorted iterators, preferring the primary
+// iterator's point when both hold the same timestamp
+type mergeIterator struct {
+	primary, secondary     PointIterator
+	primaryOK, secondaryOK bool
+	started                bool
+	current                DataPoint
+}
+
+func newMergeIterator(primary, secondary PointIterator) *mergeIterator {
+	return &mergeIterator{primary: primary, secondary: secondary}
+}
+
+func (it *mergeIterator) Next() bool {
+	if !it.started {
+		it.primaryOK = it.primary.Next()
+		it.secondaryOK = it.secondary.Next()
+		it.started = true
+	}
+
+	switch {
+	case it.primaryOK && it.secondaryOK:
+		p, s := it.primary.At(), it.secondary.At()
+		switch {
+		case p.Timestamp.Before(s.Timestamp):
+			it.current = p
+			it.primaryOK = it.primary.Next()
+		case s.Timestamp.Before(p.Timestamp):
+			it.current = s
+			it.secondaryOK = it.secondary.Next()
+		default:
+			it.current = p
+			it.primaryOK = it.primary.Next()
+			it.secondaryOK = it.secondary.Next()
+		}
+	case it.primaryOK:
+		it.current = it.primary.At()
+		it.primaryOK = it.primary.Next()
+	case it.secondaryOK:
+		it.current = it.secondary.At()
+		it.secondaryOK = it.secondary.Next()
+	default:
+		return false
+	}
+	return true
+}
+
+func (it *mergeIterator) At() DataPoint { return it.current }
+
+func (it *mergeIterator) Err() error {
+	if err := it.primary.Err(); err != nil {
+		return err
+	}
+	return it.secondary.Err()
+}
+
+func (it *mergeIterator) Close() error {
+	it.primary.Close()
+	return it.secondary.Close()
+}
+
+// tailIterator yields only the last n points of the wrapped iterator,
+// buffering at most n points
+type tailIterator struct {
+	source PointIterator
+	limit  int
+	ring   []DataPoint
+	filled bool
+	next   int
+	pos    int
+	count  int
+}
+
+// NewTailIterator returns an iterator over the most recent n points of it.
+// A non-positive n returns it unchanged.
+func NewTailIterator(it PointIterator, n int) PointIterator {
+	if n <= 0 {
+		return it
+	}
+	return &tailIterator{source: it, limit: n, pos: -1}
+}
+
+func (it *tailIterator) Next() bool {
+	if !it.filled {
+		it.filled = true
+		for it.source.Next() {
+			if len(it.ring) < it.limit {
+				it.ring = append(it.ring, it.source.At())
+				continue
+			}
+			it.ring[it.next] = it.source.At()
+			it.next = (it.next + 1) % it.limit
+		}
+		if len(it.ring) < it.limit {
+			it.next = 0
+		}
+	}
+	if it.count >= len(it.ring) {
+		return false
+	}
+	it.pos = (it.next + it.count) % len(it.ring)
+	it.count++
+	return true
+}
+
+func (it *tailIterator) At() DataPoint { return it.ring[it.pos] }
+func (it *tailIterator) Err() error    { return it.source.Err() }
+func (it *tailIterator) Close() error  { return it.source.Close() }
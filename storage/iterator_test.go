@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIterator_MergesHotAndWarm(t *testing.T) {
+	engine, err := NewStorageEngine(&StorageConfig{
+		Hot:  HotStorageConfig{MaxSeries: 100, MaxPointsPerSeries: 5000},
+		Warm: WarmStorageConfig{Enabled: true, DataPath: t.TempDir(), MaxFileSize: 10, CompressionLevel: 6, RetentionPeriod: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	defer engine.Stop()
+
+	base := time.Now().Truncate(time.Second).Add(-time.Hour)
+
+	// Two overlapping warm blocks written out of order
+	engine.warm.WriteSeriesData("merge.test", nil, []DataPoint{
+		{Timestamp: base.Add(10 * time.Second), Value: 10},
+		{Timestamp: base.Add(30 * time.Second), Value: 30},
+	})
+	engine.warm.WriteSeriesData("merge.test", nil, []DataPoint{
+		{Timestamp: base, Value: 0},
+		{Timestamp: base.Add(20 * time.Second), Value: 20},
+	})
+
+	// Hot points overlap the warm range and win on equal timestamps
+	for i := 3; i < 3000; i++ {
+		engine.AddPoint("merge.test", nil, base.Add(time.Duration(i)*10*time.Second), float64(i*10))
+	}
+	engine.AddPoint("merge.test", nil, base.Add(30*time.Second), 300)
+
+	points, err := CollectPoints(engine.Iterator(context.Background(), "merge.test", base, base.Add(24*time.Hour)))
+	if err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+	if len(points) != 3000 {
+		t.Fatalf("Expected 3000 merged points, got %d", len(points))
+	}
+	for i := 1; i < len(points); i++ {
+		if !points[i].Timestamp.After(points[i-1].Timestamp) {
+			t.Fatalf("Points out of order at %d", i)
+		}
+	}
+	if points[3].Value != 300 {
+		t.Errorf("Expected hot value to win for duplicate timestamp, got %f", points[3].Value)
+	}
+
+	// A range starting inside a warm block still returns its points
+	points, _ = CollectPoints(engine.Iterator(context.Background(), "merge.test", base.Add(15*time.Second), base.Add(25*time.Second)))
+	if len(points) != 1 || points[0].Value != 20 {
+		t.Errorf("Expected the single point at 20s, got %v", points)
+	}
+}
+
+func TestTailIterator(t *testing.T) {
+	now := time.Now()
+	var points []DataPoint
+	for i := 0; i < 10; i++ {
+		points = append(points, DataPoint{Timestamp: now.Add(time.Duration(i) * time.Second), Value: float64(i)})
+	}
+
+	tail, _ := CollectPoints(NewTailIterator(NewSliceIterator(points), 3))
+	if len(tail) != 3 || tail[0].Value != 7 || tail[2].Value != 9 {
+		t.Errorf("Expected last 3 points in order, got %v", tail)
+	}
+
+	all, _ := CollectPoints(NewTailIterator(NewSliceIterator(points[:2]), 5))
+	if len(all) != 2 || all[0].Value != 0 {
+		t.Errorf("Expected both points when fewer than the limit, got %v", all)
+	}
+}
+
+func TestIterator_StopsOnCancel(t *testing.T) {
+	engine, err := NewStorageEngine(&StorageConfig{
+		Hot:  HotStorageConfig{MaxSeries: 100, MaxPointsPerSeries: 5000},
+		Warm: WarmStorageConfig{Enabled: true, DataPath: t.TempDir(), MaxFileSize: 10, CompressionLevel: 6, RetentionPeriod: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	defer engine.Stop()
+
+	base := time.Now().Truncate(time.Second).Add(-time.Hour)
+	engine.warm.WriteSeriesData("cancel.test", nil, []DataPoint{{Timestamp: base, Value: 1}})
+	for i := 1; i < 3000; i++ {
+		engine.AddPoint("cancel.test", nil, base.Add(time.Duration(i)*time.Second), float64(i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := engine.GetRange(ctx, "cancel.test", base, base.Add(time.Hour)); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from a cancelled read, got %v", err)
+	}
+
+	// Cancelling mid-iteration stops at the next chunk boundary
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	it := engine.Iterator(ctx, "cancel.test", base, base.Add(time.Hour))
+	count := 0
+	for it.Next() {
+		count++
+		if count == 10 {
+			cancel()
+		}
+	}
+	if it.Err() != context.Canceled || count >= 3000 {
+		t.Errorf("Expected iteration to stop with context.Canceled, got %v after %d points", it.Err(), count)
+	}
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MetricNameLabel is the reserved label holding a series' metric name
+const MetricNameLabel = "__name__"
+
+// MatchType is the comparison performed by a label matcher
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return "?"
+}
+
+// LabelMatcher selects series by comparing one label against a value or pattern.
+// A label that is absent from a series is treated as the empty string.
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewLabelMatcher creates a label matcher, compiling the pattern for regexp matchers
+func NewLabelMatcher(t MatchType, name, value string) (*LabelMatcher, error) {
+	m := &LabelMatcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		// Patterns are fully anchored, as in Prometheus
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp for label %s: %w", name, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches reports whether a label value satisfies the matcher
+func (m *LabelMatcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+func (m *LabelMatcher) String() string {
+	return m.Name + m.Type.String() + strconv.Quote(m.Value)
+}
+
+// MatchesLabels reports whether a label set satisfies every matcher
+func MatchesLabels(labels map[string]string, matchers []*LabelMatcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector parses a series selector such as `cpu.usage{host="a",env=~"prod.*"}`,
+// `cpu.usage` or `{__name__="cpu.usage"}` into label matchers.
+func ParseSelector(selector string) ([]*LabelMatcher, error) {
+	s := strings.TrimSpace(selector)
+	if s == "" {
+		return nil, fmt.Errorf("empty selector")
+	}
+
+	var matchers []*LabelMatcher
+	brace := strings.IndexByte(s, '{')
+	name := s
+	if brace >= 0 {
+		name = strings.TrimSpace(s[:brace])
+	}
+	if name != "" {
+		if strings.ContainsAny(name, " \t\"'}=!~,") {
+			return nil, fmt.Errorf("invalid metric name %q", name)
+		}
+		m, _ := NewLabelMatcher(MatchEqual, MetricNameLabel, name)
+		matchers = append(matchers, m)
+	}
+	if brace < 0 {
+		return matchers, nil
+	}
+
+	if !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("selector %q is missing closing brace", selector)
+	}
+	body := s[brace+1 : len(s)-1]
+	for {
+		body = strings.TrimLeft(body, " \t")
+		if body == "" {
+			break
+		}
+
+		// Label name
+		end := 0
+		for end < len(body) && isLabelNameChar(body[end]) {
+			end++
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("expected label name at %q", body)
+		}
+		label := body[:end]
+		body = strings.TrimLeft(body[end:], " \t")
+
+		// Operator
+		var t MatchType
+		switch {
+		case strings.HasPrefix(body, "=~"):
+			t, body = MatchRegexp, body[2:]
+		case strings.HasPrefix(body, "!~"):
+			t, body = MatchNotRegexp, body[2:]
+		case strings.HasPrefix(body, "!="):
+			t, body = MatchNotEqual, body[2:]
+		case strings.HasPrefix(body, "="):
+			t, body = MatchEqual, body[1:]
+		default:
+			return nil, fmt.Errorf("expected match operator after label %s", label)
+		}
+		body = strings.TrimLeft(body, " \t")
+
+		// Quoted value
+		value, rest, err := unquotePrefix(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %s: %w", label, err)
+		}
+		m, err := NewLabelMatcher(t, label, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+
+		body = strings.TrimLeft(rest, " \t")
+		if body == "" {
+			break
+		}
+		if body[0] != ',' {
+			return nil, fmt.Errorf("expected ',' in selector at %q", body)
+		}
+		body = body[1:]
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("selector %q must contain at least one matcher", selector)
+	}
+	return matchers, nil
+}
+
+func isLabelNameChar(c byte) bool {
+	return c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// unquotePrefix reads a single- or double-quoted string from the start of s
+func unquotePrefix(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return "", s, fmt.Errorf("expected quoted string")
+	}
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case quote:
+			if quote == '\'' {
+				// strconv only unquotes single characters with single quotes
+				return strings.ReplaceAll(s[1:i], `\'`, `'`), s[i+1:], nil
+			}
+			value, err := strconv.Unquote(s[:i+1])
+			return value, s[i+1:], err
+		}
+	}
+	return "", s, fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MetricType is the kind of value a metric records
+type MetricType string
+
+const (
+	MetricTypeUnknown   MetricType = ""
+	MetricTypeCounter   MetricType = "counter"
+	MetricTypeGauge     MetricType = "gauge"
+	MetricTypeHistogram MetricType = "histogram"
+	MetricTypeSummary   MetricType = "summary"
+)
+
+// ParseMetricType parses a metric type as written in Prometheus # TYPE lines.
+// "untyped" and "unknown" are accepted as unknown.
+func ParseMetricType(s string) (MetricType, error) {
+	switch t := MetricType(strings.ToLower(s)); t {
+	case MetricTypeCounter, MetricTypeGauge, MetricTypeHistogram, MetricTypeSummary:
+		return t, nil
+	case "", "untyped", "unknown":
+		return MetricTypeUnknown, nil
+	}
+	return MetricTypeUnknown, fmt.Errorf("unknown metric type %q", s)
+}
+
+// Metadata describes what a metric measures. It applies to every series of
+// the metric, so it is kept by metric name rather than with series data.
+type Metadata struct {
+	Type MetricType `json:"type,omitempty"`
+	Unit string     `json:"unit,omitempty"`
+	Help string     `json:"help,omitempty"`
+}
+
+// IsZero reports whether no metadata is set
+func (m Metadata) IsZero() bool {
+	return m == Metadata{}
+}
+
+// merge returns m with the fields set in other replaced
+func (m Metadata) merge(other Metadata) Metadata {
+	if other.Type != MetricTypeUnknown {
+		m.Type = other.Type
+	}
+	if other.Unit != "" {
+		m.Unit = other.Unit
+	}
+	if other.Help != "" {
+		m.Help = other.Help
+	}
+	return m
+}
+
+// MetadataStore keeps metric metadata in memory and, when given a path,
+// in a JSON file rewritten on every change. Metadata changes far less often
+// than samples are written, so the whole set is small and cheap to rewrite.
+type MetadataStore struct {
+	mu       sync.RWMutex
+	metadata map[string]Metadata
+	path     string
+}
+
+// NewMetadataStore loads metadata from path. An empty path keeps metadata
+// in memory only.
+func NewMetadataStore(path string) (*MetadataStore, error) {
+	ms := &MetadataStore{metadata: make(map[string]Metadata), path: path}
+	if path == "" {
+		return ms, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ms, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	if err := json.Unmarshal(data, &ms.metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata %s: %w", path, err)
+	}
+	return ms, nil
+}
+
+// familySuffixes are appended to a metric family's name by the series that
+// make it up, e.g. the _bucket, _sum and _count series of a histogram. The
+// value tells whether the series is in the family's unit; buckets and counts
+// count observations instead.
+var familySuffixes = map[string]bool{"_bucket": false, "_sum": true, "_count": false, "_total": true}
+
+// Get returns the metadata of a metric. Series of a histogram, summary or
+// counter family fall back to the metadata of the family.
+func (ms *MetadataStore) Get(metric string) (Metadata, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if md, ok := ms.metadata[metric]; ok {
+		return md, true
+	}
+	for suffix, keepsUnit := range familySuffixes {
+		family := strings.TrimSuffix(metric, suffix)
+		if family == metric {
+			continue
+		}
+		md, ok := ms.metadata[family]
+		if ok && !keepsUnit {
+			md.Unit = ""
+		}
+		return md, ok
+	}
+	return Metadata{}, false
+}
+
+// Set replaces the metadata of a metric
+func (ms *MetadataStore) Set(metric string, md Metadata) error {
+	if metric == "" {
+		return fmt.Errorf("metric name is required")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if current, ok := ms.metadata[metric]; ok && current == md {
+		return nil
+	}
+	return ms.update(func() { ms.metadata[metric] = md })
+}
+
+// Merge updates the fields set in md, keeping the others. Ingestion uses it
+// so that a # HELP line does not clear a unit set through the API.
+func (ms *MetadataStore) Merge(metric string, md Metadata) error {
+	if metric == "" {
+		return fmt.Errorf("metric name is required")
+	}
+	if md.IsZero() {
+		return nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	merged := ms.metadata[metric].merge(md)
+	if current, ok := ms.metadata[metric]; ok && current == merged {
+		return nil
+	}
+	return ms.update(func() { ms.metadata[metric] = merged })
+}
+
+// Delete removes the metadata of a metric
+func (ms *MetadataStore) Delete(metric string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.metadata[metric]; !ok {
+		return nil
+	}
+	return ms.update(func() { delete(ms.metadata, metric) })
+}
+
+// update applies change and persists the result, undoing the change if it
+// cannot be written. Callers hold the lock.
+func (ms *MetadataStore) update(change func()) error {
+	previous := make(map[string]Metadata, len(ms.metadata))
+	for name, md := range ms.metadata {
+		previous[name] = md
+	}
+	change()
+	if ms.path == "" {
+		return nil
+	}
+	if err := ms.write(); err != nil {
+		ms.metadata = previous
+		return err
+	}
+	return nil
+}
+
+// write replaces the metadata file through a synced temporary file
+func (ms *MetadataStore) write() error {
+	data, err := json.MarshalIndent(ms.metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	tmpPath := ms.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, ms.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return nil
+}
+
+// unitScale gives each unit's dimension and its size in the dimension's
+// base unit. Names follow Prometheus' base units, with common abbreviations.
+var unitScale = map[string]struct {
+	dimension string
+	factor    float64
+}{
+	"nanoseconds":  {"time", 1e-9},
+	"ns":           {"time", 1e-9},
+	"microseconds": {"time", 1e-6},
+	"us":           {"time", 1e-6},
+	"milliseconds": {"time", 1e-3},
+	"ms":           {"time", 1e-3},
+	"seconds":      {"time", 1},
+	"s":            {"time", 1},
+	"minutes":      {"time", 60},
+	"min":          {"time", 60},
+	"hours":        {"time", 3600},
+	"h":            {"time", 3600},
+	"days":         {"time", 86400},
+	"d":            {"time", 86400},
+
+	"bits":      {"data", 1.0 / 8},
+	"bytes":     {"data", 1},
+	"B":         {"data", 1},
+	"kilobytes": {"data", 1e3},
+	"KB":        {"data", 1e3},
+	"kibibytes": {"data", 1 << 10},
+	"KiB":       {"data", 1 << 10},
+	"megabytes": {"data", 1e6},
+	"MB":        {"data", 1e6},
+	"mebibytes": {"data", 1 << 20},
+	"MiB":       {"data", 1 << 20},
+	"gigabytes": {"data", 1e9},
+	"GB":        {"data", 1e9},
+	"gibibytes": {"data", 1 << 30},
+	"GiB":       {"data", 1 << 30},
+	"terabytes": {"data", 1e12},
+	"TB":        {"data", 1e12},
+	"tebibytes": {"data", 1 << 40},
+	"TiB":       {"data", 1 << 40},
+
+	"ratio":   {"ratio", 1},
+	"percent": {"ratio", 0.01},
+	"%":       {"ratio", 0.01},
+}
+
+// UnitFactor returns the factor converting values in unit from to unit to.
+// Both units must be known and measure the same dimension.
+func UnitFactor(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	source, ok := unitScale[from]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", from)
+	}
+	target, ok := unitScale[to]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", to)
+	}
+	if source.dimension != target.dimension {
+		return 0, fmt.Errorf("cannot convert %s to %s", from, to)
+	}
+	return source.factor / target.factor, nil
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetadataStore_MergeAndPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	store, err := NewMetadataStore(path)
+	if err != nil {
+		t.Fatalf("Failed to create metadata store: %v", err)
+	}
+
+	store.Set("http_request_duration_seconds", Metadata{Type: MetricTypeHistogram, Unit: "seconds"})
+	// A later # HELP line adds help text without clearing the unit
+	store.Merge("http_request_duration_seconds", Metadata{Help: "Request latency"})
+
+	reopened, err := NewMetadataStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen metadata store: %v", err)
+	}
+	md, ok := reopened.Get("http_request_duration_seconds")
+	expected := Metadata{Type: MetricTypeHistogram, Unit: "seconds", Help: "Request latency"}
+	if !ok || md != expected {
+		t.Errorf("Expected %+v after reopening, got %+v", expected, md)
+	}
+
+	// Series of the family fall back to its metadata; counts have no unit
+	if md, _ := reopened.Get("http_request_duration_seconds_sum"); md.Unit != "seconds" {
+		t.Errorf("Expected _sum to keep the family unit, got %+v", md)
+	}
+	if md, ok := reopened.Get("http_request_duration_seconds_count"); !ok || md.Unit != "" || md.Type != MetricTypeHistogram {
+		t.Errorf("Expected _count to have the family type without a unit, got %+v", md)
+	}
+
+	reopened.Delete("http_request_duration_seconds")
+	if _, ok := reopened.Get("http_request_duration_seconds"); ok {
+		t.Error("Expected metadata to be deleted")
+	}
+}
+
+func TestUnitFactor(t *testing.T) {
+	tests := []struct {
+		from, to string
+		factor   float64
+		valid    bool
+	}{
+		{"seconds", "ms", 1000, true},
+		{"bytes", "MiB", 1.0 / (1 << 20), true},
+		{"ratio", "percent", 100, true},
+		{"bits", "bytes", 0.125, true},
+		{"seconds", "bytes", 0, false},
+		{"furlongs", "seconds", 0, false},
+	}
+	for _, tt := range tests {
+		factor, err := UnitFactor(tt.from, tt.to)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s to %s: unexpected error %v", tt.from, tt.to, err)
+			continue
+		}
+		if tt.valid && math.Abs(factor-tt.factor) > 1e-12 {
+			t.Errorf("%s to %s: expected factor %v, got %v", tt.from, tt.to, tt.factor, factor)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Series sort orders supported by ListSeries
+const (
+	SortByID       = "id"
+	SortByLastSeen = "last_seen"
+	SortBySize     = "size"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded or
+// was issued for a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SeriesPageRequest describes one page of a series listing
+type SeriesPageRequest struct {
+	Limit      int
+	Cursor     string
+	SortBy     string
+	Descending bool
+	NamePrefix string
+}
+
+// SeriesPage is one page of a series listing. NextCursor is empty on the last page.
+type SeriesPage struct {
+	Series     []SeriesInfo
+	Total      int
+	NextCursor string
+}
+
+// seriesCursor is the keyset position after which the next page starts. The
+// series ID breaks ties, so series created between requests never shift the
+// page boundaries.
+type seriesCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Key        int64  `json:"k,omitempty"`
+	ID         string `json:"i"`
+}
+
+// ListSeries returns a page of series matching any of the matcher sets with
+// data within [start, end], ordered by the requested sort key
+func (se *StorageEngine) ListSeries(matcherSets [][]*LabelMatcher, start, end time.Time, req SeriesPageRequest) (SeriesPage, error) {
+	if req.SortBy == "" {
+		req.SortBy = SortByID
+	}
+	if req.SortBy != SortByID && req.SortBy != SortByLastSeen && req.SortBy != SortBySize {
+		return SeriesPage{}, fmt.Errorf("unsupported sort key %q", req.SortBy)
+	}
+
+	var after *seriesCursor
+	if req.Cursor != "" {
+		cursor, err := decodeSeriesCursor(req.Cursor)
+		if err != nil || cursor.SortBy != req.SortBy || cursor.Descending != req.Descending {
+			return SeriesPage{}, ErrInvalidCursor
+		}
+		after = cursor
+	}
+
+	// A name prefix becomes an anchored regexp on the metric name so the
+	// label index resolves it from the __name__ postings
+	if req.NamePrefix != "" {
+		prefix, err := NewLabelMatcher(MatchRegexp, MetricNameLabel, regexp.QuoteMeta(req.NamePrefix)+".*")
+		if err != nil {
+			return SeriesPage{}, err
+		}
+		if len(matcherSets) == 0 {
+			matcherSets = [][]*LabelMatcher{nil}
+		}
+		scoped := make([][]*LabelMatcher, len(matcherSets))
+		for i, matchers := range matcherSets {
+			scoped[i] = append(append([]*LabelMatcher{}, matchers...), prefix)
+		}
+		matcherSets = scoped
+	}
+
+	infos := se.seriesInfos(matcherSets, start, end)
+	page := SeriesPage{Total: len(infos)}
+
+	// Order by (sort key, series ID), reversed for descending listings
+	less := func(keyA int64, idA string, keyB int64, idB string) bool {
+		if keyA != keyB {
+			return (keyA < keyB) != req.Descending
+		}
+		return (idA < idB) != req.Descending
+	}
+
+	if after != nil {
+		remaining := infos[:0]
+		for _, info := range infos {
+			if less(after.Key, after.ID, seriesSortKey(info, req.SortBy), info.ID) {
+				remaining = append(remaining, info)
+			}
+		}
+		infos = remaining
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return less(seriesSortKey(infos[i], req.SortBy), infos[i].ID, seriesSortKey(infos[j], req.SortBy), infos[j].ID)
+	})
+
+	if req.Limit > 0 && len(infos) > req.Limit {
+		infos = infos[:req.Limit]
+		last := infos[len(infos)-1]
+		page.NextCursor = encodeSeriesCursor(seriesCursor{
+			SortBy:     req.SortBy,
+			Descending: req.Descending,
+			Key:        seriesSortKey(last, req.SortBy),
+			ID:         last.ID,
+		})
+	}
+
+	for i := range infos {
+		if md, ok := se.metadata.Get(MetricName(infos[i].ID, infos[i].Labels)); ok {
+			infos[i].Metadata = &md
+		}
+	}
+	page.Series = infos
+	return page, nil
+}
+
+// seriesInfos collects series info from every storage layer, preferring the
+// hot layer's view of series present in both
+func (se *StorageEngine) seriesInfos(matcherSets [][]*LabelMatcher, start, end time.Time) []SeriesInfo {
+	if len(matcherSets) == 0 {
+		matcherSets = [][]*LabelMatcher{nil}
+	}
+
+	seen := make(map[string]struct{})
+	var infos []SeriesInfo
+	for _, matchers := range matcherSets {
+		for _, series := range se.hot.Select(matchers, start, end) {
+			if _, dup := seen[series.ID]; dup {
+				continue
+			}
+			seen[series.ID] = struct{}{}
+			infos = append(infos, series.Info())
+		}
+		if se.warm == nil {
+			continue
+		}
+		for _, id := range se.warm.Select(matchers, start, end) {
+			if _, dup := seen[id]; dup {
+				continue
+			}
+			if info, ok := se.warm.seriesInfo(id); ok {
+				seen[id] = struct{}{}
+				infos = append(infos, info)
+			}
+		}
+	}
+	return infos
+}
+
+// seriesSortKey returns the numeric sort key of a series; ID ordering relies
+// solely on the ID tiebreak
+func seriesSortKey(info SeriesInfo, sortBy string) int64 {
+	switch sortBy {
+	case SortByLastSeen:
+		return info.LastSeen.UnixNano()
+	case SortBySize:
+		return int64(info.Size)
+	}
+	return 0
+}
+
+func encodeSeriesCursor(cursor seriesCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSeriesCursor(token string) (*seriesCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var cursor seriesCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestEngine(t *testing.T) *StorageEngine {
+	engine, err := NewStorageEngine(&StorageConfig{
+		Hot: HotStorageConfig{MaxSeries: 1000, MaxPointsPerSeries: 1000},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	return engine
+}
+
+func TestListSeries_CursorStableAcrossInserts(t *testing.T) {
+	engine := newTestEngine(t)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		engine.AddPoint(fmt.Sprintf("series.%02d", i), nil, now, float64(i))
+	}
+
+	first, err := engine.ListSeries(nil, time.Time{}, time.Time{}, SeriesPageRequest{Limit: 4})
+	if err != nil {
+		t.Fatalf("Failed to list series: %v", err)
+	}
+	if len(first.Series) != 4 || first.Total != 10 || first.NextCursor == "" {
+		t.Fatalf("Unexpected first page: %d series, total %d, cursor %q", len(first.Series), first.Total, first.NextCursor)
+	}
+
+	// A series sorting before the cursor must not shift the next page
+	engine.AddPoint("series.00a", nil, now, 100)
+
+	second, err := engine.ListSeries(nil, time.Time{}, time.Time{}, SeriesPageRequest{Limit: 4, Cursor: first.NextCursor})
+	if err != nil {
+		t.Fatalf("Failed to list second page: %v", err)
+	}
+	if second.Series[0].ID != "series.04" {
+		t.Errorf("Expected second page to start at series.04, got %s", second.Series[0].ID)
+	}
+
+	third, _ := engine.ListSeries(nil, time.Time{}, time.Time{}, SeriesPageRequest{Limit: 4, Cursor: second.NextCursor})
+	if len(third.Series) != 2 || third.NextCursor != "" {
+		t.Errorf("Expected a final page of 2 series, got %d (cursor %q)", len(third.Series), third.NextCursor)
+	}
+}
+
+func TestListSeries_SortAndFilter(t *testing.T) {
+	engine := newTestEngine(t)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		for j := 0; j <= i; j++ {
+			engine.AddPoint(fmt.Sprintf("cpu.%d", i), map[string]string{"host": fmt.Sprintf("h%d", i%2)}, now.Add(time.Duration(j)*time.Second), 1)
+		}
+	}
+	engine.AddPoint("mem.0", map[string]string{"host": "h0"}, now, 1)
+
+	page, err := engine.ListSeries(nil, time.Time{}, time.Time{}, SeriesPageRequest{
+		SortBy:     SortBySize,
+		Descending: true,
+		NamePrefix: "cpu.",
+	})
+	if err != nil {
+		t.Fatalf("Failed to list series: %v", err)
+	}
+	if page.Total != 5 || page.Series[0].ID != "cpu.4" || page.Series[4].ID != "cpu.0" {
+		t.Errorf("Expected cpu series sorted by size descending, got %+v", page.Series)
+	}
+
+	matchers, _ := ParseSelector(`{host="h0"}`)
+	page, _ = engine.ListSeries([][]*LabelMatcher{matchers}, time.Time{}, time.Time{}, SeriesPageRequest{NamePrefix: "cpu."})
+	if page.Total != 3 {
+		t.Errorf("Expected 3 cpu series on host h0, got %d", page.Total)
+	}
+
+	if _, err := engine.ListSeries(nil, time.Time{}, time.Time{}, SeriesPageRequest{SortBy: SortBySize, Cursor: "bogus"}); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
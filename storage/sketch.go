@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultSketchAccuracy is the relative accuracy of sketches built by the
+// ingestion API: quantiles are within 1% of the true value
+const DefaultSketchAccuracy = 0.01
+
+// minIndexableValue is the smallest magnitude given its own bucket; values
+// closer to zero are counted as zero
+const minIndexableValue = 1e-9
+
+// Sketch is a DDSketch: a histogram with logarithmically sized buckets, so
+// that every quantile it returns is within a relative accuracy of the true
+// value. Sketches with the same accuracy merge exactly, which makes them
+// suitable for aggregating latencies across time and across series.
+//
+// Sketches stored in a DataPoint are shared between readers and must not be
+// modified; use Copy before adding to or merging into one.
+type Sketch struct {
+	accuracy float64
+	// gamma is the ratio between consecutive bucket bounds
+	gamma    float64
+	logGamma float64
+
+	count, sum, min, max float64
+	zero                 float64
+	positive             map[int]float64
+	negative             map[int]float64
+}
+
+// NewSketch returns an empty sketch with the given relative accuracy, which
+// must be between 0 and 1
+func NewSketch(accuracy float64) (*Sketch, error) {
+	if !(accuracy > 0 && accuracy < 1) {
+		return nil, fmt.Errorf("sketch accuracy must be between 0 and 1, got %v", accuracy)
+	}
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &Sketch{
+		accuracy: accuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+		positive: make(map[int]float64),
+		negative: make(map[int]float64),
+	}, nil
+}
+
+// Accuracy returns the relative accuracy of the sketch's quantiles
+func (s *Sketch) Accuracy() float64 { return s.accuracy }
+
+// Count returns the number of values added
+func (s *Sketch) Count() float64 { return s.count }
+
+// Sum returns the sum of the values added
+func (s *Sketch) Sum() float64 { return s.sum }
+
+// SetSum overrides the sum, e.g. with the exact sum reported alongside
+// bucketed observations
+func (s *Sketch) SetSum(sum float64) { s.sum = sum }
+
+// Add adds a value
+func (s *Sketch) Add(value float64) error {
+	return s.AddCount(value, 1)
+}
+
+// AddCount adds a value n times
+func (s *Sketch) AddCount(value, n float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("cannot add %v to a sketch", value)
+	}
+	if n <= 0 {
+		return nil
+	}
+	switch {
+	case value > minIndexableValue:
+		s.positive[s.index(value)] += n
+	case value < -minIndexableValue:
+		s.negative[s.index(-value)] += n
+	default:
+		s.zero += n
+	}
+	s.count += n
+	s.sum += value * n
+	s.min = math.Min(s.min, value)
+	s.max = math.Max(s.max, value)
+	return nil
+}
+
+// AddBucket adds n observations known only to lie in the bucket (lower,
+// upper]. They are placed at the bucket's midpoint, as histogram_quantile
+// interpolates them in Prometheus; in a bucket with an infinite bound, at
+// its finite bound.
+func (s *Sketch) AddBucket(lower, upper, n float64) error {
+	if upper <= lower {
+		return fmt.Errorf("bucket bounds must be increasing")
+	}
+	value := (lower + upper) / 2
+	switch {
+	case math.IsInf(lower, -1):
+		value = upper
+	case math.IsInf(upper, 1):
+		value = lower
+	}
+	if n > 0 && math.IsInf(value, 0) {
+		return fmt.Errorf("a bucket needs a finite bound")
+	}
+	return s.AddCount(value, n)
+}
+
+// Merge adds the values of another sketch, which must have the same accuracy
+func (s *Sketch) Merge(other *Sketch) error {
+	if other.accuracy != s.accuracy {
+		return fmt.Errorf("cannot merge sketches with accuracy %v and %v", s.accuracy, other.accuracy)
+	}
+	for index, n := range other.positive {
+		s.positive[index] += n
+	}
+	for index, n := range other.negative {
+		s.negative[index] += n
+	}
+	s.zero += other.zero
+	s.count += other.count
+	s.sum += other.sum
+	s.min = math.Min(s.min, other.min)
+	s.max = math.Max(s.max, other.max)
+	return nil
+}
+
+// Copy returns an independent copy of the sketch
+func (s *Sketch) Copy() *Sketch {
+	c := *s
+	c.positive = make(map[int]float64, len(s.positive))
+	for index, n := range s.positive {
+		c.positive[index] = n
+	}
+	c.negative = make(map[int]float64, len(s.negative))
+	for index, n := range s.negative {
+		c.negative[index] = n
+	}
+	return &c
+}
+
+// Quantile returns an estimate of the phi-quantile of the values added; the
+// minimum and maximum are exact. It is NaN for an empty sketch, and -Inf or
+// +Inf for phi below 0 or above 1.
+func (s *Sketch) Quantile(phi float64) float64 {
+	switch {
+	case s.count == 0 || math.IsNaN(phi):
+		return math.NaN()
+	case phi < 0:
+		return math.Inf(-1)
+	case phi > 1:
+		return math.Inf(1)
+	case phi == 0:
+		return s.min
+	case phi == 1:
+		return s.max
+	}
+
+	rank := phi * (s.count - 1)
+	seen := 0.0
+	// Negative values from the most negative, then zero, then positive values
+	for _, index := range sortedIndexes(s.negative, true) {
+		if seen += s.negative[index]; seen > rank {
+			return math.Max(-s.value(index), s.min)
+		}
+	}
+	if seen += s.zero; seen > rank {
+		return 0
+	}
+	for _, index := range sortedIndexes(s.positive, false) {
+		if seen += s.positive[index]; seen > rank {
+			return math.Min(s.value(index), s.max)
+		}
+	}
+	return s.max
+}
+
+// index returns the bucket holding a positive value: bucket i covers
+// (gamma^(i-1), gamma^i]
+func (s *Sketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / s.logGamma))
+}
+
+// value returns the representative value of a bucket, which is within the
+// relative accuracy of every value in it
+func (s *Sketch) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+func sortedIndexes(buckets map[int]float64, descending bool) []int {
+	indexes := make([]int, 0, len(buckets))
+	for index := range buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return (indexes[i] < indexes[j]) != descending })
+	return indexes
+}
+
+// sketchJSON is the JSON form of a sketch, as accepted by the ingestion API
+// and written to warm storage
+type sketchJSON struct {
+	Accuracy float64         `json:"accuracy"`
+	Count    float64         `json:"count"`
+	Sum      float64         `json:"sum"`
+	Min      *float64        `json:"min,omitempty"`
+	Max      *float64        `json:"max,omitempty"`
+	Zero     float64         `json:"zero,omitempty"`
+	Positive map[int]float64 `json:"positive,omitempty"`
+	Negative map[int]float64 `json:"negative,omitempty"`
+}
+
+// MarshalJSON encodes the sketch with its buckets keyed by index
+func (s *Sketch) MarshalJSON() ([]byte, error) {
+	encoded := sketchJSON{
+		Accuracy: s.accuracy,
+		Count:    s.count,
+		Sum:      s.sum,
+		Zero:     s.zero,
+		Positive: s.positive,
+		Negative: s.negative,
+	}
+	if s.count > 0 {
+		encoded.Min, encoded.Max = &s.min, &s.max
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes a sketch, checking that its counts add up
+func (s *Sketch) UnmarshalJSON(data []byte) error {
+	var decoded sketchJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	sketch, err := NewSketch(decoded.Accuracy)
+	if err != nil {
+		return err
+	}
+
+	total := decoded.Zero
+	for _, buckets := range []map[int]float64{decoded.Positive, decoded.Negative} {
+		for index, n := range buckets {
+			if n < 0 || math.IsNaN(n) {
+				return fmt.Errorf("invalid count %v in sketch bucket %d", n, index)
+			}
+			total += n
+		}
+	}
+	if math.Abs(total-decoded.Count) > 1e-9*math.Max(1, decoded.Count) {
+		return fmt.Errorf("sketch count %v does not match its buckets' total %v", decoded.Count, total)
+	}
+
+	for index, n := range decoded.Positive {
+		sketch.positive[index] = n
+	}
+	for index, n := range decoded.Negative {
+		sketch.negative[index] = n
+	}
+	sketch.zero = decoded.Zero
+	sketch.count = decoded.Count
+	sketch.sum = decoded.Sum
+	if decoded.Count > 0 {
+		// Without bounds, use the edges of the outermost buckets
+		sketch.min, sketch.max = sketch.bounds()
+		if decoded.Min != nil {
+			sketch.min = *decoded.Min
+		}
+		if decoded.Max != nil {
+			sketch.max = *decoded.Max
+		}
+	}
+	*s = *sketch
+	return nil
+}
+
+// bounds estimates the smallest and largest values from the buckets
+func (s *Sketch) bounds() (float64, float64) {
+	min, max := math.Inf(1), math.Inf(-1)
+	if s.zero > 0 {
+		min, max = 0, 0
+	}
+	for index := range s.positive {
+		min = math.Min(min, s.value(index))
+		max = math.Max(max, s.value(index))
+	}
+	for index := range s.negative {
+		min = math.Min(min, -s.value(index))
+		max = math.Max(max, -s.value(index))
+	}
+	return min, max
+}
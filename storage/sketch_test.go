@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSketch_QuantileAccuracy(t *testing.T) {
+	sketch, _ := NewSketch(DefaultSketchAccuracy)
+	var values []float64
+	for i := 1; i <= 10000; i++ {
+		// Latencies spanning several orders of magnitude, plus a few zeros
+		value := math.Exp(float64(i%1000) / 100)
+		if i%500 == 0 {
+			value = 0
+		}
+		values = append(values, value)
+		sketch.Add(value)
+	}
+	sort.Float64s(values)
+
+	for _, phi := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+		expected := values[int(phi*float64(len(values)-1))]
+		got := sketch.Quantile(phi)
+		if math.Abs(got-expected) > DefaultSketchAccuracy*expected+1e-12 {
+			t.Errorf("Quantile %v: expected %v within 1%%, got %v", phi, expected, got)
+		}
+	}
+	if sketch.Count() != 10000 {
+		t.Errorf("Expected count 10000, got %v", sketch.Count())
+	}
+
+	empty, _ := NewSketch(DefaultSketchAccuracy)
+	if !math.IsNaN(empty.Quantile(0.5)) || !math.IsInf(sketch.Quantile(2), 1) {
+		t.Error("Expected NaN for an empty sketch and +Inf above 1")
+	}
+	if _, err := NewSketch(1); err == nil {
+		t.Error("Expected an accuracy of 1 to be rejected")
+	}
+}
+
+func TestSketch_Merge(t *testing.T) {
+	a, _ := NewSketch(DefaultSketchAccuracy)
+	b, _ := NewSketch(DefaultSketchAccuracy)
+	for i := 1; i <= 100; i++ {
+		a.Add(float64(i))
+		b.Add(float64(-i))
+	}
+
+	merged := a.Copy()
+	if err := merged.Merge(b); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if merged.Count() != 200 || merged.Sum() != 0 {
+		t.Errorf("Expected 200 values summing to 0, got %v and %v", merged.Count(), merged.Sum())
+	}
+	if q := merged.Quantile(0); q != -100 {
+		t.Errorf("Expected the minimum to be exact, got %v", q)
+	}
+	if q := merged.Quantile(0.75); math.Abs(q-50) > 1 {
+		t.Errorf("Expected the 75th percentile near 50, got %v", q)
+	}
+	if a.Count() != 100 {
+		t.Error("Expected Copy to leave the original unchanged")
+	}
+
+	coarse, _ := NewSketch(0.05)
+	if err := merged.Merge(coarse); err == nil {
+		t.Error("Expected sketches of different accuracy not to merge")
+	}
+}
+
+func TestSketch_StoredInWarmTier(t *testing.T) {
+	engine, err := NewStorageEngine(&StorageConfig{
+		Hot:  HotStorageConfig{MaxSeries: 100, MaxPointsPerSeries: 100},
+		Warm: WarmStorageConfig{Enabled: true, DataPath: t.TempDir(), MaxFileSize: 10, CompressionLevel: 6, RetentionPeriod: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage engine: %v", err)
+	}
+	defer engine.Stop()
+
+	sketch, _ := NewSketch(DefaultSketchAccuracy)
+	for _, value := range []float64{0.1, 0.2, 0.4, 0.8} {
+		sketch.Add(value)
+	}
+	base := time.Now().Truncate(time.Second).Add(-30 * time.Minute)
+	engine.warm.WriteSeriesData("request.duration", nil, []DataPoint{
+		{Timestamp: base, Value: sketch.Count(), Sketch: sketch},
+		{Timestamp: base.Add(time.Minute), Value: 1},
+	})
+	engine.AddHistogram("request.duration", nil, base.Add(2*time.Minute), sketch)
+
+	points, err := CollectPoints(engine.Iterator(context.Background(), "request.duration", base, base.Add(time.Hour)))
+	if err != nil || len(points) != 3 {
+		t.Fatalf("Expected 3 points, got %v (%v)", points, err)
+	}
+	for _, i := range []int{0, 2} {
+		stored := points[i].Sketch
+		if stored == nil || stored.Count() != 4 || stored.Quantile(1) != 0.8 || points[i].Value != 4 {
+			t.Errorf("Point %d: expected the histogram to survive, got %+v", i, points[i])
+		}
+	}
+	if points[1].Sketch != nil {
+		t.Errorf("Expected a plain value, got %+v", points[1])
+	}
+
+	var invalid Sketch
+	if err := json.Unmarshal([]byte(`{"accuracy": 0.01, "count": 5, "positive": {"3": 2}}`), &invalid); err == nil {
+		t.Error("Expected a count not matching the buckets to be rejected")
+	}
+}
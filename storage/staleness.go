@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// staleNaNBits is the NaN bit pattern used for stale markers, the same one
+// Prometheus uses so markers survive remote write and federation unchanged
+const staleNaNBits = 0x7ff0000000000002
+
+// StaleNaN is the value of a stale marker: a point recording that a series
+// stopped receiving data at its timestamp. Ordinary NaN values are not
+// markers; use IsStaleMarker to tell them apart.
+var StaleNaN = math.Float64frombits(staleNaNBits)
+
+// IsStaleMarker reports whether a value is a stale marker
+func IsStaleMarker(value float64) bool {
+	return math.Float64bits(value) == staleNaNBits
+}
+
+// dataPointJSON is the JSON form of a DataPoint. JSON has no NaN, so values
+// it cannot represent are encoded as null and stale markers are flagged.
+// Values of other types than float are written as JSON integers, booleans
+// and strings, with the type alongside.
+type dataPointJSON struct {
+	Timestamp time.Time
+	Value     json.RawMessage
+	Type      ValueType `json:",omitempty"`
+	Stale     bool      `json:",omitempty"`
+	Sketch    *Sketch   `json:",omitempty"`
+}
+
+// MarshalJSON encodes NaN and infinite values as null
+func (p DataPoint) MarshalJSON() ([]byte, error) {
+	encoded := dataPointJSON{Timestamp: p.Timestamp, Type: p.Type, Stale: IsStaleMarker(p.Value), Sketch: p.Sketch}
+	switch {
+	case p.Type == ValueInt:
+		encoded.Value = strconv.AppendInt(nil, p.Int, 10)
+	case p.Type == ValueBool:
+		encoded.Value = strconv.AppendBool(nil, p.Value != 0)
+	case p.Type == ValueString:
+		text, err := json.Marshal(p.Text)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Value = text
+	case !math.IsNaN(p.Value) && !math.IsInf(p.Value, 0):
+		value, err := json.Marshal(p.Value)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Value = value
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes null values as NaN, restoring stale markers
+func (p *DataPoint) UnmarshalJSON(data []byte) error {
+	var decoded dataPointJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*p = DataPoint{Timestamp: decoded.Timestamp, Sketch: decoded.Sketch}
+	if decoded.Stale {
+		p.Value = StaleNaN
+		return nil
+	}
+	if len(decoded.Value) == 0 || string(decoded.Value) == "null" {
+		p.Value = math.NaN()
+		p.Type = decoded.Type
+		return nil
+	}
+	var value FieldValue
+	if err := value.decodeTyped(decoded.Type, decoded.Value); err != nil {
+		return err
+	}
+	*p = value.Point(decoded.Timestamp)
+	p.Sketch = decoded.Sketch
+	return nil
+}
+
+// DropStaleMarkers returns points without stale markers. The input is not
+// modified, as it may be shared with a cache.
+func DropStaleMarkers(points []DataPoint) []DataPoint {
+	for i, point := range points {
+		if IsStaleMarker(point.Value) {
+			result := append(make([]DataPoint, 0, len(points)-1), points[:i]...)
+			for _, rest := range points[i+1:] {
+				if !IsStaleMarker(rest.Value) {
+					result = append(result, rest)
+				}
+			}
+			return result
+		}
+	}
+	return points
+}
+
+// SkipStaleMarkers wraps an iterator to hide stale markers from readers that
+// only want sample values
+func SkipStaleMarkers(it PointIterator) PointIterator {
+	return &staleFilterIterator{PointIterator: it}
+}
+
+type staleFilterIterator struct {
+	PointIterator
+}
+
+func (it *staleFilterIterator) Next() bool {
+	for it.PointIterator.Next() {
+		if !IsStaleMarker(it.PointIterator.At().Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkStale records a stale marker for a series, e.g. when the source it is
+// scraped or received from disappears. Marking an already stale series is a
+// no-op; the next sample clears the stale state.
+func (se *StorageEngine) MarkStale(seriesID string, timestamp time.Time) error {
+	series, exists := se.hot.GetSeries(seriesID)
+	if !exists {
+		return fmt.Errorf("series %s not found", seriesID)
+	}
+	if series.IsStale() {
+		return nil
+	}
+	return se.AddPoint(seriesID, series.Labels, timestamp, StaleNaN)
+}
+
+// markStaleSeries writes stale markers for hot series that have not received
+// a sample for the configured StaleAfter, and returns their IDs
+func (se *StorageEngine) markStaleSeries(now time.Time) []string {
+	staleAfter := se.config.Hot.StaleAfter
+	if staleAfter <= 0 {
+		return nil
+	}
+
+	var marked []string
+	for _, series := range se.hot.GetSeriesByLabels(map[string]string{}) {
+		if series.IsStale() || now.Sub(series.LastSeen) < staleAfter {
+			continue
+		}
+		// Never place the marker before the newest point, e.g. when points
+		// were written with future timestamps
+		if _, last, ok := series.TimeRange(); ok && !last.Before(now) {
+			continue
+		}
+		if err := se.AddPoint(series.ID, series.Labels, now, StaleNaN); err == nil {
+			marked = append(marked, series.ID)
+		}
+	}
+	return marked
+}
+
+// StalenessWorker periodically marks series that stopped receiving data
+type StalenessWorker struct {
+	engine   *StorageEngine
+	interval time.Duration
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func (sw *StalenessWorker) Start() {
+	sw.wg.Add(1)
+	go sw.run()
+}
+
+func (sw *StalenessWorker) Stop() {
+	close(sw.stopChan)
+	sw.wg.Wait()
+}
+
+func (sw *StalenessWorker) run() {
+	defer sw.wg.Done()
+
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sw.stopChan:
+			return
+		case now := <-ticker.C:
+			sw.engine.markStaleSeries(now)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
@@ -10,16 +13,32 @@ import (
 type StorageEngine struct {
 	hot            *HotStorage
 	warm           *WarmStorage
+	annotations    *AnnotationStore
+	metadata       *MetadataStore
+	exemplars      *ExemplarStore
 	config         *StorageConfig
 	tieringEnabled bool
 	
 	// Background workers
-	tieringWorker  *TieringWorker
-	cleanupWorker  *CleanupWorker
+	tieringWorker   *TieringWorker
+	cleanupWorker   *CleanupWorker
+	stalenessWorker *StalenessWorker
+	
+	// Watchers notified of data changes, e.g. to invalidate query caches
+	watchers   []func([]DataChange)
+	watchersMu sync.RWMutex
 	
 	mu sync.RWMutex
 }
 
+// DataChange describes data written to or removed from a series. Zero Start
+// and End times mean the whole series changed.
+type DataChange struct {
+	SeriesID string
+	Start    time.Time
+	End      time.Time
+}
+
 // StorageConfig contains configuration for the storage engine
 type StorageConfig struct {
 	Hot  HotStorageConfig
@@ -33,6 +52,9 @@ type HotStorageConfig struct {
 	MaxPointsPerSeries int
 	RetentionPeriod    time.Duration
 	CleanupInterval    time.Duration
+	// StaleAfter writes a stale marker for series that receive no samples
+	// for this long; zero disables automatic markers
+	StaleAfter time.Duration
 }
 
 // WarmStorageConfig contains warm storage configuration  
@@ -90,10 +112,29 @@ func NewStorageEngine(config *StorageConfig) (*StorageEngine, error) {
 			return nil, fmt.Errorf("failed to initialize warm storage: %w", err)
 		}
 	}
+
+	// Annotations and metric metadata are kept next to the warm series
+	// files, or in memory when there is no warm tier
+	annotationPath, metadataPath := "", ""
+	if config.Warm.Enabled {
+		annotationPath = filepath.Join(config.Warm.DataPath, "annotations.log")
+		metadataPath = filepath.Join(config.Warm.DataPath, "metadata.json")
+	}
+	annotations, err := NewAnnotationStore(annotationPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize annotation store: %w", err)
+	}
+	metadata, err := NewMetadataStore(metadataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metadata store: %w", err)
+	}
 	
 	engine := &StorageEngine{
 		hot:            hot,
 		warm:           warm,
+		annotations:    annotations,
+		metadata:       metadata,
+		exemplars:      NewExemplarStore(DefaultExemplarsPerSeries),
 		config:         config,
 		tieringEnabled: config.Warm.Enabled,
 	}
@@ -111,13 +152,135 @@ func NewStorageEngine(config *StorageConfig) (*StorageEngine, error) {
 		stopChan: make(chan struct{}),
 	}
 	
+	if config.Hot.StaleAfter > 0 {
+		// Check often enough that markers land close to StaleAfter
+		interval := config.Hot.StaleAfter / 4
+		if interval < time.Second {
+			interval = time.Second
+		}
+		engine.stalenessWorker = &StalenessWorker{
+			engine:   engine,
+			interval: interval,
+			stopChan: make(chan struct{}),
+		}
+	}
+	
 	return engine, nil
 }
 
 // AddPoint adds a data point to the storage engine
 func (se *StorageEngine) AddPoint(seriesID string, labels map[string]string, timestamp time.Time, value float64) error {
 	// Always write to hot storage first
-	return se.hot.AddPoint(seriesID, labels, timestamp, value)
+	evicted, err := se.hot.add(seriesID, labels, DataPoint{Timestamp: timestamp, Value: value})
+	if err != nil {
+		return err
+	}
+	
+	se.notifyWrite(seriesID, timestamp, evicted)
+	return nil
+}
+
+// AddValue adds a typed value to the storage engine, e.g. one field of a
+// measurement. It fails with ErrTypeConflict when the series holds values of
+// another type.
+func (se *StorageEngine) AddValue(seriesID string, labels map[string]string, timestamp time.Time, value FieldValue) error {
+	evicted, err := se.hot.add(seriesID, labels, value.Point(timestamp))
+	if err != nil {
+		return err
+	}
+	
+	se.notifyWrite(seriesID, timestamp, evicted)
+	return nil
+}
+
+// AddHistogram adds a histogram sample to the storage engine. The sketch
+// must not be modified afterwards.
+func (se *StorageEngine) AddHistogram(seriesID string, labels map[string]string, timestamp time.Time, sketch *Sketch) error {
+	evicted, err := se.hot.add(seriesID, labels, DataPoint{Timestamp: timestamp, Value: sketch.Count(), Sketch: sketch})
+	if err != nil {
+		return err
+	}
+	
+	se.notifyWrite(seriesID, timestamp, evicted)
+	return nil
+}
+
+// AddBatch writes samples to the storage engine, as AddBatch on the hot
+// storage does. Watchers are told once per batch, with one change per series
+// covering the points evicted to make room and one covering those written.
+func (se *StorageEngine) AddBatch(samples []Sample) []error {
+	errs, evicted := se.hot.addBatch(samples)
+	
+	written := make([]DataChange, 0, len(samples))
+	for i, sample := range samples {
+		if errs != nil && errs[i] != nil {
+			continue
+		}
+		t := sample.Point.Timestamp
+		written = append(written, DataChange{SeriesID: sample.SeriesID, Start: t, End: t})
+	}
+	se.notifyWatchers(append(coalesceChanges(evicted), coalesceChanges(written)...))
+	return errs
+}
+
+// AddChangeWatcher registers a function called whenever stored data changes:
+// points are written, evicted from a full hot series or dropped by retention.
+// Each call passes the changes of one write or cleanup. Moving data between
+// tiers is not a change.
+func (se *StorageEngine) AddChangeWatcher(fn func([]DataChange)) {
+	se.watchersMu.Lock()
+	defer se.watchersMu.Unlock()
+	se.watchers = append(se.watchers, fn)
+}
+
+// notifyWrite tells watchers of a point written at timestamp and of the
+// point evicted for it, if any
+func (se *StorageEngine) notifyWrite(seriesID string, timestamp, evicted time.Time) {
+	changes := make([]DataChange, 0, 2)
+	if !evicted.IsZero() {
+		changes = append(changes, DataChange{SeriesID: seriesID, Start: evicted, End: evicted})
+	}
+	se.notifyWatchers(append(changes, DataChange{SeriesID: seriesID, Start: timestamp, End: timestamp}))
+}
+
+func (se *StorageEngine) notifyWatchers(changes []DataChange) {
+	if len(changes) == 0 {
+		return
+	}
+	se.watchersMu.RLock()
+	defer se.watchersMu.RUnlock()
+	for _, watcher := range se.watchers {
+		watcher(changes)
+	}
+}
+
+// coalesceChanges merges the changes to each series into one spanning them
+// all, in the order the series first appear
+func coalesceChanges(changes []DataChange) []DataChange {
+	merged := make([]DataChange, 0, len(changes))
+	index := make(map[string]int)
+	for _, change := range changes {
+		i, ok := index[change.SeriesID]
+		if !ok {
+			index[change.SeriesID] = len(merged)
+			merged = append(merged, change)
+			continue
+		}
+		m := &merged[i]
+		switch {
+		case m.Start.IsZero():
+		case change.Start.IsZero():
+			m.Start, m.End = time.Time{}, time.Time{}
+		default:
+			if change.Start.Before(m.Start) {
+				m.Start = change.Start
+			}
+			if change.End.After(m.End) {
+				m.End = change.End
+			}
+		}
+	}
+	return merged
 }
 
 // GetSeries retrieves a series by ID from any storage layer
@@ -133,31 +296,28 @@ func (se *StorageEngine) GetSeries(seriesID string) (*Series, bool) {
 	return nil, false
 }
 
-// GetRange retrieves data points within a time range across all storage layers
-func (se *StorageEngine) GetRange(seriesID string, start, end time.Time) ([]DataPoint, error) {
-	var allPoints []DataPoint
-	
-	// Get points from hot storage
-	if series, exists := se.hot.GetSeries(seriesID); exists {
-		hotPoints := series.GetRange(start, end)
-		allPoints = append(allPoints, hotPoints...)
+// SeriesExists reports whether a series is stored in any layer
+func (se *StorageEngine) SeriesExists(seriesID string) bool {
+	if _, exists := se.hot.GetSeries(seriesID); exists {
+		return true
 	}
-	
-	// Get points from warm storage if enabled
 	if se.warm != nil {
-		warmPoints, err := se.warm.ReadSeriesRange(seriesID, start, end)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read from warm storage: %w", err)
-		}
-		allPoints = append(allPoints, warmPoints...)
+		_, exists := se.warm.seriesInfo(seriesID)
+		return exists
 	}
-	
-	// Merge and sort points from all layers
-	if len(allPoints) > 1 {
-		allPoints = mergeSortedPoints(allPoints)
+	return false
+}
+
+// GetRange retrieves data points within a time range across all storage layers
+func (se *StorageEngine) GetRange(ctx context.Context, seriesID string, start, end time.Time) ([]DataPoint, error) {
+	points, err := CollectPoints(se.Iterator(ctx, seriesID, start, end))
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("failed to read from warm storage: %w", err)
 	}
-	
-	return allPoints, nil
+	return points, nil
 }
 
 // GetSeriesByLabels returns series matching label filters from all storage layers
@@ -167,6 +327,135 @@ func (se *StorageEngine) GetSeriesByLabels(labelFilters map[string]string) []*Se
 	return se.hot.GetSeriesByLabels(labelFilters)
 }
 
+// Select returns info on every series matching the matchers with data within
+// [start, end], sorted by series ID
+func (se *StorageEngine) Select(matchers []*LabelMatcher, start, end time.Time) []SeriesInfo {
+	infos := se.seriesInfos([][]*LabelMatcher{matchers}, start, end)
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// LabelNames returns the sorted label names of series matching any of the
+// matcher sets within [start, end]. Without matchers or a time range the
+// names are read straight from the label indexes.
+func (se *StorageEngine) LabelNames(matcherSets [][]*LabelMatcher, start, end time.Time) []string {
+	names := make(map[string]struct{})
+	if len(matcherSets) == 0 && start.IsZero() && end.IsZero() {
+		for _, name := range se.hot.index.LabelNames() {
+			names[name] = struct{}{}
+		}
+		if se.warm != nil {
+			for _, name := range se.warm.index.LabelNames() {
+				names[name] = struct{}{}
+			}
+		}
+		return sortedKeys(names)
+	}
+
+	for _, labels := range se.selectLabelSets(matcherSets, start, end) {
+		for name := range labels {
+			names[name] = struct{}{}
+		}
+	}
+	return sortedKeys(names)
+}
+
+// LabelValues returns the sorted values of a label across series matching any
+// of the matcher sets within [start, end]
+func (se *StorageEngine) LabelValues(name string, matcherSets [][]*LabelMatcher, start, end time.Time) []string {
+	values := make(map[string]struct{})
+	if len(matcherSets) == 0 && start.IsZero() && end.IsZero() {
+		for _, value := range se.hot.index.LabelValues(name) {
+			values[value] = struct{}{}
+		}
+		if se.warm != nil {
+			for _, value := range se.warm.index.LabelValues(name) {
+				values[value] = struct{}{}
+			}
+		}
+		return sortedKeys(values)
+	}
+
+	for _, labels := range se.selectLabelSets(matcherSets, start, end) {
+		if value, ok := labels[name]; ok {
+			values[value] = struct{}{}
+		}
+	}
+	return sortedKeys(values)
+}
+
+// MetricMetadata summarises each metric name among series matching any of the
+// matcher sets within [start, end], sorted by metric name
+func (se *StorageEngine) MetricMetadata(matcherSets [][]*LabelMatcher, start, end time.Time) []MetricMetadata {
+	type metricSummary struct {
+		count  int
+		labels map[string]struct{}
+	}
+	summaries := make(map[string]*metricSummary)
+
+	for _, labels := range se.selectLabelSets(matcherSets, start, end) {
+		metric := labels[MetricNameLabel]
+		summary, exists := summaries[metric]
+		if !exists {
+			summary = &metricSummary{labels: make(map[string]struct{})}
+			summaries[metric] = summary
+		}
+		summary.count++
+		for name := range labels {
+			if name != MetricNameLabel {
+				summary.labels[name] = struct{}{}
+			}
+		}
+	}
+
+	result := make([]MetricMetadata, 0, len(summaries))
+	for metric, summary := range summaries {
+		md, _ := se.metadata.Get(metric)
+		result = append(result, MetricMetadata{
+			Metric:      metric,
+			Metadata:    md,
+			SeriesCount: summary.count,
+			LabelNames:  sortedKeys(summary.labels),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Metric < result[j].Metric
+	})
+	return result
+}
+
+// selectLabelSets returns the indexed labels of series matching any of the
+// matcher sets in every storage layer, keyed by series ID. No matcher sets
+// selects all series.
+func (se *StorageEngine) selectLabelSets(matcherSets [][]*LabelMatcher, start, end time.Time) map[string]map[string]string {
+	if len(matcherSets) == 0 {
+		matcherSets = [][]*LabelMatcher{nil}
+	}
+
+	result := make(map[string]map[string]string)
+	for _, matchers := range matcherSets {
+		for _, series := range se.hot.Select(matchers, start, end) {
+			if labels, ok := se.hot.index.Labels(series.ID); ok {
+				result[series.ID] = labels
+			}
+		}
+		if se.warm == nil {
+			continue
+		}
+		for _, id := range se.warm.Select(matchers, start, end) {
+			if _, seen := result[id]; seen {
+				continue
+			}
+			if labels, ok := se.warm.index.Labels(id); ok {
+				result[id] = labels
+			}
+		}
+	}
+	return result
+}
+
 // GetStorageStats returns statistics about storage usage
 func (se *StorageEngine) GetStorageStats() StorageStats {
 	stats := StorageStats{
@@ -193,6 +482,9 @@ func (se *StorageEngine) Start() {
 		se.tieringWorker.Start()
 	}
 	se.cleanupWorker.Start()
+	if se.stalenessWorker != nil {
+		se.stalenessWorker.Start()
+	}
 }
 
 // Stop shuts down background workers and closes storage layers
@@ -202,6 +494,9 @@ func (se *StorageEngine) Stop() error {
 		se.tieringWorker.Stop()
 	}
 	se.cleanupWorker.Stop()
+	if se.stalenessWorker != nil {
+		se.stalenessWorker.Stop()
+	}
 	
 	// Close storage layers
 	if se.warm != nil {
@@ -209,10 +504,50 @@ func (se *StorageEngine) Stop() error {
 			return fmt.Errorf("failed to close warm storage: %w", err)
 		}
 	}
+	if err := se.annotations.Close(); err != nil {
+		return fmt.Errorf("failed to close annotation store: %w", err)
+	}
 	
 	return nil
 }
 
+// Annotations returns the store of events overlaid on series data
+func (se *StorageEngine) Annotations() *AnnotationStore {
+	return se.annotations
+}
+
+// Metadata returns the type, unit and help text of a metric
+func (se *StorageEngine) Metadata(metric string) (Metadata, bool) {
+	return se.metadata.Get(metric)
+}
+
+// SetMetadata replaces the metadata of a metric
+func (se *StorageEngine) SetMetadata(metric string, md Metadata) error {
+	return se.metadata.Set(metric, md)
+}
+
+// MergeMetadata updates the metadata fields set in md, as reported by a
+// source such as Prometheus # HELP and # TYPE lines
+func (se *StorageEngine) MergeMetadata(metric string, md Metadata) error {
+	return se.metadata.Merge(metric, md)
+}
+
+// DeleteMetadata removes the metadata of a metric
+func (se *StorageEngine) DeleteMetadata(metric string) error {
+	return se.metadata.Delete(metric)
+}
+
+// AddExemplar records an exemplar of a series
+func (se *StorageEngine) AddExemplar(seriesID string, exemplar Exemplar) error {
+	se.exemplars.Add(seriesID, exemplar)
+	return nil
+}
+
+// Exemplars returns the exemplars of a series between start and end
+func (se *StorageEngine) Exemplars(seriesID string, start, end time.Time) []Exemplar {
+	return se.exemplars.Range(seriesID, start, end)
+}
+
 // TriggerTiering manually triggers data tiering process
 func (se *StorageEngine) TriggerTiering() error {
 	if !se.tieringEnabled {
@@ -275,19 +610,36 @@ func (se *StorageEngine) performTiering() error {
 
 func (se *StorageEngine) performCleanup() error {
 	// Clean up hot storage
-	hotCleaned := se.hot.CleanupStale(se.config.Hot.RetentionPeriod)
+	hotRemoved := se.hot.cleanupStale(se.config.Hot.RetentionPeriod)
+	hotCleaned := len(hotRemoved)
 	
 	var warmCleaned int
-	var err error
 	
 	// Clean up warm storage if enabled
 	if se.warm != nil {
-		warmCleaned, err = se.warm.CleanupExpired()
+		warmRemoved, err := se.warm.cleanupExpired()
+		warmCleaned = len(warmRemoved)
+		changes := make([]DataChange, len(warmRemoved))
+		for i, seriesID := range warmRemoved {
+			changes[i] = DataChange{SeriesID: seriesID}
+		}
+		se.notifyWatchers(changes)
 		if err != nil {
 			return fmt.Errorf("failed to cleanup warm storage: %w", err)
 		}
 	}
 	
+	// Reads of series dropped from hot storage change even when a warm copy
+	// remains, as points not yet tiered are gone
+	changes := make([]DataChange, len(hotRemoved))
+	for i, seriesID := range hotRemoved {
+		if !se.SeriesExists(seriesID) {
+			se.exemplars.Delete(seriesID)
+		}
+		changes[i] = DataChange{SeriesID: seriesID}
+	}
+	se.notifyWatchers(changes)
+	
 	fmt.Printf("Cleaned up %d hot series and %d warm series\n", hotCleaned, warmCleaned)
 	return nil
 }
@@ -375,35 +727,21 @@ type ColdStorageStats struct {
 	TotalSize   int64 `json:"total_size_bytes"`
 }
 
-// mergeSortedPoints merges and deduplicates sorted data points from multiple sources
-func mergeSortedPoints(points []DataPoint) []DataPoint {
-	if len(points) <= 1 {
-		return points
-	}
-	
-	// Create a map to deduplicate by timestamp
-	pointMap := make(map[int64]DataPoint)
-	
-	for _, point := range points {
-		timestamp := point.Timestamp.UnixNano()
-		// Keep the latest value for duplicate timestamps
-		pointMap[timestamp] = point
-	}
-	
-	// Convert back to slice and sort
-	result := make([]DataPoint, 0, len(pointMap))
-	for _, point := range pointMap {
-		result = append(result, point)
-	}
-	
-	// Sort by timestamp
-	for i := 0; i < len(result)-1; i++ {
-		for j := i + 1; j < len(result); j++ {
-			if result[i].Timestamp.After(result[j].Timestamp) {
-				result[i], result[j] = result[j], result[i]
-			}
-		}
+// MetricMetadata summarises the series stored under one metric name,
+// along with the metric's type, unit and help text when known
+type MetricMetadata struct {
+	Metric string `json:"metric"`
+	Metadata
+	SeriesCount int      `json:"series_count"`
+	LabelNames  []string `json:"label_names"`
+}
+
+// sortedKeys returns the keys of a string set in sorted order
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
 	}
-	
-	return result
-}
\ No newline at end of file
+	sort.Strings(keys)
+	return keys
+}
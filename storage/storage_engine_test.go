@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestStorageEngine_ChangeWatchers(t *testing.T) {
+	engine := newTestEngine(t)
+	engine.config.Hot.RetentionPeriod = -time.Second
+
+	var changes []DataChange
+	calls := 0
+	engine.AddChangeWatcher(func(batch []DataChange) {
+		changes = append(changes, batch...)
+		calls++
+	})
+
+	old := time.Now().Add(-2 * time.Hour)
+	engine.AddPoint("cpu.usage", nil, old, 1.0)
+	if len(changes) != 1 || changes[0].SeriesID != "cpu.usage" || !changes[0].Start.Equal(old) {
+		t.Fatalf("Expected a change for the written point, got %+v", changes)
+	}
+
+	// Without a warm tier, dropping the series removes its data
+	if err := engine.performCleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if len(changes) != 2 || !changes[1].Start.IsZero() {
+		t.Errorf("Expected a whole-series change after cleanup, got %+v", changes)
+	}
+
+	// Evicting the oldest point of a full series changes its range too
+	engine.hot.maxPointsPerSeries = 1
+	engine.AddPoint("mem.used", nil, old, 1.0)
+	engine.AddBatch([]Sample{{SeriesID: "mem.used", Point: DataPoint{Timestamp: old.Add(time.Minute), Value: 2}}})
+	if len(changes) != 5 || !changes[3].Start.Equal(old) || !changes[4].Start.Equal(old.Add(time.Minute)) {
+		t.Errorf("Expected changes for the evicted and the written point, got %+v", changes[2:])
+	}
+
+	// A batch is one notification with one change per series and kind
+	calls = 0
+	engine.AddBatch([]Sample{
+		{SeriesID: "mem.used", Point: DataPoint{Timestamp: old.Add(2 * time.Minute), Value: 3}},
+		{SeriesID: "mem.used", Point: DataPoint{Timestamp: old.Add(3 * time.Minute), Value: 4}},
+	})
+	batch := changes[5:]
+	if calls != 1 || len(batch) != 2 ||
+		!batch[0].Start.Equal(old.Add(time.Minute)) || !batch[0].End.Equal(old.Add(2*time.Minute)) ||
+		!batch[1].Start.Equal(old.Add(2*time.Minute)) || !batch[1].End.Equal(old.Add(3*time.Minute)) {
+		t.Errorf("Expected one coalesced eviction and write, got %d calls with %+v", calls, batch)
+	}
+}
+
+func TestStorageEngine_MarkStaleSeries(t *testing.T) {
+	engine := newTestEngine(t)
+	engine.config.Hot.StaleAfter = 5 * time.Minute
+
+	now := time.Now()
+	engine.AddPoint("cpu.usage", nil, now.Add(-time.Minute), 1.0)
+	if marked := engine.markStaleSeries(now); len(marked) != 0 {
+		t.Fatalf("Expected no stale series yet, got %v", marked)
+	}
+
+	later := now.Add(10 * time.Minute)
+	if marked := engine.markStaleSeries(later); len(marked) != 1 || marked[0] != "cpu.usage" {
+		t.Fatalf("Expected cpu.usage to be marked stale, got %v", marked)
+	}
+	if marked := engine.markStaleSeries(later.Add(time.Minute)); len(marked) != 0 {
+		t.Errorf("Expected a stale series to be marked once, got %v", marked)
+	}
+
+	series, _ := engine.hot.GetSeries("cpu.usage")
+	if !series.IsStale() {
+		t.Fatal("Expected series to be stale")
+	}
+	points := series.GetRange(now.Add(-time.Hour), later)
+	if len(points) != 2 || !IsStaleMarker(points[1].Value) || len(DropStaleMarkers(points)) != 1 {
+		t.Errorf("Expected a trailing stale marker, got %v", points)
+	}
+
+	// A new sample makes the series live again
+	engine.AddPoint("cpu.usage", nil, later.Add(time.Minute), 2.0)
+	if series.IsStale() {
+		t.Error("Expected a new sample to clear the stale state")
+	}
+}
+
+func TestDataPoint_JSONStaleMarker(t *testing.T) {
+	points := []DataPoint{
+		{Timestamp: time.Unix(100, 0).UTC(), Value: 1.5},
+		{Timestamp: time.Unix(160, 0).UTC(), Value: StaleNaN},
+		{Timestamp: time.Unix(220, 0).UTC(), Value: math.NaN()},
+	}
+	data, err := json.Marshal(points)
+	if err != nil {
+		t.Fatalf("Failed to marshal points: %v", err)
+	}
+
+	var decoded []DataPoint
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal %s: %v", data, err)
+	}
+	if len(decoded) != 3 || decoded[0].Value != 1.5 {
+		t.Fatalf("Unexpected round trip: %s", data)
+	}
+	if !IsStaleMarker(decoded[1].Value) {
+		t.Errorf("Expected stale marker to survive the round trip, got %v", decoded[1].Value)
+	}
+	if !math.IsNaN(decoded[2].Value) || IsStaleMarker(decoded[2].Value) {
+		t.Errorf("Expected a plain NaN, got %v", decoded[2].Value)
+	}
+}
@@ -8,10 +8,19 @@ import (
 	"time"
 )
 
-// DataPoint represents a single time-series data point
+// DataPoint represents a single time-series data point. Histogram samples
+// carry a Sketch of their observations, with Value holding its count.
+// Integer and boolean values are held in Value, as is and as 0 or 1, so that
+// they can be queried as numbers; integers are also held exactly in Int, as
+// Value rounds those beyond 2^53. String values are held in Text, with a NaN
+// Value.
 type DataPoint struct {
 	Timestamp time.Time
 	Value     float64
+	Type      ValueType
+	Int       int64
+	Text      string
+	Sketch    *Sketch
 }
 
 // Series represents a time series with metadata
@@ -20,7 +29,12 @@ type Series struct {
 	Labels   map[string]string
 	Points   []DataPoint
 	LastSeen time.Time
-	mu       sync.RWMutex
+	// Type is the type of the series' values, set by its first point
+	Type ValueType
+	// stale is set by a stale marker and cleared by the next sample
+	stale bool
+	typed bool
+	mu    sync.RWMutex
 }
 
 // NewSeries creates a new time series
@@ -36,12 +50,41 @@ func NewSeries(id string, labels map[string]string) *Series {
 	}
 }
 
-// AddPoint adds a data point to the series (thread-safe)
+// AddPoint adds a data point to the series (thread-safe). A StaleNaN value
+// marks the series stale without counting as a sample for LastSeen. The
+// point is dropped if the series holds values of another type.
 func (s *Series) AddPoint(timestamp time.Time, value float64) {
+	s.add(DataPoint{Timestamp: timestamp, Value: value})
+}
+
+// AddHistogram adds a histogram sample to the series. The sketch must not be
+// modified afterwards.
+func (s *Series) AddHistogram(timestamp time.Time, sketch *Sketch) {
+	s.add(DataPoint{Timestamp: timestamp, Value: sketch.Count(), Sketch: sketch})
+}
+
+// AddValue adds a typed value to the series. It fails when the value's
+// type differs from the series' type.
+func (s *Series) AddValue(timestamp time.Time, value FieldValue) error {
+	return s.add(value.Point(timestamp))
+}
+
+func (s *Series) add(point DataPoint) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	
-	point := DataPoint{Timestamp: timestamp, Value: value}
+	timestamp := point.Timestamp
+	marker := IsStaleMarker(point.Value)
+	// Stale markers end a series of any type
+	if !marker {
+		if s.typed && point.Type != s.Type {
+			return fmt.Errorf("%w: series %s holds %s values, got %s", ErrTypeConflict, s.ID, s.Type, point.Type)
+		}
+		s.Type, s.typed = point.Type, true
+	}
+	if len(s.Points) == 0 || !timestamp.Before(s.Points[len(s.Points)-1].Timestamp) {
+		s.stale = marker
+	}
 	
 	// Insert in sorted order (by timestamp)
 	pos := sort.Search(len(s.Points), func(i int) bool {
@@ -50,15 +93,32 @@ func (s *Series) AddPoint(timestamp time.Time, value float64) {
 	
 	// Check for duplicate timestamp
 	if pos > 0 && s.Points[pos-1].Timestamp.Equal(timestamp) {
-		s.Points[pos-1].Value = value // Update existing point
-		return
+		s.Points[pos-1] = point // Update existing point
+		return nil
 	}
 	
 	// Insert at correct position
 	s.Points = append(s.Points, DataPoint{})
 	copy(s.Points[pos+1:], s.Points[pos:])
 	s.Points[pos] = point
-	s.LastSeen = time.Now()
+	if !marker {
+		s.LastSeen = time.Now()
+	}
+	return nil
+}
+
+// valueType returns the type of the series' values, if it has any
+func (s *Series) valueType() (ValueType, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Type, s.typed
+}
+
+// IsStale reports whether the newest point of the series is a stale marker
+func (s *Series) IsStale() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stale
 }
 
 // GetRange returns points within a time range
@@ -120,9 +180,36 @@ func (s *Series) Size() int {
 	return len(s.Points)
 }
 
+// Info returns a summary of the series without its points
+func (s *Series) Info() SeriesInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return SeriesInfo{
+		ID:       s.ID,
+		Labels:   s.Labels,
+		Size:     len(s.Points),
+		LastSeen: s.LastSeen,
+		Stale:    s.stale,
+		Type:     s.Type,
+	}
+}
+
+// TimeRange returns the timestamps of the oldest and newest points
+func (s *Series) TimeRange() (time.Time, time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.Points) == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	return s.Points[0].Timestamp, s.Points[len(s.Points)-1].Timestamp, true
+}
+
 // HotStorage represents the in-memory hot storage layer
 type HotStorage struct {
 	series       map[string]*Series
+	index        *LabelIndex
 	maxSeries    int
 	maxPointsPerSeries int
 	mu           sync.RWMutex
@@ -133,6 +220,7 @@ type HotStorage struct {
 func NewHotStorage(maxSeries, maxPointsPerSeries int) *HotStorage {
 	return &HotStorage{
 		series:             make(map[string]*Series),
+		index:              NewLabelIndex(),
 		maxSeries:          maxSeries,
 		maxPointsPerSeries: maxPointsPerSeries,
 	}
@@ -140,25 +228,97 @@ func NewHotStorage(maxSeries, maxPointsPerSeries int) *HotStorage {
 
 // AddPoint adds a data point to a series
 func (hs *HotStorage) AddPoint(seriesID string, labels map[string]string, timestamp time.Time, value float64) error {
+	_, err := hs.add(seriesID, labels, DataPoint{Timestamp: timestamp, Value: value})
+	return err
+}
+
+// AddValue adds a typed value to a series
+func (hs *HotStorage) AddValue(seriesID string, labels map[string]string, timestamp time.Time, value FieldValue) error {
+	_, err := hs.add(seriesID, labels, value.Point(timestamp))
+	return err
+}
+
+// AddHistogram adds a histogram sample to a series
+func (hs *HotStorage) AddHistogram(seriesID string, labels map[string]string, timestamp time.Time, sketch *Sketch) error {
+	_, err := hs.add(seriesID, labels, DataPoint{Timestamp: timestamp, Value: sketch.Count(), Sketch: sketch})
+	return err
+}
+
+// Sample is a point to write to a series, for batched writes
+type Sample struct {
+	SeriesID string
+	Labels   map[string]string
+	Point    DataPoint
+}
+
+// AddBatch writes samples in order, taking the storage lock once. It
+// returns nil when all are written, otherwise the error of each sample,
+// nil for those written.
+func (hs *HotStorage) AddBatch(samples []Sample) []error {
+	errs, _ := hs.addBatch(samples)
+	return errs
+}
+
+// addBatch writes samples as AddBatch does and also returns the points
+// evicted to make room for them
+func (hs *HotStorage) addBatch(samples []Sample) ([]error, []DataChange) {
 	hs.mu.Lock()
 	defer hs.mu.Unlock()
 	
+	var errs []error
+	var evicted []DataChange
+	for i, sample := range samples {
+		oldest, err := hs.addLocked(sample.SeriesID, sample.Labels, sample.Point)
+		if err != nil {
+			if errs == nil {
+				errs = make([]error, len(samples))
+			}
+			errs[i] = err
+			continue
+		}
+		if !oldest.IsZero() {
+			evicted = append(evicted, DataChange{SeriesID: sample.SeriesID, Start: oldest, End: oldest})
+		}
+	}
+	return errs, evicted
+}
+
+// add adds a point, returning the timestamp of the point evicted to make
+// room for it, or the zero time
+func (hs *HotStorage) add(seriesID string, labels map[string]string, point DataPoint) (time.Time, error) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.addLocked(seriesID, labels, point)
+}
+
+// addLocked adds a point as add does; the caller holds hs.mu
+func (hs *HotStorage) addLocked(seriesID string, labels map[string]string, point DataPoint) (time.Time, error) {
 	series, exists := hs.series[seriesID]
 	if !exists {
 		// Check series limit
 		if len(hs.series) >= hs.maxSeries {
-			return fmt.Errorf("series limit exceeded: %d", hs.maxSeries)
+			return time.Time{}, fmt.Errorf("series limit exceeded: %d", hs.maxSeries)
 		}
 		
 		series = NewSeries(seriesID, labels)
 		hs.series[seriesID] = series
+		hs.index.Add(seriesID, labels)
+	}
+	
+	// Check the type before evicting a point for the new one
+	if !IsStaleMarker(point.Value) {
+		if t, ok := series.valueType(); ok && t != point.Type {
+			return time.Time{}, fmt.Errorf("%w: series %s holds %s values, got %s", ErrTypeConflict, seriesID, t, point.Type)
+		}
 	}
 	
 	// Check points per series limit
+	var evicted time.Time
 	if series.Size() >= hs.maxPointsPerSeries {
 		// Remove oldest point
 		series.mu.Lock()
 		if len(series.Points) > 0 {
+			evicted = series.Points[0].Timestamp
 			series.Points = series.Points[1:]
 		}
 		series.mu.Unlock()
@@ -166,8 +326,7 @@ func (hs *HotStorage) AddPoint(seriesID string, labels map[string]string, timest
 		hs.totalPoints++
 	}
 	
-	series.AddPoint(timestamp, value)
-	return nil
+	return evicted, series.add(point)
 }
 
 // GetSeries returns a series by ID
@@ -195,6 +354,31 @@ func (hs *HotStorage) GetSeriesByLabels(labelFilters map[string]string) []*Serie
 	return result
 }
 
+// Select returns series matching every label matcher that have points within
+// [start, end]. Zero start or end values leave the range unbounded.
+func (hs *HotStorage) Select(matchers []*LabelMatcher, start, end time.Time) []*Series {
+	ids := hs.index.Select(matchers)
+
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	result := make([]*Series, 0, len(ids))
+	for _, id := range ids {
+		series, exists := hs.series[id]
+		if !exists {
+			continue
+		}
+		if !start.IsZero() || !end.IsZero() {
+			minTime, maxTime, ok := series.TimeRange()
+			if !ok || !overlapsRange(minTime, maxTime, start, end) {
+				continue
+			}
+		}
+		result = append(result, series)
+	}
+	return result
+}
+
 // GetSeriesCount returns the number of series in storage
 func (hs *HotStorage) GetSeriesCount() int {
 	hs.mu.RLock()
@@ -211,6 +395,11 @@ func (hs *HotStorage) GetTotalPoints() int64 {
 
 // CleanupStale removes series that haven't received data recently
 func (hs *HotStorage) CleanupStale(maxAge time.Duration) int {
+	return len(hs.cleanupStale(maxAge))
+}
+
+// cleanupStale removes stale series and returns their IDs
+func (hs *HotStorage) cleanupStale(maxAge time.Duration) []string {
 	hs.mu.Lock()
 	defer hs.mu.Unlock()
 	
@@ -226,9 +415,10 @@ func (hs *HotStorage) CleanupStale(maxAge time.Duration) int {
 	
 	for _, id := range staleIDs {
 		delete(hs.series, id)
+		hs.index.Remove(id)
 	}
 	
-	return len(staleIDs)
+	return staleIDs
 }
 
 // Basic aggregation functions
@@ -285,9 +475,10 @@ var (
 	}
 )
 
-// Aggregate applies an aggregation function to a time range
+// Aggregate applies an aggregation function to a time range, ignoring
+// stale markers
 func (s *Series) Aggregate(start, end time.Time, aggFunc AggregationFunc) float64 {
-	points := s.GetRange(start, end)
+	points := DropStaleMarkers(s.GetRange(start, end))
 	return aggFunc(points)
 }
 
@@ -297,6 +488,13 @@ type SeriesInfo struct {
 	Labels   map[string]string `json:"labels"`
 	Size     int               `json:"size"`
 	LastSeen time.Time         `json:"last_seen"`
+	// Stale is set when the series' newest point is a stale marker
+	Stale bool `json:"stale"`
+	// Type is the type of the series' values
+	Type ValueType `json:"type"`
+	// Metadata describes the series' metric, when known. It is only filled
+	// in by listings.
+	Metadata *Metadata `json:"metadata,omitempty"`
 }
 
 // Helper function to match label filters
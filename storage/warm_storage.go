@@ -4,10 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -23,6 +24,7 @@ type WarmStorage struct {
 	retentionPeriod  time.Duration
 	mu               sync.RWMutex
 	files            map[string]*WarmFile // series_id -> file
+	index            *LabelIndex
 	compactionMu     sync.Mutex
 }
 
@@ -32,6 +34,9 @@ type WarmFile struct {
 	FilePath     string
 	FileSize     int64
 	LastModified time.Time
+	Labels       map[string]string
+	MinTime      time.Time
+	MaxTime      time.Time
 	IndexEntries []IndexEntry
 	file         *os.File
 	mu           sync.RWMutex
@@ -40,18 +45,20 @@ type WarmFile struct {
 // IndexEntry represents an index entry for efficient data access
 type IndexEntry struct {
 	Timestamp time.Time
+	EndTime   time.Time // zero when unknown, e.g. for blocks loaded from disk
 	Offset    int64
 	Length    int32
 }
 
-// WarmDataBlock represents a compressed block of data points
+// WarmDataBlock represents a compressed block of data points. Points are
+// written in a column encoding by type unless the block holds histograms.
 type WarmDataBlock struct {
 	SeriesID  string      `json:"series_id"`
 	Labels    map[string]string `json:"labels"`
 	StartTime time.Time   `json:"start_time"`
 	EndTime   time.Time   `json:"end_time"`
 	Count     int         `json:"count"`
-	Points    []DataPoint `json:"points"`
+	Points    []DataPoint `json:"points,omitempty"`
 }
 
 // NewWarmStorage creates a new warm storage instance
@@ -66,6 +73,7 @@ func NewWarmStorage(dataPath string, maxFileSize int64, compressionLevel int, re
 		compressionLevel: compressionLevel,
 		retentionPeriod:  retentionPeriod,
 		files:            make(map[string]*WarmFile),
+		index:            NewLabelIndex(),
 	}
 
 	// Load existing files
@@ -102,11 +110,22 @@ func (ws *WarmStorage) WriteSeriesData(seriesID string, labels map[string]string
 	}
 
 	// Compress and write data block
-	return ws.writeDataBlock(warmFile, &block)
+	if err := ws.writeDataBlock(warmFile, &block); err != nil {
+		return err
+	}
+
+	if warmFile.Labels == nil {
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		warmFile.Labels = labels
+		ws.index.Add(seriesID, labels)
+	}
+	return nil
 }
 
 // ReadSeriesRange reads time-series data from warm storage within a time range
-func (ws *WarmStorage) ReadSeriesRange(seriesID string, start, end time.Time) ([]DataPoint, error) {
+func (ws *WarmStorage) ReadSeriesRange(ctx context.Context, seriesID string, start, end time.Time) ([]DataPoint, error) {
 	ws.mu.RLock()
 	warmFile, exists := ws.files[seriesID]
 	ws.mu.RUnlock()
@@ -115,7 +134,34 @@ func (ws *WarmStorage) ReadSeriesRange(seriesID string, start, end time.Time) ([
 		return nil, nil // No data for this series
 	}
 
-	return ws.readDataRange(warmFile, start, end)
+	return ws.readDataRange(ctx, warmFile, start, end)
+}
+
+// Select returns the IDs of warm series matching every label matcher that
+// hold data within [start, end]. Zero start or end values leave the range unbounded.
+func (ws *WarmStorage) Select(matchers []*LabelMatcher, start, end time.Time) []string {
+	ids := ws.index.Select(matchers)
+	if start.IsZero() && end.IsZero() {
+		return ids
+	}
+
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		warmFile, exists := ws.files[id]
+		if !exists {
+			continue
+		}
+		warmFile.mu.RLock()
+		overlaps := overlapsRange(warmFile.MinTime, warmFile.MaxTime, start, end)
+		warmFile.mu.RUnlock()
+		if overlaps {
+			result = append(result, id)
+		}
+	}
+	return result
 }
 
 // GetSeriesInfo returns information about stored series
@@ -124,21 +170,25 @@ func (ws *WarmStorage) GetSeriesInfo() []SeriesInfo {
 	defer ws.mu.RUnlock()
 
 	var info []SeriesInfo
-	for seriesID, warmFile := range ws.files {
-		warmFile.mu.RLock()
-		seriesInfo := SeriesInfo{
-			ID:       seriesID,
-			Labels:   make(map[string]string), // Would need to read from file for actual labels
-			Size:     len(warmFile.IndexEntries),
-			LastSeen: warmFile.LastModified,
-		}
-		warmFile.mu.RUnlock()
-		info = append(info, seriesInfo)
+	for _, warmFile := range ws.files {
+		info = append(info, warmFile.info())
 	}
 
 	return info
 }
 
+// seriesInfo returns information about a single stored series
+func (ws *WarmStorage) seriesInfo(seriesID string) (SeriesInfo, bool) {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+
+	warmFile, exists := ws.files[seriesID]
+	if !exists {
+		return SeriesInfo{}, false
+	}
+	return warmFile.info(), true
+}
+
 // Compact performs compaction on warm storage files
 func (ws *WarmStorage) Compact() error {
 	ws.compactionMu.Lock()
@@ -164,12 +214,18 @@ func (ws *WarmStorage) Compact() error {
 
 // CleanupExpired removes expired data based on retention policy
 func (ws *WarmStorage) CleanupExpired() (int, error) {
+	removed, err := ws.cleanupExpired()
+	return len(removed), err
+}
+
+// cleanupExpired removes expired series files and returns the removed series IDs
+func (ws *WarmStorage) cleanupExpired() ([]string, error) {
 	ws.mu.Lock()
 	defer ws.mu.Unlock()
 
 	cutoffTime := time.Now().Add(-ws.retentionPeriod)
 	var expiredFiles []string
-	cleanedCount := 0
+	var removed []string
 
 	for seriesID, warmFile := range ws.files {
 		warmFile.mu.RLock()
@@ -182,13 +238,14 @@ func (ws *WarmStorage) CleanupExpired() (int, error) {
 	for _, seriesID := range expiredFiles {
 		warmFile := ws.files[seriesID]
 		if err := ws.removeFile(warmFile); err != nil {
-			return cleanedCount, fmt.Errorf("failed to remove expired file: %w", err)
+			return removed, fmt.Errorf("failed to remove expired file: %w", err)
 		}
 		delete(ws.files, seriesID)
-		cleanedCount++
+		ws.index.Remove(seriesID)
+		removed = append(removed, seriesID)
 	}
 
-	return cleanedCount, nil
+	return removed, nil
 }
 
 // Close closes all open files and shuts down warm storage
@@ -215,7 +272,10 @@ func (ws *WarmStorage) loadExistingFiles() error {
 	}
 
 	for _, filePath := range files {
-		seriesID := ws.extractSeriesID(filePath)
+		seriesID, current := ws.extractSeriesID(filePath)
+		if !current {
+			filePath = ws.migrateFile(seriesID, filePath)
+		}
 		warmFile, err := ws.loadFile(seriesID, filePath)
 		if err != nil {
 			// Log error but continue with other files
@@ -223,15 +283,45 @@ func (ws *WarmStorage) loadExistingFiles() error {
 			continue
 		}
 		ws.files[seriesID] = warmFile
+		ws.index.Add(seriesID, warmFile.Labels)
 	}
 
 	return nil
 }
 
-func (ws *WarmStorage) extractSeriesID(filePath string) string {
+// extractSeriesID returns the series ID a warm file holds and whether the
+// file is named in the current format, the path-escaped series ID. Older
+// files are named after the raw series ID; names that are valid in both
+// formats are read in the current one.
+func (ws *WarmStorage) extractSeriesID(filePath string) (string, bool) {
 	base := filepath.Base(filePath)
 	ext := filepath.Ext(base)
-	return base[:len(base)-len(ext)]
+	name := base[:len(base)-len(ext)]
+	if seriesID, err := url.PathUnescape(name); err == nil && url.PathEscape(seriesID) == name {
+		return seriesID, true
+	}
+	return name, false
+}
+
+// migrateFile renames a file named in the old format to its current name
+// and returns its path. The file keeps its old name if that fails.
+func (ws *WarmStorage) migrateFile(seriesID, filePath string) string {
+	newPath := ws.seriesFilePath(seriesID)
+	if _, err := os.Stat(newPath); err == nil {
+		fmt.Printf("Warning: not renaming %s, %s already exists\n", filePath, newPath)
+		return filePath
+	}
+	if err := os.Rename(filePath, newPath); err != nil {
+		fmt.Printf("Warning: failed to rename %s: %v\n", filePath, err)
+		return filePath
+	}
+	return newPath
+}
+
+// seriesFilePath returns the path of a series' file. Series IDs carry label
+// selectors, so they are escaped into a single path segment.
+func (ws *WarmStorage) seriesFilePath(seriesID string) string {
+	return filepath.Join(ws.dataPath, url.PathEscape(seriesID)+".tsw")
 }
 
 func (ws *WarmStorage) loadFile(seriesID, filePath string) (*WarmFile, error) {
@@ -253,6 +343,23 @@ func (ws *WarmStorage) loadFile(seriesID, filePath string) (*WarmFile, error) {
 		return nil, fmt.Errorf("failed to load index entries: %w", err)
 	}
 
+	// Recover labels and time bounds from the first and last blocks
+	if len(warmFile.IndexEntries) > 0 {
+		first, err := ws.readDataBlock(context.Background(), warmFile, warmFile.IndexEntries[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read first block: %w", err)
+		}
+		last, err := ws.readDataBlock(context.Background(), warmFile, warmFile.IndexEntries[len(warmFile.IndexEntries)-1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read last block: %w", err)
+		}
+		warmFile.Labels = first.Labels
+		warmFile.MinTime = first.StartTime
+		warmFile.MaxTime = last.EndTime
+		warmFile.IndexEntries[0].EndTime = first.EndTime
+		warmFile.IndexEntries[len(warmFile.IndexEntries)-1].EndTime = last.EndTime
+	}
+
 	return warmFile, nil
 }
 
@@ -288,7 +395,7 @@ func (ws *WarmStorage) loadIndexEntries(warmFile *WarmFile) error {
 			return fmt.Errorf("failed to skip block data: %w", err)
 		}
 
-		offset += int64(blockHeader.Length) + 24 // 24 bytes for header
+		offset += int64(blockHeader.Length) + 12 // 12 bytes for header
 	}
 
 	// Sort index entries by timestamp
@@ -328,10 +435,9 @@ func (ws *WarmStorage) getOrCreateFile(seriesID string) (*WarmFile, error) {
 		return warmFile, nil
 	}
 
-	filePath := filepath.Join(ws.dataPath, seriesID+".tsw")
 	warmFile := &WarmFile{
 		SeriesID:     seriesID,
-		FilePath:     filePath,
+		FilePath:     ws.seriesFilePath(seriesID),
 		FileSize:     0,
 		LastModified: time.Now(),
 		IndexEntries: make([]IndexEntry, 0),
@@ -355,7 +461,7 @@ func (ws *WarmStorage) writeDataBlock(warmFile *WarmFile, block *WarmDataBlock)
 	}
 
 	// Serialize and compress block
-	jsonData, err := json.Marshal(block)
+	blockData, err := encodeBlock(block)
 	if err != nil {
 		return fmt.Errorf("failed to marshal block: %w", err)
 	}
@@ -366,7 +472,7 @@ func (ws *WarmStorage) writeDataBlock(warmFile *WarmFile, block *WarmDataBlock)
 		return fmt.Errorf("failed to create gzip writer: %w", err)
 	}
 
-	if _, err := gzipWriter.Write(jsonData); err != nil {
+	if _, err := gzipWriter.Write(blockData); err != nil {
 		return fmt.Errorf("failed to compress data: %w", err)
 	}
 
@@ -394,10 +500,17 @@ func (ws *WarmStorage) writeDataBlock(warmFile *WarmFile, block *WarmDataBlock)
 	// Update file metadata
 	warmFile.FileSize += int64(8 + 4 + dataLength) // timestamp + length + data
 	warmFile.LastModified = time.Now()
+	if warmFile.MinTime.IsZero() || block.StartTime.Before(warmFile.MinTime) {
+		warmFile.MinTime = block.StartTime
+	}
+	if block.EndTime.After(warmFile.MaxTime) {
+		warmFile.MaxTime = block.EndTime
+	}
 
 	// Add index entry
 	warmFile.IndexEntries = append(warmFile.IndexEntries, IndexEntry{
 		Timestamp: block.StartTime,
+		EndTime:   block.EndTime,
 		Offset:    offset,
 		Length:    dataLength,
 	})
@@ -410,7 +523,7 @@ func (ws *WarmStorage) writeDataBlock(warmFile *WarmFile, block *WarmDataBlock)
 	return nil
 }
 
-func (ws *WarmStorage) readDataRange(warmFile *WarmFile, start, end time.Time) ([]DataPoint, error) {
+func (ws *WarmStorage) readDataRange(ctx context.Context, warmFile *WarmFile, start, end time.Time) ([]DataPoint, error) {
 	warmFile.mu.RLock()
 	defer warmFile.mu.RUnlock()
 
@@ -426,7 +539,7 @@ func (ws *WarmStorage) readDataRange(warmFile *WarmFile, start, end time.Time) (
 		}
 
 		// Read and decompress block
-		block, err := ws.readDataBlock(warmFile, entry)
+		block, err := ws.readDataBlock(ctx, warmFile, entry)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read data block: %w", err)
 		}
@@ -448,7 +561,12 @@ func (ws *WarmStorage) readDataRange(warmFile *WarmFile, start, end time.Time) (
 	return allPoints, nil
 }
 
-func (ws *WarmStorage) readDataBlock(warmFile *WarmFile, entry IndexEntry) (*WarmDataBlock, error) {
+func (ws *WarmStorage) readDataBlock(ctx context.Context, warmFile *WarmFile, entry IndexEntry) (*WarmDataBlock, error) {
+	// Stop before touching disk once the caller has given up
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Open file for reading
 	file, err := os.Open(warmFile.FilePath)
 	if err != nil {
@@ -474,18 +592,34 @@ func (ws *WarmStorage) readDataBlock(warmFile *WarmFile, entry IndexEntry) (*War
 	}
 	defer gzipReader.Close()
 
-	jsonData, err := io.ReadAll(gzipReader)
+	blockData, err := io.ReadAll(gzipReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read decompressed data: %w", err)
 	}
 
 	// Deserialize block
-	var block WarmDataBlock
-	if err := json.Unmarshal(jsonData, &block); err != nil {
+	block, err := decodeBlock(blockData)
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal block: %w", err)
 	}
 
-	return &block, nil
+	return block, nil
+}
+
+func (wf *WarmFile) info() SeriesInfo {
+	wf.mu.RLock()
+	defer wf.mu.RUnlock()
+
+	labels := wf.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	return SeriesInfo{
+		ID:       wf.SeriesID,
+		Labels:   labels,
+		Size:     len(wf.IndexEntries),
+		LastSeen: wf.LastModified,
+	}
 }
 
 func (ws *WarmStorage) needsCompaction(warmFile *WarmFile) bool {
@@ -0,0 +1,248 @@
+// Package timeexpr parses the time expressions accepted by the HTTP API and
+// tsdb-cli: absolute timestamps, unix times and times relative to now.
+package timeexpr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixMillisThreshold separates unix seconds from milliseconds. 1e11 seconds
+// is in the year 5138, while 1e11 milliseconds is in 1973.
+const unixMillisThreshold = 1e11
+
+// durationUnits are the units accepted by ParseDuration
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// ParseDuration parses a duration such as 90s, 1h30m or 7d. It accepts the
+// units of time.ParseDuration plus d (24h), w (7d) and y (365d).
+func ParseDuration(s string) (time.Duration, error) {
+	rest := s
+	negative := false
+	if rest != "" && (rest[0] == '-' || rest[0] == '+') {
+		negative = rest[0] == '-'
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if rest == "0" {
+		return 0, nil
+	}
+
+	var total float64
+	for rest != "" {
+		i := 0
+		for i < len(rest) && (rest[i] >= '0' && rest[i] <= '9' || rest[i] == '.') {
+			i++
+		}
+		j := i
+		for j < len(rest) && !(rest[j] >= '0' && rest[j] <= '9' || rest[j] == '.') {
+			j++
+		}
+		unit, ok := durationUnits[rest[i:j]]
+		if i == 0 || !ok {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total += n * float64(unit)
+		rest = rest[j:]
+	}
+	if total > math.MaxInt64 {
+		return 0, fmt.Errorf("duration %q is too large", s)
+	}
+	if negative {
+		total = -total
+	}
+	return time.Duration(total), nil
+}
+
+// Parse parses a time expression. It accepts:
+//
+//	now, now-7d, now-1d/d      relative to now, optionally rounded down
+//	-1h, -7d                   shorthand for now-1h, now-7d
+//	1700000000, 1700000000000  unix seconds or milliseconds
+//	2024-01-02T15:04:05.999Z   RFC3339 with optional fractional seconds
+//
+// Relative offsets chain (now-1d+2h) and use the units ms, s, m, h, d, w,
+// M (months) and y. Days and longer move by calendar days in loc, so now-1d
+// is the same wall-clock time yesterday across DST changes. A trailing /unit
+// rounds down to the start of that unit in loc; weeks start on Monday.
+func Parse(expr string, now time.Time, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	switch {
+	case expr == "":
+		return time.Time{}, fmt.Errorf("empty time expression")
+	case strings.HasPrefix(expr, "now"):
+		return parseRelative(expr, expr[3:], now.In(loc))
+	case expr[0] == '-' || expr[0] == '+':
+		return parseRelative(expr, expr, now.In(loc))
+	case isUnixTime(expr):
+		// Whole numbers are parsed exactly so that milliseconds survive
+		if n, err := strconv.ParseInt(expr, 10, 64); err == nil {
+			if n >= unixMillisThreshold {
+				return time.UnixMilli(n).In(loc), nil
+			}
+			return time.Unix(n, 0).In(loc), nil
+		}
+		value, err := strconv.ParseFloat(expr, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid unix time %q", expr)
+		}
+		if value >= unixMillisThreshold {
+			value /= 1000
+		}
+		sec, frac := math.Modf(value)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e9))).In(loc), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, expr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC3339, unix time or an expression such as now-1h", expr)
+	}
+	return t, nil
+}
+
+// ParseRange parses optional start and end expressions against the same
+// now. An empty start defaults to defaultRange before end, and an empty end
+// defaults to now.
+func ParseRange(start, end string, defaultRange time.Duration, now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	endTime := now
+	if end != "" {
+		var err error
+		if endTime, err = Parse(end, now, loc); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end: %v", err)
+		}
+	}
+	startTime := endTime.Add(-defaultRange)
+	if start != "" {
+		var err error
+		if startTime, err = Parse(start, now, loc); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start: %v", err)
+		}
+	}
+	return startTime, endTime, nil
+}
+
+func isUnixTime(expr string) bool {
+	for i := 0; i < len(expr); i++ {
+		if (expr[i] < '0' || expr[i] > '9') && expr[i] != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRelative applies the offsets and rounding in rest to t
+func parseRelative(expr, rest string, t time.Time) (time.Time, error) {
+	for rest != "" && (rest[0] == '+' || rest[0] == '-') {
+		sign := 1
+		if rest[0] == '-' {
+			sign = -1
+		}
+		rest = rest[1:]
+
+		// An offset is one or more number-unit pairs, as in now-1h30m
+		matched := false
+		for rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+			i := 0
+			for i < len(rest) && (rest[i] >= '0' && rest[i] <= '9' || rest[i] == '.') {
+				i++
+			}
+			j := i
+			for j < len(rest) && (rest[j] >= 'a' && rest[j] <= 'z' || rest[j] >= 'A' && rest[j] <= 'Z') {
+				j++
+			}
+			n, err := strconv.ParseFloat(rest[:i], 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid time expression %q", expr)
+			}
+			if t, err = addUnit(t, rest[i:j], float64(sign)*n); err != nil {
+				return time.Time{}, fmt.Errorf("invalid time expression %q: %v", expr, err)
+			}
+			rest = rest[j:]
+			matched = true
+		}
+		if !matched {
+			return time.Time{}, fmt.Errorf("invalid time expression %q", expr)
+		}
+	}
+
+	if rest != "" {
+		if rest[0] != '/' {
+			return time.Time{}, fmt.Errorf("invalid time expression %q", expr)
+		}
+		var err error
+		if t, err = roundDown(t, rest[1:]); err != nil {
+			return time.Time{}, fmt.Errorf("invalid time expression %q: %v", expr, err)
+		}
+	}
+	return t, nil
+}
+
+// addUnit moves t by n units; days and longer keep the local wall clock
+// and must be whole numbers
+func addUnit(t time.Time, unit string, n float64) (time.Time, error) {
+	switch unit {
+	case "ms", "s", "m", "h":
+		return t.Add(time.Duration(n * float64(durationUnits[unit]))), nil
+	case "d", "w", "M", "y":
+	default:
+		return time.Time{}, fmt.Errorf("unknown unit %q", unit)
+	}
+	if n != math.Trunc(n) {
+		return time.Time{}, fmt.Errorf("%s offsets must be whole numbers", unit)
+	}
+	whole := int(n)
+	switch unit {
+	case "d":
+		return t.AddDate(0, 0, whole), nil
+	case "w":
+		return t.AddDate(0, 0, 7*whole), nil
+	case "M":
+		return t.AddDate(0, whole, 0), nil
+	}
+	return t.AddDate(whole, 0, 0), nil
+}
+
+// roundDown rounds t down to the start of a unit in t's location
+func roundDown(t time.Time, unit string) (time.Time, error) {
+	year, month, day := t.Date()
+	loc := t.Location()
+	switch unit {
+	case "s":
+		return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, loc), nil
+	case "m":
+		return time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, loc), nil
+	case "h":
+		return time.Date(year, month, day, t.Hour(), 0, 0, 0, loc), nil
+	case "d":
+		return time.Date(year, month, day, 0, 0, 0, 0, loc), nil
+	case "w":
+		return time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc), nil
+	case "M":
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc), nil
+	case "y":
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, loc), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown unit %q", unit)
+}
@@ -0,0 +1,95 @@
+package timeexpr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, 5, 15, 13, 45, 30, 0, time.UTC)
+	tests := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"now", now},
+		{"now-1h", now.Add(-time.Hour)},
+		{"-1h30m", now.Add(-90 * time.Minute)},
+		{"-7d", now.AddDate(0, 0, -7)},
+		{"now-1d/d", time.Date(2024, 5, 14, 0, 0, 0, 0, time.UTC)},
+		{"now/w", time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)},
+		{"now-1M/M", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"now+1d-2h/h", time.Date(2024, 5, 16, 11, 0, 0, 0, time.UTC)},
+		{"now-1y/y", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"1700000000", time.Unix(1700000000, 0)},
+		{"1700000000123", time.Unix(1700000000, 123e6)},
+		{"1700000000.5", time.Unix(1700000000, 5e8)},
+		{"2024-01-02T15:04:05Z", time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{"2024-01-02T15:04:05.123456789+02:00", time.Date(2024, 1, 2, 13, 4, 5, 123456789, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.expr, now, time.UTC)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if !got.Equal(tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.expected, got)
+		}
+	}
+
+	for _, expr := range []string{"", "now-", "now-1x", "now/d/d", "now-1.5d", "later", "2024-01-02"} {
+		if _, err := Parse(expr, now, time.UTC); err == nil {
+			t.Errorf("Expected error parsing %q", expr)
+		}
+	}
+}
+
+func TestParse_TimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone data unavailable: %v", err)
+	}
+
+	// Noon on the day of the spring DST change
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, loc)
+	got, err := Parse("now-1d/d", now, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2024, 3, 9, 0, 0, 0, 0, loc); !got.Equal(expected) {
+		t.Errorf("Expected local midnight %v, got %v", expected, got)
+	}
+
+	// A calendar day back keeps the wall clock even though only 23 hours passed
+	got, _ = Parse("now-1d", now, loc)
+	if got.Hour() != 12 || now.Sub(got) != 23*time.Hour {
+		t.Errorf("Expected noon the previous day, got %v", got)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90s":    90 * time.Second,
+		"1h30m":  90 * time.Minute,
+		"1.5h":   90 * time.Minute,
+		"7d":     7 * 24 * time.Hour,
+		"2w":     14 * 24 * time.Hour,
+		"1y":     365 * 24 * time.Hour,
+		"250ms":  250 * time.Millisecond,
+		"-1d12h": -36 * time.Hour,
+		"0":      0,
+	}
+	for input, expected := range tests {
+		got, err := ParseDuration(input)
+		if err != nil || got != expected {
+			t.Errorf("%s: expected %v, got %v (%v)", input, expected, got, err)
+		}
+	}
+
+	for _, input := range []string{"", "5", "5x", "d", "1M"} {
+		if _, err := ParseDuration(input); err == nil {
+			t.Errorf("Expected error parsing %q", input)
+		}
+	}
+}